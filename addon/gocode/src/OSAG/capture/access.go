@@ -0,0 +1,111 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// access.go
+//
+// Access control for the control socket based on peer credentials
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	capconfig "OSAG/capture/config"
+)
+
+const CONTROL_REPLY_DENIED = "PERMISSION DENIED"
+
+// readOnlyCommands are the control commands that neither change goProbe's
+// state nor write any files. All other commands are considered mutating.
+var readOnlyCommands = map[string]struct{}{
+	CONTROL_CMD_STATUS:      struct{}{},
+	CONTROL_CMD_DEBUGSTATUS: struct{}{},
+	CONTROL_CMD_ERRORS:      struct{}{},
+	CONTROL_CMD_METRICS:     struct{}{},
+}
+
+// isReadOnlyCommand checks whether the control socket command line
+// is read-only.
+func isReadOnlyCommand(line string) bool {
+	_, exists := readOnlyCommands[line]
+	return exists
+}
+
+// controlAccess is what a client of the control socket may do.
+type controlAccess struct {
+	cred     *syscall.Ucred
+	read     bool
+	mutating bool
+}
+
+func (a controlAccess) String() string {
+	return fmt.Sprintf("pid %d, uid %d, gid %d", a.cred.Pid, a.cred.Uid, a.cred.Gid)
+}
+
+// allows checks whether the client may run the given command line.
+func (a controlAccess) allows(line string) bool {
+	if isReadOnlyCommand(line) {
+		return a.read
+	}
+	return a.mutating
+}
+
+// peerCredentials returns the credentials of the process at the other
+// end of a unix socket connection.
+func peerCredentials(conn net.Conn) (*syscall.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("Not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// checkControlAccess determines what the peer of conn may do according to
+// the access lists of c. root and the user goProbe runs as may always do
+// everything.
+func checkControlAccess(conn net.Conn, c capconfig.ControlSocketConfig) (controlAccess, error) {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return controlAccess{}, err
+	}
+
+	access := controlAccess{cred: cred}
+	if cred.Uid == 0 || int(cred.Uid) == os.Geteuid() {
+		access.read, access.mutating = true, true
+		return access, nil
+	}
+
+	access.mutating = c.AllowsMutating(cred.Uid, cred.Gid)
+	access.read = access.mutating || c.AllowsRead(cred.Uid, cred.Gid)
+	return access, nil
+}
+
+// commandName returns the command of a control socket command line for
+// logging purposes.
+func commandName(line string) string {
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields[0]
+	}
+	return line
+}
@@ -0,0 +1,72 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// access_test.go
+//
+// Tests for the access control of the control socket
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	capconfig "OSAG/capture/config"
+)
+
+func TestControlAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, CONTROL_SOCKET))
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", filepath.Join(dir, CONTROL_SOCKET))
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	defer conn.Close()
+
+	// we are connecting to ourselves, so everything is allowed
+	access, err := checkControlAccess(conn, capconfig.ControlSocketConfig{})
+	if err != nil {
+		t.Fatalf("failed to check access: %s", err)
+	}
+	if int(access.cred.Pid) != os.Getpid() || !access.read || !access.mutating {
+		t.Fatalf("unexpected access %+v", access)
+	}
+
+	readOnly := controlAccess{cred: &syscall.Ucred{}, read: true}
+	for line, allowed := range map[string]bool{
+		CONTROL_CMD_STATUS:            true,
+		CONTROL_CMD_ERRORS:            true,
+		CONTROL_CMD_METRICS:           true,
+		CONTROL_CMD_RELOAD:            false,
+		CONTROL_CMD_DUMP + " eth0":    false,
+		CONTROL_CMD_STATUS + " extra": false,
+		"BOGUS":                       false,
+	} {
+		if readOnly.allows(line) != allowed {
+			t.Fatalf("command '%s': expected allowed to be %v", line, allowed)
+		}
+	}
+}
@@ -15,10 +15,14 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -26,6 +30,7 @@ import (
 	capconfig "OSAG/capture/config"
 	"OSAG/goDB"
 	"OSAG/goProbe"
+	"OSAG/netflow"
 	"OSAG/version"
 )
 
@@ -35,14 +40,33 @@ const (
 
 	DB_WRITE_INTERVAL   = 300 // seconds
 	CONTROL_SOCKET      = "control.sock"
+	STREAM_SOCKET       = "stream.sock"
 	WRITEOUTSCHAN_DEPTH = 100
+	// Writeouts are spooled to disk once this many are queued
+	WRITEOUTS_SPOOL_THRESHOLD = 3
+	// How often interfaces matching patterns in the config are looked for
+	// and expired triggers are ended
+	INTERFACE_DISCOVERY_INTERVAL = 30 // seconds
+	// How often the retention policy in the config is enforced and the
+	// aggregates are built
+	MAINTENANCE_INTERVAL = 3600 // seconds
+	// Number of daily directories rolled up at most per MAINTENANCE_INTERVAL
+	ROLLUP_MAX_DAYS = 10
+	// Number of daily directories aggregated at most per MAINTENANCE_INTERVAL
+	AGGREGATE_MAX_DAYS = 10
 
 	// TODO(lob): For debugging. Consider removing this later.
 	CONTROL_CMD_DEBUGSTATUS = "DEBUGSTATUS"
 
-	CONTROL_CMD_STATUS = "STATUS"
-	CONTROL_CMD_RELOAD = "RELOAD"
-	CONTROL_CMD_ERRORS = "ERRORS"
+	CONTROL_CMD_STATUS  = "STATUS"
+	CONTROL_CMD_RELOAD  = "RELOAD"
+	CONTROL_CMD_ERRORS  = "ERRORS"
+	CONTROL_CMD_METRICS = "METRICS"
+
+	// TRIGGER <iface> <limits> [BPF] [<filter>]
+	CONTROL_CMD_TRIGGER = "TRIGGER"
+	// DUMP <iface>
+	CONTROL_CMD_DUMP = "DUMP"
 
 	CONTROL_REPLY_DONE       = "DONE"
 	CONTROL_REPLY_ERROR      = "ERROR"
@@ -62,7 +86,9 @@ func init() {
 
 // A writeout consists of a channel over which the individual
 // interfaces' TaggedAggFlowMaps are sent and is tagged with
-// the timestamp of when it was triggered.
+// the timestamp of when it was triggered. A writeout with a nil
+// channel only serves to wake up handleWriteouts so that it
+// replays the spool.
 type writeout struct {
 	Chan      <-chan goProbe.TaggedAggFlowMap
 	Timestamp time.Time
@@ -78,11 +104,23 @@ var (
 	// and then never changed
 	dbpath string
 
+	// number of interfaces matching patterns in the config that were
+	// left out because of MAX_IFACES. Protected by configMutex.
+	skippedIfaces int
+
 	// captureManager and lastRotation may also be accessed
 	// from multiple goroutines, so we need to synchronize access.
 	captureManagerMutex sync.Mutex
 	captureManager      *goProbe.CaptureManager
 	lastRotation        time.Time
+
+	// collector is nil unless flows are collected from other exporters.
+	// It is protected by captureManagerMutex as well.
+	collector *goProbe.Collector
+
+	// spool holds the writeouts that couldn't be queued because
+	// writeouts were lagging behind. It is safe for concurrent use.
+	spool *goProbe.Spool
 )
 
 // reloadConfig attempts to reload the configuration file and updates
@@ -100,6 +138,12 @@ func reloadConfig() error {
 	if config != nil && dbpath != c.DBPath {
 		return fmt.Errorf("Failed to reload config file: Cannot change database path while running.")
 	}
+	if config != nil && (config.User != c.User || config.Group != c.Group) {
+		return fmt.Errorf("Failed to reload config file: Cannot change user or group while running.")
+	}
+	if config != nil && config.Compression != c.Compression {
+		return fmt.Errorf("Failed to reload config file: Cannot change compression while running.")
+	}
 	config = c
 	return nil
 }
@@ -139,7 +183,7 @@ func main() {
 	goProbe.SysLog.Debug("Loaded config file")
 
 	// It doesn't make sense to monitor zero interfaces
-	if len(config.Interfaces) == 0 {
+	if len(config.Interfaces) == 0 && !config.Collector.Enabled() {
 		fmt.Fprintf(os.Stderr, "No interfaces have been specified in the configuration file.\n")
 		os.Exit(1)
 	}
@@ -159,6 +203,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Make sure we're the only ones writing to the DB
+	dbLock, err := goDB.LockDB(dbpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to lock database: %s\n", err)
+		os.Exit(1)
+	}
+	defer dbLock.Unlock()
+
+	// Repair whatever an interrupted writeout of the last run left behind
+	reports, err := goDB.RecoverDB(dbpath, time.Now().Unix())
+	for _, report := range reports {
+		goProbe.SysLog.Warning(fmt.Sprintf("Repaired database: %s", report.String()))
+	}
+	if err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Database recovery incomplete: %s", err))
+	}
+
 	// Open control socket
 	listener, err := net.Listen("unix", filepath.Join(dbpath, CONTROL_SOCKET))
 	if err != nil {
@@ -166,39 +227,94 @@ func main() {
 		os.Exit(1)
 	}
 	defer listener.Close()
+	// Who may use the control socket is decided based on the peer's
+	// credentials (see handleControlSocket)
+	if err := os.Chmod(filepath.Join(dbpath, CONTROL_SOCKET), 0666); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set permissions of control socket '%s': %s\n", CONTROL_SOCKET, err)
+		os.Exit(1)
+	}
+
+	// Open flow stream socket
+	streamListener, err := net.Listen("unix", filepath.Join(dbpath, STREAM_SOCKET))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to listen on flow stream socket '%s': %s\n", STREAM_SOCKET, err)
+		os.Exit(1)
+	}
+	defer streamListener.Close()
+
+	// Look for interfaces matching patterns in the config
+	captureIfaces, err := resolveInterfaces(config)
+	if err != nil {
+		// the named interfaces are captured anyways and we'll try
+		// again at the next discovery
+		goProbe.SysLog.Err(err.Error())
+	}
 
 	// Initialize packet logger
-	ifaces := make([]string, len(config.Interfaces))
+	ifaces := make([]string, len(captureIfaces))
 	i := 0
-	for k, _ := range config.Interfaces {
+	for k, _ := range captureIfaces {
 		ifaces[i] = k
 		i++
 	}
-	goProbe.InitPacketLog(config.DBPath, ifaces)
+	goProbe.InitPacketLog(config.DBPath, ifaces, config.ErrorLog)
 	defer goProbe.PacketLog.Close()
 
+	// Initialize trigger log
+	goProbe.InitTriggerLog(config.DBPath)
+
+	// Open the spool, which may still contain writeouts from the last run
+	if spool, err = goProbe.NewSpool(dbpath, config.Spool); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open spool: %s\n", err)
+		os.Exit(1)
+	}
+	if n, size := spool.Depth(); n > 0 {
+		goProbe.SysLog.Info(fmt.Sprintf("Found %d spooled writeouts (%d bytes)", n, size))
+	}
+
 	// None of the initialization steps failed.
 	goProbe.SysLog.Info("Started goProbe")
 
 	// Start goroutine for writeouts
 	writeoutsChan := make(chan writeout, WRITEOUTSCHAN_DEPTH)
 	completedWriteoutsChan := make(chan struct{})
-	go handleWriteouts(writeoutsChan, completedWriteoutsChan, config.SyslogFlows)
+	go handleWriteouts(writeoutsChan, completedWriteoutsChan, config, goProbe.NewFlowStreamer(streamListener))
 
 	lastRotation = time.Now()
 
 	captureManager = goProbe.NewCaptureManager()
 	// No captures are being deleted here, so we can safely discard the channel we pass
 	captureManagerMutex.Lock()
-	captureManager.Update(config.Interfaces, make(chan goProbe.TaggedAggFlowMap))
+	captureManager.Update(captureIfaces, make(chan goProbe.TaggedAggFlowMap))
 	captureManagerMutex.Unlock()
 
+	// Start collecting flows from other exporters
+	if config.Collector.Enabled() {
+		if collector, err = goProbe.NewCollector(config.Collector, MAX_IFACES, collectedIfaces(config.DBPath)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start collector on '%s': %s\n", config.Collector.Listen, err)
+			os.Exit(1)
+		}
+	}
+
+	// Now that the capture handles are open, we no longer need to be root
+	if config.User != "" {
+		if err := dropPrivileges(config.User, config.Group); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to drop privileges: %s\n", err)
+			os.Exit(1)
+		}
+		droppedConfigs = captureIfaces
+		goProbe.SysLog.Info(fmt.Sprintf("Dropped privileges: running as user '%s'", config.User))
+	}
+
 	// We're ready to accept commands on the control socket
 	go handleControlSocket(listener, writeoutsChan)
 
 	// Start regular rotations
 	go handleRotations(writeoutsChan)
 
+	// Start looking for new (or vanished) interfaces
+	go handleDiscovery(writeoutsChan)
+
 	// Wait for signal to exit
 	<-sigExitChan
 
@@ -210,11 +326,14 @@ func main() {
 	captureManagerMutex.Lock()
 	captureManager.DisableAll()
 
-	// One last writeout
-	woChan := make(chan goProbe.TaggedAggFlowMap, MAX_IFACES)
-	writeoutsChan <- writeout{woChan, time.Now()}
-	captureManager.RotateAll(woChan)
-	close(woChan)
+	// One last writeout. Spooled writeouts are written after the next start.
+	queueWriteout(writeoutsChan, time.Now(), func(woChan chan goProbe.TaggedAggFlowMap) {
+		captureManager.RotateAll(woChan)
+		if collector != nil {
+			collector.Close()
+			collector.Rotate(woChan)
+		}
+	})
 	close(writeoutsChan)
 
 	captureManager.CloseAll()
@@ -234,18 +353,19 @@ func handleRotations(writeoutsChan chan<- writeout) {
 			goProbe.SysLog.Debug("Initiating flow data flush")
 
 			lastRotation = time.Now()
-			woChan := make(chan goProbe.TaggedAggFlowMap, MAX_IFACES)
-			writeoutsChan <- writeout{woChan, lastRotation}
-			captureManager.RotateAll(woChan)
-			close(woChan)
+			queueWriteout(writeoutsChan, lastRotation, func(woChan chan goProbe.TaggedAggFlowMap) {
+				captureManager.RotateAll(woChan)
+				if collector != nil {
+					collector.Rotate(woChan)
+				}
+			})
 
 			if len(writeoutsChan) > 2 {
-				if len(writeoutsChan) > WRITEOUTSCHAN_DEPTH {
-					goProbe.SysLog.Err(fmt.Sprintf("Writeouts are lagging behind too much: Queue length is %d", len(writeoutsChan)))
-					os.Exit(1)
-				}
 				goProbe.SysLog.Warning(fmt.Sprintf("Writeouts are lagging behind: Queue length is %d", len(writeoutsChan)))
 			}
+			if n, size := spool.Depth(); n > 0 {
+				goProbe.SysLog.Warning(fmt.Sprintf("Writeouts are lagging behind: %d writeouts (%d of %d bytes) spooled", n, size, spool.MaxSize()))
+			}
 
 			goProbe.SysLog.Debug("Restarting any interfaces that have encountered errors.")
 			captureManager.EnableAll()
@@ -254,107 +374,270 @@ func handleRotations(writeoutsChan chan<- writeout) {
 	}
 }
 
-func handleWriteouts(writeoutsChan <-chan writeout, doneChan chan<- struct{}, logToSyslog bool) {
-	writeoutsCount := 0
-	dbWriters := make(map[string]*goDB.DBWriter)
-	lastWrite := make(map[string]int)
-
-	var syslogWriter *goDB.SyslogDBWriter
-	if logToSyslog {
-		var err error
-		if syslogWriter, err = goDB.NewSyslogDBWriter(); err != nil {
-			// we are not failing here due to the fact that a DB write out should still be attempted.
-			// TODO: consider making a hard fail configurable
-			goProbe.SysLog.Err(fmt.Sprintf("Failed to create syslog based flow writer: %s", err.Error()))
+// resolveInterfaces returns the interfaces to capture on according to c. If
+// the available interfaces can't be determined, only the interfaces
+// configured by name are returned, along with an error.
+//
+// Must be called with configMutex held.
+func resolveInterfaces(c *capconfig.Config) (map[string]goProbe.CaptureConfig, error) {
+	var available []string
+	var err error
+	if c.HasInterfacePatterns() {
+		if available, err = goProbe.AvailableInterfaces(); err != nil {
+			err = fmt.Errorf("Failed to discover interfaces: %s", err)
 		}
 	}
 
-	for writeout := range writeoutsChan {
-		t0 := time.Now()
-		var summaryUpdates []goDB.InterfaceSummaryUpdate
-		count := 0
-		for taggedMap := range writeout.Chan {
-			// Ensure that there is a DBWriter for the given interface
-			_, exists := dbWriters[taggedMap.Iface]
-			if !exists {
-				w := goDB.NewDBWriter(dbpath, taggedMap.Iface)
-				dbWriters[taggedMap.Iface] = w
-			}
+	ifaces, skipped := c.ResolveInterfaces(available, MAX_IFACES)
+	if len(skipped) != skippedIfaces && err == nil {
+		if len(skipped) > 0 {
+			goProbe.SysLog.Warning(fmt.Sprintf("Cannot monitor more than %d interfaces. Ignoring %d matching interfaces: %s", MAX_IFACES, len(skipped), strings.Join(skipped, ", ")))
+		}
+		skippedIfaces = len(skipped)
+	}
+	return ifaces, err
+}
 
-			// Prep metadata for current block
-			meta := goDB.BlockMetadata{}
-			meta.PcapPacketsReceived = -1
-			meta.PcapPacketsDropped = -1
-			meta.PcapPacketsIfDropped = -1
-			if taggedMap.Stats.Pcap != nil {
-				meta.PcapPacketsReceived = taggedMap.Stats.Pcap.PacketsReceived
-				meta.PcapPacketsDropped = taggedMap.Stats.Pcap.PacketsDropped
-				meta.PcapPacketsIfDropped = taggedMap.Stats.Pcap.PacketsIfDropped
-			}
-			meta.PacketsLogged = taggedMap.Stats.PacketsLogged
-			meta.Timestamp = writeout.Timestamp.Unix()
+// collectedIfaces returns the names of the virtual interfaces of the collector
+// already present in the database at dbpath, which count towards its limit.
+func collectedIfaces(dbpath string) []string {
+	entries, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return nil
+	}
 
-			// Write to database, update summary
-			update, err := dbWriters[taggedMap.Iface].Write(taggedMap.Map, meta, writeout.Timestamp.Unix())
-			lastWrite[taggedMap.Iface] = writeoutsCount
-			if err != nil {
-				goProbe.SysLog.Err(fmt.Sprintf("Error during writeout: %s", err.Error()))
-			} else {
-				summaryUpdates = append(summaryUpdates, update)
-			}
+	var ifaces []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), goProbe.COLLECTOR_IFACE_PREFIX) {
+			ifaces = append(ifaces, entry.Name())
+		}
+	}
+	return ifaces
+}
 
-			// write out flows to syslog if necessary
-			if logToSyslog {
-				if syslogWriter != nil {
-					syslogWriter.Write(taggedMap.Map, taggedMap.Iface, writeout.Timestamp.Unix())
-				} else {
-					goProbe.SysLog.Err("Cannot write flows to <nil> syslog writer. Attempting reinitialization.")
+// warnUnprivileged logs the interfaces of ifaces that goProbe can't start
+// capturing on because it has dropped its privileges.
+//
+// Must be called with captureManagerMutex held.
+func warnUnprivileged(ifaces map[string]goProbe.CaptureConfig) {
+	if !privilegesDropped {
+		return
+	}
 
-					// try to reinitialize the writer
-					if syslogWriter, err = goDB.NewSyslogDBWriter(); err != nil {
-						goProbe.SysLog.Err(fmt.Sprintf("Failed to reinitialize syslog writer: %s", err.Error()))
-					}
-				}
-			}
+	current := make(map[string]struct{})
+	for _, iface := range captureManager.Ifaces() {
+		current[iface] = struct{}{}
+	}
+	for iface := range ifaces {
+		if _, exists := current[iface]; !exists {
+			goProbe.SysLog.Warning(fmt.Sprintf("Interface '%s': cannot open capture handle after dropping privileges. Restart goProbe to capture on it.", iface))
+		}
+	}
+}
 
-			count++
+// handleDiscovery periodically starts (and stops) capturing on the interfaces
+// matching patterns in the config as they appear (and disappear). It also
+// ends the triggers whose time is up on interfaces that don't capture any
+// packets.
+func handleDiscovery(writeoutsChan chan<- writeout) {
+	ticker := time.NewTicker(time.Second * time.Duration(INTERFACE_DISCOVERY_INTERVAL))
+	for range ticker.C {
+		captureManagerMutex.Lock()
+		captureManager.ExpireTriggersAll()
+		captureManagerMutex.Unlock()
+
+		configMutex.Lock()
+		if !config.HasInterfacePatterns() {
+			configMutex.Unlock()
+			continue
 		}
 
-		// We are done with the writeout, let's try to write the updated summary
-		err := goDB.ModifyDBSummary(dbpath, 10*time.Second, func(summ *goDB.DBSummary) (*goDB.DBSummary, error) {
-			if summ == nil {
-				summ = goDB.NewDBSummary()
-			}
-			for _, update := range summaryUpdates {
-				summ.Update(update)
-			}
-			return summ, nil
-		})
+		ifaces, err := resolveInterfaces(config)
 		if err != nil {
-			goProbe.SysLog.Err(fmt.Sprintf("Error updating summary: %s", err.Error()))
+			goProbe.SysLog.Err(err.Error())
+			configMutex.Unlock()
+			continue
 		}
 
-		// Clean up dead writers. We say that a writer is dead
-		// if it hasn't been used in the last few writeouts.
-		var remove []string
-		for iface, last := range lastWrite {
-			if writeoutsCount-last >= 3 {
-				remove = append(remove, iface)
+		captureManagerMutex.Lock()
+		warnUnprivileged(ifaces)
+		keepDroppedConfigs(ifaces)
+		current := captureManager.Ifaces()
+		removed := false
+		for _, iface := range current {
+			if _, exists := ifaces[iface]; !exists {
+				removed = true
 			}
 		}
-		for _, iface := range remove {
-			delete(dbWriters, iface)
-			delete(lastWrite, iface)
+
+		if removed {
+			// the flows of the removed interfaces need to be written out
+			queueWriteout(writeoutsChan, time.Now(), func(woChan chan goProbe.TaggedAggFlowMap) {
+				captureManager.Update(ifaces, woChan)
+			})
+		} else if len(ifaces) != len(current) {
+			// No captures are being deleted here, so we can safely discard the channel we pass
+			captureManager.Update(ifaces, make(chan goProbe.TaggedAggFlowMap))
 		}
+		captureManagerMutex.Unlock()
+		configMutex.Unlock()
+	}
+}
 
-		writeoutsCount++
-		goProbe.SysLog.Debug(fmt.Sprintf("Completed writeout (count: %d) in %s", count, time.Now().Sub(t0)))
+func handleWriteouts(writeoutsChan <-chan writeout, doneChan chan<- struct{}, config *capconfig.Config, streamer *goProbe.FlowStreamer) {
+	// The database sink runs synchronously so that it never drops flows.
+	// All other sinks run in goroutines of their own so that they can't
+	// hold up (or break) writing to the database.
+	sinks := goProbe.NewFlowSinks(config.DefaultSinks(), config.Sinks)
+	sinks.Add(goProbe.SINK_GODB, goDB.NewDBSink(dbpath, config.Compression), false)
+	if syslogWriter, err := goDB.NewSyslogDBWriter(config.SyslogFlowExport); err == nil {
+		sinks.Add(goProbe.SINK_SYSLOG, syslogWriter, true)
+	} else {
+		goProbe.SysLog.Err(fmt.Sprintf("Failed to create syslog based flow writer: %s", err))
 	}
+	sinks.Add(goProbe.SINK_STREAM, streamer, true)
+	if config.FlowExport.Enabled() {
+		sinks.Add(goProbe.SINK_NETFLOW, netflow.NewExporter(config.FlowExport, DB_WRITE_INTERVAL), true)
+	}
+
+	maintenance := startMaintenance()
+
+	var lastMaintenance time.Time
+	for {
+		var wo writeout
+		var ok bool
+		select {
+		case wo, ok = <-writeoutsChan:
+		default:
+			// We have caught up, so let's write the oldest spooled writeout
+			if replaySpool(sinks) {
+				continue
+			}
+			wo, ok = <-writeoutsChan
+		}
+		if !ok {
+			break
+		}
+		if wo.Chan == nil {
+			continue
+		}
+		writeFlows(sinks, wo.Chan, wo.Timestamp)
+
+		// old data is maintained in the background while the next
+		// writeouts are written (see maintainer)
+		if time.Now().Sub(lastMaintenance) >= MAINTENANCE_INTERVAL*time.Second {
+			maintenance.trigger()
+			lastMaintenance = time.Now()
+		}
+	}
+
+	maintenance.stop()
+	sinks.Close()
 
 	goProbe.SysLog.Debug("Completed all writeouts")
 	doneChan <- struct{}{}
 }
 
+// writeFlows passes the flow maps received over woChan to the sinks.
+func writeFlows(sinks *goProbe.FlowSinks, woChan <-chan goProbe.TaggedAggFlowMap, timestamp time.Time) {
+	t0 := time.Now()
+	count := 0
+	for taggedMap := range woChan {
+		// Prep metadata for current block
+		meta := goDB.BlockMetadata{}
+		meta.PcapPacketsReceived = -1
+		meta.PcapPacketsDropped = -1
+		meta.PcapPacketsIfDropped = -1
+		if taggedMap.Stats.Pcap != nil {
+			meta.PcapPacketsReceived = taggedMap.Stats.Pcap.PacketsReceived
+			meta.PcapPacketsDropped = taggedMap.Stats.Pcap.PacketsDropped
+			meta.PcapPacketsIfDropped = taggedMap.Stats.Pcap.PacketsIfDropped
+		}
+		meta.PacketsLogged = taggedMap.Stats.PacketsLogged
+		meta.Timestamp = timestamp.Unix()
+
+		sinks.Write(taggedMap.Iface, timestamp.Unix(), taggedMap.Map, meta)
+
+		count++
+	}
+
+	// We are done with the writeout. Among other things, this updates the summary.
+	sinks.Flush()
+
+	goProbe.SysLog.Debug(fmt.Sprintf("Completed writeout (count: %d) in %s", count, time.Now().Sub(t0)))
+}
+
+// replaySpool writes the oldest spooled writeout to the sinks and removes it
+// from the spool. Returns false if the spool is empty.
+//
+// If goProbe stops after the writeout but before its removal, it is
+// written a second time after the next start.
+func replaySpool(sinks *goProbe.FlowSinks) bool {
+	spooled, ok, err := spool.Peek()
+	if err != nil {
+		goProbe.SysLog.Err(err.Error())
+		return true
+	}
+	if !ok {
+		return false
+	}
+
+	woChan := make(chan goProbe.TaggedAggFlowMap, len(spooled.Maps))
+	for _, taggedMap := range spooled.Maps {
+		woChan <- taggedMap
+	}
+	close(woChan)
+	writeFlows(sinks, woChan, time.Unix(spooled.Timestamp, 0))
+
+	if err := spool.Pop(); err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Failed to remove spooled writeout: %s", err))
+	}
+	return true
+}
+
+// queueWriteout creates a writeout, whose flow maps are provided by rotate,
+// and queues it for handleWriteouts. If writeouts are lagging behind (or
+// older writeouts are still spooled), the writeout is spooled instead. We
+// only give up if the spool is full.
+//
+// Must be called with captureManagerMutex held.
+func queueWriteout(writeoutsChan chan<- writeout, timestamp time.Time, rotate func(woChan chan goProbe.TaggedAggFlowMap)) {
+	woChan := make(chan goProbe.TaggedAggFlowMap, MAX_IFACES)
+
+	if n, _ := spool.Depth(); n == 0 && len(writeoutsChan) < WRITEOUTS_SPOOL_THRESHOLD {
+		writeoutsChan <- writeout{woChan, timestamp}
+		rotate(woChan)
+		close(woChan)
+		return
+	}
+
+	// Nobody reads woChan, so we have to collect the flow maps ourselves
+	mapsChan := make(chan []goProbe.TaggedAggFlowMap)
+	go func() {
+		var maps []goProbe.TaggedAggFlowMap
+		for taggedMap := range woChan {
+			maps = append(maps, taggedMap)
+		}
+		mapsChan <- maps
+	}()
+	rotate(woChan)
+	close(woChan)
+
+	if err := spool.Add(goProbe.SpooledWriteout{Timestamp: timestamp.Unix(), Maps: <-mapsChan}); err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Writeouts are lagging behind too much: Queue length is %d and spooling failed: %s", len(writeoutsChan), err))
+		os.Exit(1)
+	}
+
+	// Make sure handleWriteouts doesn't wait for the next writeout
+	// before replaying the spool
+	if len(writeoutsChan) == 0 {
+		select {
+		case writeoutsChan <- writeout{nil, timestamp}:
+		default:
+		}
+	}
+}
+
 // handleControlSocket accepts connections on the given listener and handles any interactions
 // with clients.
 //
@@ -383,18 +666,45 @@ func handleControlSocket(listener net.Listener, writeoutsChan chan<- writeout) {
 				_, writeError = io.WriteString(conn, msg+"\n")
 			}
 
+			configMutex.Lock()
+			access, err := checkControlAccess(conn, config.ControlSocket)
+			configMutex.Unlock()
+			if err != nil {
+				goProbe.SysLog.Err(fmt.Sprintf("Failed to get credentials of control socket client: %s", err))
+				return
+			}
+			if !access.read {
+				goProbe.SysLog.Warning(fmt.Sprintf("Denied access to control socket (%s)", access))
+				writeLn(CONTROL_REPLY_DENIED)
+				return
+			}
+
 			scanner := bufio.NewScanner(conn)
 			for scanner.Scan() {
+				if !access.allows(scanner.Text()) {
+					goProbe.SysLog.Warning(fmt.Sprintf("Denied control socket command '%s' (%s)", commandName(scanner.Text()), access))
+					writeLn(CONTROL_REPLY_DENIED)
+					continue
+				}
+
 				switch scanner.Text() {
 				case CONTROL_CMD_RELOAD:
 					configMutex.Lock()
 					if err := reloadConfig(); err == nil {
-						captureManagerMutex.Lock()
-						woChan := make(chan goProbe.TaggedAggFlowMap, MAX_IFACES)
-						writeoutsChan <- writeout{woChan, time.Now()}
-						captureManager.Update(config.Interfaces, woChan)
-						close(woChan)
-						captureManagerMutex.Unlock()
+						goProbe.PacketLog.SetConfig(config.ErrorLog)
+
+						if captureIfaces, err := resolveInterfaces(config); err == nil {
+							captureManagerMutex.Lock()
+							warnUnprivileged(captureIfaces)
+							keepDroppedConfigs(captureIfaces)
+							queueWriteout(writeoutsChan, time.Now(), func(woChan chan goProbe.TaggedAggFlowMap) {
+								captureManager.Update(captureIfaces, woChan)
+							})
+							captureManagerMutex.Unlock()
+						} else {
+							// the interfaces are updated at the next discovery
+							goProbe.SysLog.Err(err.Error())
+						}
 
 						writeLn(CONTROL_REPLY_DONE)
 					} else {
@@ -404,7 +714,13 @@ func handleControlSocket(listener net.Listener, writeoutsChan chan<- writeout) {
 					configMutex.Unlock()
 				case CONTROL_CMD_STATUS, CONTROL_CMD_DEBUGSTATUS:
 					captureManagerMutex.Lock()
-					writeLn(fmt.Sprintf("%.0f", time.Now().Sub(lastRotation).Seconds()))
+					spooled, spoolSize := spool.Depth()
+					writeLn(fmt.Sprintf("%.0f %d %d %d",
+						time.Now().Sub(lastRotation).Seconds(),
+						len(writeoutsChan),
+						spooled,
+						spoolSize,
+					))
 					for iface, status := range captureManager.StatusAll() {
 						var stateStr string
 						switch scanner.Text() {
@@ -414,19 +730,21 @@ func handleControlSocket(listener net.Listener, writeoutsChan chan<- writeout) {
 							stateStr = status.State.String()
 						}
 						if status.Stats.Pcap == nil {
-							writeLn(fmt.Sprintf("%s %s %d NA NA NA",
+							writeLn(fmt.Sprintf("%s %s %d NA NA NA %d",
 								iface,
 								stateStr,
 								status.Stats.PacketsLogged,
+								status.RingMemory,
 							))
 						} else {
-							writeLn(fmt.Sprintf("%s %s %d %d %d %d",
+							writeLn(fmt.Sprintf("%s %s %d %d %d %d %d",
 								iface,
 								stateStr,
 								status.Stats.PacketsLogged,
 								status.Stats.Pcap.PacketsReceived,
 								status.Stats.Pcap.PacketsDropped,
 								status.Stats.Pcap.PacketsIfDropped,
+								status.RingMemory,
 							))
 						}
 					}
@@ -444,13 +762,72 @@ func handleControlSocket(listener net.Listener, writeoutsChan chan<- writeout) {
 						} else {
 							writeLn(fmt.Sprintf("%s:\n no errors", iface))
 						}
+						for _, file := range goProbe.PacketLog.Files(iface) {
+							var names []string
+							for errString := range file.Classes {
+								names = append(names, errString)
+							}
+							sort.Strings(names)
+							classes := ""
+							for _, errString := range names {
+								classes += fmt.Sprintf(" %s(%d);", errString, file.Classes[errString])
+							}
+							writeLn(fmt.Sprintf(" pcap %s [%d bytes]:%s", file.Path, file.Size, classes))
+						}
 					}
 
 					captureManagerMutex.Unlock()
 
+					writeLn(CONTROL_REPLY_DONE)
+				case CONTROL_CMD_METRICS:
+					spooled, spoolSize := spool.Depth()
+					writeLn(fmt.Sprintf("writeouts_queued %d", len(writeoutsChan)))
+					writeLn(fmt.Sprintf("writeouts_spooled %d", spooled))
+					writeLn(fmt.Sprintf("spool_bytes %d", spoolSize))
+					writeLn(fmt.Sprintf("spool_max_bytes %d", spool.MaxSize()))
+
 					writeLn(CONTROL_REPLY_DONE)
 				default:
-					writeLn(CONTROL_REPY_UNKNOWN_CMD)
+					if strings.HasPrefix(scanner.Text(), CONTROL_CMD_DUMP+" ") {
+						iface := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), CONTROL_CMD_DUMP+" "))
+
+						captureManagerMutex.Lock()
+						record, err := captureManager.Dump(iface)
+						captureManagerMutex.Unlock()
+
+						if err == nil {
+							writeLn(record.File)
+							writeLn(CONTROL_REPLY_DONE)
+						} else {
+							goProbe.SysLog.Err(fmt.Sprintf("Interface '%s': failed to dump packet ring: %s", iface, err))
+							writeLn(CONTROL_REPLY_ERROR)
+						}
+						break
+					}
+
+					if !strings.HasPrefix(scanner.Text(), CONTROL_CMD_TRIGGER+" ") {
+						writeLn(CONTROL_REPY_UNKNOWN_CMD)
+						break
+					}
+
+					iface, spec, err := parseTriggerCommand(strings.TrimPrefix(scanner.Text(), CONTROL_CMD_TRIGGER+" "))
+					if err != nil {
+						goProbe.SysLog.Err(fmt.Sprintf("Invalid trigger command: %s", err))
+						writeLn(CONTROL_REPLY_ERROR)
+						break
+					}
+
+					captureManagerMutex.Lock()
+					record, err := captureManager.Trigger(iface, spec)
+					captureManagerMutex.Unlock()
+
+					if err == nil {
+						writeLn(record.File)
+						writeLn(CONTROL_REPLY_DONE)
+					} else {
+						goProbe.SysLog.Err(fmt.Sprintf("Interface '%s': failed to start trigger: %s", iface, err))
+						writeLn(CONTROL_REPLY_ERROR)
+					}
 				}
 			}
 			if writeError != nil {
@@ -465,6 +842,48 @@ func handleControlSocket(listener net.Listener, writeoutsChan chan<- writeout) {
 	}
 }
 
+// parseTriggerCommand parses the arguments of a TRIGGER command:
+//
+//	<iface> <limits> [BPF] [<filter>]
+//
+// where <limits> is a comma separated list of a duration (e.g. "30s")
+// and/or a packet count (e.g. "1000p"). The filter is a goDB conditional
+// unless it is preceded by BPF.
+func parseTriggerCommand(args string) (string, goProbe.TriggerSpec, error) {
+	spec := goProbe.TriggerSpec{FilterType: goProbe.TRIGGER_FILTER_CONDITIONAL}
+
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return "", spec, fmt.Errorf("Expected interface and limits")
+	}
+	iface := fields[0]
+
+	for _, limit := range strings.Split(fields[1], ",") {
+		if strings.HasSuffix(limit, "p") {
+			n, err := strconv.Atoi(strings.TrimSuffix(limit, "p"))
+			if err != nil || n <= 0 {
+				return "", spec, fmt.Errorf("Invalid packet limit '%s'", limit)
+			}
+			spec.MaxPackets = n
+		} else {
+			d, err := time.ParseDuration(limit)
+			if err != nil || d <= 0 {
+				return "", spec, fmt.Errorf("Invalid duration '%s'", limit)
+			}
+			spec.Duration = d
+		}
+	}
+
+	filter := fields[2:]
+	if len(filter) > 0 && filter[0] == "BPF" {
+		spec.FilterType = goProbe.TRIGGER_FILTER_BPF
+		filter = filter[1:]
+	}
+	spec.Filter = strings.Join(filter, " ")
+
+	return iface, spec, spec.Validate()
+}
+
 // Returns a brief string without whitespace
 // that represents the argument CaptureState.
 func stateMessage(cs goProbe.CaptureState) string {
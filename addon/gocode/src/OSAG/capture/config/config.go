@@ -16,20 +16,76 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 
+	"OSAG/goDB"
 	"OSAG/goProbe"
+	"OSAG/netflow"
 )
 
 type Config struct {
-	DBPath      string                           `json:"db_path"`
-	Interfaces  map[string]goProbe.CaptureConfig `json:"interfaces"`
-	SyslogFlows bool                             `json:"syslog_flows"`
+	DBPath string `json:"db_path"`
+	// codec and level of newly written blocks
+	Compression goDB.Compression `json:"compression"`
+	// Keys are interface names, glob patterns (e.g. "t4_*") or regular
+	// expressions enclosed in slashes (e.g. "/^t4_[0-9]+$/").
+	Interfaces       map[string]goProbe.CaptureConfig `json:"interfaces"`
+	SyslogFlows      bool                             `json:"syslog_flows"`
+	SyslogFlowExport goDB.SyslogFlowConfig            `json:"syslog_flow_export"`
+	ErrorLog         goProbe.PacketLogConfig          `json:"error_log"`
+	FlowExport       netflow.ExporterConfig           `json:"flow_export"`
+	Collector        goProbe.CollectorConfig          `json:"collector"`
+	Spool            goProbe.SpoolConfig              `json:"spool"`
+	// maximum age of the data per interface and size of the database
+	Retention goDB.RetentionConfig `json:"retention"`
+	// query types (e.g. "talk_src") for which per-day aggregates are kept
+	Aggregates []string `json:"aggregates"`
+	// user (and group) to run as once the captures have been started
+	User          string              `json:"user"`
+	Group         string              `json:"group"`
+	ControlSocket ControlSocketConfig `json:"control_socket"`
+	// flow sinks per interface. Interfaces not listed here use DefaultSinks().
+	Sinks map[string][]string `json:"sinks"`
+}
+
+// ControlSocketConfig lists the users and groups (by primary group) other
+// than root and the user goProbe runs as that may use the control socket.
+type ControlSocketConfig struct {
+	// may use read-only commands such as STATUS and ERRORS
+	ReadUIDs []uint32 `json:"read_uids"`
+	ReadGIDs []uint32 `json:"read_gids"`
+	// may use all commands, including mutating ones such as RELOAD
+	AdminUIDs []uint32 `json:"admin_uids"`
+	AdminGIDs []uint32 `json:"admin_gids"`
+}
+
+func contains(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRead checks whether the given user or group may use read-only commands.
+func (cc ControlSocketConfig) AllowsRead(uid, gid uint32) bool {
+	return contains(cc.ReadUIDs, uid) || contains(cc.ReadGIDs, gid)
+}
+
+// AllowsMutating checks whether the given user or group may use all commands.
+func (cc ControlSocketConfig) AllowsMutating(uid, gid uint32) bool {
+	return contains(cc.AdminUIDs, uid) || contains(cc.AdminGIDs, gid)
 }
 
 func NewConfig() *Config {
 	interfaces := make(map[string]goProbe.CaptureConfig)
 	return &Config{
 		Interfaces: interfaces,
+		ErrorLog:   goProbe.DefaultPacketLogConfig(),
 	}
 }
 
@@ -37,7 +93,53 @@ func (c Config) Validate() error {
 	if c.DBPath == "" {
 		return fmt.Errorf("Database path must not be empty")
 	}
+	if err := c.Compression.Validate(); err != nil {
+		return fmt.Errorf("Compression has invalid configuration: %s", err)
+	}
+	if c.Group != "" && c.User == "" {
+		return fmt.Errorf("Group '%s' requires a user", c.Group)
+	}
+	if err := c.ErrorLog.Validate(); err != nil {
+		return fmt.Errorf("Error log has invalid configuration: %s", err)
+	}
+	if err := c.SyslogFlowExport.Validate(); err != nil {
+		return fmt.Errorf("Syslog flow export has invalid configuration: %s", err)
+	}
+	if err := c.FlowExport.Validate(); err != nil {
+		return fmt.Errorf("Flow export has invalid configuration: %s", err)
+	}
+	if err := c.Collector.Validate(); err != nil {
+		return fmt.Errorf("Collector has invalid configuration: %s", err)
+	}
+	if err := c.Spool.Validate(); err != nil {
+		return fmt.Errorf("Spool has invalid configuration: %s", err)
+	}
+	if err := c.Retention.Validate(); err != nil {
+		return fmt.Errorf("Retention has invalid configuration: %s", err)
+	}
+	if err := goDB.ValidateAggregateTypes(c.Aggregates); err != nil {
+		return fmt.Errorf("Aggregates have invalid configuration: %s", err)
+	}
+	for iface, sinks := range c.Sinks {
+		if len(sinks) == 0 {
+			return fmt.Errorf("Interface '%s' has no flow sinks", iface)
+		}
+		for _, sink := range sinks {
+			switch sink {
+			case goProbe.SINK_GODB, goProbe.SINK_SYSLOG, goProbe.SINK_STREAM:
+			case goProbe.SINK_NETFLOW:
+				if !c.FlowExport.Enabled() {
+					return fmt.Errorf("Interface '%s' uses flow sink '%s' but flow_export has no targets", iface, sink)
+				}
+			default:
+				return fmt.Errorf("Interface '%s' uses unknown flow sink '%s'", iface, sink)
+			}
+		}
+	}
 	for iface, cc := range c.Interfaces {
+		if _, err := newIfacePattern(iface); err != nil {
+			return fmt.Errorf("Interface '%s' is an invalid pattern: %s", iface, err)
+		}
 		err := cc.Validate()
 		if err != nil {
 			return fmt.Errorf("Interface '%s' has invalid configuration: %s", iface, err)
@@ -46,6 +148,127 @@ func (c Config) Validate() error {
 	return nil
 }
 
+// ifacePattern matches interface names against a glob pattern or regular
+// expression.
+type ifacePattern struct {
+	key    string
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// isIfacePattern checks whether an interface key of the configuration is a
+// pattern rather than an interface name.
+func isIfacePattern(key string) bool {
+	return isRegexpKey(key) || strings.ContainsAny(key, "*?[")
+}
+
+func isRegexpKey(key string) bool {
+	return len(key) >= 2 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/")
+}
+
+// newIfacePattern parses an interface key. The key of a plain interface
+// name yields a nil pattern.
+func newIfacePattern(key string) (*ifacePattern, error) {
+	if !isIfacePattern(key) {
+		return nil, nil
+	}
+	if isRegexpKey(key) {
+		re, err := regexp.Compile(key[1 : len(key)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &ifacePattern{key: key, regexp: re}, nil
+	}
+	if _, err := path.Match(key, ""); err != nil {
+		return nil, err
+	}
+	return &ifacePattern{key: key, glob: key}, nil
+}
+
+func (p *ifacePattern) matches(iface string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(iface)
+	}
+	matched, _ := path.Match(p.glob, iface)
+	return matched
+}
+
+// HasInterfacePatterns checks whether any of the configured interfaces is
+// a pattern, in which case the interfaces to capture on depend on the
+// interfaces present on the system.
+func (c Config) HasInterfacePatterns() bool {
+	for key := range c.Interfaces {
+		if isIfacePattern(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveInterfaces returns the interfaces to capture on given the
+// interfaces available on the system. Interfaces configured by name are
+// always included and take precedence over patterns. An available
+// interface matching several patterns uses the configuration of the
+// (lexicographically) first one. At most max interfaces are returned;
+// the names of the matching interfaces left out are returned as well.
+func (c Config) ResolveInterfaces(available []string, max int) (map[string]goProbe.CaptureConfig, []string) {
+	ifaces := make(map[string]goProbe.CaptureConfig)
+
+	var keys []string
+	for key, cc := range c.Interfaces {
+		if isIfacePattern(key) {
+			keys = append(keys, key)
+		} else {
+			ifaces[key] = cc
+		}
+	}
+	sort.Strings(keys)
+
+	var patterns []*ifacePattern
+	for _, key := range keys {
+		// the configuration has been validated, so there are no errors
+		pattern, _ := newIfacePattern(key)
+		patterns = append(patterns, pattern)
+	}
+
+	// sorted so that the same interfaces are left out each time
+	available = append([]string(nil), available...)
+	sort.Strings(available)
+
+	var skipped []string
+	for _, iface := range available {
+		if _, exists := ifaces[iface]; exists {
+			continue
+		}
+		for _, pattern := range patterns {
+			if !pattern.matches(iface) {
+				continue
+			}
+			if len(ifaces) >= max {
+				skipped = append(skipped, iface)
+			} else {
+				ifaces[iface] = c.Interfaces[pattern.key]
+			}
+			break
+		}
+	}
+	return ifaces, skipped
+}
+
+// DefaultSinks returns the flow sinks of interfaces without an entry in
+// Sinks: the database and the flow stream, plus syslog and flow export if
+// enabled.
+func (c Config) DefaultSinks() []string {
+	sinks := []string{goProbe.SINK_GODB, goProbe.SINK_STREAM}
+	if c.SyslogFlows {
+		sinks = append(sinks, goProbe.SINK_SYSLOG)
+	}
+	if c.FlowExport.Enabled() {
+		sinks = append(sinks, goProbe.SINK_NETFLOW)
+	}
+	return sinks
+}
+
 func ParseFile(path string) (*Config, error) {
 	config := NewConfig()
 
@@ -0,0 +1,100 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// config_test.go
+//
+// Tests for the resolution of interface patterns
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"OSAG/goProbe"
+)
+
+func TestResolveInterfaces(t *testing.T) {
+	c := NewConfig()
+	c.DBPath = "/tmp/db"
+	c.Interfaces = map[string]goProbe.CaptureConfig{
+		"eth0":              {BufSize: goProbe.MIN_PCAP_BUF_SIZE, BPFFilter: "eth0"},
+		"t4_*":              {BufSize: goProbe.MIN_PCAP_BUF_SIZE, BPFFilter: "glob"},
+		"/^t[0-9]_[0-9]+$/": {BufSize: goProbe.MIN_PCAP_BUF_SIZE, BPFFilter: "tunnel"},
+		"/^vti[0-9]+$/":     {BufSize: goProbe.MIN_PCAP_BUF_SIZE, BPFFilter: "vti"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+	if !c.HasInterfacePatterns() {
+		t.Fatalf("expected config to have interface patterns")
+	}
+
+	available := []string{"vti1", "t4_2", "lo", "t6_1", "vti0", "eth0", "t4_1", "vti2"}
+
+	ifaces, skipped := c.ResolveInterfaces(available, 100)
+	// "/^t[0-9]_[0-9]+$/" sorts before "t4_*"
+	expected := map[string]string{"eth0": "eth0", "t4_1": "tunnel", "t4_2": "tunnel", "t6_1": "tunnel", "vti0": "vti", "vti1": "vti", "vti2": "vti"}
+	if len(ifaces) != len(expected) || len(skipped) != 0 {
+		t.Fatalf("unexpected interfaces %v (skipped: %v)", ifaces, skipped)
+	}
+	for iface, filter := range expected {
+		if ifaces[iface].BPFFilter != filter {
+			t.Fatalf("interface %s: expected configuration %s, got %+v", iface, filter, ifaces[iface])
+		}
+	}
+
+	// matching interfaces beyond the limit are left out
+	ifaces, skipped = c.ResolveInterfaces(available, 4)
+	if len(ifaces) != 4 || ifaces["eth0"].BPFFilter != "eth0" {
+		t.Fatalf("unexpected interfaces %v", ifaces)
+	}
+	if !reflect.DeepEqual(skipped, []string{"vti0", "vti1", "vti2"}) {
+		t.Fatalf("unexpected skipped interfaces %v", skipped)
+	}
+
+	// named interfaces are kept even if they are not available
+	if ifaces, _ = c.ResolveInterfaces(nil, 100); len(ifaces) != 1 {
+		t.Fatalf("expected only named interface, got %v", ifaces)
+	}
+}
+
+func TestInvalidInterfacePattern(t *testing.T) {
+	for _, pattern := range []string{"t4_[", "/t4_(/"} {
+		c := NewConfig()
+		c.DBPath = "/tmp/db"
+		c.Interfaces[pattern] = goProbe.CaptureConfig{BufSize: goProbe.MIN_PCAP_BUF_SIZE}
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected pattern %s to be rejected", pattern)
+		}
+	}
+}
+
+func TestControlSocketAccess(t *testing.T) {
+	cc := ControlSocketConfig{
+		ReadUIDs:  []uint32{1000},
+		ReadGIDs:  []uint32{100},
+		AdminUIDs: []uint32{1001},
+		AdminGIDs: []uint32{10},
+	}
+
+	var tests = []struct {
+		uid, gid       uint32
+		read, mutating bool
+	}{
+		{1000, 1000, true, false},
+		{2000, 100, true, false},
+		{1001, 1001, false, true},
+		{2000, 10, false, true},
+		{2000, 2000, false, false},
+	}
+	for _, test := range tests {
+		if cc.AllowsRead(test.uid, test.gid) != test.read || cc.AllowsMutating(test.uid, test.gid) != test.mutating {
+			t.Fatalf("uid %d, gid %d: expected read %v, mutating %v", test.uid, test.gid, test.read, test.mutating)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// maintenance.go
+//
+// Rollups, retention and aggregates of old data, run alongside the writeouts
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"OSAG/goDB"
+	"OSAG/goProbe"
+)
+
+// maintainer maintains the old data of the database in a goroutine of its
+// own, so that the writeouts don't have to wait for it. It works on one
+// daily directory at a time, which it locks while working on it (the
+// writeouts lock the directory they write to, see goDB.DBWriter).
+type maintainer struct {
+	triggerChan chan struct{}
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+}
+
+// startMaintenance starts the maintenance goroutine. It does nothing until
+// it is triggered.
+func startMaintenance() *maintainer {
+	m := &maintainer{
+		triggerChan: make(chan struct{}, 1),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// trigger starts a maintenance run unless one is running already.
+func (m *maintainer) trigger() {
+	select {
+	case m.triggerChan <- struct{}{}:
+	default:
+	}
+}
+
+// stop stops the maintenance goroutine once it is done with the daily
+// directory it is working on.
+func (m *maintainer) stop() {
+	close(m.stopChan)
+	<-m.doneChan
+}
+
+func (m *maintainer) stopped() bool {
+	select {
+	case <-m.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *maintainer) run() {
+	defer close(m.doneChan)
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-m.triggerChan:
+			configMutex.Lock()
+			retention := config.Retention
+			compression := config.Compression
+			queryTypes := config.Aggregates
+			configMutex.Unlock()
+
+			m.rollup(retention.Rollup, compression)
+			m.enforceRetention(retention)
+			m.buildAggregates(queryTypes)
+		}
+	}
+}
+
+// rollup rolls up at most ROLLUP_MAX_DAYS old daily directories, one at a time
+func (m *maintainer) rollup(rc goDB.RollupConfig, compression goDB.Compression) {
+	days, err := goDB.RollupCandidates(dbpath, rc, time.Now().Unix())
+	if err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Failed to roll up old data: %s", err))
+		return
+	}
+
+	rolled := 0
+	for _, d := range days {
+		if rolled >= ROLLUP_MAX_DAYS || m.stopped() {
+			return
+		}
+		result, ok, err := goDB.RollupDay(dbpath, d.Iface, d.Day, rc, compression)
+		if err != nil {
+			goProbe.SysLog.Err(fmt.Sprintf("Failed to roll up %s: %s", d, err))
+			continue
+		}
+		if ok {
+			goProbe.SysLog.Info(fmt.Sprintf("Retention: %s", result.String()))
+			rolled++
+		}
+	}
+}
+
+// enforceRetention removes the daily directories that are too old or exceed
+// the maximum size of the database according to the retention settings.
+func (m *maintainer) enforceRetention(retention goDB.RetentionConfig) {
+	if !retention.Enabled() || m.stopped() {
+		return
+	}
+
+	report, err := goDB.EnforceRetention(dbpath, retention, time.Now().Unix())
+	for _, removal := range report.Removed {
+		goProbe.SysLog.Info(fmt.Sprintf("Retention: %s", removal.String()))
+	}
+	if err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Failed to enforce retention: %s", err))
+	}
+	if report.OverQuota {
+		goProbe.SysLog.Warning(fmt.Sprintf("Retention: database uses %d bytes, exceeding the maximum size of %d bytes, with only the current day left", report.Size, retention.MaxSize))
+	}
+}
+
+// buildAggregates builds the per-day aggregates for the given query types of
+// at most AGGREGATE_MAX_DAYS complete days, one at a time.
+func (m *maintainer) buildAggregates(queryTypes []string) {
+	if len(queryTypes) == 0 {
+		return
+	}
+	days, err := goDB.AggregateCandidates(dbpath, time.Now().Unix())
+	if err != nil {
+		goProbe.SysLog.Err(fmt.Sprintf("Failed to build aggregates: %s", err))
+		return
+	}
+
+	built := 0
+	for _, d := range days {
+		if built >= AGGREGATE_MAX_DAYS || m.stopped() {
+			return
+		}
+		result, ok, err := goDB.BuildDayAggregates(dbpath, d.Iface, d.Day, queryTypes)
+		if err != nil {
+			goProbe.SysLog.Err(fmt.Sprintf("Failed to build aggregates of %s: %s", d, err))
+			continue
+		}
+		if ok {
+			goProbe.SysLog.Info(result.String())
+			built++
+		}
+	}
+}
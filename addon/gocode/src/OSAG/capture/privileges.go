@@ -0,0 +1,131 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// privileges.go
+//
+// Dropping of root privileges once the capture handles have been opened
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"OSAG/goProbe"
+)
+
+// privilegesDropped is set once goProbe runs as the configured user. From
+// then on, no new capture handles can be opened.
+var privilegesDropped bool
+
+// droppedConfigs holds the configs of the captures whose handles were open
+// when privileges were dropped. These handles can't be reopened with a
+// different config.
+var droppedConfigs map[string]goProbe.CaptureConfig
+
+// lookupCredentials returns the uid and gid goProbe should run as. If
+// groupName is empty, the primary group of the user is used.
+func lookupCredentials(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid uid '%s' of user '%s'", u.Uid, userName)
+	}
+
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid gid '%s'", gidStr)
+	}
+
+	return uid, gid, nil
+}
+
+// chownTree hands dbpath and everything in it (including the control and
+// flow stream sockets) over to uid and gid, so that goProbe can still write
+// to the database after dropping privileges. Files that already belong to
+// uid and gid, which is all of them except after the first start or a
+// change of user, are left alone.
+func chownTree(path string, uid, gid int) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) == uid && int(stat.Gid) == gid {
+			return nil
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// dropPrivileges makes goProbe run as the given user and group. All
+// capabilities are lost in the process, so capture handles that are
+// already open keep working, but no new ones can be opened.
+//
+// Since Go 1.16, the ids are changed for all threads of the process, not
+// just the calling one.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid, err := lookupCredentials(userName, groupName)
+	if err != nil {
+		return fmt.Errorf("Failed to look up user '%s': %s", userName, err)
+	}
+
+	if err := chownTree(dbpath, uid, gid); err != nil {
+		return fmt.Errorf("Failed to change owner of database: %s", err)
+	}
+
+	// The group has to be changed first since we can't do so
+	// once we're no longer root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("Failed to set supplementary groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("Failed to set group id %d: %s", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("Failed to set user id %d: %s", uid, err)
+	}
+
+	// Make sure there is no way back
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("Regained root privileges after dropping them")
+	}
+
+	privilegesDropped = true
+	return nil
+}
+
+// keepDroppedConfigs replaces the configs of the interfaces in ifaces whose
+// capture handles were opened before dropping privileges by the configs
+// they were opened with, since applying a different config would require
+// reopening the handle, which would fail and stop the capture. A warning
+// is logged for each changed config.
+func keepDroppedConfigs(ifaces map[string]goProbe.CaptureConfig) {
+	if !privilegesDropped {
+		return
+	}
+	for iface, config := range ifaces {
+		if dropped, exists := droppedConfigs[iface]; exists && dropped != config {
+			goProbe.SysLog.Warning(fmt.Sprintf("Interface '%s': cannot apply changed configuration after dropping privileges. Restart goProbe to apply it.", iface))
+			ifaces[iface] = dropped
+		}
+	}
+}
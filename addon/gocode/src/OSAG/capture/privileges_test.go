@@ -0,0 +1,135 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// privileges_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// set to the database path in the process dropping its privileges
+const dropTestEnv = "GOPROBE_DROP_TEST_DB"
+
+// threadIds returns the real, effective, saved and filesystem ids in the
+// given field ("Uid" or "Gid") of /proc/self/task/*/status of all threads
+func threadIds(t *testing.T, field string) map[string][]string {
+	paths, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("failed to list threads: %v", err)
+	}
+	ids := make(map[string][]string)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			// the thread exited
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), field+":") {
+				ids[path] = strings.Fields(scanner.Text())[1:]
+			}
+		}
+		f.Close()
+	}
+	return ids
+}
+
+// dropInChild drops the privileges of the test process to those of nobody
+// and checks that all of its threads run as nobody afterwards
+func dropInChild(t *testing.T) {
+	dbpath = os.Getenv(dropTestEnv)
+
+	// keep some threads around besides the one dropping the privileges
+	block := make(chan struct{})
+	defer close(block)
+	for i := 0; i < 4; i++ {
+		go func() {
+			runtime.LockOSThread()
+			<-block
+		}()
+	}
+
+	if err := dropPrivileges("nobody", ""); err != nil {
+		t.Fatalf("failed to drop privileges: %s", err)
+	}
+	uid, gid, err := lookupCredentials("nobody", "")
+	if err != nil {
+		t.Fatalf("failed to look up nobody: %s", err)
+	}
+
+	expected := map[string]string{"Uid": strconv.Itoa(uid), "Gid": strconv.Itoa(gid)}
+	for field, id := range expected {
+		for thread, ids := range threadIds(t, field) {
+			for _, threadId := range ids {
+				if threadId != id {
+					t.Fatalf("%s: %s %v, expected %s", thread, field, ids, id)
+				}
+			}
+		}
+	}
+	if groups, err := syscall.Getgroups(); err != nil || len(groups) != 1 || groups[0] != gid {
+		t.Fatalf("unexpected supplementary groups %v (error: %v)", groups, err)
+	}
+
+	// the database is still writable
+	if err := ioutil.WriteFile(filepath.Join(dbpath, "eth0", "test"), nil, 0644); err != nil {
+		t.Fatalf("failed to write to database: %s", err)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv(dropTestEnv) != "" {
+		dropInChild(t)
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "privileges_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "eth0"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "summary.json"), []byte("{}"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// the ids can't be changed back, so the privileges are dropped in a
+	// separate process
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), dropTestEnv+"="+dir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to drop privileges: %s\n%s", err, output)
+	}
+
+	uid, gid, _ := lookupCredentials("nobody", "")
+	for _, name := range []string{"", "eth0", "summary.json"} {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", name, err)
+		}
+		if stat := info.Sys().(*syscall.Stat_t); int(stat.Uid) != uid || int(stat.Gid) != gid {
+			t.Fatalf("%s: expected owner %d:%d, got %d:%d", name, uid, gid, stat.Uid, stat.Gid)
+		}
+	}
+}
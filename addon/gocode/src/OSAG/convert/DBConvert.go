@@ -220,7 +220,7 @@ func main() {
 		wg.Add(1)
 		for fm := range writeChan {
 			if _, ok := mapWriters[fm.iface]; !ok {
-				mapWriters[fm.iface] = goDB.NewDBWriter(config.SavePath, fm.iface)
+				mapWriters[fm.iface] = goDB.NewDBWriter(config.SavePath, fm.iface, goDB.Compression{})
 			}
 
 			// create an empty metadata block for this timestamp. Of course this
@@ -57,6 +57,15 @@ func ParseAndInstrumentConditional(conditional string, dnsTimeout time.Duration)
     return conditionalNode, nil
 }
 
+// Evaluates the given (parsed and instrumented) conditional on key.
+// A nil conditional is satisfied by every key.
+func EvaluateConditional(conditional Node, key *ExtraKey) bool {
+    if conditional == nil {
+        return true
+    }
+    return conditional.evaluate(key)
+}
+
 // An AST node for the conditional grammar
 // This interface is not meant to be implemented by structs
 // outside of this package.
@@ -75,6 +84,11 @@ type Node interface {
 
     // Returns the set of attributes used in the conditional.
     attributes() map[string]struct{}
+
+    // Returns false if none of the summarized flows (e.g. those of a
+    // block) can satisfy the conditional. Make sure that you called
+    // instrument before calling this.
+    mayMatch(flowSummary) bool
 }
 
 type conditionNode struct {
@@ -83,10 +97,12 @@ type conditionNode struct {
     value        string
     currentValue []byte
     compareValue func(*ExtraKey) bool
+    // nil if summaries can't rule out the condition
+    compareSummary func(flowSummary) bool
 }
 
 func newConditionNode(attribute, comparator, value string) conditionNode {
-    return conditionNode{attribute, comparator, value, nil, nil}
+    return conditionNode{attribute, comparator, value, nil, nil, nil}
 }
 func (n conditionNode) String() string {
     return fmt.Sprintf("%s %s %s", n.attribute, n.comparator, n.value)
@@ -98,7 +114,10 @@ func (n conditionNode) desugar() (Node, error) {
     return desugarConditionNode(n)
 }
 func (n conditionNode) instrument() (Node, error) {
-    err := generateCompareValue(&n)
+    if err := generateCompareValue(&n); err != nil {
+        return n, err
+    }
+    err := generateCompareSummary(&n)
     return n, err
 }
 func (n conditionNode) evaluate(comparisonValue *ExtraKey) bool {
@@ -109,6 +128,12 @@ func (n conditionNode) attributes() map[string]struct{} {
         n.attribute: struct{}{},
     }
 }
+func (n conditionNode) mayMatch(summary flowSummary) bool {
+    if n.compareSummary == nil {
+        return true
+    }
+    return n.compareSummary(summary)
+}
 
 type notNode struct {
     node Node
@@ -134,6 +159,10 @@ func (n notNode) evaluate(comparisonValue *ExtraKey) bool {
 func (n notNode) attributes() map[string]struct{} {
     return n.node.attributes()
 }
+func (n notNode) mayMatch(summary flowSummary) bool {
+    // the summary can't tell whether all flows satisfy the inner node
+    return true
+}
 
 type andNode struct {
     left  Node
@@ -166,6 +195,9 @@ func (n andNode) transform(transformer func(conditionNode) (Node, error)) (Node,
 func (n andNode) evaluate(comparisonValue *ExtraKey) bool {
     return n.left.evaluate(comparisonValue) && n.right.evaluate(comparisonValue)
 }
+func (n andNode) mayMatch(summary flowSummary) bool {
+    return n.left.mayMatch(summary) && n.right.mayMatch(summary)
+}
 func (n andNode) attributes() map[string]struct{} {
     result := n.left.attributes()
     for attribute, _ := range n.right.attributes() {
@@ -205,6 +237,9 @@ func (n orNode) transform(transformer func(conditionNode) (Node, error)) (Node,
 func (n orNode) evaluate(comparisonValue *ExtraKey) bool {
     return n.left.evaluate(comparisonValue) || n.right.evaluate(comparisonValue)
 }
+func (n orNode) mayMatch(summary flowSummary) bool {
+    return n.left.mayMatch(summary) || n.right.mayMatch(summary)
+}
 func (n orNode) attributes() map[string]struct{} {
     result := n.left.attributes()
     for attribute, _ := range n.right.attributes() {
@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"OSAG/goDB/bigendian"
@@ -29,19 +30,56 @@ import (
 const (
 	EPOCH_DAY         int64 = 86400 // one day in seconds
 	DB_WRITE_INTERVAL int64 = 300   // write out interval of capture probe
+
+	// minimum number of blocks of a workload, so that splitting a day
+	// doesn't cost more than it gains
+	WORKLOAD_MIN_BLOCKS = 12
 )
 
 type DBWorkload struct {
 	query    *Query
 	work_dir string
 	load     []int64
+	// durations of the rolled up blocks of the directory. Only read for
+	// directories at the edges of the queried time span.
+	durations map[int64]int64
+	// aggregate of the directory covering the query, if the load consists
+	// of all blocks of the directory
+	aggregate attributeSet
+}
+
+// blockDuration returns the number of seconds covered by the block ending at
+// timestamp
+func blockDuration(durations map[int64]int64, timestamp int64) int64 {
+	if duration, exists := durations[timestamp]; exists {
+		return duration
+	}
+	return DB_WRITE_INTERVAL
 }
 
 type DBWorkManager struct {
+	// number of blocks skipped based on their summary. Accessed atomically,
+	// so it comes first to be 64 bit aligned.
+	skippedBlocks int64
+	// number of blocks whose flows were taken from an aggregate instead
+	aggregatedBlocks int64
+
 	dbIfaceDir         string // path to interface directory in DB, e.g. /path/to/db/eth0
 	iface              string
 	workloads          []DBWorkload
 	numProcessingUnits int
+	// number of blocks of the days left out based on their host index
+	prunedBlocks int
+}
+
+// BlockStats counts the blocks covered by a query
+type BlockStats struct {
+	Total int
+	// blocks whose summary (or the host index of whose day) showed that
+	// none of their flows can satisfy the conditional, so they weren't read
+	Skipped int
+	// blocks of whole days answered from the days' aggregates instead
+	Aggregated int
 }
 
 func NewDBWorkManager(dbpath string, iface string, numProcessingUnits int) (*DBWorkManager, error) {
@@ -50,7 +88,26 @@ func NewDBWorkManager(dbpath string, iface string, numProcessingUnits int) (*DBW
 		return nil, err
 	}
 
-	return &DBWorkManager{filepath.Join(dbpath, iface), iface, []DBWorkload{}, numProcessingUnits}, nil
+	return &DBWorkManager{
+		dbIfaceDir:         filepath.Join(dbpath, iface),
+		iface:              iface,
+		workloads:          []DBWorkload{},
+		numProcessingUnits: numProcessingUnits,
+	}, nil
+}
+
+// BlockStats returns the number of blocks covered by the workloads and, once
+// they were executed, how many of them were skipped
+func (w *DBWorkManager) BlockStats() BlockStats {
+	stats := BlockStats{
+		Total:      w.prunedBlocks,
+		Skipped:    w.prunedBlocks + int(atomic.LoadInt64(&w.skippedBlocks)),
+		Aggregated: int(atomic.LoadInt64(&w.aggregatedBlocks)),
+	}
+	for _, workload := range w.workloads {
+		stats.Total += len(workload.load)
+	}
+	return stats
 }
 
 // make number of workloads available to the outside world for loop bounds etc.
@@ -64,12 +121,31 @@ func (w *DBWorkManager) GetCoveredTimeInterval() (time.Time, time.Time) {
 	numWorkers := len(w.workloads)
 	lenLoad := len(w.workloads[numWorkers-1].load)
 
-	first := w.workloads[0].load[0] - DB_WRITE_INTERVAL
+	// the first block may have been rolled up into a longer one
+	durations := w.workloads[0].durations
+	if durations == nil {
+		durations = readBlockDurations(filepath.Join(w.dbIfaceDir, w.workloads[0].work_dir))
+	}
+	first := w.workloads[0].load[0] - blockDuration(durations, w.workloads[0].load[0])
 	last := w.workloads[numWorkers-1].load[lenLoad-1]
 
 	return time.Unix(first, 0), time.Unix(last, 0)
 }
 
+// dayMayMatch uses the host index of the daily directory dir, if it has one,
+// to tell whether any flow of the day can satisfy the query's conditional
+func (w *DBWorkManager) dayMayMatch(dir string, query *Query) bool {
+	if query.Conditional == nil {
+		return true
+	}
+	index, err := openHostIndex(filepath.Join(w.dbIfaceDir, dir))
+	if err != nil {
+		return true
+	}
+	defer index.Close()
+	return query.Conditional.mayMatch(index)
+}
+
 func (w *DBWorkManager) CreateWorkerJobs(tfirst int64, tlast int64, query *Query) (nonempty bool, err error) {
 	// Get list of files in directory
 	var dirList []os.FileInfo
@@ -104,66 +180,145 @@ func (w *DBWorkManager) CreateWorkerJobs(tfirst int64, tlast int64, query *Query
 					return false, errors.New("could not read file: " + w.dbIfaceDir + "/" + dir_name + "/bytes_rcvd.gpf")
 				}
 
+				// A block covers the time span up to its timestamp, which is
+				// DB_WRITE_INTERVAL seconds long unless the block was rolled
+				// up. All blocks of a day in the middle of the queried time
+				// span are relevant, so the durations are only needed for the
+				// days at its edges.
+				if !(tfirst < temp_dir_tstamp && temp_dir_tstamp+EPOCH_DAY <= tlast) {
+					workload.durations = readBlockDurations(filepath.Join(w.dbIfaceDir, dir_name))
+				}
+
 				// add the relevant timestamps to the workload's list
+				numBlocks := 0
 				for _, stamp := range info_file.GetTimestamps() {
-					if stamp != 0 && tfirst < stamp && stamp < tlast+DB_WRITE_INTERVAL {
+					if stamp == 0 {
+						continue
+					}
+					numBlocks++
+					if tfirst < stamp && stamp-blockDuration(workload.durations, stamp) < tlast {
 						workload.load = append(workload.load, stamp)
 					}
 				}
 				info_file.Close()
 
+				// Queries over whole days can use the day's aggregates
+				if len(workload.load) == numBlocks && !query.hasAttrTime {
+					workload.aggregate = findAggregate(filepath.Join(w.dbIfaceDir, dir_name), newAttributeSet(query.columnIndizes))
+				}
+
 				// Assume we have a directory with timestamp td.
 				// Assume that the first block in the directory has timestamp td + 10.
 				// When tlast = td + 5, we have to scan the directory for blocks and create
 				// a workload that has an empty load list. The rest of the code assumes
 				// that the load isn't empty, so we check for this case here.
 				if len(workload.load) > 0 {
-					w.workloads = append(w.workloads, workload)
+					// days that can't contain a matching flow aren't read at all
+					if w.dayMayMatch(dir_name, query) {
+						w.workloads = append(w.workloads, workload)
+					} else {
+						w.prunedBlocks += len(workload.load)
+					}
 				}
 			}
 		}
 	}
 
+	w.workloads = splitWorkloads(w.workloads, w.numProcessingUnits)
+
 	return 0 < len(w.workloads), err
 }
 
+// splitWorkloads splits the workloads into chunks of consecutive blocks of
+// the same day, so that even the blocks of a single day are spread over
+// numProcessingUnits workers. Each chunk opens the files it needs itself.
+// Workloads using an aggregate are only processed as a whole.
+func splitWorkloads(workloads []DBWorkload, numProcessingUnits int) []DBWorkload {
+	numBlocks := 0
+	for _, workload := range workloads {
+		if workload.aggregate == 0 {
+			numBlocks += len(workload.load)
+		}
+	}
+	if numProcessingUnits < 1 {
+		numProcessingUnits = 1
+	}
+	chunkSize := (numBlocks + numProcessingUnits - 1) / numProcessingUnits
+	if chunkSize < WORKLOAD_MIN_BLOCKS {
+		chunkSize = WORKLOAD_MIN_BLOCKS
+	}
+
+	var chunks []DBWorkload
+	for _, workload := range workloads {
+		if workload.aggregate != 0 || len(workload.load) <= chunkSize {
+			chunks = append(chunks, workload)
+			continue
+		}
+		load := workload.load
+		for len(load) > 0 {
+			n := chunkSize
+			if len(load) < n {
+				n = len(load)
+			}
+			chunk := workload
+			chunk.load = load[:n:n]
+			chunks = append(chunks, chunk)
+			load = load[n:]
+		}
+	}
+	return chunks
+}
+
 // Processing units ---------------------------------------------------------------------
-func (w *DBWorkManager) grabAndProcessWorkload(workloadChan <-chan DBWorkload, mapChan chan map[ExtraKey]Val, wg *sync.WaitGroup) {
-	// parse conditions
-	var err error
+// workerJob is a workload along with the work manager it belongs to
+type workerJob struct {
+	w        *DBWorkManager
+	workload DBWorkload
+}
+
+func grabAndProcessWorkload(jobChan <-chan workerJob, mapChan chan map[ExtraKey]Val, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	for workload := range workloadChan {
+	for job := range jobChan {
 		// create the map in which the workload will store the aggregations
 		resultMap := make(map[ExtraKey]Val)
 
-		// if there is an error during one of the read jobs, throw a syslog message and terminate
-		if err = w.readBlocksAndEvaluate(workload, resultMap); err != nil {
+		// if there is an error during one of the read jobs, throw a syslog message and
+		// report it by sending a nil map
+		if err := job.w.readBlocksAndEvaluate(job.workload, resultMap); err != nil {
 			SysLog.Err(err.Error())
 			mapChan <- nil
-			wg.Done()
+			continue
 		}
 
 		mapChan <- resultMap
 	}
-
-	wg.Done()
 }
 
 // Spawning of processing units and pushing of workload onto factory channel -----------
 func (w *DBWorkManager) ExecuteWorkerReadJobs(mapChan chan map[ExtraKey]Val) {
+	ExecuteReadJobs([]*DBWorkManager{w}, w.numProcessingUnits, mapChan)
+}
+
+// ExecuteReadJobs processes the workloads of all work managers with a single
+// pool of numProcessingUnits workers, so that queries over several interfaces
+// keep all of them busy. The result of each workload is sent over mapChan.
+func ExecuteReadJobs(workManagers []*DBWorkManager, numProcessingUnits int, mapChan chan map[ExtraKey]Val) {
 	procsWG := sync.WaitGroup{}
-	procsWG.Add(w.numProcessingUnits)
+	procsWG.Add(numProcessingUnits)
 
-	workloadChan := make(chan DBWorkload, 128)
-	for i := 0; i < w.numProcessingUnits; i++ {
-		go w.grabAndProcessWorkload(workloadChan, mapChan, &procsWG)
+	jobChan := make(chan workerJob, 128)
+	for i := 0; i < numProcessingUnits; i++ {
+		go grabAndProcessWorkload(jobChan, mapChan, &procsWG)
 	}
 
-	// push the workloads onto the channel
-	for _, workload := range w.workloads {
-		workloadChan <- workload
+	// push the workloads of all interfaces onto the channel
+	for _, w := range workManagers {
+		for _, workload := range w.workloads {
+			jobChan <- workerJob{w, workload}
+		}
 	}
-	close(workloadChan)
+	close(jobChan)
 
 	procsWG.Wait()
 }
@@ -195,8 +350,22 @@ func (w *DBWorkManager) readBlocksAndEvaluate(workload DBWorkload, resultMap map
 		dir   = workload.work_dir
 	)
 
+	// An aggregate that doesn't describe the current blocks of the
+	// directory is ignored
+	if workload.aggregate != 0 {
+		if err = w.evaluateAggregate(workload, resultMap); err == nil {
+			atomic.AddInt64(&w.aggregatedBlocks, int64(len(workload.load)))
+			return nil
+		}
+		SysLog.Warning(fmt.Sprintf("[D %s] Failed to use %s: %s", dir, workload.aggregate.fileName(), err.Error()))
+	}
+
 	var key, comparisonValue ExtraKey
 
+	// The blocks of each column are read into the same buffer, since the
+	// keys copy what they need from them
+	var buffers [COLIDX_COUNT][]byte
+
 	// Load the GPFiles corresponding to the columns we need for the query. Each file is loaded at most once.
 	var columnFiles [COLIDX_COUNT]*GPFile
 	for _, colIdx := range query.columnIndizes {
@@ -207,10 +376,27 @@ func (w *DBWorkManager) readBlocksAndEvaluate(workload DBWorkload, resultMap map
 		}
 	}
 
+	// The summaries of the blocks (if the directory has any) tell which
+	// blocks can't contain any flow satisfying the conditional
+	var index *blockIndex
+	if query.Conditional != nil {
+		if index = openBlockIndex(w.dbIfaceDir + "/" + dir); index != nil {
+			defer index.Close()
+		}
+	}
+
 	// Process the workload
 	// The workload consists of timestamps whose blocks we should process.
 	for b, tstamp := range workload.load {
 
+		// Blocks without a (readable) summary are always read
+		if index != nil {
+			if summary, err := index.summary(tstamp); err == nil && !summaryMayMatch(query.Conditional, summary) {
+				atomic.AddInt64(&w.skippedBlocks, 1)
+				continue
+			}
+		}
+
 		var (
 			blocks      [COLIDX_COUNT][]byte
 			blockBroken = false
@@ -219,11 +405,12 @@ func (w *DBWorkManager) readBlocksAndEvaluate(workload DBWorkload, resultMap map
 		for _, colIdx := range query.columnIndizes {
 
 			// Read the block from the file
-			if blocks[colIdx], err = columnFiles[colIdx].ReadTimedBlock(tstamp); err != nil {
+			if blocks[colIdx], err = columnFiles[colIdx].ReadTimedBlockInto(tstamp, buffers[colIdx]); err != nil {
 				blockBroken = true
 				SysLog.Warning(fmt.Sprintf("[D %s; B %d] Failed to read %s.gpf: %s", dir, tstamp, columnFileNames[colIdx], err.Error()))
 				break
 			}
+			buffers[colIdx] = blocks[colIdx]
 
 			// Check whether timestamps contained in headers match
 			blockTstamp := bigendian.ReadInt64At(blocks[colIdx], 0) // The timestamp header is 8 bytes
@@ -0,0 +1,151 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// DBWorkManager_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// runParallelQuery runs the query on the given interfaces of the database
+// over the whole synthetic day with a single pool of numProcessingUnits
+// workers and returns the aggregated result along with the work managers
+func runParallelQuery(tb testing.TB, dbpath string, ifaces []string, numProcessingUnits int, queryType, conditional string) (map[ExtraKey]Val, []*DBWorkManager) {
+	attributes, hasAttrTime, hasAttrIface, err := ParseQueryType(queryType)
+	if err != nil {
+		tb.Fatalf("failed to parse query type: %s", err)
+	}
+	condition, err := ParseAndInstrumentConditional(conditional, time.Second)
+	if err != nil {
+		tb.Fatalf("failed to parse conditional: %s", err)
+	}
+	query := NewQuery(attributes, condition, hasAttrTime, hasAttrIface)
+
+	var workManagers []*DBWorkManager
+	for _, iface := range ifaces {
+		wm, err := NewDBWorkManager(dbpath, iface, numProcessingUnits)
+		if err != nil {
+			tb.Fatalf("failed to create work manager: %s", err)
+		}
+		if _, err := wm.CreateWorkerJobs(0, 1450656000+EPOCH_DAY, query); err != nil {
+			tb.Fatalf("failed to create worker jobs: %s", err)
+		}
+		workManagers = append(workManagers, wm)
+	}
+
+	var (
+		result  = make(map[ExtraKey]Val)
+		mapChan = make(chan map[ExtraKey]Val, 1024)
+		done    = make(chan struct{})
+	)
+	go func() {
+		for m := range mapChan {
+			if m == nil {
+				tb.Errorf("workload failed")
+				continue
+			}
+			for k, v := range m {
+				val := result[k]
+				val.NBytesRcvd += v.NBytesRcvd
+				val.NBytesSent += v.NBytesSent
+				val.NPktsRcvd += v.NPktsRcvd
+				val.NPktsSent += v.NPktsSent
+				result[k] = val
+			}
+		}
+		close(done)
+	}()
+	ExecuteReadJobs(workManagers, numProcessingUnits, mapChan)
+	close(mapChan)
+	<-done
+
+	return result, workManagers
+}
+
+func TestSplitWorkloads(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "workmanager_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	ifaces := []string{"eth0", "eth1"}
+	for _, iface := range ifaces {
+		writeSyntheticIface(t, dbpath, iface, 50, 100, ENCODING_IP)
+	}
+
+	var tests = []struct {
+		numProcessingUnits int
+		// number of workloads per interface
+		workloads int
+	}{
+		{1, 1},
+		{2, 2},
+		// 13, 13, 13 and 11 blocks
+		{4, 4},
+		// no less than WORKLOAD_MIN_BLOCKS blocks per workload
+		{16, 5},
+	}
+	for _, queryType := range []string{"talk_conv", "iface,dport"} {
+		expected, _ := runParallelQuery(t, dbpath, ifaces, 1, queryType, "")
+		if len(expected) == 0 {
+			t.Fatalf("%s: empty result", queryType)
+		}
+		for _, test := range tests {
+			result, workManagers := runParallelQuery(t, dbpath, ifaces, test.numProcessingUnits, queryType, "")
+			if !reflect.DeepEqual(result, expected) {
+				t.Fatalf("%s: results differ with %d processing units", queryType, test.numProcessingUnits)
+			}
+			for _, wm := range workManagers {
+				if wm.GetNumWorkers() != test.workloads || wm.BlockStats().Total != 50 {
+					t.Fatalf("%d processing units: expected %d workloads of 50 blocks, got %d workloads of %d blocks",
+						test.numProcessingUnits, test.workloads, wm.GetNumWorkers(), wm.BlockStats().Total)
+				}
+				first, last := wm.GetCoveredTimeInterval()
+				if first.Unix() != 1450656000 || last.Unix() != 1450656000+50*DB_WRITE_INTERVAL {
+					t.Fatalf("unexpected covered time interval %v - %v", first, last)
+				}
+			}
+		}
+	}
+}
+
+// The speedup over a single processing unit depends on the number of
+// available cores
+func BenchmarkQueryParallel(b *testing.B) {
+	const blocks, flows = 96, 2000
+
+	dir, err := ioutil.TempDir("", "workmanager_bench")
+	if err != nil {
+		b.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ifaces := []string{"eth0", "eth1", "eth2", "eth3"}
+	for _, iface := range ifaces {
+		writeSyntheticIface(b, dir, iface, blocks, flows, ENCODING_IP)
+	}
+	b.Logf("%d cores", runtime.NumCPU())
+
+	for _, numIfaces := range []int{1, len(ifaces)} {
+		for _, numProcessingUnits := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("ifaces=%d/units=%d", numIfaces, numProcessingUnits), func(b *testing.B) {
+				b.SetBytes(int64(numIfaces * blocks * flows))
+				for i := 0; i < b.N; i++ {
+					runParallelQuery(b, dir, ifaces[:numIfaces], numProcessingUnits, "talk_conv", "dport = 443")
+				}
+			})
+		}
+	}
+}
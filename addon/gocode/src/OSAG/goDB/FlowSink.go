@@ -0,0 +1,119 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// FlowSink.go
+//
+// Interface for consumers of rotated flow maps and its implementation
+// writing to the database.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"time"
+)
+
+// A FlowSink consumes the flow maps of all interfaces at each writeout.
+//
+// Open is called before the first Write. If it fails, it is retried at
+// the next Write. Write must not modify flowmap since it is shared by all
+// sinks.
+type FlowSink interface {
+	Open() error
+	Write(iface string, timestamp int64, flowmap AggFlowMap, meta BlockMetadata) error
+	Close() error
+}
+
+// FlowSinkFlusher is implemented by FlowSinks that need to do some work
+// once all flow maps of a writeout have been written.
+type FlowSinkFlusher interface {
+	Flush() error
+}
+
+const (
+	// DBSink forgets about an interface's DBWriter if the interface
+	// hasn't been written in this many writeouts
+	DBSINK_WRITER_TIMEOUT = 3
+
+	DBSINK_SUMMARY_TIMEOUT = 10 * time.Second
+)
+
+// DBSink is the FlowSink writing flows to the database. The database
+// summary is updated when the sink is flushed.
+type DBSink struct {
+	dbpath      string
+	compression Compression
+
+	writers   map[string]*DBWriter
+	lastWrite map[string]int
+	writeouts int
+
+	summaryUpdates []InterfaceSummaryUpdate
+}
+
+func NewDBSink(dbpath string, compression Compression) *DBSink {
+	return &DBSink{
+		dbpath:      dbpath,
+		compression: compression,
+		writers:     make(map[string]*DBWriter),
+		lastWrite:   make(map[string]int),
+	}
+}
+
+func (s *DBSink) Open() error {
+	return nil
+}
+
+func (s *DBSink) Write(iface string, timestamp int64, flowmap AggFlowMap, meta BlockMetadata) error {
+	// Ensure that there is a DBWriter for the given interface
+	w, exists := s.writers[iface]
+	if !exists {
+		w = NewDBWriter(s.dbpath, iface, s.compression)
+		s.writers[iface] = w
+	}
+
+	update, err := w.Write(flowmap, meta, timestamp)
+	s.lastWrite[iface] = s.writeouts
+	if err != nil {
+		return err
+	}
+	s.summaryUpdates = append(s.summaryUpdates, update)
+	return nil
+}
+
+// Flush writes the updated summary.
+func (s *DBSink) Flush() error {
+	err := ModifyDBSummary(s.dbpath, DBSINK_SUMMARY_TIMEOUT, func(summ *DBSummary) (*DBSummary, error) {
+		if summ == nil {
+			summ = NewDBSummary()
+		}
+		for _, update := range s.summaryUpdates {
+			summ.Update(update)
+		}
+		return summ, nil
+	})
+	s.summaryUpdates = nil
+
+	// Clean up dead writers. We say that a writer is dead
+	// if it hasn't been used in the last few writeouts.
+	for iface, last := range s.lastWrite {
+		if s.writeouts-last >= DBSINK_WRITER_TIMEOUT {
+			delete(s.writers, iface)
+			delete(s.lastWrite, iface)
+		}
+	}
+	s.writeouts++
+
+	if err != nil {
+		return fmt.Errorf("Error updating summary: %s", err)
+	}
+	return nil
+}
+
+func (s *DBSink) Close() error {
+	return nil
+}
@@ -1,50 +1,86 @@
 package goDB
 
-/*
-#cgo CFLAGS: -O3
-#define LZ4_STATIC_LINKING_ONLY
-
-#include <stdlib.h>
-#include <stdio.h>
-#include "lz4/lz4hc.h"
-#include "lz4/lz4.h"
-
-int cCompress(int len, char *input, char *output, int level) {
-  return LZ4_compressHC2(input, output, len, level);
-}
-
-int cUncompress(char *output, int out_len, char *input) {
-  return LZ4_decompress_fast(input, output, out_len);
-}
-*/
-import "C"
-
 import (
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
-	"unsafe"
 )
 
 const (
 	BUF_SIZE = 4096         // 512 * 64bit
 	N_ELEM   = BUF_SIZE / 8 // 512
+
+	// Files without a version section are version 1. They have a single
+	// header page, no checksums and only hold raw LZ4 compressed blocks.
+	GPF_VERSION_LEGACY = 1
+	// Adds a version section in front of the header, which links further
+	// header pages, and sections holding the CRC32C checksum, the codec
+	// and the EncodingType of each block after it. This is the version of
+	// newly created files.
+	GPF_VERSION = 2
+
+	// The version section starts with GPF_MAGIC followed by the version as
+	// 32 bit big-endian integer. The first 64 bit value of a legacy header
+	// is 0 or the end of the first block, so the two can't be confused.
+	GPF_MAGIC = "GPF\x00"
+	// Position of the 64 bit big-endian pointer to the next header page
+	// within the version section
+	GPF_NEXT_PAGE_OFFSET = 8
+	// Size of the version section
+	GPF_VERSION_SIZE = 16
+	// Size of the checksum, codec and encoding of a block in the header
+	GPF_CHECKSUM_SIZEOF = 4
+	GPF_CODEC_SIZEOF    = 1
+	GPF_ENCODING_SIZEOF = 1
+	// Upper bound for the number of header pages of a file, which protects
+	// against following corrupted page pointers forever
+	GPF_MAX_PAGES = 2048
 )
 
+// ErrIncompleteHeader is returned by NewGPFile for files that are too short
+// to hold a header. This happens if the creation of the file was interrupted.
+var ErrIncompleteHeader = errors.New("Incomplete header")
+
+// ErrChecksumMismatch is returned when reading a block whose data doesn't
+// match the checksum in the header.
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type GPFile struct {
 	// The file header //
 	// Contains 512 64 bit addresses pointing to the end
 	// (+1 byte) of each compressed block and the lookup
 	// table which stores 512 timestamps as int64 for
-	// lookup without having to parse the file
+	// lookup without having to parse the file. Files of
+	// the current version have a header page for each 512
+	// blocks, whose entries are concatenated here.
 	blocks     []int64
 	timestamps []int64
 	lengths    []int64
+	// CRC32C, CodecType and EncodingType of each block
+	// (not in legacy files)
+	checksums []int64
+	codecs    []int64
+	encodings []int64
+	// position of each header page in the file. The first page is the
+	// header at the start of the file.
+	pages []int64
+
+	version     int
+	header_size int64
 
 	// The path to the file
 	filename string
 	cur_file *os.File
 	w_buf    []byte
+	// holds encoded blocks between their decompression and decoding
+	d_buf []byte
 
 	last_seek_pos int64
 }
@@ -59,106 +95,296 @@ type GPFiler interface {
 	Close() error
 }
 
+// Positions of the sections within a header page of the current version.
+// Legacy header pages lack the version section and start with the blocks.
+const (
+	GPF_BLOCKS_OFFSET     = GPF_VERSION_SIZE
+	GPF_TIMESTAMPS_OFFSET = GPF_BLOCKS_OFFSET + BUF_SIZE
+	GPF_LENGTHS_OFFSET    = GPF_TIMESTAMPS_OFFSET + BUF_SIZE
+	GPF_CHECKSUMS_OFFSET  = GPF_LENGTHS_OFFSET + BUF_SIZE
+	GPF_CODECS_OFFSET     = GPF_CHECKSUMS_OFFSET + N_ELEM*GPF_CHECKSUM_SIZEOF
+	GPF_ENCODINGS_OFFSET  = GPF_CODECS_OFFSET + N_ELEM*GPF_CODEC_SIZEOF
+	GPF_HEADER_SIZE       = GPF_ENCODINGS_OFFSET + N_ELEM*GPF_ENCODING_SIZEOF
+)
+
+// headerSize returns the size of a header page of a file of the given version
+func headerSize(version int) int64 {
+	if version == GPF_VERSION_LEGACY {
+		return BUF_SIZE * 3
+	}
+	return GPF_HEADER_SIZE
+}
+
+// decodeSection reads the N_ELEM big-endian values of size bytes each in buf
+func decodeSection(buf []byte, section []int64, size int) {
+	var pos int = 0
+	for i := 0; i < N_ELEM; i++ {
+		var value int64
+		for j := 0; j < size; j++ {
+			value = value<<8 | int64(buf[pos+j])
+		}
+		section[i] = value
+		pos += size
+	}
+}
+
+// encodeSection writes the N_ELEM values as big-endian values of size bytes
+// each to buf
+func encodeSection(buf []byte, section []int64, size int) {
+	var pos int = 0
+	for i := 0; i < N_ELEM; i++ {
+		for j := 0; j < size; j++ {
+			buf[pos+j] = byte(section[i] >> uint((size-1-j)*8))
+		}
+		pos += size
+	}
+}
+
+// syncDir makes the creation of files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// newHeader returns an empty file of the given version with a single
+// header page, which isn't backed by a file yet.
+func newHeader(version int) *GPFile {
+	return &GPFile{
+		blocks:      make([]int64, N_ELEM),
+		timestamps:  make([]int64, N_ELEM),
+		lengths:     make([]int64, N_ELEM),
+		checksums:   make([]int64, N_ELEM),
+		codecs:      make([]int64, N_ELEM),
+		encodings:   make([]int64, N_ELEM),
+		pages:       []int64{0},
+		version:     version,
+		header_size: headerSize(version),
+		w_buf:       make([]byte, headerSize(version)),
+	}
+}
+
+// writeFileAtomic writes data under a temporary name and renames it to p
+// once it is on disk, so p either has the complete data or its previous
+// content (if any).
+func writeFileAtomic(p string, data []byte) error {
+	tmp := p + ".tmp"
+	wfile, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = wfile.Write(data); err == nil {
+		err = wfile.Sync()
+	}
+	if cerr := wfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// createGPFile creates an empty file with a header of the current version.
+// The file either exists with a complete header or not at all.
+func createGPFile(p string) error {
+	f := newHeader(GPF_VERSION)
+	f.encodePage(0)
+	return writeFileAtomic(p, f.w_buf)
+}
+
 func NewGPFile(p string) (*GPFile, error) {
 	var (
-		buf_h            = make([]byte, BUF_SIZE)
-		buf_ts           = make([]byte, BUF_SIZE)
-		buf_len          = make([]byte, BUF_SIZE)
-		f                *os.File
-		n_h, n_ts, n_len int
-		err              error
+		buf_h = make([]byte, headerSize(GPF_VERSION))
+		file  *os.File
+		err   error
 	)
 
-	// open file if it exists and read header, otherwise create it
-	// and write empty header
-	if _, err = os.Stat(p); err == nil {
-		if f, err = os.Open(p); err != nil {
+	// create file with an empty header if it doesn't exist
+	if _, err = os.Stat(p); os.IsNotExist(err) {
+		if err = createGPFile(p); err != nil {
 			return nil, err
 		}
-		if n_h, err = f.Read(buf_h); err != nil {
-			return nil, err
-		}
-		if n_ts, err = f.Read(buf_ts); err != nil {
-			return nil, err
+	}
+
+	if file, err = os.Open(p); err != nil {
+		return nil, err
+	}
+
+	// the first three sections are present in all versions
+	if _, err = io.ReadFull(file, buf_h[:BUF_SIZE*3]); err != nil {
+		file.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompleteHeader
 		}
-		if n_len, err = f.Read(buf_len); err != nil {
-			return nil, err
+		return nil, err
+	}
+
+	var version int = GPF_VERSION_LEGACY
+	if string(buf_h[:len(GPF_MAGIC)]) == GPF_MAGIC {
+		version = int(uint32(buf_h[4])<<24 | uint32(buf_h[5])<<16 | uint32(buf_h[6])<<8 | uint32(buf_h[7]))
+		if version != GPF_VERSION {
+			file.Close()
+			return nil, fmt.Errorf("Unsupported gpf version %d", version)
 		}
-	} else {
-		if f, err = os.Create(p); err != nil {
+		if _, err = io.ReadFull(file, buf_h[BUF_SIZE*3:headerSize(version)]); err != nil {
+			file.Close()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, ErrIncompleteHeader
+			}
 			return nil, err
 		}
-		if n_h, err = f.Write(buf_h); err != nil {
-			return nil, err
+	}
+
+	f := &GPFile{
+		pages:         []int64{0},
+		version:       version,
+		header_size:   headerSize(version),
+		filename:      p,
+		cur_file:      file,
+		w_buf:         make([]byte, headerSize(version)),
+		last_seek_pos: headerSize(version),
+	}
+
+	// read the header information of all pages
+	for next := f.decodePage(buf_h); next != 0; next = f.decodePage(buf_h) {
+		if len(f.pages) >= GPF_MAX_PAGES || next < f.pages[len(f.pages)-1]+f.header_size {
+			file.Close()
+			return nil, fmt.Errorf("Invalid header page position %d", next)
 		}
-		if n_ts, err = f.Write(buf_ts); err != nil {
-			return nil, err
+		if _, err = file.ReadAt(buf_h[:f.header_size], next); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Failed to read header page at %d: %s", next, err)
 		}
-		if n_len, err = f.Write(buf_len); err != nil {
-			return nil, err
+		page_version := int(uint32(buf_h[4])<<24 | uint32(buf_h[5])<<16 | uint32(buf_h[6])<<8 | uint32(buf_h[7]))
+		if string(buf_h[:len(GPF_MAGIC)]) != GPF_MAGIC || page_version != version {
+			file.Close()
+			return nil, fmt.Errorf("No header page at %d", next)
 		}
-		f.Sync()
+		f.pages = append(f.pages, next)
 	}
 
-	if n_h != BUF_SIZE {
-		return nil, errors.New("Invalid header (blocks)")
-	}
-	if n_ts != BUF_SIZE {
-		return nil, errors.New("Invalid header (lookup table)")
-	}
-	if n_len != BUF_SIZE {
-		return nil, errors.New("Invalid header (block lengths)")
-	}
+	return f, nil
+}
 
-	// read the header information
-	var h = make([]int64, N_ELEM)
-	var ts = make([]int64, N_ELEM)
-	var le = make([]int64, N_ELEM)
-	var pos int = 0
-	for i := 0; i < N_ELEM; i++ {
-		h[i] = int64(buf_h[pos])<<56 | int64(buf_h[pos+1])<<48 | int64(buf_h[pos+2])<<40 | int64(buf_h[pos+3])<<32 | int64(buf_h[pos+4])<<24 | int64(buf_h[pos+5])<<16 | int64(buf_h[pos+6])<<8 | int64(buf_h[pos+7])
-		ts[i] = int64(buf_ts[pos])<<56 | int64(buf_ts[pos+1])<<48 | int64(buf_ts[pos+2])<<40 | int64(buf_ts[pos+3])<<32 | int64(buf_ts[pos+4])<<24 | int64(buf_ts[pos+5])<<16 | int64(buf_ts[pos+6])<<8 | int64(buf_ts[pos+7])
-		le[i] = int64(buf_len[pos])<<56 | int64(buf_len[pos+1])<<48 | int64(buf_len[pos+2])<<40 | int64(buf_len[pos+3])<<32 | int64(buf_len[pos+4])<<24 | int64(buf_len[pos+5])<<16 | int64(buf_len[pos+6])<<8 | int64(buf_len[pos+7])
-		pos += 8
+// decodePage appends the entries of the header page in buf to the header
+// and returns the position of the next page (0 if there is none)
+func (f *GPFile) decodePage(buf []byte) int64 {
+	var (
+		h     = make([]int64, N_ELEM)
+		ts    = make([]int64, N_ELEM)
+		le    = make([]int64, N_ELEM)
+		crc   = make([]int64, N_ELEM)
+		codec = make([]int64, N_ELEM)
+		enc   = make([]int64, N_ELEM)
+		next  int64
+		off   = GPF_BLOCKS_OFFSET
+	)
+	if f.version == GPF_VERSION_LEGACY {
+		off = 0
+	} else {
+		decodeSection(buf[GPF_CHECKSUMS_OFFSET:], crc, GPF_CHECKSUM_SIZEOF)
+		decodeSection(buf[GPF_CODECS_OFFSET:], codec, GPF_CODEC_SIZEOF)
+		decodeSection(buf[GPF_ENCODINGS_OFFSET:], enc, GPF_ENCODING_SIZEOF)
+		for j := 0; j < 8; j++ {
+			next = next<<8 | int64(buf[GPF_NEXT_PAGE_OFFSET+j])
+		}
 	}
+	decodeSection(buf[off:], h, 8)
+	decodeSection(buf[off+BUF_SIZE:], ts, 8)
+	decodeSection(buf[off+BUF_SIZE*2:], le, 8)
+
+	f.blocks = append(f.blocks, h...)
+	f.timestamps = append(f.timestamps, ts...)
+	f.lengths = append(f.lengths, le...)
+	f.checksums = append(f.checksums, crc...)
+	f.codecs = append(f.codecs, codec...)
+	f.encodings = append(f.encodings, enc...)
+	return next
+}
 
-	return &GPFile{h, ts, le, p, f, make([]byte, BUF_SIZE*3), 0}, nil
+// Version returns the format version of the file
+func (f *GPFile) Version() int {
+	return f.version
 }
 
 func (f *GPFile) BlocksUsed() (int, error) {
-	for i := 0; i < N_ELEM; i++ {
+	for i := 0; i < len(f.timestamps); i++ {
 		if f.timestamps[i] == 0 && f.blocks[i] == 0 && f.lengths[i] == 0 {
 			return i, nil
 		}
 	}
-	return -1, errors.New("Could not retrieve number of allocated blocks")
+	return len(f.timestamps), nil
 }
 
-func (f *GPFile) ReadBlock(block int) ([]byte, error) {
-	if f.timestamps[block] == 0 && f.blocks[block] == 0 && f.lengths[block] == 0 {
-		return nil, errors.New("Block " + strconv.Itoa(block) + " is empty")
+// blockCodec returns the codec the block is compressed with
+func (f *GPFile) blockCodec(block int) (CodecType, Codec, error) {
+	id := CODEC_LZ4
+	if f.version != GPF_VERSION_LEGACY {
+		id = CodecType(f.codecs[block])
+	}
+	codec, err := GetCodec(id)
+	if err != nil {
+		return id, nil, errors.New("Block " + strconv.Itoa(block) + ": " + err.Error())
+	}
+	return id, codec, nil
+}
+
+// blockEncoding returns the encoding the data of the block is stored in
+func (f *GPFile) blockEncoding(block int) EncodingType {
+	if f.version != GPF_VERSION_LEGACY {
+		return EncodingType(f.encodings[block])
 	}
+	return ENCODING_RAW
+}
+
+// blockStart returns the position of the block. The first block of each
+// header page follows the page.
+func (f *GPFile) blockStart(block int) int64 {
+	if block%N_ELEM == 0 {
+		return f.pages[block/N_ELEM] + f.header_size
+	}
+	return f.blocks[block-1]
+}
+
+// blockRange returns the position and the compressed length of the block
+func (f *GPFile) blockRange(block int) (int64, int64) {
+	start := f.blockStart(block)
+	return start, f.blocks[block] - start
+}
 
+// readRaw reads the compressed data of the block without verifying it
+func (f *GPFile) readRaw(block int) ([]byte, error) {
 	var (
 		err      error
-		seek_pos int64 = BUF_SIZE * 3
+		seek_pos int64
 		read_len int64
-		n_read   int
+		codec    Codec
 	)
 
+	if _, codec, err = f.blockCodec(block); err != nil {
+		return nil, err
+	}
+
 	// Check if file has already been opened for reading. If not, open it
 	if f.cur_file == nil {
 		if f.cur_file, err = os.OpenFile(f.filename, os.O_RDONLY, 0600); err != nil {
 			return nil, err
 		}
+		f.last_seek_pos = 0
 	}
 
-	// If first block is requested, set seek position to end of header and read length of
-	// first block. Otherwise start at last block's end
-	read_len = f.blocks[block] - BUF_SIZE*3
-	if block != 0 {
-		seek_pos = f.blocks[block-1]
-		read_len = f.blocks[block] - f.blocks[block-1]
+	// the compressed block can't be larger than the bound of its codec
+	seek_pos, read_len = f.blockRange(block)
+	if read_len <= 0 || f.lengths[block] > math.MaxInt32 || read_len > int64(codec.Bound(int(f.lengths[block]))) {
+		return nil, errors.New("Block " + strconv.Itoa(block) + " has invalid position")
 	}
 
 	// if the file is read continuously, do not seek
@@ -171,110 +397,408 @@ func (f *GPFile) ReadBlock(block int) ([]byte, error) {
 	}
 
 	buf_comp := make([]byte, read_len)
-	if n_read, err = f.cur_file.Read(buf_comp); err != nil {
+	if _, err = io.ReadFull(f.cur_file, buf_comp); err != nil {
+		// the position in the file is unknown now
+		f.last_seek_pos = -1
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Incorrect number of bytes read from file")
+		}
+		return nil, err
+	}
+	f.last_seek_pos += read_len
+
+	return buf_comp, nil
+}
+
+// readCompressed reads the compressed data of the block and verifies its checksum
+func (f *GPFile) readCompressed(block int) ([]byte, error) {
+	buf_comp, err := f.readRaw(block)
+	if err != nil {
 		return nil, err
 	}
 
-	if int64(n_read) != read_len {
-		return nil, errors.New("Incorrect number of bytes read from file")
+	if f.version != GPF_VERSION_LEGACY && int64(crc32.Checksum(buf_comp, crc32cTable)) != f.checksums[block] {
+		return nil, ErrChecksumMismatch
+	}
+
+	return buf_comp, nil
+}
+
+func (f *GPFile) ReadBlock(block int) ([]byte, error) {
+	return f.ReadBlockInto(block, nil)
+}
+
+// ReadBlockInto reads the block like ReadBlock, but stores it in buf if buf
+// has enough capacity. Readers going through many blocks can thus reuse a
+// single buffer, which must not be used for anything else in the meantime.
+func (f *GPFile) ReadBlockInto(block int, buf []byte) ([]byte, error) {
+	if f.timestamps[block] == 0 && f.blocks[block] == 0 && f.lengths[block] == 0 {
+		return nil, errors.New("Block " + strconv.Itoa(block) + " is empty")
+	}
+
+	if f.lengths[block] <= 0 || f.lengths[block] > math.MaxInt32 {
+		return nil, errors.New("Block " + strconv.Itoa(block) + " has invalid length")
 	}
 
-	buf := make([]byte, f.lengths[block])
+	buf_comp, err := f.readCompressed(block)
+	if err != nil {
+		return nil, err
+	}
+	_, codec, err := f.blockCodec(block)
+	if err != nil {
+		return nil, err
+	}
 
-	var uncomp_len int = int(C.cUncompress((*C.char)(unsafe.Pointer(&buf[0])), C.int(f.lengths[block]), (*C.char)(unsafe.Pointer(&buf_comp[0]))))
+	encoding := f.blockEncoding(block)
+	if encoding == ENCODING_RAW {
+		buf = growBuffer(buf, int(f.lengths[block]))
+		if err = codec.Decompress(buf_comp, buf); err != nil {
+			return nil, errors.New("Failed to decompress block " + strconv.Itoa(block) + ": " + err.Error())
+		}
+		return buf, nil
+	}
+
+	// the encoded block is only needed until it is decoded into buf
+	f.d_buf = growBuffer(f.d_buf, int(f.lengths[block]))
+	if err = codec.Decompress(buf_comp, f.d_buf); err != nil {
+		return nil, errors.New("Failed to decompress block " + strconv.Itoa(block) + ": " + err.Error())
+	}
 
-	if int64(uncomp_len) != read_len {
-		return nil, errors.New("Incorrect number of bytes read for decompression")
+	if buf, err = decodeBlock(f.d_buf, encoding, buf); err != nil {
+		return nil, errors.New("Failed to decode block " + strconv.Itoa(block) + ": " + err.Error())
 	}
 
 	return buf, nil
 }
 
-func (f *GPFile) ReadTimedBlock(timestamp int64) ([]byte, error) {
-	for i := 0; i < N_ELEM; i++ {
+// findBlock returns the index of the block for timestamp
+func (f *GPFile) findBlock(timestamp int64) (int, error) {
+	for i := 0; i < len(f.timestamps); i++ {
 		if f.timestamps[i] == timestamp {
-			return f.ReadBlock(i)
+			return i, nil
 		}
 	}
 
-	return nil, errors.New("Timestamp " + strconv.Itoa(int(timestamp)) + " not found")
+	return -1, errors.New("Timestamp " + strconv.Itoa(int(timestamp)) + " not found")
 }
 
-func (f *GPFile) WriteTimedBlock(timestamp int64, data []byte, comp int) error {
+func (f *GPFile) ReadTimedBlock(timestamp int64) ([]byte, error) {
+	return f.ReadTimedBlockInto(timestamp, nil)
+}
+
+// ReadTimedBlockInto reads the block for timestamp into buf (see ReadBlockInto)
+func (f *GPFile) ReadTimedBlockInto(timestamp int64, buf []byte) ([]byte, error) {
+	block, err := f.findBlock(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return f.ReadBlockInto(block, buf)
+}
+
+// WriteTimedBlock stores data in the given encoding, compresses it with the
+// selected codec and appends it to the file as the block for timestamp.
+// Legacy files only hold raw LZ4 blocks, so data appended to them is always
+// stored raw and LZ4 compressed.
+func (f *GPFile) WriteTimedBlock(timestamp int64, data []byte, compression Compression, encoding EncodingType) error {
+	id, codec, err := compression.codec()
+	if err != nil {
+		return err
+	}
+	level := compression.Level
+	if f.version == GPF_VERSION_LEGACY {
+		id, codec, level = CODEC_LZ4, lz4Codec{}, 0
+		encoding = ENCODING_RAW
+	}
+	data, encoding = encodeBlock(data, encoding)
+
+	buf, err := codec.Compress(data, level)
+	if err != nil {
+		return err
+	}
+
+	// sanity check whether the codec exceeded its worst case
+	if len(buf) > codec.Bound(len(data)) {
+		return errors.New("Buffer size mismatch for compressed data")
+	}
+
+	return f.appendBlock(timestamp, buf, int64(len(data)), id, encoding)
+}
+
+// copyBlock appends the block of src to the file without recompressing it.
+func (f *GPFile) copyBlock(src *GPFile, block int) error {
+	id, _, err := src.blockCodec(block)
+	if err != nil {
+		return err
+	}
+	encoding := src.blockEncoding(block)
+	if f.version == GPF_VERSION_LEGACY && (id != CODEC_LZ4 || encoding != ENCODING_RAW) {
+		return errors.New("Cannot copy " + id.String() + " block in " + encoding.String() + " encoding to legacy file")
+	}
+
+	buf_comp, err := src.readCompressed(block)
+	if err != nil {
+		return err
+	}
+	return f.appendBlock(src.timestamps[block], buf_comp, src.lengths[block], id, encoding)
+}
+
+// appendBlock writes the compressed data of a block for timestamp after the
+// last block. The block is on disk before the header referencing it is
+// updated, so after a crash the header never points to missing data. If
+// all header entries are used, the header is extended by another page.
+func (f *GPFile) appendBlock(timestamp int64, buf []byte, length int64, codec CodecType, encoding EncodingType) error {
 	var (
-		nextFreeBlock = int64(-1)
-		cur_wfile     *os.File
-		buf           []byte
-		err           error
-		n_write       int
-		new_pos       int64
+		cur_wfile *os.File
+		err       error
+		n_write   int
+		new_pos   = -1
 	)
 
-	for new_pos = 0; new_pos < N_ELEM; new_pos++ {
-		cur_timestamp := f.timestamps[new_pos]
+	for i := 0; i < len(f.timestamps); i++ {
+		cur_timestamp := f.timestamps[i]
 		if cur_timestamp == timestamp {
 			return errors.New("Timestamp" + strconv.Itoa(int(cur_timestamp)) + " already exists in file " + f.filename)
 		} else if cur_timestamp == 0 {
-			if new_pos != 0 {
-				nextFreeBlock = f.blocks[new_pos-1]
-			} else {
-				nextFreeBlock = BUF_SIZE * 3
-			}
+			new_pos = i
 			break
 		}
 	}
 
-	if nextFreeBlock == -1 {
-		return errors.New("File is full")
+	if new_pos == -1 {
+		// the header of legacy files can't grow
+		if f.version == GPF_VERSION_LEGACY {
+			if err = f.upgrade(); err != nil {
+				return fmt.Errorf("Failed to upgrade full file %s: %s", f.filename, err)
+			}
+		}
+		if err = f.addPage(); err != nil {
+			return err
+		}
+		new_pos = len(f.timestamps) - N_ELEM
 	}
+	nextFreeBlock := f.blockStart(new_pos)
 
-	// LZ4 states that non-compressible data can be expanded to up to 0.4%.
-	// This length bound is the conservative version of the bound specified in the LZ4 source
-	buf = make([]byte, int((1.004*float64(len(data)))+16))
-	var comp_len int = int(C.cCompress(C.int(len(data)), (*C.char)(unsafe.Pointer(&data[0])), (*C.char)(unsafe.Pointer(&buf[0])), C.int(comp)))
-
-	if cur_wfile, err = os.OpenFile(f.filename, os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+	if cur_wfile, err = os.OpenFile(f.filename, os.O_WRONLY, 0600); err != nil {
 		return err
 	}
+	defer cur_wfile.Close()
 
-	// sanity check whether the computed worst case has been exceeded in C call
-	if len(buf) < comp_len {
-		return errors.New("Buffer size mismatch for compressed data")
+	// The block is written right after the previous one (rather than
+	// appended) so that the remains of an interrupted write are overwritten
+	if n_write, err = cur_wfile.WriteAt(buf, nextFreeBlock); err != nil {
+		return err
 	}
-
-	if n_write, err = cur_wfile.Write(buf[0:comp_len]); err != nil {
+	if err = cur_wfile.Truncate(nextFreeBlock + int64(n_write)); err != nil {
+		return err
+	}
+	if err = cur_wfile.Sync(); err != nil {
 		return err
 	}
-
-	cur_wfile.Close()
 
 	// Update header
 	f.blocks[new_pos] = nextFreeBlock + int64(n_write)
 	f.timestamps[new_pos] = timestamp
-	f.lengths[new_pos] = int64(len(data))
+	f.lengths[new_pos] = length
+	f.checksums[new_pos] = int64(crc32.Checksum(buf, crc32cTable))
+	f.codecs[new_pos] = int64(codec)
+	f.encodings[new_pos] = int64(encoding)
 
-	var pos int = 0
-	for i := 0; i < N_ELEM; i++ {
-		for j := 0; j < 8; j++ {
-			f.w_buf[pos+j] = byte(f.blocks[i] >> uint(56-(j*8)))
-			f.w_buf[BUF_SIZE+pos+j] = byte(f.timestamps[i] >> uint(56-(j*8)))
-			f.w_buf[BUF_SIZE+BUF_SIZE+pos+j] = byte(f.lengths[i] >> uint(56-(j*8)))
-		}
-		pos += 8
+	return f.writePage(cur_wfile, new_pos/N_ELEM)
+}
+
+// writePage writes the header page to the file and syncs it
+func (f *GPFile) writePage(wfile *os.File, page int) error {
+	f.encodePage(page)
+	if _, err := wfile.WriteAt(f.w_buf, f.pages[page]); err != nil {
+		return err
 	}
+	return wfile.Sync()
+}
 
-	if cur_wfile, err = os.OpenFile(f.filename, os.O_WRONLY, 0600); err != nil {
+// addPage appends an empty header page after the last block and links it
+// to the previous page. The new page is on disk before it is linked, so a
+// crash leaves at most some unreferenced bytes at the end of the file.
+func (f *GPFile) addPage() error {
+	if len(f.pages) >= GPF_MAX_PAGES {
+		return errors.New("File is full")
+	}
+
+	wfile, err := os.OpenFile(f.filename, os.O_WRONLY, 0600)
+	if err != nil {
 		return err
 	}
-	if _, err = cur_wfile.Write(f.w_buf); err != nil {
+	defer wfile.Close()
+
+	page := len(f.pages)
+	pos := f.blocks[len(f.blocks)-1]
+	f.pages = append(f.pages, pos)
+	f.blocks = append(f.blocks, make([]int64, N_ELEM)...)
+	f.timestamps = append(f.timestamps, make([]int64, N_ELEM)...)
+	f.lengths = append(f.lengths, make([]int64, N_ELEM)...)
+	f.checksums = append(f.checksums, make([]int64, N_ELEM)...)
+	f.codecs = append(f.codecs, make([]int64, N_ELEM)...)
+	f.encodings = append(f.encodings, make([]int64, N_ELEM)...)
+
+	err = f.writePage(wfile, page)
+	if err == nil {
+		err = wfile.Truncate(pos + f.header_size)
+	}
+	if err == nil {
+		err = f.writePage(wfile, page-1)
+	}
+	if err != nil {
+		f.dropPages(page)
 		return err
 	}
+	return nil
+}
+
+// dropPages removes all header pages from the n-th page onwards
+func (f *GPFile) dropPages(n int) {
+	f.pages = f.pages[:n]
+	f.blocks = f.blocks[:n*N_ELEM]
+	f.timestamps = f.timestamps[:n*N_ELEM]
+	f.lengths = f.lengths[:n*N_ELEM]
+	f.checksums = f.checksums[:n*N_ELEM]
+	f.codecs = f.codecs[:n*N_ELEM]
+	f.encodings = f.encodings[:n*N_ELEM]
+}
+
+// upgrade rewrites the legacy file, whose header can't grow, in the current
+// version. The blocks are copied as they are and the new file replaces the
+// old one atomically.
+func (f *GPFile) upgrade() error {
+	var (
+		upgraded = newHeader(GPF_VERSION)
+		data     []byte
+	)
+	for i := 0; i < N_ELEM && f.timestamps[i] != 0; i++ {
+		id, _, err := f.blockCodec(i)
+		if err != nil {
+			return err
+		}
+		buf_comp, err := f.readRaw(i)
+		if err != nil {
+			return err
+		}
+		data = append(data, buf_comp...)
+
+		upgraded.blocks[i] = upgraded.header_size + int64(len(data))
+		upgraded.timestamps[i] = f.timestamps[i]
+		upgraded.lengths[i] = f.lengths[i]
+		upgraded.codecs[i] = int64(id)
+		upgraded.encodings[i] = int64(f.blockEncoding(i))
+		upgraded.checksums[i] = int64(crc32.Checksum(buf_comp, crc32cTable))
+	}
+	upgraded.encodePage(0)
 
-	cur_wfile.Close()
+	if err := writeFileAtomic(f.filename, append(upgraded.w_buf, data...)); err != nil {
+		return err
+	}
 
+	reopened, err := NewGPFile(f.filename)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	*f = *reopened
 	return nil
 }
 
+// encodePage serializes the header page into w_buf
+func (f *GPFile) encodePage(page int) {
+	var (
+		off    = GPF_BLOCKS_OFFSET
+		lo, hi = page * N_ELEM, (page + 1) * N_ELEM
+	)
+	if f.version == GPF_VERSION_LEGACY {
+		off = 0
+	} else {
+		for i := 0; i < GPF_VERSION_SIZE; i++ {
+			f.w_buf[i] = 0
+		}
+		copy(f.w_buf, GPF_MAGIC)
+		for j := 0; j < 4; j++ {
+			f.w_buf[len(GPF_MAGIC)+j] = byte(uint32(f.version) >> uint(24-(j*8)))
+		}
+		if page+1 < len(f.pages) {
+			for j := 0; j < 8; j++ {
+				f.w_buf[GPF_NEXT_PAGE_OFFSET+j] = byte(f.pages[page+1] >> uint(56-(j*8)))
+			}
+		}
+		encodeSection(f.w_buf[GPF_CHECKSUMS_OFFSET:], f.checksums[lo:hi], GPF_CHECKSUM_SIZEOF)
+		encodeSection(f.w_buf[GPF_CODECS_OFFSET:], f.codecs[lo:hi], GPF_CODEC_SIZEOF)
+		encodeSection(f.w_buf[GPF_ENCODINGS_OFFSET:], f.encodings[lo:hi], GPF_ENCODING_SIZEOF)
+	}
+	encodeSection(f.w_buf[off:], f.blocks[lo:hi], 8)
+	encodeSection(f.w_buf[off+BUF_SIZE:], f.timestamps[lo:hi], 8)
+	encodeSection(f.w_buf[off+BUF_SIZE*2:], f.lengths[lo:hi], 8)
+}
+
+// validBlocks returns the number of leading blocks whose header entries are
+// sane, whose data lies completely within the first size bytes of the
+// file and, if verify is set and the file has checksums, whose data matches
+// its checksum. Blocks beyond that were not (completely) written.
+func (f *GPFile) validBlocks(size int64, verify bool) (int, error) {
+	var end int64 = f.header_size
+	for i := 0; i < len(f.timestamps); i++ {
+		// each further header page follows the last block of the previous one
+		if page := i / N_ELEM; i%N_ELEM == 0 && page > 0 {
+			if f.pages[page] < end || f.pages[page]+f.header_size > size {
+				return i, nil
+			}
+			end = f.pages[page] + f.header_size
+		}
+
+		if f.timestamps[i] == 0 || f.lengths[i] <= 0 || f.blocks[i] <= end || f.blocks[i] > size {
+			return i, nil
+		}
+		end = f.blocks[i]
+
+		if verify && f.version != GPF_VERSION_LEGACY {
+			if _, err := f.readCompressed(i); err == ErrChecksumMismatch {
+				return i, nil
+			} else if err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(f.timestamps), nil
+}
+
+// truncateBlocks removes all blocks from the n-th block onwards from the
+// header, along with the header pages that aren't needed anymore, and cuts
+// the file off after the (n-1)-th block.
+func (f *GPFile) truncateBlocks(n int) error {
+	var end int64 = f.header_size
+	if n > 0 {
+		end = f.blocks[n-1]
+	}
+	pages := (n + N_ELEM - 1) / N_ELEM
+	if pages == 0 {
+		pages = 1
+	}
+	f.dropPages(pages)
+	for i := n; i < len(f.timestamps); i++ {
+		f.blocks[i], f.timestamps[i], f.lengths[i], f.checksums[i], f.codecs[i], f.encodings[i] = 0, 0, 0, 0, 0, 0
+	}
+
+	wfile, err := os.OpenFile(f.filename, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer wfile.Close()
+
+	// the header mustn't reference the removed data at any point
+	if err = f.writePage(wfile, pages-1); err != nil {
+		return err
+	}
+	if err = wfile.Truncate(end); err != nil {
+		return err
+	}
+	return wfile.Sync()
+}
+
 func (f *GPFile) GetBlocks() []int64 {
 	return f.blocks
 }
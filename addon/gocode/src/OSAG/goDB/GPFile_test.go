@@ -0,0 +1,299 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// GPFile_test.go
+//
+// Tests for reading and writing gpf files of both format versions
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"OSAG/goDB/bigendian"
+)
+
+func testBlockData(timestamp int64, n int) []byte {
+	dbdata, _ := dbData("eth0", timestamp, testFlowMap(n))
+	return dbdata[SIP_COLIDX]
+}
+
+func readTestBlock(t *testing.T, path string, block int) ([]byte, int) {
+	gpfile, err := NewGPFile(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	defer gpfile.Close()
+
+	data, err := gpfile.ReadBlock(block)
+	if err != nil {
+		t.Fatalf("failed to read block %d: %s", block, err)
+	}
+	return data, gpfile.Version()
+}
+
+func TestGPFileChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpfile_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sip.gpf")
+
+	var written [][]byte
+	for i := 0; i < 3; i++ {
+		ts := recoveryTestDay + int64(i+1)*DB_WRITE_INTERVAL
+		data := testBlockData(ts, 10*(i+1))
+		gpfile, err := NewGPFile(path)
+		if err != nil {
+			t.Fatalf("failed to open file: %s", err)
+		}
+		if err := gpfile.WriteTimedBlock(ts, data, Compression{}, ENCODING_RAW); err != nil {
+			t.Fatalf("failed to write block: %s", err)
+		}
+		gpfile.Close()
+		written = append(written, data)
+	}
+
+	for i, data := range written {
+		read, version := readTestBlock(t, path, i)
+		if version != GPF_VERSION {
+			t.Fatalf("expected version %d, got %d", GPF_VERSION, version)
+		}
+		if !bytes.Equal(read, data) {
+			t.Fatalf("block %d: data mismatch", i)
+		}
+	}
+
+	// flip a bit in the second block
+	gpfile, _ := NewGPFile(path)
+	pos := gpfile.GetBlocks()[0] + 1
+	gpfile.Close()
+	f, _ := os.OpenFile(path, os.O_RDWR, 0600)
+	b := make([]byte, 1)
+	f.ReadAt(b, pos)
+	b[0] ^= 0x10
+	f.WriteAt(b, pos)
+	f.Close()
+
+	gpfile, _ = NewGPFile(path)
+	defer gpfile.Close()
+	if _, err := gpfile.ReadBlock(1); err != ErrChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if _, err := gpfile.ReadBlock(2); err != nil {
+		t.Fatalf("failed to read intact block: %s", err)
+	}
+	if n, err := gpfile.validBlocks(1<<30, true); n != 1 || err != nil {
+		t.Fatalf("expected one valid block, got %d (error: %v)", n, err)
+	}
+}
+
+func TestGPFileLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpfile_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// take a compressed block from a current file...
+	ts := recoveryTestDay + DB_WRITE_INTERVAL
+	data := testBlockData(ts, 20)
+	gpfile, _ := NewGPFile(filepath.Join(dir, "current.gpf"))
+	if err := gpfile.WriteTimedBlock(ts, data, Compression{}, ENCODING_RAW); err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
+	pos, length := gpfile.blockRange(0)
+	gpfile.Close()
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "current.gpf"))
+
+	// ... and put it into a file with a legacy header
+	legacy := newHeader(GPF_VERSION_LEGACY)
+	legacy.blocks[0] = headerSize(GPF_VERSION_LEGACY) + length
+	legacy.timestamps[0] = ts
+	legacy.lengths[0] = int64(len(data))
+	legacy.encodePage(0)
+	path := filepath.Join(dir, "legacy.gpf")
+	if err := ioutil.WriteFile(path, append(legacy.w_buf, content[pos:pos+length]...), 0644); err != nil {
+		t.Fatalf("failed to write legacy file: %s", err)
+	}
+
+	read, version := readTestBlock(t, path, 0)
+	if version != GPF_VERSION_LEGACY {
+		t.Fatalf("expected legacy version, got %d", version)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("legacy block: data mismatch")
+	}
+
+	// blocks appended to legacy files keep the legacy format, are LZ4
+	// compressed regardless of the configured codec and are stored raw
+	ts2 := ts + DB_WRITE_INTERVAL
+	data2 := testBlockData(ts2, 30)
+	gpfile, _ = NewGPFile(path)
+	if err := gpfile.WriteTimedBlock(ts2, data2, Compression{Codec: CODEC_ZSTD}, ENCODING_IP); err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
+	gpfile.Close()
+
+	read, version = readTestBlock(t, path, 1)
+	if version != GPF_VERSION_LEGACY || !bytes.Equal(read, data2) {
+		t.Fatalf("appended legacy block: version %d, data mismatch: %v", version, !bytes.Equal(read, data2))
+	}
+	if read, _ = readTestBlock(t, path, 0); !bytes.Equal(read, data) {
+		t.Fatalf("legacy block: data mismatch after append")
+	}
+}
+
+// smallBlock returns a block of a few flows for timestamp
+func smallBlock(timestamp int64) []byte {
+	block := make([]byte, 16+8*(timestamp%3))
+	bigendian.PutInt64(block, timestamp)
+	bigendian.PutInt64(block[len(block)-8:], timestamp)
+	return block
+}
+
+// writeTestBlocks appends n small blocks to the file at path
+func writeTestBlocks(t *testing.T, path string, first int64, n int) {
+	gpfile, err := NewGPFile(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	defer gpfile.Close()
+	for i := int64(0); i < int64(n); i++ {
+		if err := gpfile.WriteTimedBlock(first+i, smallBlock(first+i), Compression{}, ENCODING_RAW); err != nil {
+			t.Fatalf("failed to write block %d: %s", first+i, err)
+		}
+	}
+}
+
+func checkTestBlocks(t *testing.T, path string, first int64, n int) {
+	gpfile, err := NewGPFile(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	defer gpfile.Close()
+	if used, _ := gpfile.BlocksUsed(); used != n {
+		t.Fatalf("expected %d blocks, got %d", n, used)
+	}
+	for i := int64(0); i < int64(n); i++ {
+		data, err := gpfile.ReadTimedBlock(first + i)
+		if err != nil || !bytes.Equal(data, smallBlock(first+i)) {
+			t.Fatalf("block %d: data mismatch (error: %v)", first+i, err)
+		}
+	}
+}
+
+func TestGPFilePages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpfile_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sip.gpf")
+
+	// a new file only consists of its first header page
+	gpfile, _ := NewGPFile(path)
+	gpfile.Close()
+	if info, _ := os.Stat(path); info.Size() != GPF_HEADER_SIZE {
+		t.Fatalf("expected new file of %d bytes, got %d", GPF_HEADER_SIZE, info.Size())
+	}
+
+	// more blocks than fit into a single header page
+	n := 2*N_ELEM + 100
+	writeTestBlocks(t, path, recoveryTestDay, n-10)
+	writeTestBlocks(t, path, recoveryTestDay+int64(n-10), 10)
+	checkTestBlocks(t, path, recoveryTestDay, n)
+
+	gpfile, _ = NewGPFile(path)
+	info, _ := os.Stat(path)
+	if len(gpfile.pages) != 3 || gpfile.Version() != GPF_VERSION {
+		t.Fatalf("expected 3 header pages, got %v (version %d)", gpfile.pages, gpfile.Version())
+	}
+	if valid, err := gpfile.validBlocks(info.Size(), true); valid != n || err != nil {
+		t.Fatalf("expected %d valid blocks, got %d (error: %v)", n, valid, err)
+	}
+
+	// cutting the file down drops the pages that aren't needed anymore
+	if err := gpfile.truncateBlocks(N_ELEM); err != nil {
+		t.Fatalf("failed to truncate: %s", err)
+	}
+	end := gpfile.blocks[N_ELEM-1]
+	gpfile.Close()
+	if info, _ = os.Stat(path); info.Size() != end {
+		t.Fatalf("expected size %d after truncation, got %d", end, info.Size())
+	}
+	checkTestBlocks(t, path, recoveryTestDay, N_ELEM)
+
+	// a page that was added but never used (e.g. due to a crash) isn't valid
+	gpfile, _ = NewGPFile(path)
+	if err := gpfile.addPage(); err != nil {
+		t.Fatalf("failed to add page: %s", err)
+	}
+	gpfile.Close()
+	gpfile, _ = NewGPFile(path)
+	info, _ = os.Stat(path)
+	if len(gpfile.pages) != 2 {
+		t.Fatalf("expected added page to be linked, got %v", gpfile.pages)
+	}
+	if valid, _ := gpfile.validBlocks(info.Size(), true); valid != N_ELEM {
+		t.Fatalf("expected %d valid blocks, got %d", N_ELEM, valid)
+	}
+	gpfile.Close()
+
+	// and is used by the next write
+	writeTestBlocks(t, path, recoveryTestDay+N_ELEM, 1)
+	checkTestBlocks(t, path, recoveryTestDay, N_ELEM+1)
+
+	// a broken page pointer is reported
+	f, _ := os.OpenFile(path, os.O_RDWR, 0600)
+	f.WriteAt([]byte{0xff}, GPF_NEXT_PAGE_OFFSET+6)
+	f.Close()
+	if _, err := NewGPFile(path); err == nil {
+		t.Fatalf("expected error for broken page pointer")
+	}
+}
+
+func TestGPFileUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gpfile_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sip.gpf")
+
+	// a full legacy file
+	legacy := newHeader(GPF_VERSION_LEGACY)
+	content := make([]byte, legacy.header_size)
+	for i := 0; i < N_ELEM; i++ {
+		data := smallBlock(recoveryTestDay + int64(i))
+		comp, _ := lz4Codec{}.Compress(data, 0)
+		content = append(content, comp...)
+		legacy.blocks[i] = int64(len(content))
+		legacy.timestamps[i] = recoveryTestDay + int64(i)
+		legacy.lengths[i] = int64(len(data))
+	}
+	legacy.encodePage(0)
+	copy(content, legacy.w_buf)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("failed to write legacy file: %s", err)
+	}
+
+	// is upgraded when it runs out of space
+	writeTestBlocks(t, path, recoveryTestDay+N_ELEM, 5)
+	checkTestBlocks(t, path, recoveryTestDay, N_ELEM+5)
+	if _, version := readTestBlock(t, path, 0); version != GPF_VERSION {
+		t.Fatalf("expected version %d after upgrade, got %d", GPF_VERSION, version)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary file to be removed")
+	}
+}
@@ -29,7 +29,10 @@ import (
 // evaluation.
 func instrument(node Node) (Node, error) {
 	return node.transform(func(cn conditionNode) (Node, error) {
-		err := generateCompareValue(&cn)
+		if err := generateCompareValue(&cn); err != nil {
+			return cn, err
+		}
+		err := generateCompareSummary(&cn)
 		return cn, err
 	})
 }
@@ -48,6 +48,11 @@ var columnSizeofs = [COLIDX_COUNT]int{
 	SIP_SIZEOF, DIP_SIZEOF, PROTO_SIZEOF, DPORT_SIZEOF,
 	BYTESRCVD_SIZEOF, BYTESSENT_SIZEOF, PKTSRCVD_SIZEOF, PKTSSENT_SIZEOF}
 
+// Encoding of the blocks written for each column type
+var columnEncodings = [COLIDX_COUNT]EncodingType{
+	ENCODING_IP, ENCODING_IP, ENCODING_RAW, ENCODING_RAW,
+	ENCODING_RAW, ENCODING_RAW, ENCODING_RAW, ENCODING_RAW}
+
 var columnFileNames = [COLIDX_COUNT]string{
 	"sip", "dip", "proto", "dport",
 	"bytes_rcvd", "bytes_sent", "pkts_rcvd", "pkts_sent"}
@@ -13,33 +13,307 @@
 package goDB
 
 import (
+    "bytes"
+    "encoding/json"
     "fmt"
     "log/syslog"
+    "strconv"
+    "strings"
+    "time"
+
+    "OSAG/version"
+)
+
+// Formats of the flows written to syslog
+const (
+    SYSLOG_FORMAT_CSV  = "csv"  // ts,iface,sip,dip,dport,proto,pkts rcvd,pkts sent,bytes rcvd,bytes sent
+    SYSLOG_FORMAT_JSON = "json" // one JSON object per line
+    SYSLOG_FORMAT_CEF  = "cef"  // ArcSight Common Event Format
+    SYSLOG_FORMAT_KV   = "kv"   // space separated key=value pairs
 )
 
+// DNS timeout used for resolving hostnames in the flow filter
+const SYSLOG_FILTER_DNS_TIMEOUT = time.Second
+
+// SyslogFlowConfig determines which flows are written to syslog and how.
+type SyslogFlowConfig struct {
+    // one of the SYSLOG_FORMAT_* constants. Defaults to SYSLOG_FORMAT_CSV.
+    Format string `json:"format"`
+    // goDB conditional a flow has to match in order to be written
+    Filter string `json:"filter"`
+    // minimum number of bytes / packets (received and sent) of a flow
+    MinBytes   uint64 `json:"min_bytes"`
+    MinPackets uint64 `json:"min_packets"`
+    // write block summaries in the csv format as well. They are off by
+    // default, since their fields differ from those of the flows.
+    CSVSummary bool `json:"csv_summary"`
+}
+
+// Validate checks that the given SyslogFlowConfig contains no bogus settings.
+func (c SyslogFlowConfig) Validate() error {
+    switch c.Format {
+    case "", SYSLOG_FORMAT_CSV, SYSLOG_FORMAT_JSON, SYSLOG_FORMAT_CEF, SYSLOG_FORMAT_KV:
+    default:
+        return fmt.Errorf("Unknown format '%s'", c.Format)
+    }
+    if _, err := c.parseFilter(); err != nil {
+        return fmt.Errorf("Invalid filter '%s': %s", c.Filter, err)
+    }
+    return nil
+}
+
+func (c SyslogFlowConfig) parseFilter() (Node, error) {
+    if c.Filter == "" {
+        return nil, nil
+    }
+    conditional, err := SanitizeUserInput(c.Filter)
+    if err != nil {
+        return nil, err
+    }
+    return ParseAndInstrumentConditional(conditional, SYSLOG_FILTER_DNS_TIMEOUT)
+}
+
+// SyslogDBWriter is a FlowSink writing each flow as a line to syslog.
+// After the flows of an interface, a summary of the block (number of
+// flows, number of flows written and the packet counters of the block's
+// metadata) is written in the same format. In the csv format, this only
+// happens if summaries were explicitly enabled.
 type SyslogDBWriter struct {
     logger *syslog.Writer
+
+    format      string
+    conditional Node
+    minBytes    uint64
+    minPackets  uint64
+    summary     bool
 }
 
-func NewSyslogDBWriter() (*SyslogDBWriter, error) {
-    s := &SyslogDBWriter{}
+func NewSyslogDBWriter(config SyslogFlowConfig) (*SyslogDBWriter, error) {
+    conditional, err := config.parseFilter()
+    if err != nil {
+        return nil, err
+    }
+
+    format := config.Format
+    if format == "" {
+        format = SYSLOG_FORMAT_CSV
+    }
 
+    return &SyslogDBWriter{
+        format:      format,
+        conditional: conditional,
+        minBytes:    config.MinBytes,
+        minPackets:  config.MinPackets,
+        summary:     format != SYSLOG_FORMAT_CSV || config.CSVSummary,
+    }, nil
+}
+
+func (s *SyslogDBWriter) Open() error {
     var err error
     if s.logger, err = syslog.Dial("unix", SOCKET_PATH, syslog.LOG_NOTICE, "ntm"); err != nil {
-        return nil, err
+        return err
     }
-    return s, nil
+    return nil
 }
 
-func (s *SyslogDBWriter) Write(flowmap AggFlowMap, iface string, timestamp int64) {
+// matches checks whether a flow passes the filter and thresholds.
+func (s *SyslogDBWriter) matches(key *ExtraKey, val *Val) bool {
+    if val.NBytesRcvd+val.NBytesSent < s.minBytes || val.NPktsRcvd+val.NPktsSent < s.minPackets {
+        return false
+    }
+    return EvaluateConditional(s.conditional, key)
+}
+
+func (s *SyslogDBWriter) Write(iface string, timestamp int64, flowmap AggFlowMap, meta BlockMetadata) error {
+    if s.logger == nil {
+        return fmt.Errorf("Syslog flow writer is not open")
+    }
+
+    var err error
+    written := 0
     for flowKey, flowVal := range flowmap {
-        s.logger.Info(
-            fmt.Sprintf("%d,%s,%s,%s",
-                timestamp,
-                iface,
-                flowKey.String(),
-                flowVal.String(),
-            ),
+        key := &ExtraKey{Time: timestamp, Iface: iface, Key: flowKey}
+        if !s.matches(key, flowVal) {
+            continue
+        }
+
+        if werr := s.logger.Info(s.formatFlow(key, flowVal)); werr != nil && err == nil {
+            err = werr
+        }
+        written++
+    }
+
+    if !s.summary {
+        return err
+    }
+    if werr := s.logger.Info(s.formatSummary(iface, timestamp, len(flowmap), written, meta)); werr != nil && err == nil {
+        err = werr
+    }
+    return err
+}
+
+func (s *SyslogDBWriter) Close() error {
+    if s.logger == nil {
+        return nil
+    }
+    err := s.logger.Close()
+    s.logger = nil
+    return err
+}
+
+// field is a single named value of a syslog message.
+type field struct {
+    name  string
+    value interface{}
+}
+
+func flowFields(key *ExtraKey, val *Val) []field {
+    return []field{
+        {"time", key.Time},
+        {"iface", key.Iface},
+        {"sip", rawIpToString(key.Sip[:])},
+        {"dip", rawIpToString(key.Dip[:])},
+        {"dport", int(uint16(key.Dport[0])<<8 | uint16(key.Dport[1]))},
+        {"proto", GetIPProto(int(key.Protocol))},
+        {"packets_rcvd", val.NPktsRcvd},
+        {"packets_sent", val.NPktsSent},
+        {"bytes_rcvd", val.NBytesRcvd},
+        {"bytes_sent", val.NBytesSent},
+    }
+}
+
+// summaryFields lists the counters of a block. Pcap counters are -1
+// if they are not available.
+func summaryFields(iface string, timestamp int64, flows, written int, meta BlockMetadata) []field {
+    return []field{
+        {"time", timestamp},
+        {"iface", iface},
+        {"flows", flows},
+        {"flows_written", written},
+        {"packets_logged", meta.PacketsLogged},
+        {"pcap_received", meta.PcapPacketsReceived},
+        {"pcap_dropped", meta.PcapPacketsDropped},
+        {"pcap_if_dropped", meta.PcapPacketsIfDropped},
+    }
+}
+
+func (s *SyslogDBWriter) formatFlow(key *ExtraKey, val *Val) string {
+    return FormatFlow(s.format, key, val)
+}
+
+// FormatFlow formats a flow as a single line in the given SYSLOG_FORMAT_*
+// format. Unknown formats are treated as SYSLOG_FORMAT_CSV.
+func FormatFlow(format string, key *ExtraKey, val *Val) string {
+    switch format {
+    case SYSLOG_FORMAT_JSON:
+        return formatJSON("flow", flowFields(key, val))
+    case SYSLOG_FORMAT_CEF:
+        return formatFlowCEF(key, val)
+    case SYSLOG_FORMAT_KV:
+        return formatKV("flow", flowFields(key, val))
+    }
+    return fmt.Sprintf("%d,%s,%s,%s",
+        key.Time,
+        key.Iface,
+        key.Key.String(),
+        val.String(),
+    )
+}
+
+func (s *SyslogDBWriter) formatSummary(iface string, timestamp int64, flows, written int, meta BlockMetadata) string {
+    fields := summaryFields(iface, timestamp, flows, written, meta)
+    switch s.format {
+    case SYSLOG_FORMAT_JSON:
+        return formatJSON("summary", fields)
+    case SYSLOG_FORMAT_CEF:
+        return formatSummaryCEF(fields)
+    case SYSLOG_FORMAT_KV:
+        return formatKV("summary", fields)
+    }
+    // the third field tells summaries apart from flows, which have
+    // an IP address there
+    values := []string{fmt.Sprint(timestamp), iface, "summary"}
+    for _, f := range fields[2:] {
+        values = append(values, fmt.Sprint(f.value))
+    }
+    return strings.Join(values, ",")
+}
+
+func formatJSON(msgType string, fields []field) string {
+    // build the object by hand in order to keep the order of the fields
+    var b bytes.Buffer
+    b.WriteString(`{"type":"` + msgType + `"`)
+    for _, f := range fields {
+        value, _ := json.Marshal(f.value)
+        b.WriteString(`,"` + f.name + `":`)
+        b.Write(value)
+    }
+    b.WriteString("}")
+    return b.String()
+}
+
+func formatKV(msgType string, fields []field) string {
+    values := []string{"type=" + msgType}
+    for _, f := range fields {
+        value := fmt.Sprint(f.value)
+        if value == "" || strings.ContainsAny(value, " =\"") {
+            value = strconv.Quote(value)
+        }
+        values = append(values, f.name+"="+value)
+    }
+    return strings.Join(values, " ")
+}
+
+// CEF header and extension escaping as per the CEF specification
+var (
+    cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+    cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func cef(signature, name string, extension []string) string {
+    return fmt.Sprintf("CEF:0|Open Systems|goProbe|%s|%s|%s|1|%s",
+        cefHeaderEscaper.Replace(version.Version()),
+        signature,
+        name,
+        strings.Join(extension, " "),
+    )
+}
+
+func formatFlowCEF(key *ExtraKey, val *Val) string {
+    sip, dip := rawIpToString(key.Sip[:]), rawIpToString(key.Dip[:])
+    srcKey, dstKey := "src", "dst"
+    if strings.Contains(sip, ":") {
+        srcKey, dstKey = "c6a2", "c6a3"
+    }
+
+    return cef("flow", "Flow", []string{
+        fmt.Sprintf("rt=%d", key.Time*1000),
+        "deviceInboundInterface=" + cefExtensionEscaper.Replace(key.Iface),
+        srcKey + "=" + sip,
+        dstKey + "=" + dip,
+        fmt.Sprintf("dpt=%d", int(uint16(key.Dport[0])<<8|uint16(key.Dport[1]))),
+        "proto=" + cefExtensionEscaper.Replace(GetIPProto(int(key.Protocol))),
+        fmt.Sprintf("in=%d", val.NBytesRcvd),
+        fmt.Sprintf("out=%d", val.NBytesSent),
+        fmt.Sprintf("cn1=%d", val.NPktsRcvd),
+        "cn1Label=packets_rcvd",
+        fmt.Sprintf("cn2=%d", val.NPktsSent),
+        "cn2Label=packets_sent",
+    })
+}
+
+func formatSummaryCEF(fields []field) string {
+    extension := []string{
+        fmt.Sprintf("rt=%d", fields[0].value.(int64)*1000),
+        "deviceInboundInterface=" + cefExtensionEscaper.Replace(fields[1].value.(string)),
+    }
+    // there are only three custom number fields, so the six
+    // counters go into the custom string fields
+    for i, f := range fields[2:] {
+        extension = append(extension,
+            fmt.Sprintf("cs%d=%v", i+1, f.value),
+            fmt.Sprintf("cs%dLabel=%s", i+1, f.name),
         )
     }
+    return cef("summary", "Flow summary", extension)
 }
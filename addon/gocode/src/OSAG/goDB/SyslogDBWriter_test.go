@@ -0,0 +1,123 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// SyslogDBWriter_test.go
+//
+// Tests for the formatting and filtering of flows written to syslog
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+)
+
+var syslogTestKey = &ExtraKey{
+    Time:  1466000000,
+    Iface: "eth0",
+    Key: Key{
+        Sip:      [16]byte{10, 0, 0, 1},
+        Dip:      [16]byte{10, 0, 0, 2},
+        Dport:    [2]byte{0x01, 0xbb},
+        Protocol: 6,
+    },
+}
+
+var syslogTestVal = &Val{NBytesRcvd: 1000, NBytesSent: 2000, NPktsRcvd: 10, NPktsSent: 20}
+
+func newTestSyslogWriter(t *testing.T, config SyslogFlowConfig) *SyslogDBWriter {
+    if err := config.Validate(); err != nil {
+        t.Fatalf("invalid config %+v: %s", config, err)
+    }
+    s, err := NewSyslogDBWriter(config)
+    if err != nil {
+        t.Fatalf("failed to create writer: %s", err)
+    }
+    return s
+}
+
+func TestSyslogFormats(t *testing.T) {
+    var tests = []struct {
+        format string
+        flow   string
+    }{
+        {"", "1466000000,eth0,10.0.0.1,10.0.0.2,443,TCP,10,20,1000,2000"},
+        {SYSLOG_FORMAT_KV, "type=flow time=1466000000 iface=eth0 sip=10.0.0.1 dip=10.0.0.2 dport=443 proto=TCP packets_rcvd=10 packets_sent=20 bytes_rcvd=1000 bytes_sent=2000"},
+        {SYSLOG_FORMAT_CEF, "|flow|Flow|1|rt=1466000000000 deviceInboundInterface=eth0 src=10.0.0.1 dst=10.0.0.2 dpt=443 proto=TCP in=1000 out=2000 cn1=10 cn1Label=packets_rcvd cn2=20 cn2Label=packets_sent"},
+    }
+
+    for _, test := range tests {
+        s := newTestSyslogWriter(t, SyslogFlowConfig{Format: test.format})
+        if flow := s.formatFlow(syslogTestKey, syslogTestVal); !strings.HasSuffix(flow, test.flow) {
+            t.Fatalf("format '%s': expected %q, got %q", test.format, test.flow, flow)
+        }
+    }
+
+    s := newTestSyslogWriter(t, SyslogFlowConfig{Format: SYSLOG_FORMAT_JSON})
+    var flow map[string]interface{}
+    if err := json.Unmarshal([]byte(s.formatFlow(syslogTestKey, syslogTestVal)), &flow); err != nil {
+        t.Fatalf("failed to parse JSON flow: %s", err)
+    }
+    if flow["type"] != "flow" || flow["sip"] != "10.0.0.1" || flow["bytes_sent"] != float64(2000) {
+        t.Fatalf("unexpected JSON flow %v", flow)
+    }
+
+    meta := BlockMetadata{PcapPacketsReceived: 100, PcapPacketsDropped: 5, PcapPacketsIfDropped: -1, PacketsLogged: 95}
+    var summary map[string]interface{}
+    if err := json.Unmarshal([]byte(s.formatSummary("eth0", 1466000000, 3, 1, meta)), &summary); err != nil {
+        t.Fatalf("failed to parse JSON summary: %s", err)
+    }
+    if summary["type"] != "summary" || summary["flows"] != float64(3) || summary["pcap_dropped"] != float64(5) {
+        t.Fatalf("unexpected JSON summary %v", summary)
+    }
+
+    // csv summaries would break consumers expecting flows only
+    for _, test := range []struct {
+        config  SyslogFlowConfig
+        summary bool
+    }{
+        {SyslogFlowConfig{}, false},
+        {SyslogFlowConfig{Format: SYSLOG_FORMAT_CSV}, false},
+        {SyslogFlowConfig{CSVSummary: true}, true},
+        {SyslogFlowConfig{Format: SYSLOG_FORMAT_KV}, true},
+        {SyslogFlowConfig{Format: SYSLOG_FORMAT_CEF}, true},
+    } {
+        if s := newTestSyslogWriter(t, test.config); s.summary != test.summary {
+            t.Fatalf("config %+v: expected summary %v, got %v", test.config, test.summary, s.summary)
+        }
+    }
+}
+
+func TestSyslogFilter(t *testing.T) {
+    var tests = []struct {
+        config  SyslogFlowConfig
+        matches bool
+    }{
+        {SyslogFlowConfig{}, true},
+        {SyslogFlowConfig{MinBytes: 3000}, true},
+        {SyslogFlowConfig{MinBytes: 3001}, false},
+        {SyslogFlowConfig{MinPackets: 31}, false},
+        {SyslogFlowConfig{Filter: "dport = 443 & sip = 10.0.0.1"}, true},
+        {SyslogFlowConfig{Filter: "dport = 80"}, false},
+        {SyslogFlowConfig{Filter: "dport = 443", MinPackets: 100}, false},
+    }
+
+    for _, test := range tests {
+        s := newTestSyslogWriter(t, test.config)
+        if matches := s.matches(syslogTestKey, syslogTestVal); matches != test.matches {
+            t.Fatalf("config %+v: expected match %v, got %v", test.config, test.matches, matches)
+        }
+    }
+
+    if err := (SyslogFlowConfig{Format: "xml"}).Validate(); err == nil {
+        t.Fatalf("expected unknown format to be rejected")
+    }
+    if err := (SyslogFlowConfig{Filter: "dport = "}).Validate(); err == nil {
+        t.Fatalf("expected invalid filter to be rejected")
+    }
+}
@@ -0,0 +1,543 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// aggregates.go
+//
+// Per-day aggregates of the flows of a day over a subset of the attributes,
+// which let queries over whole days skip reading the blocks
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// aggregate files are named AGGREGATE_FILE_PREFIX followed by the
+	// attributes they cover, e.g. aggregate_sip_dip.gpf
+	AGGREGATE_FILE_PREFIX = "aggregate_"
+
+	// fingerprint, number of blocks and number of entries
+	aggregateHeaderSize = 8 + 4 + 4
+	// the four counters of an entry
+	aggregateCountersSize = 4 * 8
+)
+
+var errCorruptAggregate = errors.New("corrupt aggregate")
+
+// attributeSet is a set of attribute columns. Bit i is set if the column
+// with columnIndex i is in the set.
+type attributeSet uint8
+
+func newAttributeSet(columns []columnIndex) attributeSet {
+	var set attributeSet
+	for _, colIdx := range columns {
+		if colIdx < COLIDX_ATTRIBUTE_COUNT {
+			set |= 1 << uint(colIdx)
+		}
+	}
+	return set
+}
+
+func (s attributeSet) contains(colIdx columnIndex) bool {
+	return s&(1<<uint(colIdx)) != 0
+}
+
+// covers checks whether all attributes of other are in s
+func (s attributeSet) covers(other attributeSet) bool {
+	return s&other == other
+}
+
+// columns returns the attribute columns in the set in column order
+func (s attributeSet) columns() []columnIndex {
+	var columns []columnIndex
+	for colIdx := columnIndex(0); colIdx < COLIDX_ATTRIBUTE_COUNT; colIdx++ {
+		if s.contains(colIdx) {
+			columns = append(columns, colIdx)
+		}
+	}
+	return columns
+}
+
+// entrySize returns the size of an aggregate entry for the set
+func (s attributeSet) entrySize() int {
+	size := aggregateCountersSize
+	for _, colIdx := range s.columns() {
+		size += columnSizeofs[colIdx]
+	}
+	return size
+}
+
+func (s attributeSet) fileName() string {
+	var names []string
+	for _, colIdx := range s.columns() {
+		names = append(names, columnFileNames[colIdx])
+	}
+	return AGGREGATE_FILE_PREFIX + strings.Join(names, "_") + ".gpf"
+}
+
+// project returns the key reduced to the attributes of the set
+func (s attributeSet) project(key Key) Key {
+	var projected Key
+	if s.contains(SIP_COLIDX) {
+		projected.Sip = key.Sip
+	}
+	if s.contains(DIP_COLIDX) {
+		projected.Dip = key.Dip
+	}
+	if s.contains(PROTO_COLIDX) {
+		projected.Protocol = key.Protocol
+	}
+	if s.contains(DPORT_COLIDX) {
+		projected.Dport = key.Dport
+	}
+	return projected
+}
+
+// parseAggregateTypes returns the distinct attribute sets of the given query
+// types. Query types involving the time can't be aggregated per day.
+func parseAggregateTypes(queryTypes []string) ([]attributeSet, error) {
+	var sets []attributeSet
+	seen := make(map[attributeSet]bool)
+	for _, queryType := range queryTypes {
+		attributes, hasAttrTime, _, err := ParseQueryType(queryType)
+		if err != nil {
+			return nil, err
+		}
+		if hasAttrTime {
+			return nil, fmt.Errorf("Query type '%s' includes the time", queryType)
+		}
+		var columns []columnIndex
+		for _, attribute := range attributes {
+			columns = append(columns, queryAttributeNameToColumnIndex(attribute.Name()))
+		}
+		set := newAttributeSet(columns)
+		if set == 0 {
+			return nil, fmt.Errorf("Query type '%s' has no attributes", queryType)
+		}
+		if !seen[set] {
+			seen[set] = true
+			sets = append(sets, set)
+		}
+	}
+	return sets, nil
+}
+
+// ValidateAggregateTypes checks that per-day aggregates can be maintained
+// for the given query types.
+func ValidateAggregateTypes(queryTypes []string) error {
+	_, err := parseAggregateTypes(queryTypes)
+	return err
+}
+
+// blocksFingerprint identifies the blocks of a day by their timestamps. An
+// aggregate only describes the day if it was built from the same blocks.
+func blocksFingerprint(timestamps []int64) uint64 {
+	sorted := make(int64Slice, 0, len(timestamps))
+	for _, ts := range timestamps {
+		if ts != 0 {
+			sorted = append(sorted, ts)
+		}
+	}
+	sort.Sort(sorted)
+
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, ts := range sorted {
+		binary.BigEndian.PutUint64(buf, uint64(ts))
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+// marshalAggregate encodes the aggregate of the day over the attributes of
+// set. An aggregate has the following format:
+//
+//	fingerprint of the timestamps of the blocks as 64bit integer (big-endian)
+//	number of blocks as unsigned 32bit integer (big-endian)
+//	number of entries n as unsigned 32bit integer (big-endian)
+//	n entries consisting of the attributes of the set (in column order)
+//	  followed by the bytes received, bytes sent, packets received and
+//	  packets sent as unsigned 64bit integers (big-endian)
+func marshalAggregate(set attributeSet, fingerprint uint64, blocks int, flowmap AggFlowMap) []byte {
+	keys := make(aggregateKeys, 0, len(flowmap))
+	for key := range flowmap {
+		keys = append(keys, key)
+	}
+	// sorted entries compress better and make the file reproducible
+	sort.Sort(keys)
+
+	data := make([]byte, aggregateHeaderSize, aggregateHeaderSize+len(keys)*set.entrySize())
+	binary.BigEndian.PutUint64(data[0:], fingerprint)
+	binary.BigEndian.PutUint32(data[8:], uint32(blocks))
+	binary.BigEndian.PutUint32(data[12:], uint32(len(keys)))
+
+	counter := make([]byte, 8)
+	for _, key := range keys {
+		for _, colIdx := range set.columns() {
+			switch colIdx {
+			case SIP_COLIDX:
+				data = append(data, key.Sip[:]...)
+			case DIP_COLIDX:
+				data = append(data, key.Dip[:]...)
+			case PROTO_COLIDX:
+				data = append(data, key.Protocol)
+			case DPORT_COLIDX:
+				data = append(data, key.Dport[:]...)
+			}
+		}
+		val := flowmap[key]
+		for _, c := range []uint64{val.NBytesRcvd, val.NBytesSent, val.NPktsRcvd, val.NPktsSent} {
+			binary.BigEndian.PutUint64(counter, c)
+			data = append(data, counter...)
+		}
+	}
+	return data
+}
+
+type aggregateKeys []Key
+
+func (k aggregateKeys) Len() int      { return len(k) }
+func (k aggregateKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k aggregateKeys) Less(i, j int) bool {
+	if c := strings.Compare(string(k[i].Sip[:]), string(k[j].Sip[:])); c != 0 {
+		return c < 0
+	}
+	if c := strings.Compare(string(k[i].Dip[:]), string(k[j].Dip[:])); c != 0 {
+		return c < 0
+	}
+	if k[i].Protocol != k[j].Protocol {
+		return k[i].Protocol < k[j].Protocol
+	}
+	return string(k[i].Dport[:]) < string(k[j].Dport[:])
+}
+
+// aggregate is a decoded aggregate file
+type aggregate struct {
+	set         attributeSet
+	fingerprint uint64
+	blocks      int
+	entries     int
+	data        []byte
+}
+
+func unmarshalAggregate(set attributeSet, data []byte) (*aggregate, error) {
+	if len(data) < aggregateHeaderSize {
+		return nil, errCorruptAggregate
+	}
+	a := &aggregate{
+		set:         set,
+		fingerprint: binary.BigEndian.Uint64(data[0:]),
+		blocks:      int(binary.BigEndian.Uint32(data[8:])),
+		entries:     int(binary.BigEndian.Uint32(data[12:])),
+		data:        data[aggregateHeaderSize:],
+	}
+	if len(a.data) != a.entries*set.entrySize() {
+		return nil, errCorruptAggregate
+	}
+	return a, nil
+}
+
+// readAggregate reads the aggregate over the attributes of set of the daily
+// directory dir
+func readAggregate(dir string, set attributeSet) (*aggregate, error) {
+	gpfile, err := NewGPFile(filepath.Join(dir, set.fileName()))
+	if err != nil {
+		return nil, err
+	}
+	defer gpfile.Close()
+
+	day, err := strconv.ParseInt(filepath.Base(dir), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gpfile.ReadTimedBlock(day)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalAggregate(set, data)
+}
+
+// entry decodes the attributes and counters of the i-th entry
+func (a *aggregate) entry(i int) (key Key, val Val) {
+	entry := a.data[i*a.set.entrySize():]
+	offset := 0
+	for _, colIdx := range a.set.columns() {
+		switch colIdx {
+		case SIP_COLIDX:
+			copy(key.Sip[:], entry[offset:offset+SIP_SIZEOF])
+		case DIP_COLIDX:
+			copy(key.Dip[:], entry[offset:offset+DIP_SIZEOF])
+		case PROTO_COLIDX:
+			key.Protocol = entry[offset]
+		case DPORT_COLIDX:
+			copy(key.Dport[:], entry[offset:offset+DPORT_SIZEOF])
+		}
+		offset += columnSizeofs[colIdx]
+	}
+	val.NBytesRcvd = binary.BigEndian.Uint64(entry[offset:])
+	val.NBytesSent = binary.BigEndian.Uint64(entry[offset+8:])
+	val.NPktsRcvd = binary.BigEndian.Uint64(entry[offset+16:])
+	val.NPktsSent = binary.BigEndian.Uint64(entry[offset+24:])
+	return
+}
+
+// evaluateAggregate adds the flows of the workload's aggregate satisfying
+// the query's conditional to resultMap. The aggregate has to describe the
+// blocks of the workload, which must be all blocks of its directory.
+func (w *DBWorkManager) evaluateAggregate(workload DBWorkload, resultMap map[ExtraKey]Val) error {
+	query := workload.query
+	a, err := readAggregate(filepath.Join(w.dbIfaceDir, workload.work_dir), workload.aggregate)
+	if err != nil {
+		return err
+	}
+	if a.fingerprint != blocksFingerprint(workload.load) || a.blocks != len(workload.load) {
+		return errors.New("aggregate is outdated")
+	}
+
+	var key, comparisonValue ExtraKey
+	if query.hasAttrIface {
+		key.Iface = w.iface
+	}
+	querySet := newAttributeSet(query.queryAttributeIndizes)
+
+	for i := 0; i < a.entries; i++ {
+		entryKey, delta := a.entry(i)
+
+		if query.Conditional != nil {
+			comparisonValue.Key = entryKey
+			if !query.Conditional.evaluate(&comparisonValue) {
+				continue
+			}
+		}
+
+		key.Key = querySet.project(entryKey)
+		if val, exists := resultMap[key]; exists {
+			val.NBytesRcvd += delta.NBytesRcvd
+			val.NBytesSent += delta.NBytesSent
+			val.NPktsRcvd += delta.NPktsRcvd
+			val.NPktsSent += delta.NPktsSent
+			resultMap[key] = val
+		} else {
+			resultMap[key] = delta
+		}
+	}
+	return nil
+}
+
+// findAggregate returns the smallest aggregate set of the daily directory
+// dir covering the given attributes, or 0 if there is none
+func findAggregate(dir string, needed attributeSet) attributeSet {
+	var best attributeSet
+	bestSize := 0
+	for set := attributeSet(1); set < 1<<uint(COLIDX_ATTRIBUTE_COUNT); set++ {
+		if !set.covers(needed) || (best != 0 && set.entrySize() >= bestSize) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, set.fileName())); err == nil {
+			best, bestSize = set, set.entrySize()
+		}
+	}
+	return best
+}
+
+// writeAggregate replaces the aggregate file of dir for set
+func writeAggregate(dir string, day int64, set attributeSet, data []byte) error {
+	path := filepath.Join(dir, set.fileName())
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+
+	gpfile, err := NewGPFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = gpfile.WriteTimedBlock(day, data, Compression{}, ENCODING_RAW)
+	if closeErr := gpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removeAggregates removes all aggregates of the daily directory dir, e.g.
+// because its blocks changed
+func removeAggregates(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, AGGREGATE_FILE_PREFIX+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AggregateResult describes the aggregates built for a daily directory.
+type AggregateResult struct {
+	Iface string
+	Day   int64
+	// number of entries per aggregate file
+	Entries map[string]int
+}
+
+func (r AggregateResult) String() string {
+	var files []string
+	for name := range r.Entries {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for i, name := range files {
+		files[i] = fmt.Sprintf("%s (%d entries)", name, r.Entries[name])
+	}
+	return fmt.Sprintf("Built aggregates of %s/%d (%s): %s",
+		r.Iface, r.Day, time.Unix(r.Day, 0).UTC().Format("2006-01-02"), strings.Join(files, ", "))
+}
+
+// buildAggregates writes the aggregates over the given attribute sets of
+// the daily directory dir
+func buildAggregates(dir string, day int64, sets []attributeSet) (map[string]int, error) {
+	var files [COLIDX_COUNT]*GPFile
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		gpfile, err := NewGPFile(filepath.Join(dir, columnFileNames[i]+".gpf"))
+		if err != nil {
+			return nil, err
+		}
+		defer gpfile.Close()
+		files[i] = gpfile
+	}
+
+	// the same blocks a query of the whole day reads
+	var timestamps []int64
+	for _, ts := range files[BYTESRCVD_COLIDX].GetTimestamps() {
+		if ts != 0 {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	flows := make(AggFlowMap)
+	for _, ts := range timestamps {
+		if err := readFlows(files, ts, flows); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make(map[string]int)
+	fingerprint := blocksFingerprint(timestamps)
+	for _, set := range sets {
+		projected := make(AggFlowMap)
+		for key, val := range flows {
+			key = set.project(key)
+			sum, exists := projected[key]
+			if !exists {
+				sum = &Val{}
+				projected[key] = sum
+			}
+			sum.NBytesRcvd += val.NBytesRcvd
+			sum.NBytesSent += val.NBytesSent
+			sum.NPktsRcvd += val.NPktsRcvd
+			sum.NPktsSent += val.NPktsSent
+		}
+		if err := writeAggregate(dir, day, set, marshalAggregate(set, fingerprint, len(timestamps), projected)); err != nil {
+			return entries, err
+		}
+		entries[set.fileName()] = len(projected)
+	}
+	return entries, nil
+}
+
+// AggregateCandidates returns the complete days (all but the current one)
+// of all interfaces in the database at dbpath, newest first. Those whose
+// aggregates exist already are included; BuildDayAggregates skips them.
+func AggregateCandidates(dbpath string, now int64) ([]DayDir, error) {
+	days, err := listDayDirs(dbpath, func(day int64) bool { return day < DayTimestamp(now) })
+	sort.Sort(sort.Reverse(days))
+	return days, err
+}
+
+// BuildDayAggregates builds the missing aggregates for the given query types
+// of the daily directory of iface for day. Returns false if none were
+// missing. The directory is locked (see lockDay) while the aggregates are
+// built.
+//
+// The caller must hold the database lock.
+func BuildDayAggregates(dbpath string, iface string, day int64, queryTypes []string) (AggregateResult, bool, error) {
+	result := AggregateResult{Iface: iface, Day: day}
+	sets, err := parseAggregateTypes(queryTypes)
+	if err != nil {
+		return result, false, err
+	}
+
+	dir := filepath.Join(dbpath, iface, strconv.FormatInt(day, 10))
+	defer lockDay(dir)()
+
+	var missing []attributeSet
+	for _, set := range sets {
+		if _, err := os.Stat(filepath.Join(dir, set.fileName())); os.IsNotExist(err) {
+			missing = append(missing, set)
+		}
+	}
+	if len(missing) == 0 {
+		return result, false, nil
+	}
+
+	if result.Entries, err = buildAggregates(dir, day, missing); err != nil {
+		return result, false, err
+	}
+	return result, true, nil
+}
+
+// BuildAggregates builds the missing aggregates for the given query types of
+// the complete days (all but the current one) of all interfaces in the
+// database at dbpath, newest first. At most maxDays directories are
+// processed, so that a large backlog is worked off in several runs.
+//
+// The caller must hold the database lock.
+func BuildAggregates(dbpath string, queryTypes []string, now int64, maxDays int) ([]AggregateResult, error) {
+	if sets, err := parseAggregateTypes(queryTypes); err != nil || len(sets) == 0 {
+		return nil, err
+	}
+	days, err := AggregateCandidates(dbpath, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []AggregateResult
+		errs    []string
+	)
+	for _, d := range days {
+		if len(results) >= maxDays {
+			break
+		}
+		result, built, err := BuildDayAggregates(dbpath, d.Iface, d.Day, queryTypes)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", d, err))
+			continue
+		}
+		if built {
+			results = append(results, result)
+		}
+	}
+
+	if len(errs) > 0 {
+		return results, fmt.Errorf("Failed to build aggregates of %s", strings.Join(errs, "; "))
+	}
+	return results, nil
+}
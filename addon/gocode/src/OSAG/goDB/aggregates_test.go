@@ -0,0 +1,176 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// aggregates_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var aggregateTestQueries = []struct {
+	queryType, conditional string
+}{
+	{"talk_src", ""},
+	{"talk_dst", ""},
+	{"talk_conv", ""},
+	{"apps_port", ""},
+	{"sip,dport", ""},
+	{"iface,dport", ""},
+	{"iface", ""},
+	{"agg_talk_port", ""},
+	{"talk_src", "dport = 443"},
+	{"talk_src", "snet = 10.1.2.0/24 | proto = 17"},
+	{"apps_port", "sip = 10.0.0.1"},
+	{"apps_port", "dip = 10.0.1.1 & dport != 80"},
+	{"talk_conv", "snet = 10.1.0.0/16 & dport = 53"},
+	{"sip,dip,dport", "proto = 6"},
+	{"time,sip", ""},
+}
+
+// runAggregateTestQueries runs all test queries between tfirst and tlast
+func runAggregateTestQueries(t *testing.T, dbpath string, tfirst, tlast int64) ([]map[ExtraKey]Val, BlockStats) {
+	var (
+		results []map[ExtraKey]Val
+		stats   BlockStats
+	)
+	for _, q := range aggregateTestQueries {
+		result, wm := runQueryInterval(t, dbpath, q.queryType, q.conditional, tfirst, tlast)
+		results = append(results, result)
+		s := wm.BlockStats()
+		stats.Total += s.Total
+		stats.Aggregated += s.Aggregated
+	}
+	return results, stats
+}
+
+func TestAggregates(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "aggregates_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	day := func(n int) int64 { return rollupTestDay + int64(n)*EPOCH_DAY }
+	for n := 0; n < 3; n++ {
+		writeRollupTestDay(t, dbpath, day(n), 24)
+	}
+	// the current day, which isn't aggregated
+	now := day(2) + 3600
+
+	var tests = []struct {
+		tfirst, tlast int64
+		// number of blocks answered from aggregates per query
+		aggregated int
+	}{
+		{0, day(3), 48},
+		{day(0), day(1) + DB_WRITE_INTERVAL, 24},
+		// days that are only partially covered use the blocks
+		{day(0) + 3600, day(1) + 3600, 0},
+		{day(2), day(3), 0},
+	}
+	var before [][]map[ExtraKey]Val
+	for _, test := range tests {
+		results, _ := runAggregateTestQueries(t, dbpath, test.tfirst, test.tlast)
+		before = append(before, results)
+	}
+
+	results, err := BuildAggregates(dbpath, []string{"talk_conv", "apps_port", "sip,dip,dport,proto"}, now, 10)
+	if err != nil {
+		t.Fatalf("failed to build aggregates: %s", err)
+	}
+	if len(results) != 2 || results[0].Day != day(1) || results[1].Day != day(0) || len(results[0].Entries) != 3 {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(dbpath, "eth0", "1450656000", "aggregate_sip_dip.gpf")); err != nil {
+		t.Fatalf("expected aggregate file: %s", err)
+	}
+
+	// nothing left to do
+	if results, err := BuildAggregates(dbpath, []string{"talk_conv"}, now, 10); err != nil || len(results) != 0 {
+		t.Fatalf("expected no aggregates to be built, got %+v (error: %v)", results, err)
+	}
+
+	// queries with the time as an attribute can't use aggregates
+	timeQueries := 1
+	for i, test := range tests {
+		after, stats := runAggregateTestQueries(t, dbpath, test.tfirst, test.tlast)
+		for k, q := range aggregateTestQueries {
+			if !reflect.DeepEqual(before[i][k], after[k]) {
+				t.Fatalf("%d: %s (%s): results differ with aggregates", i, q.queryType, q.conditional)
+			}
+		}
+		if expected := test.aggregated * (len(aggregateTestQueries) - timeQueries); stats.Aggregated != expected {
+			t.Fatalf("%d: expected %d blocks to be aggregated, got %d", i, expected, stats.Aggregated)
+		}
+	}
+}
+
+func TestAggregatesFallback(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "aggregates_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeRollupTestDay(t, dbpath, rollupTestDay, 12)
+	now := rollupTestDay + EPOCH_DAY
+	if _, err := BuildAggregates(dbpath, []string{"talk_src"}, now, 10); err != nil {
+		t.Fatalf("failed to build aggregates: %s", err)
+	}
+	before, stats := runQuery(t, dbpath, "talk_src", "")
+	if stats.Aggregated != 12 {
+		t.Fatalf("expected aggregate to be used, got %+v", stats)
+	}
+
+	// queries on attributes the aggregate lacks use the blocks
+	if _, stats := runQuery(t, dbpath, "talk_src", "dport = 80"); stats.Aggregated != 0 {
+		t.Fatalf("expected aggregate not to be used, got %+v", stats)
+	}
+
+	// a block written after the aggregate was built makes it outdated
+	writeRollupTestDay(t, dbpath, rollupTestDay+12*DB_WRITE_INTERVAL, 1)
+	after, stats := runQuery(t, dbpath, "talk_src", "")
+	if stats.Aggregated != 0 || reflect.DeepEqual(before, after) {
+		t.Fatalf("expected outdated aggregate not to be used, got %+v", stats)
+	}
+
+	// a corrupt aggregate is ignored as well
+	if err := ioutil.WriteFile(filepath.Join(dir, "aggregate_sip.gpf"), []byte("garbage"), 0644); err != nil {
+		t.Fatalf("failed to overwrite aggregate: %s", err)
+	}
+	if result, stats := runQuery(t, dbpath, "talk_src", ""); stats.Aggregated != 0 || !reflect.DeepEqual(result, after) {
+		t.Fatalf("expected corrupt aggregate not to be used, got %+v", stats)
+	}
+
+	// removed aggregates are rebuilt
+	if err := removeAggregates(dir); err != nil {
+		t.Fatalf("failed to remove aggregates: %s", err)
+	}
+	if _, err := BuildAggregates(dbpath, []string{"talk_src"}, now, 10); err != nil {
+		t.Fatalf("failed to rebuild aggregates: %s", err)
+	}
+	if result, stats := runQuery(t, dbpath, "talk_src", ""); stats.Aggregated != 13 || !reflect.DeepEqual(result, after) {
+		t.Fatalf("expected rebuilt aggregate to be used, got %+v", stats)
+	}
+}
+
+func TestValidateAggregateTypes(t *testing.T) {
+	if err := ValidateAggregateTypes([]string{"talk_src", "apps_port", "sip,dport"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, queryTypes := range [][]string{{"raw"}, {"time,sip"}, {"iface"}, {"foo"}} {
+		if err := ValidateAggregateTypes(queryTypes); err == nil {
+			t.Fatalf("expected %v to be rejected", queryTypes)
+		}
+	}
+}
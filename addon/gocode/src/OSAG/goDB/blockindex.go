@@ -0,0 +1,375 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// blockindex.go
+//
+// Per-block summaries (zone maps and bloom filters) that allow queries to skip
+// blocks without reading their columns
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"OSAG/goDB/bigendian"
+)
+
+const (
+	// The summaries of the blocks of a daily directory are stored as the
+	// blocks of the sidecar file index.gpf
+	BLOCK_INDEX_NAME = "index"
+
+	// Bits per distinct address and number of hash functions of the bloom
+	// filters, which gives a false positive rate below 1%
+	BLOOM_BITS_PER_ADDRESS = 10
+	BLOOM_HASHES           = 7
+	// Smallest filter size in bits
+	BLOOM_MIN_BITS = 64
+)
+
+var errCorruptSummary = errors.New("Corrupt block summary")
+
+// bloomFilter is a bloom filter over 16 byte IP addresses. The number of
+// bits is a power of two.
+type bloomFilter struct {
+	hashes uint8
+	bits   []byte
+}
+
+// newBloomFilter returns a filter sized for n distinct addresses
+func newBloomFilter(n int) bloomFilter {
+	nbits := BLOOM_MIN_BITS
+	for nbits < n*BLOOM_BITS_PER_ADDRESS {
+		nbits <<= 1
+	}
+	return bloomFilter{BLOOM_HASHES, make([]byte, nbits/8)}
+}
+
+// bloomHashes derives the two hashes that select the bits of ip (FNV-1a,
+// followed by the finalizer of MurmurHash3 to mix the low bits)
+func bloomHashes(ip []byte) (uint32, uint32) {
+	var h uint64 = 14695981039346656037
+	for _, b := range ip {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return uint32(h), uint32(h>>32) | 1
+}
+
+func (f bloomFilter) add(ip []byte) {
+	h1, h2 := bloomHashes(ip)
+	mask := uint32(len(f.bits)*8 - 1)
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		bit := (h1 + i*h2) & mask
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if ip was definitely not added to the filter
+func (f bloomFilter) mayContain(ip []byte) bool {
+	h1, h2 := bloomHashes(ip)
+	mask := uint32(len(f.bits)*8 - 1)
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		bit := (h1 + i*h2) & mask
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// flowSummary describes what is known about a set of flows, e.g. those of a
+// block or a day, so that queries can tell whether any of them can match a
+// conditional without reading them.
+type flowSummary interface {
+	// mayContainIP returns false if no flow has ip in the address column
+	// (SIP_COLIDX or DIP_COLIDX)
+	mayContainIP(column columnIndex, ip []byte) bool
+	// mayContainNet returns false if no flow has an address in the network
+	// in the address column
+	mayContainNet(column columnIndex, network []byte, netmask int) bool
+	// ranges of the values (in their database representation)
+	dportRange() (min, max []byte)
+	protoRange() (min, max byte)
+}
+
+// BlockSummary describes the values of a block. It implements flowSummary.
+type BlockSummary struct {
+	Timestamp int64
+	FlowCount int
+	// ranges of the values (in their database representation)
+	MinDport, MaxDport [DPORT_SIZEOF]byte
+	MinProto, MaxProto byte
+	// addresses contained in the block
+	sip, dip bloomFilter
+}
+
+// addressFilter returns a bloom filter containing all addresses of the
+// block of an address column
+func addressFilter(block []byte) bloomFilter {
+	var (
+		values   = block[8 : len(block)-8]
+		distinct = make(map[[16]byte]struct{})
+		ip       [16]byte
+	)
+	for i := 0; i+16 <= len(values); i += 16 {
+		copy(ip[:], values[i:i+16])
+		distinct[ip] = struct{}{}
+	}
+
+	filter := newBloomFilter(len(distinct))
+	for ip := range distinct {
+		filter.add(ip[:])
+	}
+	return filter
+}
+
+// newBlockSummary summarizes the block for timestamp given the raw blocks of
+// its columns
+func newBlockSummary(timestamp int64, blocks [COLIDX_COUNT][]byte) *BlockSummary {
+	s := &BlockSummary{
+		Timestamp: timestamp,
+		FlowCount: (len(blocks[PROTO_COLIDX]) - 16) / PROTO_SIZEOF,
+		sip:       addressFilter(blocks[SIP_COLIDX]),
+		dip:       addressFilter(blocks[DIP_COLIDX]),
+	}
+
+	dports := blocks[DPORT_COLIDX][8 : len(blocks[DPORT_COLIDX])-8]
+	protos := blocks[PROTO_COLIDX][8 : len(blocks[PROTO_COLIDX])-8]
+	for i := 0; i < s.FlowCount; i++ {
+		dport := dports[i*DPORT_SIZEOF : i*DPORT_SIZEOF+DPORT_SIZEOF]
+		if i == 0 || bytes.Compare(dport, s.MinDport[:]) < 0 {
+			copy(s.MinDport[:], dport)
+		}
+		if i == 0 || bytes.Compare(dport, s.MaxDport[:]) > 0 {
+			copy(s.MaxDport[:], dport)
+		}
+		if i == 0 || protos[i] < s.MinProto {
+			s.MinProto = protos[i]
+		}
+		if i == 0 || protos[i] > s.MaxProto {
+			s.MaxProto = protos[i]
+		}
+	}
+	return s
+}
+
+func (s *BlockSummary) mayContainIP(column columnIndex, ip []byte) bool {
+	if column == DIP_COLIDX {
+		return s.dip.mayContain(ip)
+	}
+	return s.sip.mayContain(ip)
+}
+
+// Bloom filters can't tell whether a network contains any of their
+// addresses
+func (s *BlockSummary) mayContainNet(column columnIndex, network []byte, netmask int) bool {
+	return true
+}
+
+func (s *BlockSummary) dportRange() (min, max []byte) {
+	return s.MinDport[:], s.MaxDport[:]
+}
+
+func (s *BlockSummary) protoRange() (min, max byte) {
+	return s.MinProto, s.MaxProto
+}
+
+// marshal serializes the summary into the following block format:
+//
+//	64bit epoch timestamp of the block (big-endian)
+//	number of flows as 32bit integer (big-endian)
+//	minimum and maximum dport (2 bytes each)
+//	minimum and maximum proto (1 byte each)
+//	sip bloom filter: number of hashes (1 byte), size n in bytes as 32bit
+//	  integer (big-endian), n bytes of bits
+//	dip bloom filter in the same format
+//	64bit epoch timestamp of the block (big-endian)
+func (s *BlockSummary) marshal() []byte {
+	buf := make([]byte, 8, 8+4+2*DPORT_SIZEOF+2+2*5+len(s.sip.bits)+len(s.dip.bits)+8)
+	bigendian.PutInt64(buf, s.Timestamp)
+	buf = appendUint32(buf, uint32(s.FlowCount))
+	buf = append(buf, s.MinDport[:]...)
+	buf = append(buf, s.MaxDport[:]...)
+	buf = append(buf, s.MinProto, s.MaxProto)
+	for _, f := range []bloomFilter{s.sip, s.dip} {
+		buf = append(buf, f.hashes)
+		buf = appendUint32(buf, uint32(len(f.bits)))
+		buf = append(buf, f.bits...)
+	}
+	buf = buf[:len(buf)+8]
+	bigendian.PutInt64(buf[len(buf)-8:], s.Timestamp)
+	return buf
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func readUint32(buf []byte) uint32 {
+	return uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+}
+
+func unmarshalBlockSummary(data []byte) (*BlockSummary, error) {
+	const fixed = 8 + 4 + 2*DPORT_SIZEOF + 2
+	if len(data) < fixed+8 {
+		return nil, errCorruptSummary
+	}
+
+	s := &BlockSummary{
+		Timestamp: bigendian.ReadInt64At(data, 0),
+		FlowCount: int(readUint32(data[8:])),
+	}
+	copy(s.MinDport[:], data[12:])
+	copy(s.MaxDport[:], data[12+DPORT_SIZEOF:])
+	s.MinProto, s.MaxProto = data[fixed-2], data[fixed-1]
+
+	pos, end := fixed, len(data)-8
+	for _, f := range []*bloomFilter{&s.sip, &s.dip} {
+		if pos+5 > end {
+			return nil, errCorruptSummary
+		}
+		f.hashes = data[pos]
+		n := int(readUint32(data[pos+1:]))
+		pos += 5
+		// the number of bits must be a power of two
+		if n < BLOOM_MIN_BITS/8 || n&(n-1) != 0 || n > end-pos {
+			return nil, errCorruptSummary
+		}
+		f.bits = data[pos : pos+n]
+		pos += n
+	}
+	if pos != end || bigendian.ReadInt64At(data[end:], 0) != s.Timestamp {
+		return nil, errCorruptSummary
+	}
+	return s, nil
+}
+
+// blockIndex gives access to the summaries of the blocks of a daily
+// directory
+type blockIndex struct {
+	file *GPFile
+}
+
+// openBlockIndex opens the index of the daily directory dir. It returns nil
+// if the directory has no index, e.g. because it was written by an older
+// version of goProbe.
+func openBlockIndex(dir string) *blockIndex {
+	path := filepath.Join(dir, BLOCK_INDEX_NAME+".gpf")
+	// NewGPFile would create a missing file
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	file, err := NewGPFile(path)
+	if err != nil {
+		return nil
+	}
+	return &blockIndex{file}
+}
+
+// summary returns the summary of the block for timestamp
+func (i *blockIndex) summary(timestamp int64) (*BlockSummary, error) {
+	data, err := i.file.ReadTimedBlock(timestamp)
+	if err != nil {
+		return nil, err
+	}
+	s, err := unmarshalBlockSummary(data)
+	if err != nil {
+		return nil, err
+	}
+	if s.Timestamp != timestamp {
+		return nil, errCorruptSummary
+	}
+	return s, nil
+}
+
+func (i *blockIndex) Close() error {
+	return i.file.Close()
+}
+
+// Range checks shared by dport and proto conditions. They return false if
+// no value between min and max satisfies the comparison with value.
+func rangeMayMatch(comparator string, value, min, max []byte) bool {
+	switch comparator {
+	case "=":
+		return bytes.Compare(min, value) <= 0 && bytes.Compare(value, max) <= 0
+	case "!=":
+		return !(bytes.Equal(min, value) && bytes.Equal(max, value))
+	case "<":
+		return bytes.Compare(min, value) < 0
+	case ">":
+		return bytes.Compare(max, value) > 0
+	case "<=":
+		return bytes.Compare(min, value) <= 0
+	case ">=":
+		return bytes.Compare(max, value) >= 0
+	}
+	return true
+}
+
+// generateCompareSummary adds a closure to the condition that checks whether
+// any of the summarized flows can satisfy the condition. Conditions that
+// summaries can't rule out (e.g. sip != x) don't get one.
+func generateCompareSummary(condition *conditionNode) error {
+	value, netmask, err := conditionBytesAndNetmask(*condition)
+	if err != nil {
+		return err
+	}
+
+	column := SIP_COLIDX
+	if condition.attribute == "dip" || condition.attribute == "dnet" {
+		column = DIP_COLIDX
+	}
+	comparator := condition.comparator
+
+	switch condition.attribute {
+	case "sip", "dip":
+		if comparator == "=" {
+			condition.compareSummary = func(s flowSummary) bool {
+				return s.mayContainIP(column, value[:SIP_SIZEOF])
+			}
+		}
+	case "snet", "dnet":
+		if comparator == "=" {
+			condition.compareSummary = func(s flowSummary) bool {
+				return s.mayContainNet(column, value, netmask)
+			}
+		}
+	case "dport":
+		condition.compareSummary = func(s flowSummary) bool {
+			min, max := s.dportRange()
+			return rangeMayMatch(comparator, value[:DPORT_SIZEOF], min, max)
+		}
+	case "proto":
+		condition.compareSummary = func(s flowSummary) bool {
+			min, max := s.protoRange()
+			return rangeMayMatch(comparator, value[:1], []byte{min}, []byte{max})
+		}
+	}
+	return nil
+}
+
+// summaryMayMatch returns false if none of the flows summarized by s can
+// satisfy the (parsed and instrumented) conditional. A nil conditional is
+// satisfied by every flow.
+func summaryMayMatch(conditional Node, s *BlockSummary) bool {
+	if s.FlowCount == 0 {
+		return false
+	}
+	if conditional == nil {
+		return true
+	}
+	return conditional.mayMatch(s)
+}
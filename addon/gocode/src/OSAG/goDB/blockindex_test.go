@@ -0,0 +1,273 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// blockindex_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readSummary computes the summary of the block for timestamp from the
+// column files of dir
+func readSummary(tb testing.TB, dir string, timestamp int64) *BlockSummary {
+	var blocks [COLIDX_COUNT][]byte
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		gpfile, err := NewGPFile(filepath.Join(dir, columnFileNames[i]+".gpf"))
+		if err != nil {
+			tb.Fatalf("failed to open file: %s", err)
+		}
+		if blocks[i], err = gpfile.ReadTimedBlock(timestamp); err != nil {
+			tb.Fatalf("failed to read block: %s", err)
+		}
+		gpfile.Close()
+	}
+	return newBlockSummary(timestamp, blocks)
+}
+
+// writeIndex writes the summaries of the given blocks of dir to its index
+func writeIndex(tb testing.TB, dir string, summaries ...*BlockSummary) {
+	gpfile, err := NewGPFile(filepath.Join(dir, BLOCK_INDEX_NAME+".gpf"))
+	if err != nil {
+		tb.Fatalf("failed to open index: %s", err)
+	}
+	defer gpfile.Close()
+	for _, summary := range summaries {
+		if err := gpfile.WriteTimedBlock(summary.Timestamp, summary.marshal(), Compression{Codec: CODEC_NONE}, ENCODING_RAW); err != nil {
+			tb.Fatalf("failed to write summary: %s", err)
+		}
+	}
+}
+
+// writeSyntheticIndex adds the summaries of all blocks written by
+// writeSyntheticDB
+func writeSyntheticIndex(tb testing.TB, dbpath string) {
+	dir := filepath.Join(dbpath, "eth0", "1450656000")
+	var summaries []*BlockSummary
+	for _, ts := range columnTimestamps(tb, dir, "sip") {
+		summaries = append(summaries, readSummary(tb, dir, ts))
+	}
+	writeIndex(tb, dir, summaries...)
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000)
+	if len(filter.bits)*8 < 1000*BLOOM_BITS_PER_ADDRESS {
+		t.Fatalf("filter too small: %d bits", len(filter.bits)*8)
+	}
+
+	var ip [16]byte
+	for i := 0; i < 1000; i++ {
+		copy(ip[:], []byte{10, 0, byte(i >> 8), byte(i)})
+		filter.add(ip[:])
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		copy(ip[:], []byte{10, 0, byte(i >> 8), byte(i)})
+		if i < 1000 && !filter.mayContain(ip[:]) {
+			t.Fatalf("filter doesn't contain %v", ip)
+		}
+		if i >= 1000 && filter.mayContain(ip[:]) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 9000/50 {
+		t.Fatalf("too many false positives: %d of 9000", falsePositives)
+	}
+}
+
+func TestBlockSummaryMarshal(t *testing.T) {
+	blocks, _ := dbData("eth0", 1450656300, testFlowMap(20))
+	summary := newBlockSummary(1450656300, blocks)
+	if summary.FlowCount != 20 || summary.MinProto != 6 || summary.MaxDport != [2]byte{0, 80} {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	data := summary.marshal()
+	if parsed, err := unmarshalBlockSummary(data); err != nil || !reflect.DeepEqual(parsed, summary) {
+		t.Fatalf("round trip failed: %+v (error: %v)", parsed, err)
+	}
+
+	// truncated data, a filter size that isn't a power of two and a
+	// mismatching timestamp
+	broken := [][]byte{
+		data[:len(data)-1],
+		append([]byte{}, data...),
+		append([]byte{}, data...),
+	}
+	broken[1][8+4+2*DPORT_SIZEOF+2+4]++
+	broken[2][len(data)-1]++
+	for i, b := range broken {
+		if _, err := unmarshalBlockSummary(b); err != errCorruptSummary {
+			t.Fatalf("%d: expected corrupt summary, got %v", i, err)
+		}
+	}
+}
+
+// testFlowMap(4) holds flows from 10.0.0.0-3 to 10.0.1.1 on port 80/tcp
+var summaryMayMatchTests = []struct {
+	conditional string
+	mayMatch    bool
+}{
+	{"", true},
+	{"sip = 10.0.0.1", true},
+	{"sip = 10.0.0.200", false},
+	{"dip = 10.0.1.1", true},
+	{"dip = 10.0.1.2", false},
+	{"dip != 10.0.1.1", true},
+	{"dport = 80", true},
+	{"dport = 443", false},
+	{"dport > 80", false},
+	{"dport >= 80", true},
+	{"dport < 80", false},
+	{"dport <= 80", true},
+	{"dport != 80", false},
+	{"proto = 17", false},
+	{"proto = 6 | sip = 10.0.0.200", true},
+	{"sip = 10.0.0.1 & dport = 443", false},
+	{"!(dport = 443)", true},
+	{"!(dport = 80 | sip = 10.0.0.200)", false},
+	{"snet = 192.168.0.0/16", true},
+}
+
+func TestSummaryMayMatch(t *testing.T) {
+	blocks, _ := dbData("eth0", 1450656300, testFlowMap(4))
+	summary := newBlockSummary(1450656300, blocks)
+
+	for _, test := range summaryMayMatchTests {
+		conditional, err := ParseAndInstrumentConditional(test.conditional, time.Second)
+		if err != nil {
+			t.Fatalf("%s: failed to parse: %s", test.conditional, err)
+		}
+		if mayMatch := summaryMayMatch(conditional, summary); mayMatch != test.mayMatch {
+			t.Fatalf("%s: expected %v, got %v", test.conditional, test.mayMatch, mayMatch)
+		}
+	}
+
+	// an empty block never matches
+	blocks, _ = dbData("eth0", 1450656300, AggFlowMap{})
+	if summaryMayMatch(nil, newBlockSummary(1450656300, blocks)) {
+		t.Fatalf("empty block matches")
+	}
+}
+
+// skipping blocks must not change the results of queries
+func TestQueryBlockIndex(t *testing.T) {
+	var dbs [2]string
+	for i := range dbs {
+		dir, err := ioutil.TempDir("", "blockindex_test")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		writeSyntheticDB(t, dir, 8, 500, ENCODING_IP)
+		dbs[i] = dir
+	}
+	writeSyntheticIndex(t, dbs[1])
+
+	// number of skipped blocks, or -1 if it depends on the bloom filters
+	for _, test := range []struct {
+		queryType, conditional string
+		skipped                int
+	}{
+		{"talk_conv", "", 0},
+		{"sip,dport", "sip = 10.1.2.3", -1},
+		{"sip,dport", "sip = 10.1.9.9", 8},
+		{"dip", "dport = 53 | proto = 1", 0},
+		{"dip", "dport = 22 | proto = 1", 8},
+		{"sip", "dnet = 2a00:1450:4001:82a::/64 & dport = 443", 0},
+	} {
+		plain, stats := runQuery(t, dbs[0], test.queryType, test.conditional)
+		if stats.Skipped != 0 || stats.Total != 8 {
+			t.Fatalf("%s: unexpected block stats without index %+v", test.conditional, stats)
+		}
+		indexed, stats := runQuery(t, dbs[1], test.queryType, test.conditional)
+		if (test.skipped >= 0 && stats.Skipped != test.skipped) || stats.Total != 8 {
+			t.Fatalf("%s: expected %d skipped blocks, got %+v", test.conditional, test.skipped, stats)
+		}
+		if !reflect.DeepEqual(plain, indexed) {
+			t.Fatalf("%s (%s): results differ (%d and %d entries)", test.queryType, test.conditional, len(plain), len(indexed))
+		}
+	}
+}
+
+func TestCheckDayIndex(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "blockindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// the writer maintains the index
+	dir := writeTestDay(t, dbpath, 3)
+	timestamps := columnTimestamps(t, dir, "sip")
+	if check, err := CheckDay(dir, false); err != nil || !check.OK() {
+		t.Fatalf("expected consistent directory, got %+v (error: %v)", check, err)
+	}
+
+	// a summary of the wrong block and one without a block
+	wrong := readSummary(t, dir, timestamps[0])
+	wrong.Timestamp = timestamps[1]
+	extra := readSummary(t, dir, timestamps[2])
+	extra.Timestamp = timestamps[2] + DB_WRITE_INTERVAL
+	os.Remove(filepath.Join(dir, BLOCK_INDEX_NAME+".gpf"))
+	writeIndex(t, dir, readSummary(t, dir, timestamps[0]), wrong, readSummary(t, dir, timestamps[2]), extra)
+
+	check, err := CheckDay(dir, false)
+	if err != nil || len(check.IndexProblems) != 2 || check.Repaired {
+		t.Fatalf("expected two index problems, got %+v (error: %v)", check, err)
+	}
+	if check, err = CheckDay(dir, true); err != nil || !check.Repaired {
+		t.Fatalf("expected repair, got %+v (error: %v)", check, err)
+	}
+	if check, err = CheckDay(dir, false); err != nil || !check.OK() {
+		t.Fatalf("expected consistent directory after repair, got %+v (error: %v)", check, err)
+	}
+	checkConsistent(t, dir, timestamps)
+
+	index := openBlockIndex(dir)
+	defer index.Close()
+	summary, err := index.summary(timestamps[1])
+	if err != nil || !bytes.Equal(summary.marshal(), readSummary(t, dir, timestamps[1]).marshal()) {
+		t.Fatalf("summary wasn't rebuilt: %+v (error: %v)", summary, err)
+	}
+}
+
+func BenchmarkQueryBlockIndex(b *testing.B) {
+	const blocks, flows = 96, 2000
+
+	for _, indexed := range []bool{false, true} {
+		name := "without_index"
+		if indexed {
+			name = "with_index"
+		}
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "blockindex_bench")
+			if err != nil {
+				b.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer os.RemoveAll(dir)
+			writeSyntheticDB(b, dir, blocks, flows, ENCODING_IP)
+			if indexed {
+				writeSyntheticIndex(b, dir)
+			}
+
+			b.SetBytes(blocks * flows)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runQuery(b, dir, "sip,dport", "sip = 10.1.9.9")
+			}
+		})
+	}
+}
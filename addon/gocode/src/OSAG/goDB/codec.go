@@ -0,0 +1,301 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// codec.go
+//
+// Compression codecs for the blocks of gpf files
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"OSAG/goDB/lz4"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CodecType identifies the codec a block is compressed with. It is stored
+// in the header of gpf files, so the values of existing codecs must never
+// change.
+type CodecType uint8
+
+const (
+	CODEC_NONE CodecType = 1
+	CODEC_LZ4  CodecType = 2
+	CODEC_ZSTD CodecType = 3
+
+	// Used for new blocks unless configured otherwise. Blocks of files
+	// without a codec section are always LZ4 compressed.
+	DEFAULT_CODEC = CODEC_LZ4
+
+	LZ4_DEFAULT_LEVEL  = 9
+	ZSTD_DEFAULT_LEVEL = 3
+	ZSTD_MAX_LEVEL     = 22
+)
+
+// A Codec compresses and decompresses the data of blocks. Codecs must be
+// safe for concurrent use.
+type Codec interface {
+	// Compress returns the compressed data. Level 0 selects the default
+	// level of the codec.
+	Compress(data []byte, level int) ([]byte, error)
+	// Decompress decompresses src into dst, which has the size of the
+	// uncompressed data. It must not panic on corrupted input.
+	Decompress(src, dst []byte) error
+	// Bound returns the maximum size of the compressed data of n bytes
+	Bound(n int) int
+	// MaxLevel returns the highest supported compression level
+	MaxLevel() int
+}
+
+type registeredCodec struct {
+	name  string
+	codec Codec
+}
+
+var codecs = map[CodecType]registeredCodec{
+	CODEC_NONE: {"none", noneCodec{}},
+	CODEC_LZ4:  {"lz4", lz4Codec{}},
+	CODEC_ZSTD: {"zstd", &zstdCodec{}},
+}
+
+// RegisterCodec makes a codec available under the given ID and name. It
+// must be called before any database access, e.g. from an init function.
+func RegisterCodec(id CodecType, name string, codec Codec) {
+	if id == 0 {
+		panic("goDB: codec ID 0 is reserved")
+	}
+	if _, exists := codecs[id]; exists {
+		panic(fmt.Sprintf("goDB: codec ID %d registered twice", id))
+	}
+	if _, err := ParseCodec(name); err == nil {
+		panic("goDB: codec " + name + " registered twice")
+	}
+	codecs[id] = registeredCodec{name, codec}
+}
+
+// GetCodec returns the codec with the given ID
+func GetCodec(id CodecType) (Codec, error) {
+	c, exists := codecs[id]
+	if !exists {
+		return nil, fmt.Errorf("Unknown codec %d", id)
+	}
+	return c.codec, nil
+}
+
+// ParseCodec returns the ID of the codec with the given name
+func ParseCodec(name string) (CodecType, error) {
+	for id, c := range codecs {
+		if c.name == strings.ToLower(name) {
+			return id, nil
+		}
+	}
+
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("Unknown codec '%s'. Supported codecs: %s", name, strings.Join(names, ", "))
+}
+
+func (t CodecType) String() string {
+	if c, exists := codecs[t]; exists {
+		return c.name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(t))
+}
+
+func (t CodecType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *CodecType) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	id, err := ParseCodec(name)
+	if err != nil {
+		return err
+	}
+	*t = id
+	return nil
+}
+
+// Compression selects the codec and the level used for new blocks. The
+// zero value selects DEFAULT_CODEC at its default level.
+type Compression struct {
+	Codec CodecType `json:"codec"`
+	// 0 selects the default level of the codec
+	Level int `json:"level,omitempty"`
+}
+
+// codec returns the ID and the implementation of the selected codec
+func (c Compression) codec() (CodecType, Codec, error) {
+	id := c.Codec
+	if id == 0 {
+		id = DEFAULT_CODEC
+	}
+	codec, err := GetCodec(id)
+	return id, codec, err
+}
+
+// Validate checks that the codec exists and supports the level
+func (c Compression) Validate() error {
+	id, codec, err := c.codec()
+	if err != nil {
+		return err
+	}
+	if c.Level < 0 || c.Level > codec.MaxLevel() {
+		return fmt.Errorf("Invalid level %d for codec %s: must be between 0 and %d", c.Level, id, codec.MaxLevel())
+	}
+	return nil
+}
+
+func (c Compression) String() string {
+	id, _, _ := c.codec()
+	if c.Level == 0 {
+		return id.String()
+	}
+	return fmt.Sprintf("%s (level %d)", id, c.Level)
+}
+
+var errDecompressedSize = errors.New("Decompressed data has the wrong size")
+
+// noneCodec stores the data uncompressed
+type noneCodec struct{}
+
+func (noneCodec) Compress(data []byte, level int) ([]byte, error) {
+	return data, nil
+}
+
+func (noneCodec) Decompress(src, dst []byte) error {
+	if len(src) != len(dst) {
+		return errDecompressedSize
+	}
+	copy(dst, src)
+	return nil
+}
+
+func (noneCodec) Bound(n int) int {
+	return n
+}
+
+func (noneCodec) MaxLevel() int {
+	return 0
+}
+
+// lz4Codec produces LZ4 blocks like the C library previously used by goDB
+type lz4Codec struct{}
+
+func (lz4Codec) Compress(data []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = LZ4_DEFAULT_LEVEL
+	}
+	return lz4.Compress(data, level), nil
+}
+
+func (lz4Codec) Decompress(src, dst []byte) error {
+	n, err := lz4.Uncompress(src, dst)
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return errDecompressedSize
+	}
+	return nil
+}
+
+func (lz4Codec) Bound(n int) int {
+	return lz4.CompressBound(n)
+}
+
+func (lz4Codec) MaxLevel() int {
+	return lz4.MAX_LEVEL
+}
+
+// zstdCodec compresses blocks as zstd frames. The encoders and the decoder
+// are created on first use.
+type zstdCodec struct {
+	sync.Mutex
+	encoders map[zstd.EncoderLevel]*zstd.Encoder
+	decoder  *zstd.Decoder
+}
+
+func (c *zstdCodec) encoder(level zstd.EncoderLevel) (*zstd.Encoder, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if enc, exists := c.encoders[level]; exists {
+		return enc, nil
+	}
+	// blocks are written one at a time and already have a checksum
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, err
+	}
+	if c.encoders == nil {
+		c.encoders = make(map[zstd.EncoderLevel]*zstd.Encoder)
+	}
+	c.encoders[level] = enc
+	return enc, nil
+}
+
+func (c *zstdCodec) Compress(data []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = ZSTD_DEFAULT_LEVEL
+	}
+	enc, err := c.encoder(zstd.EncoderLevelFromZstd(level))
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(data, make([]byte, 0, c.Bound(len(data)))), nil
+}
+
+func (c *zstdCodec) Decompress(src, dst []byte) error {
+	c.Lock()
+	if c.decoder == nil {
+		// no block is larger than what ReadBlock accepts
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(math.MaxInt32))
+		if err != nil {
+			c.Unlock()
+			return err
+		}
+		c.decoder = dec
+	}
+	dec := c.decoder
+	c.Unlock()
+
+	out, err := dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return err
+	}
+	if len(out) != len(dst) {
+		return errDecompressedSize
+	}
+	// out only differs from dst if the decoder had to grow the buffer
+	copy(dst, out)
+	return nil
+}
+
+// Bound allows for the block headers and the frame header around
+// incompressible data
+func (c *zstdCodec) Bound(n int) int {
+	return n + n>>8 + 64
+}
+
+func (c *zstdCodec) MaxLevel() int {
+	return ZSTD_MAX_LEVEL
+}
@@ -0,0 +1,144 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// codec_test.go
+//
+// Tests for the block compression codecs
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := testBlockData(recoveryTestDay, 1000)
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, id := range []CodecType{CODEC_NONE, CODEC_LZ4, CODEC_ZSTD} {
+		codec, err := GetCodec(id)
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		for _, level := range []int{0, 1, codec.MaxLevel()} {
+			comp, err := codec.Compress(data, level)
+			if err != nil || len(comp) > codec.Bound(len(data)) {
+				t.Fatalf("%s, level %d: failed to compress (size %d, error: %v)", id, level, len(comp), err)
+			}
+			out := make([]byte, len(data))
+			if err := codec.Decompress(comp, out); err != nil || !bytes.Equal(out, data) {
+				t.Fatalf("%s, level %d: round trip failed (error: %v)", id, level, err)
+			}
+			if err := codec.Decompress(comp, make([]byte, len(data)+1)); err == nil {
+				t.Fatalf("%s, level %d: expected error for wrong size", id, level)
+			}
+		}
+
+		// corrupted input must be rejected or at least not crash
+		comp, _ := codec.Compress(data, 0)
+		corrupt := make([]byte, len(comp))
+		out := make([]byte, len(data))
+		for i := 0; i < 1000; i++ {
+			copy(corrupt, comp)
+			corrupt[rnd.Intn(len(corrupt))] ^= byte(1 + rnd.Intn(255))
+			codec.Decompress(corrupt, out)
+			codec.Decompress(corrupt[:rnd.Intn(len(corrupt))], out)
+		}
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	var c Compression
+	if err := json.Unmarshal([]byte(`{"codec": "zstd", "level": 19}`), &c); err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if c.Codec != CODEC_ZSTD || c.Level != 19 || c.Validate() != nil {
+		t.Fatalf("unexpected configuration %+v", c)
+	}
+	if b, _ := json.Marshal(c); string(b) != `{"codec":"zstd","level":19}` {
+		t.Fatalf("unexpected encoding %s", b)
+	}
+
+	if err := json.Unmarshal([]byte(`{"codec": "lzma"}`), &c); err == nil {
+		t.Fatalf("expected unknown codec to be rejected")
+	}
+	for _, invalid := range []Compression{{CODEC_LZ4, 17}, {CODEC_NONE, 1}, {CODEC_ZSTD, -1}, {42, 0}} {
+		if invalid.Validate() == nil {
+			t.Fatalf("expected %+v to be invalid", invalid)
+		}
+	}
+	if (Compression{}).Validate() != nil {
+		t.Fatalf("expected default compression to be valid")
+	}
+}
+
+func TestGPFileMixedCodecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sip.gpf")
+
+	compressions := []Compression{{}, {CODEC_ZSTD, 0}, {CODEC_NONE, 0}, {CODEC_LZ4, 1}, {CODEC_ZSTD, 19}}
+	var written [][]byte
+	for i, c := range compressions {
+		ts := recoveryTestDay + int64(i+1)*DB_WRITE_INTERVAL
+		data := testBlockData(ts, 50*(i+1))
+		gpfile, err := NewGPFile(path)
+		if err != nil {
+			t.Fatalf("failed to open file: %s", err)
+		}
+		if err := gpfile.WriteTimedBlock(ts, data, c, ENCODING_RAW); err != nil {
+			t.Fatalf("failed to write block with %s: %s", c, err)
+		}
+		gpfile.Close()
+		written = append(written, data)
+	}
+
+	gpfile, _ := NewGPFile(path)
+	for i, data := range written {
+		id, _, _ := gpfile.blockCodec(i)
+		expected, _, _ := compressions[i].codec()
+		if id != expected {
+			t.Fatalf("block %d: expected codec %s, got %s", i, expected, id)
+		}
+		if read, err := gpfile.ReadBlock(i); err != nil || !bytes.Equal(read, data) {
+			t.Fatalf("block %d: data mismatch (error: %v)", i, err)
+		}
+	}
+
+	// copied blocks keep their codec
+	copyPath := filepath.Join(dir, "copy.gpf")
+	copied, _ := NewGPFile(copyPath)
+	for i := range written {
+		if err := copied.copyBlock(gpfile, i); err != nil {
+			t.Fatalf("failed to copy block %d: %s", i, err)
+		}
+	}
+	gpfile.Close()
+	copied.Close()
+	for i, data := range written {
+		if read, _ := readTestBlock(t, copyPath, i); !bytes.Equal(read, data) {
+			t.Fatalf("copied block %d: data mismatch", i)
+		}
+	}
+
+	// unknown codecs are reported instead of decoding garbage
+	gpfile, _ = NewGPFile(path)
+	gpfile.codecs[1] = 42
+	if _, err := gpfile.ReadBlock(1); err == nil {
+		t.Fatalf("expected error for unknown codec")
+	}
+	gpfile.Close()
+}
@@ -0,0 +1,119 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// db_lock.go
+//
+// Exclusive lock ensuring that only a single process writes to a database,
+// and locks of the daily directories within that process
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const DB_LOCK_FILE_NAME = "db.lock"
+
+// DBLock is held by the process writing to a database. Since the lock is
+// tied to an open file, the operating system releases it when the process
+// dies, so there are no stale locks after a crash.
+type DBLock struct {
+	file *os.File
+}
+
+// LockDB acquires the exclusive write lock on the database at dbpath. It
+// fails immediately if another process holds the lock.
+func LockDB(dbpath string) (*DBLock, error) {
+	path := filepath.Join(dbpath, DB_LOCK_FILE_NAME)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("Database '%s' is locked by another process%s", dbpath, lockHolder(path))
+		}
+		return nil, err
+	}
+
+	// record who holds the lock for the benefit of whoever fails to get it
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &DBLock{file}, nil
+}
+
+// lockHolder describes the process holding the lock file at path.
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if pid := strings.TrimSpace(string(data)); pid != "" {
+		return " (pid " + pid + ")"
+	}
+	return ""
+}
+
+// Unlock releases the lock.
+func (l *DBLock) Unlock() error {
+	// closing the file releases the lock
+	return l.file.Close()
+}
+
+// dayLock is the lock of a single daily directory. refs counts the
+// goroutines holding or waiting for it.
+type dayLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	// protects dayLocks
+	dayLocksMutex sync.Mutex
+	dayLocks      = make(map[string]*dayLock)
+)
+
+// lockDay locks the daily directory dir and returns the function unlocking
+// it. Writing a block and maintaining old data (rollups, aggregates and
+// retention) lock the directory they work on, so that they can run
+// concurrently without ever working on the same directory.
+func lockDay(dir string) (unlock func()) {
+	dir = filepath.Clean(dir)
+
+	dayLocksMutex.Lock()
+	l, exists := dayLocks[dir]
+	if !exists {
+		l = &dayLock{}
+		dayLocks[dir] = l
+	}
+	l.refs++
+	dayLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		dayLocksMutex.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(dayLocks, dir)
+		}
+		dayLocksMutex.Unlock()
+	}
+}
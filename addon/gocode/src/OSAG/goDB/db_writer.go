@@ -21,9 +21,6 @@ import (
 )
 
 const (
-	// Used for compression applied by GPFile.
-	COMPRESSION_LEVEL = 512
-
 	METADATA_FILE_NAME = "meta.json"
 )
 
@@ -33,18 +30,20 @@ func DayTimestamp(timestamp int64) int64 {
 }
 
 type DBWriter struct {
-	dbpath string
-	iface  string
+	dbpath      string
+	iface       string
+	compression Compression
 
 	dayTimestamp int64
 
 	metadata *Metadata
 }
 
-func NewDBWriter(dbpath string, iface string) (w *DBWriter) {
+func NewDBWriter(dbpath string, iface string, compression Compression) (w *DBWriter) {
 	return &DBWriter{
 		dbpath,
 		iface,
+		compression,
 
 		0,
 
@@ -75,21 +74,62 @@ func (w *DBWriter) writeMetadata(timestamp int64, meta BlockMetadata) error {
 	return WriteMetadata(path, w.metadata)
 }
 
-func (w *DBWriter) writeBlock(timestamp int64, column string, data []byte) error {
-	path := filepath.Join(w.dailyDir(timestamp), column+".gpf")
+func (w *DBWriter) writeBlock(timestamp int64, column columnIndex, data []byte) error {
+	path := filepath.Join(w.dailyDir(timestamp), columnFileNames[column]+".gpf")
 	gpfile, err := NewGPFile(path)
 	if err != nil {
 		return err
 	}
 	defer gpfile.Close()
 
-	if err := gpfile.WriteTimedBlock(timestamp, data, COMPRESSION_LEVEL); err != nil {
+	if err := gpfile.WriteTimedBlock(timestamp, data, w.compression, columnEncodings[column]); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// writeSummary appends the summary of a block to the index of its day.
+// Bloom filters don't compress, so summaries are stored uncompressed.
+func (w *DBWriter) writeSummary(summary *BlockSummary) error {
+	path := filepath.Join(w.dailyDir(summary.Timestamp), BLOCK_INDEX_NAME+".gpf")
+	gpfile, err := NewGPFile(path)
+	if err != nil {
+		return err
+	}
+	defer gpfile.Close()
+
+	return gpfile.WriteTimedBlock(summary.Timestamp, summary.marshal(), Compression{Codec: CODEC_NONE}, ENCODING_RAW)
+}
+
+// updateHostIndex adds the addresses of the block to the host index of its
+// day. A day that already has blocks but no index (e.g. because it was
+// started by an older version of goProbe) doesn't get one, since it would
+// lack the addresses of the earlier blocks. An unreadable index is removed
+// for the same reason; goquery -index-hosts builds the missing indexes.
+func (w *DBWriter) updateHostIndex(timestamp int64, sipBlock, dipBlock []byte) error {
+	dir := w.dailyDir(timestamp)
+	path := filepath.Join(dir, HOST_INDEX_FILE_NAME)
+
+	hosts, err := readHostIndex(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(dir, METADATA_FILE_NAME)); err == nil {
+			return nil
+		}
+		hosts, err = make(hostSet), nil
+	}
+	if err != nil {
+		return os.Remove(path)
+	}
+
+	hosts.addBlock(timestamp, sipBlock, dipBlock)
+	if err := writeHostIndex(path, DayTimestamp(timestamp), hosts); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
 func (w *DBWriter) Write(flowmap AggFlowMap, meta BlockMetadata, timestamp int64) (InterfaceSummaryUpdate, error) {
 	var (
 		dbdata [COLIDX_COUNT][]byte
@@ -97,6 +137,9 @@ func (w *DBWriter) Write(flowmap AggFlowMap, meta BlockMetadata, timestamp int64
 		err    error
 	)
 
+	// the directory may be maintained concurrently (see lockDay)
+	defer lockDay(w.dailyDir(timestamp))()
+
 	if err = os.MkdirAll(w.dailyDir(timestamp), 0755); err != nil {
 		err = fmt.Errorf("Could not create daily directory: %s", err.Error())
 		return update, err
@@ -105,11 +148,21 @@ func (w *DBWriter) Write(flowmap AggFlowMap, meta BlockMetadata, timestamp int64
 	dbdata, update = dbData(w.iface, timestamp, flowmap)
 
 	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
-		if err = w.writeBlock(timestamp, columnFileNames[i], dbdata[i]); err != nil {
+		if err = w.writeBlock(timestamp, i, dbdata[i]); err != nil {
 			return update, err
 		}
 	}
 
+	// The summary is written after the blocks it describes. Recovery
+	// removes the summaries of blocks that weren't completely written.
+	if err = w.writeSummary(newBlockSummary(timestamp, dbdata)); err != nil {
+		return update, err
+	}
+	// Recovery rebuilds the host index if the block is removed
+	if err = w.updateHostIndex(timestamp, dbdata[SIP_COLIDX], dbdata[DIP_COLIDX]); err != nil {
+		return update, err
+	}
+
 	meta.FlowCount = update.FlowCount
 	meta.Traffic = update.Traffic
 
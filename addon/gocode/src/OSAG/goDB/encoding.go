@@ -0,0 +1,191 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// encoding.go
+//
+// Compact layouts for the values of gpf blocks
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EncodingType identifies how the values of a block are laid out before
+// compression. It is stored in the header of gpf files, so the values of
+// existing encodings must never change.
+type EncodingType uint8
+
+const (
+	// The values are stored as they are. Blocks of files without an
+	// encoding section are always stored like this.
+	ENCODING_RAW EncodingType = 0
+	// IP addresses: IPv4 addresses are stored as 4 bytes and a bitmap
+	// tells them apart from IPv6 addresses (see encodeIPBlock)
+	ENCODING_IP EncodingType = 1
+)
+
+// Length of the count of addresses in blocks with ENCODING_IP
+const IP_COUNT_SIZEOF = 4
+
+var errCorruptIPBlock = errors.New("Corrupt IP address block")
+
+func (e EncodingType) String() string {
+	switch e {
+	case ENCODING_RAW:
+		return "raw"
+	case ENCODING_IP:
+		return "ip"
+	}
+	return fmt.Sprintf("encoding(%d)", uint8(e))
+}
+
+// encodeBlock returns the data of a block in the requested encoding along
+// with the encoding actually used. Data the encoding doesn't apply to, or
+// doesn't make smaller, is stored raw.
+func encodeBlock(data []byte, encoding EncodingType) ([]byte, EncodingType) {
+	if encoding == ENCODING_IP {
+		if buf, ok := encodeIPBlock(data); ok {
+			return buf, ENCODING_IP
+		}
+	}
+	return data, ENCODING_RAW
+}
+
+// decodeBlock turns the data of a block stored in the given encoding back
+// into its raw layout. The raw layout is written to dst if it has enough
+// capacity, so that readers can reuse their buffers from block to block.
+func decodeBlock(data []byte, encoding EncodingType, dst []byte) ([]byte, error) {
+	switch encoding {
+	case ENCODING_RAW:
+		return data, nil
+	case ENCODING_IP:
+		return decodeIPBlock(data, dst)
+	}
+	return nil, fmt.Errorf("Unknown encoding %d", encoding)
+}
+
+// growBuffer returns buf resized to n bytes, allocating a new buffer only
+// if buf lacks the capacity
+func growBuffer(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// isIPv4 reports whether the 16 byte address holds an IPv4 address, i.e.
+// whether its last 12 bytes are zero
+func isIPv4(ip []byte) bool {
+	for _, b := range ip[4:16] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeIPBlock converts a raw block of 16 byte IP addresses to the
+// following layout:
+//
+//	64bit epoch timestamp of the block (big-endian)
+//	number of addresses n as unsigned 32bit integer (big-endian)
+//	family bitmap of (n+7)/8 bytes, the most significant bit of the
+//	  first byte refers to the first address. A set bit marks an IPv6
+//	  address.
+//	the addresses, 4 bytes for IPv4 and 16 bytes for IPv6 addresses
+//	64bit epoch timestamp of the block (big-endian)
+//
+// It returns false if the block doesn't contain any IPv4 addresses.
+func encodeIPBlock(data []byte) ([]byte, bool) {
+	if len(data) < 16 || (len(data)-16)%16 != 0 {
+		return nil, false
+	}
+	var (
+		addrs   = data[8 : len(data)-8]
+		n       = len(addrs) / 16
+		n_v6    = 0
+		off_bm  = 8 + IP_COUNT_SIZEOF
+		off_ips = off_bm + (n+7)/8
+	)
+	for i := 0; i < n; i++ {
+		if !isIPv4(addrs[i*16 : i*16+16]) {
+			n_v6++
+		}
+	}
+	if n_v6 == n {
+		return nil, false
+	}
+
+	buf := make([]byte, off_ips+4*(n-n_v6)+16*n_v6+8)
+	copy(buf, data[:8])
+	for j := 0; j < IP_COUNT_SIZEOF; j++ {
+		buf[8+j] = byte(uint32(n) >> uint(24-(j*8)))
+	}
+	pos := off_ips
+	for i := 0; i < n; i++ {
+		ip := addrs[i*16 : i*16+16]
+		if isIPv4(ip) {
+			pos += copy(buf[pos:], ip[:4])
+		} else {
+			buf[off_bm+i/8] |= 0x80 >> uint(i%8)
+			pos += copy(buf[pos:], ip)
+		}
+	}
+	copy(buf[pos:], data[len(data)-8:])
+
+	return buf, true
+}
+
+// decodeIPBlock expands a block produced by encodeIPBlock to 16 byte
+// addresses in dst (see decodeBlock)
+func decodeIPBlock(data []byte, dst []byte) ([]byte, error) {
+	off_bm := 8 + IP_COUNT_SIZEOF
+	if len(data) < off_bm+8 {
+		return nil, errCorruptIPBlock
+	}
+	var (
+		n       = int(uint32(data[8])<<24 | uint32(data[9])<<16 | uint32(data[10])<<8 | uint32(data[11]))
+		off_ips = off_bm + (n+7)/8
+		end     = len(data) - 8
+	)
+	// each address takes at least 4 bytes, which bounds n by the data
+	if n < 0 || n > (end-off_bm)/4 || off_ips > end {
+		return nil, errCorruptIPBlock
+	}
+
+	buf := growBuffer(dst, 8+16*n+8)
+	copy(buf, data[:8])
+	pos := off_ips
+	for i := 0; i < n; i++ {
+		addr := buf[8+i*16 : 8+i*16+16]
+		if data[off_bm+i/8]&(0x80>>uint(i%8)) != 0 {
+			if pos+16 > end {
+				return nil, errCorruptIPBlock
+			}
+			copy(addr, data[pos:pos+16])
+			pos += 16
+			continue
+		}
+		if pos+4 > end {
+			return nil, errCorruptIPBlock
+		}
+		// a reused buffer may still hold an IPv6 address here
+		copy(addr, data[pos:pos+4])
+		for j := 4; j < 16; j++ {
+			addr[j] = 0
+		}
+		pos += 4
+	}
+	if pos != end {
+		return nil, errCorruptIPBlock
+	}
+	copy(buf[8+16*n:], data[end:])
+
+	return buf, nil
+}
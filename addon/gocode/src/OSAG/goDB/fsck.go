@@ -0,0 +1,569 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// fsck.go
+//
+// Integrity check and repair of an entire database
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"OSAG/goDB/bigendian"
+)
+
+// suffix of the column files written during a repair
+const fsckTempSuffix = ".fsck"
+
+// BrokenBlock is a block that can't be read from all columns or whose
+// columns don't agree with each other.
+type BrokenBlock struct {
+	Timestamp int64    `json:"timestamp"`
+	Problems  []string `json:"problems"`
+}
+
+// DayCheck is the result of checking a daily directory.
+type DayCheck struct {
+	Iface string `json:"iface"`
+	Day   int64  `json:"day"`
+	// number of blocks found in the directory
+	Blocks int `json:"blocks"`
+	// problems with the column files themselves
+	FileProblems []string      `json:"file_problems,omitempty"`
+	BrokenBlocks []BrokenBlock `json:"broken_blocks,omitempty"`
+	// differences between meta.json and the blocks
+	MetadataProblems []string `json:"metadata_problems,omitempty"`
+	// differences between the block and host indexes and the blocks
+	IndexProblems []string `json:"index_problems,omitempty"`
+	Repaired      bool     `json:"repaired"`
+
+	// totals of the intact blocks
+	flowCount, traffic uint64
+	begin, end         int64
+}
+
+// OK checks whether no problems were found.
+func (d DayCheck) OK() bool {
+	return len(d.FileProblems) == 0 && len(d.BrokenBlocks) == 0 && len(d.MetadataProblems) == 0 && len(d.IndexProblems) == 0
+}
+
+// FsckReport is the result of checking an entire database.
+type FsckReport struct {
+	Days []DayCheck `json:"days"`
+	// differences between summary.json and the blocks
+	SummaryProblems []string `json:"summary_problems,omitempty"`
+	SummaryRepaired bool     `json:"summary_repaired"`
+}
+
+// OK checks whether no problems were found.
+func (r *FsckReport) OK() bool {
+	for _, day := range r.Days {
+		if !day.OK() {
+			return false
+		}
+	}
+	return len(r.SummaryProblems) == 0
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// dayDirs returns the daily directories of the interface directory in
+// chronological order. Directories that weren't created by goProbe (see
+// parseDayDir) are left out.
+func dayDirs(ifaceDir string) ([]int64, error) {
+	entries, err := ioutil.ReadDir(ifaceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		day, ok := parseDayDir(entry.Name())
+		if !ok {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Sort(int64Slice(days))
+	return days, nil
+}
+
+// CheckDB checks every block of every daily directory in the database at
+// dbpath, compares meta.json and summary.json with the blocks and, if repair
+// is set, removes broken blocks and rewrites the metadata and the summary to
+// match the remaining blocks.
+// The database must not be written to during a repair (see LockDB).
+func CheckDB(dbpath string, repair bool) (*FsckReport, error) {
+	entries, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(FsckReport)
+	totals := make(map[string]InterfaceSummary)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		iface := entry.Name()
+		days, err := dayDirs(filepath.Join(dbpath, iface))
+		if err != nil {
+			return report, err
+		}
+
+		for _, day := range days {
+			check, err := CheckDay(filepath.Join(dbpath, iface, strconv.FormatInt(day, 10)), repair)
+			check.Iface, check.Day = iface, day
+			report.Days = append(report.Days, check)
+			if err != nil {
+				return report, fmt.Errorf("Failed to check %s/%d: %s", iface, day, err)
+			}
+			if check.flowCount == 0 && check.traffic == 0 && check.begin == 0 {
+				continue
+			}
+
+			is, exists := totals[iface]
+			if !exists || check.begin < is.Begin {
+				is.Begin = check.begin
+			}
+			if is.End < check.end {
+				is.End = check.end
+			}
+			is.FlowCount += check.flowCount
+			is.Traffic += check.traffic
+			totals[iface] = is
+		}
+	}
+
+	summ, err := ReadDBSummary(dbpath)
+	if os.IsNotExist(err) && len(totals) == 0 {
+		summ = NewDBSummary()
+	} else if err != nil {
+		report.SummaryProblems = append(report.SummaryProblems, fmt.Sprintf("%s is unreadable: %s", SUMMARY_FILE_NAME, err))
+		summ = NewDBSummary()
+	}
+	ifaces := make([]string, 0, len(totals))
+	for iface := range totals {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	for _, iface := range ifaces {
+		is, exists := summ.Interfaces[iface]
+		if !exists {
+			report.SummaryProblems = append(report.SummaryProblems, fmt.Sprintf("%s: missing", iface))
+		} else if is != totals[iface] {
+			report.SummaryProblems = append(report.SummaryProblems, fmt.Sprintf("%s: expected %d flows, %d bytes from %d to %d, found %d flows, %d bytes from %d to %d",
+				iface, totals[iface].FlowCount, totals[iface].Traffic, totals[iface].Begin, totals[iface].End, is.FlowCount, is.Traffic, is.Begin, is.End))
+		}
+	}
+	var gone []string
+	for iface := range summ.Interfaces {
+		if _, exists := totals[iface]; !exists {
+			gone = append(gone, iface)
+		}
+	}
+	sort.Strings(gone)
+	for _, iface := range gone {
+		report.SummaryProblems = append(report.SummaryProblems, fmt.Sprintf("%s: listed, but has no data", iface))
+	}
+
+	if repair && len(report.SummaryProblems) > 0 {
+		err = ModifyDBSummary(dbpath, 10*time.Second, func(*DBSummary) (*DBSummary, error) {
+			summ := NewDBSummary()
+			for iface, is := range totals {
+				summ.Interfaces[iface] = is
+			}
+			return summ, nil
+		})
+		if err != nil {
+			return report, err
+		}
+		report.SummaryRepaired = true
+	}
+
+	return report, nil
+}
+
+// checkBlock reads the block for timestamp from all columns and verifies
+// that the columns agree with each other. Returns the number of flows and
+// the traffic stored in the block along with its summary.
+func checkBlock(files [COLIDX_COUNT]*GPFile, timestamp int64) (problems []string, flowCount, traffic uint64, summary *BlockSummary) {
+	var blocks [COLIDX_COUNT][]byte
+	entries := -1
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		name := columnFileNames[i] + ".gpf"
+		if files[i] == nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable file", name))
+			continue
+		}
+
+		block, err := files[i].ReadTimedBlock(timestamp)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		if len(block) < 16 {
+			problems = append(problems, fmt.Sprintf("%s: block of %d bytes is too short", name, len(block)))
+			continue
+		}
+		if first, last := bigendian.ReadInt64At(block, 0), bigendian.ReadInt64At(block[len(block)-8:], 0); first != timestamp || last != timestamp {
+			problems = append(problems, fmt.Sprintf("%s: block is framed by timestamps %d and %d", name, first, last))
+			continue
+		}
+		if (len(block)-16)%columnSizeofs[i] != 0 {
+			problems = append(problems, fmt.Sprintf("%s: entry size does not evenly divide block size", name))
+			continue
+		}
+
+		n := (len(block) - 16) / columnSizeofs[i]
+		if entries == -1 {
+			entries = n
+		} else if n != entries {
+			problems = append(problems, fmt.Sprintf("%s: expected %d entries, found %d", name, entries, n))
+			continue
+		}
+		blocks[i] = block
+	}
+	if len(problems) > 0 {
+		return problems, 0, 0, nil
+	}
+
+	// skip the timestamp in front of the counters
+	for j := 1; j <= entries; j++ {
+		traffic += bigendian.ReadUint64At(blocks[BYTESRCVD_COLIDX], j)
+		traffic += bigendian.ReadUint64At(blocks[BYTESSENT_COLIDX], j)
+	}
+	return nil, uint64(entries), traffic, newBlockSummary(timestamp, blocks)
+}
+
+// checkSummary compares the summary stored in the index with the one of
+// the intact block. Blocks without a summary are fine, they are always read.
+func checkSummary(index *blockIndex, summary *BlockSummary) string {
+	if _, err := index.file.findBlock(summary.Timestamp); err != nil {
+		return ""
+	}
+	stored, err := index.summary(summary.Timestamp)
+	if err != nil {
+		return fmt.Sprintf("%d: %s", summary.Timestamp, err)
+	}
+	if !bytes.Equal(stored.marshal(), summary.marshal()) {
+		return fmt.Sprintf("%d: summary doesn't match the block", summary.Timestamp)
+	}
+	return ""
+}
+
+// CheckDay checks all blocks of the daily directory dir and compares its
+// meta.json and block index with them. If repair is set and problems are
+// found, broken blocks are removed from the column files and meta.json and
+// the block index are rebuilt. A directory without intact blocks is removed.
+func CheckDay(dir string, repair bool) (DayCheck, error) {
+	var (
+		check DayCheck
+		files [COLIDX_COUNT]*GPFile
+	)
+
+	// collect the timestamps of all columns, also those of blocks that are
+	// only present in some of them
+	seen := make(map[int64]struct{})
+	var timestamps []int64
+	// blocks with header entries that make no sense aren't even read;
+	// their data is checked when the blocks are read
+	invalidEntries := make(map[int64][]string)
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		name := columnFileNames[i] + ".gpf"
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			check.FileProblems = append(check.FileProblems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		gpfile, err := NewGPFile(path)
+		if err != nil {
+			check.FileProblems = append(check.FileProblems, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		defer gpfile.Close()
+		files[i] = gpfile
+
+		used, _ := gpfile.BlocksUsed()
+		valid, err := gpfile.validBlocks(info.Size(), false)
+		if err != nil {
+			return check, err
+		}
+		if valid < used {
+			check.FileProblems = append(check.FileProblems, fmt.Sprintf("%s: only %d of %d header entries are valid", name, valid, used))
+		}
+		end := gpfile.header_size
+		if valid > 0 {
+			end = gpfile.blocks[valid-1]
+		}
+		if valid == used && end < info.Size() {
+			check.FileProblems = append(check.FileProblems, fmt.Sprintf("%s: %d bytes after the last block", name, info.Size()-end))
+		}
+
+		for k := valid; k < used; k++ {
+			if ts := gpfile.timestamps[k]; ts != 0 {
+				invalidEntries[ts] = append(invalidEntries[ts], fmt.Sprintf("%s: invalid header entry", name))
+			}
+		}
+
+		for _, ts := range gpfile.GetTimestamps() {
+			if _, exists := seen[ts]; ts != 0 && !exists {
+				seen[ts] = struct{}{}
+				timestamps = append(timestamps, ts)
+			}
+		}
+	}
+	sort.Sort(int64Slice(timestamps))
+	check.Blocks = len(timestamps)
+
+	// the block index is optional, but its summaries must match the blocks
+	var index *blockIndex
+	indexName := BLOCK_INDEX_NAME + ".gpf"
+	if _, err := os.Stat(filepath.Join(dir, indexName)); err == nil {
+		gpfile, err := NewGPFile(filepath.Join(dir, indexName))
+		if err != nil {
+			check.IndexProblems = append(check.IndexProblems, fmt.Sprintf("%s: %s", indexName, err))
+		} else {
+			index = &blockIndex{gpfile}
+			defer index.Close()
+		}
+	}
+
+	// check the blocks
+	type blockTotals struct {
+		flowCount, traffic uint64
+	}
+	var (
+		intact    []int64
+		summaries []*BlockSummary
+	)
+	intactTotals := make(map[int64]blockTotals)
+	for _, ts := range timestamps {
+		if problems, exists := invalidEntries[ts]; exists {
+			check.BrokenBlocks = append(check.BrokenBlocks, BrokenBlock{ts, problems})
+			continue
+		}
+		problems, flowCount, traffic, summary := checkBlock(files, ts)
+		if len(problems) > 0 {
+			check.BrokenBlocks = append(check.BrokenBlocks, BrokenBlock{ts, problems})
+			continue
+		}
+		intact = append(intact, ts)
+		intactTotals[ts] = blockTotals{flowCount, traffic}
+		summaries = append(summaries, summary)
+		if index != nil {
+			if problem := checkSummary(index, summary); problem != "" {
+				check.IndexProblems = append(check.IndexProblems, fmt.Sprintf("%s: %s", indexName, problem))
+			}
+		}
+
+		check.flowCount += flowCount
+		check.traffic += traffic
+		if check.begin == 0 {
+			check.begin = ts
+		}
+		check.end = ts
+	}
+
+	if index != nil {
+		for _, ts := range index.file.GetTimestamps() {
+			if _, exists := intactTotals[ts]; ts != 0 && !exists {
+				check.IndexProblems = append(check.IndexProblems, fmt.Sprintf("%s: %d: summary without intact block", indexName, ts))
+			}
+		}
+	}
+
+	// the host index is optional as well, but it must list exactly the
+	// addresses of the intact blocks
+	var (
+		hostsPath = filepath.Join(dir, HOST_INDEX_FILE_NAME)
+		hosts     hostSet
+	)
+	if _, err := os.Stat(hostsPath); err == nil {
+		hosts = make(hostSet)
+		if len(intact) > 0 {
+			if hosts, err = readHostSet(dir, intact); err != nil {
+				return check, err
+			}
+		}
+		if stored, err := readHostIndex(hostsPath); err != nil {
+			check.IndexProblems = append(check.IndexProblems, fmt.Sprintf("%s: %s", HOST_INDEX_FILE_NAME, err))
+		} else if !reflect.DeepEqual(stored, hosts) {
+			check.IndexProblems = append(check.IndexProblems, fmt.Sprintf("%s: addresses don't match the blocks", HOST_INDEX_FILE_NAME))
+		}
+	}
+
+	// compare the metadata with the intact blocks
+	metaPath := filepath.Join(dir, METADATA_FILE_NAME)
+	meta, err := ReadMetadata(metaPath)
+	if err != nil {
+		check.MetadataProblems = append(check.MetadataProblems, fmt.Sprintf("%s is unreadable: %s", METADATA_FILE_NAME, err))
+		meta = NewMetadata()
+	}
+	metaBlocks := make(map[int64]BlockMetadata)
+	for _, block := range meta.Blocks {
+		if _, exists := metaBlocks[block.Timestamp]; exists {
+			check.MetadataProblems = append(check.MetadataProblems, fmt.Sprintf("%d: duplicate entry", block.Timestamp))
+			continue
+		}
+		metaBlocks[block.Timestamp] = block
+		if _, exists := intactTotals[block.Timestamp]; !exists {
+			check.MetadataProblems = append(check.MetadataProblems, fmt.Sprintf("%d: entry without intact block", block.Timestamp))
+		}
+	}
+	for _, ts := range intact {
+		block, exists := metaBlocks[ts]
+		if !exists {
+			check.MetadataProblems = append(check.MetadataProblems, fmt.Sprintf("%d: no entry for block", ts))
+			continue
+		}
+		if totals := intactTotals[ts]; block.FlowCount != totals.flowCount || block.Traffic != totals.traffic {
+			check.MetadataProblems = append(check.MetadataProblems, fmt.Sprintf("%d: entry has %d flows and %d bytes, block has %d flows and %d bytes",
+				ts, block.FlowCount, block.Traffic, totals.flowCount, totals.traffic))
+		}
+	}
+
+	if !repair || check.OK() {
+		return check, nil
+	}
+
+	// repair
+	if len(intact) == 0 {
+		for i := range files {
+			if files[i] != nil {
+				files[i].Close()
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return check, err
+		}
+		check.Repaired = true
+		return check, nil
+	}
+
+	if len(check.FileProblems) > 0 || len(check.BrokenBlocks) > 0 {
+		if err := rewriteColumns(dir, files, intact); err != nil {
+			return check, err
+		}
+		// the aggregates are rebuilt from the remaining blocks
+		if err := removeAggregates(dir); err != nil {
+			return check, err
+		}
+	}
+	if len(check.IndexProblems) > 0 || len(check.BrokenBlocks) > 0 {
+		if err := rebuildIndex(dir, summaries); err != nil {
+			return check, err
+		}
+		if hosts != nil {
+			if err := writeHostIndex(hostsPath, DayTimestamp(intact[0]), hosts); err != nil {
+				return check, err
+			}
+		}
+	}
+
+	fixedMeta := NewMetadata()
+	for _, ts := range intact {
+		block, exists := metaBlocks[ts]
+		if !exists {
+			// the pcap statistics are lost
+			block = BlockMetadata{
+				Timestamp:            ts,
+				PcapPacketsReceived:  -1,
+				PcapPacketsDropped:   -1,
+				PcapPacketsIfDropped: -1,
+			}
+		}
+		block.FlowCount = intactTotals[ts].flowCount
+		block.Traffic = intactTotals[ts].traffic
+		fixedMeta.Blocks = append(fixedMeta.Blocks, block)
+	}
+	if err := WriteMetadata(metaPath, fixedMeta); err != nil {
+		return check, err
+	}
+
+	check.Repaired = true
+	return check, nil
+}
+
+// rewriteColumns replaces the column files in dir by files that only hold
+// the given blocks. The blocks are copied without recompressing them. The
+// new files are completely written before any of the old ones is replaced.
+func rewriteColumns(dir string, files [COLIDX_COUNT]*GPFile, timestamps []int64) error {
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		path := filepath.Join(dir, columnFileNames[i]+".gpf"+fsckTempSuffix)
+		os.Remove(path)
+
+		gpfile, err := NewGPFile(path)
+		if err != nil {
+			return err
+		}
+		for _, ts := range timestamps {
+			block, err := files[i].findBlock(ts)
+			if err == nil {
+				err = gpfile.copyBlock(files[i], block)
+			}
+			if err != nil {
+				gpfile.Close()
+				os.Remove(path)
+				return err
+			}
+		}
+		gpfile.Close()
+	}
+
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		path := filepath.Join(dir, columnFileNames[i]+".gpf")
+		if err := os.Rename(path+fsckTempSuffix, path); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// rebuildIndex replaces the block index in dir by one holding the given
+// summaries of the intact blocks.
+func rebuildIndex(dir string, summaries []*BlockSummary) error {
+	path := filepath.Join(dir, BLOCK_INDEX_NAME+".gpf")
+	os.Remove(path + fsckTempSuffix)
+
+	gpfile, err := NewGPFile(path + fsckTempSuffix)
+	if err != nil {
+		return err
+	}
+	for _, summary := range summaries {
+		if err = gpfile.WriteTimedBlock(summary.Timestamp, summary.marshal(), Compression{Codec: CODEC_NONE}, ENCODING_RAW); err != nil {
+			break
+		}
+	}
+	gpfile.Close()
+	if err != nil {
+		os.Remove(path + fsckTempSuffix)
+		return err
+	}
+
+	if err := os.Rename(path+fsckTempSuffix, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
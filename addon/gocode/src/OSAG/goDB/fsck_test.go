@@ -0,0 +1,132 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// fsck_test.go
+//
+// Tests for the integrity check and repair of databases
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// corruptBlock flips a bit in the compressed data of a block
+func corruptBlock(t *testing.T, path string, block int) {
+	gpfile, err := NewGPFile(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	pos, _ := gpfile.blockRange(block)
+	gpfile.Close()
+
+	f, _ := os.OpenFile(path, os.O_RDWR, 0600)
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, pos)
+	b[0] ^= 0x01
+	f.WriteAt(b, pos)
+}
+
+func TestCheckDB(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "fsck_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 4)
+	timestamps := columnTimestamps(t, dir, "sip")
+
+	// a consistent database
+	var summ = NewDBSummary()
+	for i, ts := range timestamps {
+		_, update := dbData("eth0", ts, testFlowMap(i+1))
+		summ.Update(update)
+	}
+	if err := WriteDBSummary(dbpath, summ); err != nil {
+		t.Fatalf("failed to write summary: %s", err)
+	}
+	report, err := CheckDB(dbpath, false)
+	if err != nil || !report.OK() || len(report.Days) != 1 || report.Days[0].Blocks != 4 {
+		t.Fatalf("expected consistent database, got %+v (error: %v)", report, err)
+	}
+
+	// break the second block and mess up the metadata of the third
+	corruptBlock(t, filepath.Join(dir, "dport.gpf"), 1)
+	metaPath := filepath.Join(dir, METADATA_FILE_NAME)
+	meta, _ := ReadMetadata(metaPath)
+	meta.Blocks[2].Traffic++
+	WriteMetadata(metaPath, meta)
+
+	report, err = CheckDB(dbpath, false)
+	if err != nil || report.OK() {
+		t.Fatalf("expected problems, got %+v (error: %v)", report, err)
+	}
+	day := report.Days[0]
+	if len(day.BrokenBlocks) != 1 || day.BrokenBlocks[0].Timestamp != timestamps[1] {
+		t.Fatalf("expected block %d to be broken, got %+v", timestamps[1], day.BrokenBlocks)
+	}
+	// the entry of the broken block and the changed entry
+	if len(day.MetadataProblems) != 2 || day.Repaired {
+		t.Fatalf("unexpected metadata problems %v", day.MetadataProblems)
+	}
+	if len(report.SummaryProblems) != 1 {
+		t.Fatalf("expected summary mismatch, got %v", report.SummaryProblems)
+	}
+
+	// repair
+	if report, err = CheckDB(dbpath, true); err != nil || !report.Days[0].Repaired || !report.SummaryRepaired {
+		t.Fatalf("expected repair, got %+v (error: %v)", report, err)
+	}
+	expected := []int64{timestamps[0], timestamps[2], timestamps[3]}
+	checkConsistent(t, dir, expected)
+
+	if report, err = CheckDB(dbpath, false); err != nil || !report.OK() {
+		t.Fatalf("expected consistent database after repair, got %+v (error: %v)", report, err)
+	}
+
+	// the metadata and summary match the remaining blocks
+	meta, _ = ReadMetadata(metaPath)
+	_, update := dbData("eth0", timestamps[2], testFlowMap(3))
+	if meta.Blocks[1].FlowCount != 3 || meta.Blocks[1].Traffic != update.Traffic || meta.Blocks[1].PacketsLogged != 2 {
+		t.Fatalf("unexpected metadata %+v", meta.Blocks[1])
+	}
+	summ, _ = ReadDBSummary(dbpath)
+	if is := summ.Interfaces["eth0"]; is.FlowCount != 1+3+4 || is.Begin != timestamps[0] || is.End != timestamps[3] {
+		t.Fatalf("unexpected summary %+v", is)
+	}
+}
+
+func TestCheckDBRemovesBrokenDay(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "fsck_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 1)
+	os.Remove(filepath.Join(dir, "pkts_sent.gpf"))
+	summ := NewDBSummary()
+	summ.Update(InterfaceSummaryUpdate{Interface: "eth0", FlowCount: 1, Traffic: 100, Timestamp: time.Unix(recoveryTestDay, 0)})
+	WriteDBSummary(dbpath, summ)
+
+	report, err := CheckDB(dbpath, true)
+	if err != nil || len(report.Days[0].FileProblems) != 1 || len(report.Days[0].BrokenBlocks) != 1 {
+		t.Fatalf("unexpected report %+v (error: %v)", report, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("expected directory without intact blocks to be removed")
+	}
+	if summ, _ = ReadDBSummary(dbpath); len(summ.Interfaces) != 0 {
+		t.Fatalf("expected interface to be removed from summary, got %+v", summ)
+	}
+}
@@ -0,0 +1,529 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// hostindex.go
+//
+// Per-day index of the IP addresses seen on an interface, used to find the
+// days on which a host appeared without reading any blocks
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	HOST_INDEX_FILE_NAME = "hosts.idx"
+
+	HOST_INDEX_VERSION = 1
+	// magic, version, day and number of entries
+	HOST_INDEX_HEADER_SIZE = 24
+	// address, first and last seen, number of blocks, roles and padding
+	HOST_ENTRY_SIZE = 32
+
+	// Roles in which an address appeared
+	HOST_ROLE_SIP = 1
+	HOST_ROLE_DIP = 2
+
+	// number of entries read at once when scanning the index
+	hostScanEntries = 256
+)
+
+var (
+	hostIndexMagic      = []byte("GPH\x00")
+	errCorruptHostIndex = errors.New("Corrupt host index")
+)
+
+// hostEntry describes the occurrences of an address on one day
+type hostEntry struct {
+	ip [16]byte
+	// timestamps of the first and last block containing the address
+	first, last int64
+	blocks      uint32
+	roles       uint8
+}
+
+// put stores the entry in buf. The timestamps are stored relative to the
+// start of the day.
+func (e *hostEntry) put(buf []byte, day int64) {
+	copy(buf, e.ip[:])
+	binary.BigEndian.PutUint32(buf[16:], uint32(e.first-day))
+	binary.BigEndian.PutUint32(buf[20:], uint32(e.last-day))
+	binary.BigEndian.PutUint32(buf[24:], e.blocks)
+	buf[28] = e.roles
+	buf[29], buf[30], buf[31] = 0, 0, 0
+}
+
+func readHostEntry(buf []byte, day int64) hostEntry {
+	var e hostEntry
+	copy(e.ip[:], buf)
+	e.first = day + int64(binary.BigEndian.Uint32(buf[16:]))
+	e.last = day + int64(binary.BigEndian.Uint32(buf[20:]))
+	e.blocks = binary.BigEndian.Uint32(buf[24:])
+	e.roles = buf[28]
+	return e
+}
+
+type hostEntries []*hostEntry
+
+func (h hostEntries) Len() int           { return len(h) }
+func (h hostEntries) Less(i, j int) bool { return bytes.Compare(h[i].ip[:], h[j].ip[:]) < 0 }
+func (h hostEntries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// hostSet collects the addresses of the blocks of a day
+type hostSet map[[16]byte]*hostEntry
+
+// addBlock adds the addresses of the raw sip and dip blocks of the block for
+// timestamp
+func (s hostSet) addBlock(timestamp int64, sipBlock, dipBlock []byte) {
+	roles := make(map[[16]byte]uint8)
+	for _, column := range []struct {
+		block []byte
+		role  uint8
+	}{{sipBlock, HOST_ROLE_SIP}, {dipBlock, HOST_ROLE_DIP}} {
+		var (
+			values = column.block[8 : len(column.block)-8]
+			ip     [16]byte
+		)
+		for i := 0; i+16 <= len(values); i += 16 {
+			copy(ip[:], values[i:i+16])
+			roles[ip] |= column.role
+		}
+	}
+
+	for ip, role := range roles {
+		e, exists := s[ip]
+		if !exists {
+			e = &hostEntry{ip: ip, first: timestamp, last: timestamp}
+			s[ip] = e
+		}
+		if timestamp < e.first {
+			e.first = timestamp
+		}
+		if timestamp > e.last {
+			e.last = timestamp
+		}
+		e.blocks++
+		e.roles |= role
+	}
+}
+
+func (s hostSet) sorted() hostEntries {
+	entries := make(hostEntries, 0, len(s))
+	for _, e := range s {
+		entries = append(entries, e)
+	}
+	sort.Sort(entries)
+	return entries
+}
+
+// writeHostIndex atomically replaces the index at path by one holding the
+// entries of s
+func writeHostIndex(path string, day int64, s hostSet) error {
+	entries := s.sorted()
+
+	buf := make([]byte, HOST_INDEX_HEADER_SIZE+len(entries)*HOST_ENTRY_SIZE)
+	copy(buf, hostIndexMagic)
+	binary.BigEndian.PutUint32(buf[4:], HOST_INDEX_VERSION)
+	binary.BigEndian.PutUint64(buf[8:], uint64(day))
+	binary.BigEndian.PutUint64(buf[16:], uint64(len(entries)))
+	for i, e := range entries {
+		e.put(buf[HOST_INDEX_HEADER_SIZE+i*HOST_ENTRY_SIZE:], day)
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// parseHostIndexHeader returns the day and number of entries of an index
+// of the given size
+func parseHostIndexHeader(header []byte, size int64) (int64, int, error) {
+	if len(header) < HOST_INDEX_HEADER_SIZE || !bytes.Equal(header[:4], hostIndexMagic) {
+		return 0, 0, errCorruptHostIndex
+	}
+	if version := binary.BigEndian.Uint32(header[4:]); version != HOST_INDEX_VERSION {
+		return 0, 0, fmt.Errorf("Unsupported host index version %d", version)
+	}
+	day := int64(binary.BigEndian.Uint64(header[8:]))
+	count := binary.BigEndian.Uint64(header[16:])
+	if uint64(size-HOST_INDEX_HEADER_SIZE) != count*HOST_ENTRY_SIZE {
+		return 0, 0, errCorruptHostIndex
+	}
+	return day, int(count), nil
+}
+
+// readHostIndex reads all entries of the index at path
+func readHostIndex(path string) (hostSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	day, count, err := parseHostIndexHeader(data, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := make(hostSet, count)
+	for i := 0; i < count; i++ {
+		e := readHostEntry(data[HOST_INDEX_HEADER_SIZE+i*HOST_ENTRY_SIZE:], day)
+		s[e.ip] = &e
+	}
+	return s, nil
+}
+
+// readHostSet collects the addresses of the given blocks from the column
+// files of dir
+func readHostSet(dir string, timestamps []int64) (hostSet, error) {
+	var files [2]*GPFile
+	for i, column := range []columnIndex{SIP_COLIDX, DIP_COLIDX} {
+		gpfile, err := NewGPFile(filepath.Join(dir, columnFileNames[column]+".gpf"))
+		if err != nil {
+			return nil, err
+		}
+		defer gpfile.Close()
+		files[i] = gpfile
+	}
+
+	s := make(hostSet)
+	for _, ts := range timestamps {
+		var blocks [2][]byte
+		for i, gpfile := range files {
+			block, err := gpfile.ReadTimedBlock(ts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: block %d: %s", filepath.Base(gpfile.filename), ts, err)
+			}
+			if len(block) < 16 || (len(block)-16)%16 != 0 {
+				return nil, fmt.Errorf("%s: block %d: incorrect length", filepath.Base(gpfile.filename), ts)
+			}
+			blocks[i] = block
+		}
+		s.addBlock(ts, blocks[0], blocks[1])
+	}
+	return s, nil
+}
+
+// BuildHostIndex (re)builds the host index of the daily directory dir from
+// the blocks listed in its meta.json
+func BuildHostIndex(dir string) error {
+	day, ok := parseDayDir(filepath.Base(dir))
+	if !ok {
+		return fmt.Errorf("Not a daily directory: %s", dir)
+	}
+	meta, err := ReadMetadata(filepath.Join(dir, METADATA_FILE_NAME))
+	if err != nil {
+		return err
+	}
+	var timestamps []int64
+	for _, block := range meta.Blocks {
+		timestamps = append(timestamps, block.Timestamp)
+	}
+
+	s, err := readHostSet(dir, timestamps)
+	if err != nil {
+		return err
+	}
+	return writeHostIndex(filepath.Join(dir, HOST_INDEX_FILE_NAME), day, s)
+}
+
+// BuildHostIndexes builds the host indexes of all daily directories of the
+// database at dbpath that don't have one yet, e.g. because they were written
+// by an older version of goProbe. The database must not be written to while
+// BuildHostIndexes is running. Returns the number of indexes built.
+func BuildHostIndexes(dbpath string) (int, error) {
+	ifaces, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		built int
+		errs  []string
+	)
+	for _, iface := range ifaces {
+		if !iface.IsDir() {
+			continue
+		}
+		days, err := ioutil.ReadDir(filepath.Join(dbpath, iface.Name()))
+		if err != nil {
+			return built, err
+		}
+		for _, day := range days {
+			if _, ok := parseDayDir(day.Name()); !ok || !day.IsDir() {
+				continue
+			}
+			dir := filepath.Join(dbpath, iface.Name(), day.Name())
+			if _, err := os.Stat(filepath.Join(dir, HOST_INDEX_FILE_NAME)); err == nil {
+				continue
+			}
+			if err := BuildHostIndex(dir); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", dir, err))
+				continue
+			}
+			built++
+		}
+	}
+
+	if len(errs) > 0 {
+		return built, fmt.Errorf("Failed to build host index %s", strings.Join(errs, "; "))
+	}
+	return built, nil
+}
+
+// hostIndex gives access to the host index of a daily directory. Entries
+// are read on demand, so that a lookup only reads a few of them.
+type hostIndex struct {
+	file  *os.File
+	day   int64
+	count int
+	// first read error. An index that can't be read may contain any host.
+	err error
+}
+
+// openHostIndex opens the host index of the daily directory dir. Returns an
+// error satisfying os.IsNotExist if the directory has no index.
+func openHostIndex(dir string) (*hostIndex, error) {
+	f, err := os.Open(filepath.Join(dir, HOST_INDEX_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, HOST_INDEX_HEADER_SIZE)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, errCorruptHostIndex
+	}
+	day, count, err := parseHostIndexHeader(header, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &hostIndex{file: f, day: day, count: count}, nil
+}
+
+func (h *hostIndex) Close() error {
+	return h.file.Close()
+}
+
+// entries reads up to n entries starting at entry i
+func (h *hostIndex) entries(i, n int) []hostEntry {
+	if i+n > h.count {
+		n = h.count - i
+	}
+	if n <= 0 || h.err != nil {
+		return nil
+	}
+	buf := make([]byte, n*HOST_ENTRY_SIZE)
+	if _, err := h.file.ReadAt(buf, HOST_INDEX_HEADER_SIZE+int64(i)*HOST_ENTRY_SIZE); err != nil {
+		h.err = err
+		return nil
+	}
+	entries := make([]hostEntry, n)
+	for k := range entries {
+		entries[k] = readHostEntry(buf[k*HOST_ENTRY_SIZE:], h.day)
+	}
+	return entries
+}
+
+// matchesNetwork checks whether the first netmask bits of ip and network
+// are the same
+func matchesNetwork(ip, network []byte, netmask int) bool {
+	n := netmask / 8
+	if !bytes.Equal(ip[:n], network[:n]) {
+		return false
+	}
+	if netmask%8 == 0 {
+		return true
+	}
+	mask := byte(0xff) << uint(8-netmask%8)
+	return ip[n]&mask == network[n]&mask
+}
+
+// search returns the position of the first entry whose address isn't
+// smaller than network, i.e. the first entry that can be in the network
+func (h *hostIndex) search(network []byte) int {
+	return sort.Search(h.count, func(i int) bool {
+		entries := h.entries(i, 1)
+		// stop the search on read errors
+		return len(entries) == 0 || bytes.Compare(entries[0].ip[:], network) >= 0
+	})
+}
+
+// lookup returns the entries of all addresses in network
+func (h *hostIndex) lookup(network []byte, netmask int) ([]hostEntry, error) {
+	var result []hostEntry
+	for i := h.search(network); i < h.count; i += hostScanEntries {
+		entries := h.entries(i, hostScanEntries)
+		for _, e := range entries {
+			if !matchesNetwork(e.ip[:], network, netmask) {
+				return result, h.err
+			}
+			result = append(result, e)
+		}
+		if len(entries) == 0 {
+			break
+		}
+	}
+	return result, h.err
+}
+
+// The host index implements flowSummary for a day. It only knows about
+// addresses, so ports and protocols aren't restricted.
+
+func (h *hostIndex) mayContainIP(column columnIndex, ip []byte) bool {
+	return h.mayContainNet(column, ip, 128)
+}
+
+// mayContainNet only checks the role of exact addresses; a network is
+// assumed to contain the address in any role if it contains it at all.
+func (h *hostIndex) mayContainNet(column columnIndex, network []byte, netmask int) bool {
+	entries := h.entries(h.search(network), 1)
+	if h.err != nil {
+		return true
+	}
+	if len(entries) == 0 || !matchesNetwork(entries[0].ip[:], network, netmask) {
+		return false
+	}
+	if netmask < 128 {
+		return true
+	}
+	role := uint8(HOST_ROLE_SIP)
+	if column == DIP_COLIDX {
+		role = HOST_ROLE_DIP
+	}
+	return entries[0].roles&role != 0
+}
+
+func (h *hostIndex) dportRange() (min, max []byte) {
+	return []byte{0, 0}, []byte{0xff, 0xff}
+}
+
+func (h *hostIndex) protoRange() (min, max byte) {
+	return 0, 0xff
+}
+
+// HostSighting describes the occurrences of an address on an interface on
+// one day
+type HostSighting struct {
+	Iface string `json:"iface"`
+	Day   int64  `json:"day"`
+	IP    string `json:"ip"`
+	// timestamps of the first and last block containing the address
+	FirstSeen int64 `json:"first_seen"`
+	LastSeen  int64 `json:"last_seen"`
+	// number of blocks containing the address
+	Blocks      int  `json:"blocks"`
+	Source      bool `json:"source"`
+	Destination bool `json:"destination"`
+}
+
+// HostLookup is the result of LookupHost
+type HostLookup struct {
+	Sightings []HostSighting `json:"sightings"`
+	// number of daily directories searched
+	Days int `json:"days"`
+	// daily directories without a (readable) host index. They weren't
+	// searched.
+	Unindexed []string `json:"unindexed,omitempty"`
+}
+
+// ParseHost parses an IP address or a network in CIDR notation into the
+// address (in its database representation) and the netmask
+func ParseHost(host string) ([]byte, int, error) {
+	if strings.Contains(host, "/") {
+		return conditionBytesAndNetmask(newConditionNode("snet", "=", host))
+	}
+	ip, err := IPStringToBytes(host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not parse IP address: %s", host)
+	}
+	return ip, 128, nil
+}
+
+// LookupHost finds the days on which the address or network host was seen on
+// the given interfaces between tfirst and tlast using the host indexes.
+func LookupHost(dbpath string, ifaces []string, host string, tfirst, tlast int64) (*HostLookup, error) {
+	network, netmask, err := ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &HostLookup{}
+	for _, iface := range ifaces {
+		days, err := ioutil.ReadDir(filepath.Join(dbpath, iface))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range days {
+			day, ok := parseDayDir(d.Name())
+			if !ok || !d.IsDir() || !(tfirst < day+EPOCH_DAY && day < tlast+DB_WRITE_INTERVAL) {
+				continue
+			}
+			dir := filepath.Join(dbpath, iface, d.Name())
+
+			index, err := openHostIndex(dir)
+			if err != nil {
+				result.Unindexed = append(result.Unindexed, dir)
+				continue
+			}
+			entries, err := index.lookup(network, netmask)
+			index.Close()
+			if err != nil {
+				result.Unindexed = append(result.Unindexed, dir)
+				continue
+			}
+			result.Days++
+
+			for _, e := range entries {
+				// same bounds as the blocks read by queries
+				if e.last <= tfirst || tlast+DB_WRITE_INTERVAL <= e.first {
+					continue
+				}
+				result.Sightings = append(result.Sightings, HostSighting{
+					Iface:       iface,
+					Day:         day,
+					IP:          rawIpToString(e.ip[:]),
+					FirstSeen:   e.first,
+					LastSeen:    e.last,
+					Blocks:      int(e.blocks),
+					Source:      e.roles&HOST_ROLE_SIP != 0,
+					Destination: e.roles&HOST_ROLE_DIP != 0,
+				})
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,227 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// hostindex_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFlowMap(n) holds flows from 10.0.0.0 to 10.0.0.n-1 to 10.0.1.1, so
+// the blocks written by writeTestDay(t, dbpath, 3) contain 10.0.0.1 twice.
+var lookupHostTests = []struct {
+	host      string
+	sightings []HostSighting
+}{
+	{"10.0.0.1", []HostSighting{
+		{"eth0", recoveryTestDay, "10.0.0.1", recoveryTestDay + 2*DB_WRITE_INTERVAL, recoveryTestDay + 3*DB_WRITE_INTERVAL, 2, true, false},
+	}},
+	{"10.0.1.1", []HostSighting{
+		{"eth0", recoveryTestDay, "10.0.1.1", recoveryTestDay + DB_WRITE_INTERVAL, recoveryTestDay + 3*DB_WRITE_INTERVAL, 3, false, true},
+	}},
+	{"10.0.0.0/31", []HostSighting{
+		{"eth0", recoveryTestDay, "10.0.0.0", recoveryTestDay + DB_WRITE_INTERVAL, recoveryTestDay + 3*DB_WRITE_INTERVAL, 3, true, false},
+		{"eth0", recoveryTestDay, "10.0.0.1", recoveryTestDay + 2*DB_WRITE_INTERVAL, recoveryTestDay + 3*DB_WRITE_INTERVAL, 2, true, false},
+	}},
+	{"10.0.0.9", nil},
+	{"2a00::/16", nil},
+}
+
+func TestLookupHost(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "hostindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+	writeTestDay(t, dbpath, 3)
+
+	for _, test := range lookupHostTests {
+		result, err := LookupHost(dbpath, []string{"eth0"}, test.host, 0, recoveryTestDay+EPOCH_DAY)
+		if err != nil {
+			t.Fatalf("%s: lookup failed: %s", test.host, err)
+		}
+		if result.Days != 1 || len(result.Unindexed) != 0 || !reflect.DeepEqual(result.Sightings, test.sightings) {
+			t.Fatalf("%s: unexpected result %+v", test.host, result)
+		}
+	}
+
+	// the time span restricts the blocks
+	result, err := LookupHost(dbpath, []string{"eth0"}, "10.0.0.1", 0, recoveryTestDay+DB_WRITE_INTERVAL)
+	if err != nil || len(result.Sightings) != 0 {
+		t.Fatalf("expected no sightings, got %+v (error: %v)", result, err)
+	}
+
+	if _, err := LookupHost(dbpath, []string{"eth0"}, "10.0.0.300", 0, recoveryTestDay+EPOCH_DAY); err == nil {
+		t.Fatalf("expected invalid address to be rejected")
+	}
+}
+
+func TestBuildHostIndexes(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "hostindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// a day started by an older version of goProbe doesn't get an index
+	dir := writeTestDay(t, dbpath, 1)
+	hostsPath := filepath.Join(dir, HOST_INDEX_FILE_NAME)
+	os.Remove(hostsPath)
+	w := NewDBWriter(dbpath, "eth0", Compression{})
+	ts := recoveryTestDay + 2*DB_WRITE_INTERVAL
+	if _, err := w.Write(testFlowMap(2), BlockMetadata{Timestamp: ts}, ts); err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
+	if _, err := os.Stat(hostsPath); !os.IsNotExist(err) {
+		t.Fatalf("expected day without host index, got %v", err)
+	}
+	result, err := LookupHost(dbpath, []string{"eth0"}, "10.0.0.1", 0, recoveryTestDay+EPOCH_DAY)
+	if err != nil || result.Days != 0 || !reflect.DeepEqual(result.Unindexed, []string{dir}) {
+		t.Fatalf("expected unindexed day, got %+v (error: %v)", result, err)
+	}
+
+	// directories that merely parse as a number weren't created by goProbe
+	os.Mkdir(filepath.Join(dbpath, "eth0", "0123"), 0755)
+
+	if built, err := BuildHostIndexes(dbpath); err != nil || built != 1 {
+		t.Fatalf("expected one index to be built, got %d (error: %v)", built, err)
+	}
+	if built, err := BuildHostIndexes(dbpath); err != nil || built != 0 {
+		t.Fatalf("expected existing index to be kept, got %d (error: %v)", built, err)
+	}
+	result, err = LookupHost(dbpath, []string{"eth0"}, "10.0.0.1", 0, recoveryTestDay+EPOCH_DAY)
+	if err != nil || result.Days != 1 || len(result.Sightings) != 1 || result.Sightings[0].Blocks != 1 {
+		t.Fatalf("expected sighting, got %+v (error: %v)", result, err)
+	}
+}
+
+func TestRecoverHostIndex(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "hostindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 3)
+	timestamps := columnTimestamps(t, dir, "sip")
+	hostsPath := filepath.Join(dir, HOST_INDEX_FILE_NAME)
+
+	// the writeout of the last block was interrupted before meta.json
+	metaPath := filepath.Join(dir, METADATA_FILE_NAME)
+	meta, _ := ReadMetadata(metaPath)
+	meta.Blocks = meta.Blocks[:2]
+	WriteMetadata(metaPath, meta)
+
+	report, err := RecoverDay(dir)
+	if err != nil || !report.HostIndexRebuilt {
+		t.Fatalf("expected host index to be rebuilt: %s (error: %v)", report.String(), err)
+	}
+	expected, _ := readHostSet(dir, timestamps[:2])
+	if hosts, err := readHostIndex(hostsPath); err != nil || !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("unexpected host index (error: %v)", err)
+	}
+
+	// a broken index is rebuilt by fsck
+	writeHostIndex(hostsPath, recoveryTestDay, make(hostSet))
+	check, err := CheckDay(dir, false)
+	if err != nil || len(check.IndexProblems) != 1 {
+		t.Fatalf("expected host index problem, got %+v (error: %v)", check, err)
+	}
+	if check, err = CheckDay(dir, true); err != nil || !check.Repaired {
+		t.Fatalf("expected repair, got %+v (error: %v)", check, err)
+	}
+	if hosts, err := readHostIndex(hostsPath); err != nil || !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("unexpected host index after repair (error: %v)", err)
+	}
+}
+
+func TestHostIndexMayMatch(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "hostindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	index, err := openHostIndex(writeTestDay(t, dbpath, 3))
+	if err != nil {
+		t.Fatalf("failed to open host index: %s", err)
+	}
+	defer index.Close()
+
+	for _, test := range []struct {
+		conditional string
+		mayMatch    bool
+	}{
+		{"sip = 10.0.0.2", true},
+		{"sip = 10.0.0.3", false},
+		{"dip = 10.0.0.2", false},
+		{"host = 10.0.1.1", true},
+		{"snet = 10.0.0.0/24", true},
+		{"dnet = 10.0.0.0/24", true},
+		{"net = 10.0.2.0/24", false},
+		{"snet = 10.0.2.0/23", false},
+		{"sip = 10.0.0.3 | dport = 443", true},
+		{"sip = 10.0.0.3 & dport = 80", false},
+		{"sip != 10.0.0.3", true},
+	} {
+		conditional, err := ParseAndInstrumentConditional(test.conditional, time.Second)
+		if err != nil {
+			t.Fatalf("%s: failed to parse: %s", test.conditional, err)
+		}
+		if mayMatch := conditional.mayMatch(index); mayMatch != test.mayMatch {
+			t.Fatalf("%s: expected %v, got %v", test.conditional, test.mayMatch, mayMatch)
+		}
+	}
+}
+
+// days without the host of the conditional aren't read
+func TestQueryHostIndex(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "hostindex_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// 10.0.0.x on the first day, 10.0.2.x on the second
+	w := NewDBWriter(dbpath, "eth0", Compression{})
+	for day, net := range []byte{0, 2} {
+		for i := 0; i < 4; i++ {
+			ts := 1450656000 + int64(day-1)*EPOCH_DAY + int64(i+1)*DB_WRITE_INTERVAL
+			flowmap := make(AggFlowMap)
+			for k, v := range testFlowMap(i + 1) {
+				k.Sip[2] = net
+				flowmap[k] = v
+			}
+			if _, err := w.Write(flowmap, BlockMetadata{Timestamp: ts}, ts); err != nil {
+				t.Fatalf("failed to write block: %s", err)
+			}
+		}
+	}
+
+	// the first day is left out, and the summary of the first block of the
+	// second day shows that it only contains 10.0.2.0
+	indexed, stats := runQuery(t, dbpath, "sip,dip", "sip = 10.0.2.1")
+	if len(indexed) != 1 || stats.Total != 8 || stats.Skipped != 4+1 {
+		t.Fatalf("expected the first day to be skipped, got %d results and %+v", len(indexed), stats)
+	}
+
+	for _, day := range []string{"1450569600", "1450656000"} {
+		os.Remove(filepath.Join(dbpath, "eth0", day, HOST_INDEX_FILE_NAME))
+		os.Remove(filepath.Join(dbpath, "eth0", day, BLOCK_INDEX_NAME+".gpf"))
+	}
+	plain, stats := runQuery(t, dbpath, "sip,dip", "sip = 10.0.2.1")
+	if stats.Skipped != 0 || !reflect.DeepEqual(indexed, plain) {
+		t.Fatalf("results differ without index (%+v)", stats)
+	}
+}
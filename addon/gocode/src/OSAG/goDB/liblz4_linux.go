@@ -1,6 +0,0 @@
-package goDB
-
-/*
-#cgo LDFLAGS: ${SRCDIR}/lz4/liblz4_linux.a
-*/
-import "C"
@@ -0,0 +1,312 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// lz4.go
+//
+// Pure go implementation of the LZ4 block format
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+// Package lz4 compresses and decompresses data in the LZ4 block format
+// (https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md). Its output
+// can be decompressed by the reference implementation and vice versa.
+//
+// Unlike LZ4_decompress_fast, Uncompress never reads or writes outside of
+// the buffers it is given, so it is safe to use on corrupted input.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	// Level 1 searches a single candidate per position. Each further level
+	// doubles the number of candidates searched, like the levels of LZ4HC.
+	MIN_LEVEL = 1
+	MAX_LEVEL = 16
+
+	minMatch = 4
+	// the last match must start at least mfLimit bytes before the end
+	mfLimit = 12
+	// the last lastLiterals bytes are always literals
+	lastLiterals = 5
+	maxOffset    = 65535
+
+	hashLog = 16
+)
+
+// ErrCorrupt is returned by Uncompress if the input is not a valid block
+// or doesn't decompress into the destination buffer.
+var ErrCorrupt = errors.New("Corrupt LZ4 block")
+
+// CompressBound returns the maximum size of the compressed data of n bytes.
+func CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+func hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - hashLog)
+}
+
+// matchLength returns the number of leading bytes a and b have in common
+func matchLength(a, b []byte) int {
+	var n int
+	for len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)>>3
+		}
+		n += 8
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func appendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// appendSequence appends the literals followed by a match of length
+// matchLen at offset. A matchLen of 0 marks the last sequence, which
+// consists of literals only.
+func appendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	pos := len(dst)
+	dst = append(dst, 0)
+
+	var token byte
+	if len(literals) >= 15 {
+		token = 15 << 4
+		dst = appendLength(dst, len(literals)-15)
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	dst = append(dst, literals...)
+
+	if matchLen > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		if ml := matchLen - minMatch; ml >= 15 {
+			token |= 15
+			dst = appendLength(dst, ml-15)
+		} else {
+			token |= byte(ml)
+		}
+	}
+	dst[pos] = token
+	return dst
+}
+
+// Compress compresses src at the given level and returns the compressed
+// data. Levels below MIN_LEVEL or above MAX_LEVEL are clamped.
+func Compress(src []byte, level int) []byte {
+	if level < MIN_LEVEL {
+		level = MIN_LEVEL
+	} else if level > MAX_LEVEL {
+		level = MAX_LEVEL
+	}
+	attempts := 1 << uint(level-1)
+
+	dst := make([]byte, 0, CompressBound(len(src)))
+	if len(src) <= mfLimit {
+		return appendSequence(dst, src, 0, 0)
+	}
+
+	var (
+		// position+1 of the last occurrence of each hash
+		head = make([]int32, 1<<hashLog)
+		// distance to the previous position with the same hash. Only
+		// needed if more than one candidate is searched.
+		chain []uint16
+
+		limit      = len(src) - mfLimit
+		matchLimit = len(src) - lastLiterals
+		anchor     int
+		inserted   int
+	)
+	if attempts > 1 {
+		chain = make([]uint16, maxOffset+1)
+	}
+
+	insert := func(pos int) {
+		h := hash(binary.LittleEndian.Uint32(src[pos:]))
+		if chain != nil {
+			var delta int
+			if prev := int(head[h]) - 1; prev >= 0 && pos-prev <= maxOffset {
+				delta = pos - prev
+			}
+			chain[pos&maxOffset] = uint16(delta)
+		}
+		head[h] = int32(pos + 1)
+	}
+
+	// find returns the longest match for the position i
+	find := func(i int) (int, int) {
+		var (
+			cur       = binary.LittleEndian.Uint32(src[i:])
+			cand      = int(head[hash(cur)]) - 1
+			bestLen   int
+			bestMatch int
+		)
+		for n := 0; n < attempts && cand >= 0 && i-cand <= maxOffset; n++ {
+			if binary.LittleEndian.Uint32(src[cand:]) == cur {
+				if l := minMatch + matchLength(src[cand+minMatch:], src[i+minMatch:matchLimit]); l > bestLen {
+					bestLen, bestMatch = l, cand
+				}
+			}
+			if chain == nil {
+				break
+			}
+			delta := int(chain[cand&maxOffset])
+			if delta == 0 {
+				break
+			}
+			cand -= delta
+		}
+		return bestLen, bestMatch
+	}
+
+	for i := 0; i < limit; {
+		// In the chained mode, all positions before i are in the hash chains
+		if chain != nil {
+			for ; inserted < i; inserted++ {
+				insert(inserted)
+			}
+		}
+
+		bestLen, bestMatch := find(i)
+		if bestLen == 0 {
+			if chain == nil {
+				insert(i)
+				// skip faster over incompressible data
+				i += 1 + (i-anchor)>>6
+			} else {
+				i++
+			}
+			continue
+		}
+
+		if chain == nil {
+			insert(i)
+		} else {
+			// lazy matching: prefer a longer match starting at the next position
+			for i+1 < limit {
+				insert(i)
+				inserted = i + 1
+				l, m := find(i + 1)
+				if l <= bestLen {
+					break
+				}
+				i, bestLen, bestMatch = i+1, l, m
+			}
+		}
+
+		// extend the match backwards into the pending literals
+		start := i
+		for start > anchor && bestMatch > 0 && src[start-1] == src[bestMatch-1] {
+			start--
+			bestMatch--
+			bestLen++
+		}
+
+		dst = appendSequence(dst, src[anchor:start], start-bestMatch, bestLen)
+		i = start + bestLen
+		anchor = i
+	}
+
+	return appendSequence(dst, src[anchor:], 0, 0)
+}
+
+// readLength reads the additional bytes of a literal or match length
+// starting at src[pos] and returns the new position.
+func readLength(src []byte, pos int, n int) (int, int, error) {
+	for {
+		if pos >= len(src) {
+			return 0, 0, ErrCorrupt
+		}
+		b := src[pos]
+		pos++
+		n += int(b)
+		// no valid length exceeds the size of the input
+		if n > len(src)*255 {
+			return 0, 0, ErrCorrupt
+		}
+		if b != 255 {
+			return pos, n, nil
+		}
+	}
+}
+
+// Uncompress decompresses the block src into dst and returns the number of
+// bytes written. It fails with ErrCorrupt if src is malformed or if the
+// decompressed data doesn't fit into dst.
+func Uncompress(src, dst []byte) (int, error) {
+	var (
+		si, di int
+		err    error
+	)
+	for {
+		if si >= len(src) {
+			return 0, ErrCorrupt
+		}
+		token := src[si]
+		si++
+
+		// literals
+		lit := int(token >> 4)
+		if lit == 15 {
+			if si, lit, err = readLength(src, si, lit); err != nil {
+				return 0, err
+			}
+		}
+		if lit > len(src)-si || lit > len(dst)-di {
+			return 0, ErrCorrupt
+		}
+		copy(dst[di:], src[si:si+lit])
+		si += lit
+		di += lit
+
+		// the last sequence ends after its literals
+		if si == len(src) {
+			return di, nil
+		}
+
+		// match
+		if len(src)-si < 2 {
+			return 0, ErrCorrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > di {
+			return 0, ErrCorrupt
+		}
+
+		ml := int(token & 15)
+		if ml == 15 {
+			if si, ml, err = readLength(src, si, ml); err != nil {
+				return 0, err
+			}
+		}
+		ml += minMatch
+		if ml > len(dst)-di {
+			return 0, ErrCorrupt
+		}
+
+		m := di - offset
+		if offset >= ml {
+			copy(dst[di:di+ml], dst[m:m+ml])
+		} else {
+			// the match overlaps the data it produces
+			for k := 0; k < ml; k++ {
+				dst[di+k] = dst[m+k]
+			}
+		}
+		di += ml
+	}
+}
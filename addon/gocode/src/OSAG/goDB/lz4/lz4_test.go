@@ -0,0 +1,110 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// lz4_test.go
+//
+// Tests for the LZ4 block compression
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package lz4
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// testInput resembles the data of an attribute column. It must not be
+// changed since testdata/legacy_5000.lz4 contains its compressed form.
+func testInput(n int) []byte {
+	data := make([]byte, 0, n*16)
+	for i := 0; i < n; i++ {
+		data = append(data, 10, byte(i>>16), byte(i>>8), byte(i%7), 0, 0, 0, 0, 0, 0, 0, 0, byte(i*31), byte(i*17), 0, 80)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"empty":   {},
+		"short":   []byte("goProbe"),
+		"zeros":   make([]byte, 70000),
+		"column":  testInput(5000),
+		"random":  random,
+		"mixed":   append(testInput(100), random[:1000]...),
+		"pattern": bytes.Repeat([]byte("abcdefghijklmnopq"), 5000),
+	}
+
+	for name, input := range inputs {
+		for _, level := range []int{MIN_LEVEL, 4, 9, MAX_LEVEL} {
+			comp := Compress(input, level)
+			if len(comp) > CompressBound(len(input)) {
+				t.Fatalf("%s, level %d: compressed size %d exceeds bound", name, level, len(comp))
+			}
+			out := make([]byte, len(input))
+			n, err := Uncompress(comp, out)
+			if err != nil || n != len(input) || !bytes.Equal(out, input) {
+				t.Fatalf("%s, level %d: round trip failed (n=%d, error: %v)", name, level, n, err)
+			}
+		}
+	}
+}
+
+func TestLegacyData(t *testing.T) {
+	// compressed by the C implementation previously used by goDB
+	comp, err := ioutil.ReadFile("testdata/legacy_5000.lz4")
+	if err != nil {
+		t.Fatalf("failed to read test data: %s", err)
+	}
+	expected := testInput(5000)
+	out := make([]byte, len(expected))
+	if n, err := Uncompress(comp, out); err != nil || n != len(expected) || !bytes.Equal(out, expected) {
+		t.Fatalf("failed to decompress legacy data (n=%d, error: %v)", n, err)
+	}
+
+	// higher levels must not compress worse than the fast mode
+	if fast, hc := Compress(expected, MIN_LEVEL), Compress(expected, MAX_LEVEL); len(hc) > len(fast) {
+		t.Fatalf("level %d: %d bytes, level %d: %d bytes", MAX_LEVEL, len(hc), MIN_LEVEL, len(fast))
+	}
+}
+
+func TestCorruptInput(t *testing.T) {
+	input := testInput(1000)
+	comp := Compress(input, 9)
+
+	// too small destination
+	if _, err := Uncompress(comp, make([]byte, len(input)-1)); err != ErrCorrupt {
+		t.Fatalf("expected error for short destination, got %v", err)
+	}
+
+	// truncated input
+	out := make([]byte, len(input))
+	for _, n := range []int{0, 1, len(comp) / 2, len(comp) - 1} {
+		if k, err := Uncompress(comp[:n], out); err == nil && k == len(input) {
+			t.Fatalf("truncation to %d bytes went unnoticed", n)
+		}
+	}
+
+	// random corruption must never read or write out of bounds
+	rnd := rand.New(rand.NewSource(1))
+	corrupt := make([]byte, len(comp))
+	for i := 0; i < 10000; i++ {
+		copy(corrupt, comp)
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			corrupt[rnd.Intn(len(corrupt))] = byte(rnd.Intn(256))
+		}
+		Uncompress(corrupt, out)
+	}
+	for i := 0; i < 1000; i++ {
+		garbage := make([]byte, rnd.Intn(100))
+		rnd.Read(garbage)
+		Uncompress(garbage, out)
+	}
+}
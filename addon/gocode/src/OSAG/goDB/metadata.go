@@ -13,6 +13,7 @@ package goDB
 import (
     "encoding/json"
     "os"
+    "path/filepath"
 )
 
 // Represents metadata for one database block.
@@ -26,6 +27,19 @@ type BlockMetadata struct {
     // As in Summary
     FlowCount uint64 `json:"flowcount"`
     Traffic   uint64 `json:"traffic"`
+
+    // Number of seconds covered by the block, which ends at Timestamp.
+    // Only set for blocks combining several writeouts (see rollup.go);
+    // all others cover DB_WRITE_INTERVAL seconds.
+    Duration int64 `json:"duration,omitempty"`
+}
+
+// BlockDuration returns the number of seconds covered by the block.
+func (b BlockMetadata) BlockDuration() int64 {
+    if b.Duration == 0 {
+        return DB_WRITE_INTERVAL
+    }
+    return b.Duration
 }
 
 // Metadata for a collection of database blocks.
@@ -65,12 +79,39 @@ func TryReadMetadata(path string) *Metadata {
     return meta
 }
 
+// readBlockDurations returns the durations of the blocks of the daily
+// directory dir that don't cover DB_WRITE_INTERVAL seconds.
+func readBlockDurations(dir string) map[int64]int64 {
+    durations := make(map[int64]int64)
+    for _, block := range TryReadMetadata(filepath.Join(dir, METADATA_FILE_NAME)).Blocks {
+        if block.Duration != 0 {
+            durations[block.Timestamp] = block.Duration
+        }
+    }
+    return durations
+}
+
+// Writes the given metadata file. The file is replaced atomically, so
+// a crash while writing leaves the previous version in place.
 func WriteMetadata(path string, meta *Metadata) error {
-    f, err := os.Create(path)
+    tmpPath := path + ".tmp"
+
+    f, err := os.Create(tmpPath)
     if err != nil {
         return err
     }
-    defer f.Close()
 
-    return json.NewEncoder(f).Encode(meta)
+    err = json.NewEncoder(f).Encode(meta)
+    if err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+
+    return os.Rename(tmpPath, path)
 }
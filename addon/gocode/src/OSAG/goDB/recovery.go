@@ -0,0 +1,461 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// recovery.go
+//
+// Repair of daily directories left inconsistent by an interrupted writeout
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RecoveryReport describes the repairs made to a daily directory.
+type RecoveryReport struct {
+	Dir string
+	// number of blocks removed per column file (and from the block index)
+	DroppedBlocks map[string]int
+	// number of bytes cut off the column files (and the block index) that
+	// didn't belong to any block
+	TruncatedBytes int64
+	// files that were removed because they were incomplete
+	RemovedFiles []string
+	// number of meta.json entries removed because their blocks are gone
+	MetadataDropped int
+	// number of meta.json entries reconstructed for blocks that had none
+	MetadataAdded int
+	// meta.json could not be parsed and was rebuilt from the column files
+	MetadataRebuilt bool
+	// the host index was rebuilt because it listed addresses of removed
+	// blocks or was unreadable
+	HostIndexRebuilt bool
+	// the directory was restored since its rollup was interrupted
+	RollupUndone bool
+}
+
+// Repaired checks whether anything had to be repaired.
+func (r RecoveryReport) Repaired() bool {
+	return len(r.DroppedBlocks) > 0 || r.TruncatedBytes > 0 || len(r.RemovedFiles) > 0 ||
+		r.MetadataDropped > 0 || r.MetadataAdded > 0 || r.MetadataRebuilt || r.HostIndexRebuilt ||
+		r.RollupUndone
+}
+
+func (r RecoveryReport) String() string {
+	var repairs []string
+	if len(r.DroppedBlocks) > 0 {
+		var dropped []string
+		for _, column := range append(columnFileNames[:], BLOCK_INDEX_NAME) {
+			if n, exists := r.DroppedBlocks[column]; exists {
+				dropped = append(dropped, fmt.Sprintf("%s: %d", column, n))
+			}
+		}
+		repairs = append(repairs, fmt.Sprintf("dropped blocks (%s)", strings.Join(dropped, ", ")))
+	}
+	if r.TruncatedBytes > 0 {
+		repairs = append(repairs, fmt.Sprintf("truncated %d trailing bytes", r.TruncatedBytes))
+	}
+	if len(r.RemovedFiles) > 0 {
+		repairs = append(repairs, fmt.Sprintf("removed incomplete files (%s)", strings.Join(r.RemovedFiles, ", ")))
+	}
+	if r.MetadataRebuilt {
+		repairs = append(repairs, "rebuilt unreadable "+METADATA_FILE_NAME)
+	}
+	if r.HostIndexRebuilt {
+		repairs = append(repairs, "rebuilt "+HOST_INDEX_FILE_NAME)
+	}
+	if r.RollupUndone {
+		repairs = append(repairs, "restored original data of interrupted rollup")
+	}
+	if r.MetadataDropped > 0 {
+		repairs = append(repairs, fmt.Sprintf("removed %d %s entries", r.MetadataDropped, METADATA_FILE_NAME))
+	}
+	if r.MetadataAdded > 0 {
+		repairs = append(repairs, fmt.Sprintf("reconstructed %d %s entries", r.MetadataAdded, METADATA_FILE_NAME))
+	}
+	if len(repairs) == 0 {
+		return r.Dir + ": consistent"
+	}
+	return r.Dir + ": " + strings.Join(repairs, ", ")
+}
+
+// RecoverDB repairs the daily directories of all interfaces in the database
+// at dbpath that can have been written to when the writer was interrupted:
+// the day containing timestamp, the day before it (the writer may have been
+// interrupted shortly before midnight) and the newest day of the interface
+// (goProbe may have been down for longer). Interrupted rollups of older
+// days are undone.
+// The database must not be written to while RecoverDB is running.
+// Returns the reports of all directories that had to be repaired.
+func RecoverDB(dbpath string, timestamp int64) ([]RecoveryReport, error) {
+	entries, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		reports []RecoveryReport
+		errs    []string
+	)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		ifaceDir := filepath.Join(dbpath, entry.Name())
+
+		rollupReports, err := recoverRollup(ifaceDir)
+		reports = append(reports, rollupReports...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", entry.Name(), err))
+		}
+
+		days, err := recoveryDays(ifaceDir, timestamp)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", entry.Name(), err))
+		}
+		for _, day := range days {
+			dir := filepath.Join(ifaceDir, strconv.FormatInt(day, 10))
+			report, err := RecoverDay(dir)
+			if report.Repaired() {
+				reports = append(reports, report)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", dir, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return reports, fmt.Errorf("Failed to recover %s", strings.Join(errs, "; "))
+	}
+	return reports, nil
+}
+
+// recoveryDays returns the existing daily directories of ifaceDir RecoverDB
+// has to check, in ascending order
+func recoveryDays(ifaceDir string, timestamp int64) ([]int64, error) {
+	entries, err := ioutil.ReadDir(ifaceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	today := DayTimestamp(timestamp)
+	var (
+		days   []int64
+		newest int64 = -1
+	)
+	for _, entry := range entries {
+		day, ok := parseDayDir(entry.Name())
+		if !ok || !entry.IsDir() {
+			continue
+		}
+		if day == today || day == today-EPOCH_DAY {
+			days = append(days, day)
+		} else if day > newest {
+			newest = day
+		}
+	}
+	// Older days can only have been written to last if neither today nor
+	// yesterday exist, i.e. after a longer downtime. Later days are left
+	// from a clock that was set back.
+	if newest > today || (newest >= 0 && len(days) == 0) {
+		days = append(days, newest)
+	}
+	sort.Sort(int64Slice(days))
+	return days, nil
+}
+
+// RecoverDay makes sure that all column files of the daily directory dir
+// contain the same blocks and that meta.json has exactly one entry for each
+// of them. Blocks that weren't completely written to all column files and
+// to meta.json are removed.
+func RecoverDay(dir string) (RecoveryReport, error) {
+	report := RecoveryReport{Dir: dir}
+
+	var (
+		files [COLIDX_COUNT]*GPFile
+		sizes [COLIDX_COUNT]int64
+		valid [COLIDX_COUNT]int
+		n     = math.MaxInt32
+	)
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		path := filepath.Join(dir, columnFileNames[i]+".gpf")
+
+		// left over from an interrupted creation of the file
+		if err := os.Remove(path + ".tmp"); err == nil {
+			report.RemovedFiles = append(report.RemovedFiles, filepath.Base(path)+".tmp")
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			n = 0
+			continue
+		} else if err != nil {
+			return report, err
+		}
+
+		gpfile, err := NewGPFile(path)
+		if err != nil {
+			if err != ErrIncompleteHeader {
+				return report, err
+			}
+			// The header was never written completely, so there can't
+			// be any blocks in the file. It is recreated on the next write.
+			if err := os.Remove(path); err != nil {
+				return report, err
+			}
+			report.RemovedFiles = append(report.RemovedFiles, filepath.Base(path))
+			n = 0
+			continue
+		}
+		defer gpfile.Close()
+
+		files[i], sizes[i] = gpfile, info.Size()
+		if valid[i], err = gpfile.validBlocks(info.Size(), true); err != nil {
+			return report, err
+		}
+		if valid[i] < n {
+			n = valid[i]
+		}
+	}
+
+	// all columns must agree on the timestamps of the blocks
+	for k := 0; k < n; k++ {
+		ts := files[0].timestamps[k]
+		for i := columnIndex(1); i < COLIDX_COUNT; i++ {
+			if files[i].timestamps[k] != ts {
+				n = k
+				break
+			}
+		}
+	}
+
+	// Metadata is written last, so blocks at the end without metadata
+	// belong to an interrupted writeout
+	metaPath := filepath.Join(dir, METADATA_FILE_NAME)
+	meta, err := ReadMetadata(metaPath)
+	metaExists := !os.IsNotExist(err)
+	if err != nil {
+		meta = NewMetadata()
+		report.MetadataRebuilt = metaExists
+	}
+	metaBlocks := make(map[int64]BlockMetadata)
+	for _, block := range meta.Blocks {
+		metaBlocks[block.Timestamp] = block
+	}
+	if !report.MetadataRebuilt {
+		for n > 0 {
+			if _, exists := metaBlocks[files[0].timestamps[n-1]]; exists {
+				break
+			}
+			n--
+		}
+	}
+
+	// cut all columns down to the blocks they agree on
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		if files[i] == nil {
+			continue
+		}
+		used := 0
+		for k := 0; k < len(files[i].timestamps); k++ {
+			if files[i].timestamps[k] != 0 || files[i].blocks[k] != 0 || files[i].lengths[k] != 0 {
+				used = k + 1
+			}
+		}
+		var end, validEnd int64 = files[i].header_size, files[i].header_size
+		if n > 0 {
+			end = files[i].blocks[n-1]
+		}
+		if valid[i] > 0 {
+			validEnd = files[i].blocks[valid[i]-1]
+		}
+		if used == n && sizes[i] == end {
+			continue
+		}
+
+		if err := files[i].truncateBlocks(n); err != nil {
+			return report, err
+		}
+		if used > n {
+			if report.DroppedBlocks == nil {
+				report.DroppedBlocks = make(map[string]int)
+			}
+			report.DroppedBlocks[columnFileNames[i]] = used - n
+		}
+		if sizes[i] > validEnd {
+			report.TruncatedBytes += sizes[i] - validEnd
+		}
+	}
+
+	var kept []int64
+	if n > 0 {
+		kept = files[0].timestamps[:n]
+	}
+	if err := recoverIndex(dir, kept, &report); err != nil {
+		return report, err
+	}
+	if err := recoverHostIndex(dir, kept, &report); err != nil {
+		return report, err
+	}
+
+	// exactly one metadata entry per block, in the order of the blocks
+	fixedMeta := NewMetadata()
+	for k := 0; k < n; k++ {
+		ts := files[0].timestamps[k]
+		block, exists := metaBlocks[ts]
+		if !exists {
+			// The pcap statistics and the traffic are lost. The
+			// flow count follows from the size of the block.
+			block = BlockMetadata{
+				Timestamp:            ts,
+				PcapPacketsReceived:  -1,
+				PcapPacketsDropped:   -1,
+				PcapPacketsIfDropped: -1,
+				FlowCount:            uint64((files[PROTO_COLIDX].lengths[k] - 16) / int64(PROTO_SIZEOF)),
+			}
+			if !report.MetadataRebuilt {
+				report.MetadataAdded++
+			}
+		}
+		delete(metaBlocks, ts)
+		fixedMeta.Blocks = append(fixedMeta.Blocks, block)
+	}
+	if !report.MetadataRebuilt {
+		report.MetadataDropped = len(meta.Blocks) - (len(fixedMeta.Blocks) - report.MetadataAdded)
+	}
+
+	if report.MetadataRebuilt || report.MetadataAdded > 0 || report.MetadataDropped > 0 {
+		if err := WriteMetadata(metaPath, fixedMeta); err != nil {
+			return report, err
+		}
+	}
+
+	// left over from an interrupted WriteMetadata
+	if err := os.Remove(metaPath + ".tmp"); err == nil {
+		report.RemovedFiles = append(report.RemovedFiles, METADATA_FILE_NAME+".tmp")
+	}
+
+	return report, nil
+}
+
+// recoverIndex cuts the block index of dir down to the summaries of the
+// leading blocks that are still in the column files, so that the removed
+// blocks can be written again. Summaries are optional, so an index that
+// can't be opened is removed.
+func recoverIndex(dir string, timestamps []int64, report *RecoveryReport) error {
+	path := filepath.Join(dir, BLOCK_INDEX_NAME+".gpf")
+
+	// left over from an interrupted creation of the file
+	if err := os.Remove(path + ".tmp"); err == nil {
+		report.RemovedFiles = append(report.RemovedFiles, filepath.Base(path)+".tmp")
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	index, err := NewGPFile(path)
+	if err != nil {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		report.RemovedFiles = append(report.RemovedFiles, filepath.Base(path))
+		return nil
+	}
+	defer index.Close()
+
+	valid, err := index.validBlocks(info.Size(), true)
+	if err != nil {
+		return err
+	}
+	kept := make(map[int64]struct{}, len(timestamps))
+	for _, ts := range timestamps {
+		kept[ts] = struct{}{}
+	}
+	n := 0
+	for ; n < valid; n++ {
+		if _, exists := kept[index.timestamps[n]]; !exists {
+			break
+		}
+	}
+
+	used := 0
+	for k := 0; k < len(index.timestamps); k++ {
+		if index.timestamps[k] != 0 || index.blocks[k] != 0 || index.lengths[k] != 0 {
+			used = k + 1
+		}
+	}
+	var end, validEnd int64 = index.header_size, index.header_size
+	if n > 0 {
+		end = index.blocks[n-1]
+	}
+	if valid > 0 {
+		validEnd = index.blocks[valid-1]
+	}
+	if used == n && info.Size() == end {
+		return nil
+	}
+
+	if err := index.truncateBlocks(n); err != nil {
+		return err
+	}
+	if used > n {
+		if report.DroppedBlocks == nil {
+			report.DroppedBlocks = make(map[string]int)
+		}
+		report.DroppedBlocks[BLOCK_INDEX_NAME] = used - n
+	}
+	if info.Size() > validEnd {
+		report.TruncatedBytes += info.Size() - validEnd
+	}
+	return nil
+}
+
+// recoverHostIndex rebuilds the host index of dir from the blocks that are
+// still in the column files if it may list addresses of removed blocks. A
+// missing index isn't created, the day may have been started by an older
+// version of goProbe.
+func recoverHostIndex(dir string, timestamps []int64, report *RecoveryReport) error {
+	path := filepath.Join(dir, HOST_INDEX_FILE_NAME)
+
+	// left over from an interrupted update of the index
+	if err := os.Remove(path + ".tmp"); err == nil {
+		report.RemovedFiles = append(report.RemovedFiles, HOST_INDEX_FILE_NAME+".tmp")
+	}
+
+	_, err := readHostIndex(path)
+	if os.IsNotExist(err) || (err == nil && len(report.DroppedBlocks) == 0) {
+		return nil
+	}
+	day, err := strconv.ParseInt(filepath.Base(dir), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Not a daily directory: %s", dir)
+	}
+
+	hosts := make(hostSet)
+	if len(timestamps) > 0 {
+		if hosts, err = readHostSet(dir, timestamps); err != nil {
+			return err
+		}
+	}
+	if err := writeHostIndex(path, day, hosts); err != nil {
+		return err
+	}
+	report.HostIndexRebuilt = true
+	return nil
+}
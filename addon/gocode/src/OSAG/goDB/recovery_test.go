@@ -0,0 +1,377 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// recovery_test.go
+//
+// Tests for the database lock and the repair of interrupted writeouts
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const recoveryTestDay int64 = 1466035200
+
+func testFlowMap(n int) AggFlowMap {
+	flowmap := make(AggFlowMap)
+	for i := 0; i < n; i++ {
+		key := Key{Sip: [16]byte{10, 0, 0, byte(i)}, Dip: [16]byte{10, 0, 1, 1}, Dport: [2]byte{0, 80}, Protocol: 6}
+		flowmap[key] = &Val{NBytesRcvd: uint64(100 * i), NPktsRcvd: uint64(i)}
+	}
+	return flowmap
+}
+
+// testBlock is a block written by writeTestFlows
+type testBlock struct {
+	flows    AggFlowMap
+	metadata BlockMetadata
+}
+
+// writeTestFlows writes the blocks to the database of iface, updates the
+// summary and returns the daily directory of the last block. It is shared
+// by all tests which need a database to work on.
+func writeTestFlows(t *testing.T, dbpath string, iface string, blocks ...testBlock) string {
+	w := NewDBWriter(dbpath, iface, Compression{})
+	var updates []InterfaceSummaryUpdate
+	var dir string
+	for _, block := range blocks {
+		ts := block.metadata.Timestamp
+		update, err := w.Write(block.flows, block.metadata, ts)
+		if err != nil {
+			t.Fatalf("failed to write block: %s", err)
+		}
+		updates = append(updates, update)
+		dir = w.dailyDir(ts)
+	}
+	err := ModifyDBSummary(dbpath, DBSINK_SUMMARY_TIMEOUT, func(summ *DBSummary) (*DBSummary, error) {
+		for _, update := range updates {
+			summ.Update(update)
+		}
+		return summ, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update summary: %s", err)
+	}
+	return dir
+}
+
+// writeTestDay writes n blocks for eth0 and returns the daily directory
+func writeTestDay(t *testing.T, dbpath string, n int) string {
+	var blocks []testBlock
+	for i := 0; i < n; i++ {
+		ts := recoveryTestDay + int64(i+1)*DB_WRITE_INTERVAL
+		blocks = append(blocks, testBlock{testFlowMap(i + 1), BlockMetadata{Timestamp: ts, PacketsLogged: i}})
+	}
+	return writeTestFlows(t, dbpath, "eth0", blocks...)
+}
+
+func columnTimestamps(t testing.TB, dir string, column string) []int64 {
+	gpfile, err := NewGPFile(filepath.Join(dir, column+".gpf"))
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", column, err)
+	}
+	defer gpfile.Close()
+
+	var timestamps []int64
+	for _, ts := range gpfile.GetTimestamps() {
+		if ts != 0 {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	return timestamps
+}
+
+// checkConsistent verifies that all columns and meta.json hold blocks for
+// the given timestamps and that the blocks can be read.
+func checkConsistent(t *testing.T, dir string, expected []int64) {
+	for _, column := range columnFileNames {
+		if timestamps := columnTimestamps(t, dir, column); !reflect.DeepEqual(timestamps, expected) {
+			t.Fatalf("%s: expected blocks %v, got %v", column, expected, timestamps)
+		}
+	}
+
+	// the block index must not describe blocks that are gone
+	if _, err := os.Stat(filepath.Join(dir, BLOCK_INDEX_NAME+".gpf")); err == nil {
+		if timestamps := columnTimestamps(t, dir, BLOCK_INDEX_NAME); !reflect.DeepEqual(timestamps, expected) {
+			t.Fatalf("%s: expected blocks %v, got %v", BLOCK_INDEX_NAME, expected, timestamps)
+		}
+	}
+
+	gpfile, _ := NewGPFile(filepath.Join(dir, "sip.gpf"))
+	defer gpfile.Close()
+	for i := range expected {
+		if _, err := gpfile.ReadBlock(i); err != nil {
+			t.Fatalf("failed to read block %d: %s", i, err)
+		}
+	}
+
+	meta, err := ReadMetadata(filepath.Join(dir, METADATA_FILE_NAME))
+	if err != nil {
+		t.Fatalf("failed to read metadata: %s", err)
+	}
+	var metaTimestamps []int64
+	for _, block := range meta.Blocks {
+		metaTimestamps = append(metaTimestamps, block.Timestamp)
+	}
+	if !reflect.DeepEqual(metaTimestamps, expected) {
+		t.Fatalf("metadata: expected blocks %v, got %v", expected, metaTimestamps)
+	}
+
+	report, err := RecoverDay(dir)
+	if err != nil || report.Repaired() {
+		t.Fatalf("expected consistent directory, got %s (error: %v)", report.String(), err)
+	}
+}
+
+func TestRecoverInterruptedWriteout(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "recovery_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 3)
+	expected := columnTimestamps(t, dir, "sip")
+	if len(expected) != 3 {
+		t.Fatalf("expected 3 blocks, got %v", expected)
+	}
+
+	// the next writeout only made it to the first two columns...
+	ts := expected[2] + DB_WRITE_INTERVAL
+	dbdata, _ := dbData("eth0", ts, testFlowMap(5))
+	for i := columnIndex(0); i < 2; i++ {
+		gpfile, _ := NewGPFile(filepath.Join(dir, columnFileNames[i]+".gpf"))
+		if err := gpfile.WriteTimedBlock(ts, dbdata[i], Compression{}, columnEncodings[i]); err != nil {
+			t.Fatalf("failed to write block: %s", err)
+		}
+		gpfile.Close()
+	}
+	// ... the third column got its data, but no header update ...
+	f, _ := os.OpenFile(filepath.Join(dir, columnFileNames[2]+".gpf"), os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte("half a block"))
+	f.Close()
+	// ... and meta.json was being rewritten
+	ioutil.WriteFile(filepath.Join(dir, METADATA_FILE_NAME+".tmp"), []byte("{\"blo"), 0644)
+
+	reports, err := RecoverDB(dbpath, ts)
+	if err != nil {
+		t.Fatalf("recovery failed: %s", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("expected one report, got %v", reports)
+	}
+	report := reports[0]
+	if !reflect.DeepEqual(report.DroppedBlocks, map[string]int{"sip": 1, "dip": 1}) {
+		t.Fatalf("unexpected dropped blocks %v", report.DroppedBlocks)
+	}
+	if report.TruncatedBytes != int64(len("half a block")) {
+		t.Fatalf("expected %d truncated bytes, got %d", len("half a block"), report.TruncatedBytes)
+	}
+	if report.MetadataDropped != 0 || report.MetadataAdded != 0 || report.MetadataRebuilt {
+		t.Fatalf("expected metadata to be untouched: %s", report.String())
+	}
+	checkConsistent(t, dir, expected)
+
+	// the repaired directory can be written to again
+	w := NewDBWriter(dbpath, "eth0", Compression{})
+	if _, err := w.Write(testFlowMap(5), BlockMetadata{Timestamp: ts}, ts); err != nil {
+		t.Fatalf("failed to write block after recovery: %s", err)
+	}
+	checkConsistent(t, dir, append(expected, ts))
+}
+
+func TestRecoverLaterDay(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "recovery_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 3)
+	expected := columnTimestamps(t, dir, "sip")
+
+	// goProbe restarts after midnight or after a few days of downtime
+	for _, now := range []int64{recoveryTestDay + EPOCH_DAY + 60, recoveryTestDay + 5*EPOCH_DAY} {
+		f, _ := os.OpenFile(filepath.Join(dir, "proto.gpf"), os.O_APPEND|os.O_WRONLY, 0600)
+		f.Write([]byte("half a block"))
+		f.Close()
+
+		reports, err := RecoverDB(dbpath, now)
+		if err != nil {
+			t.Fatalf("recovery failed: %s", err)
+		}
+		if len(reports) != 1 || reports[0].Dir != dir || reports[0].TruncatedBytes != int64(len("half a block")) {
+			t.Fatalf("expected %s to be repaired, got %v", dir, reports)
+		}
+		checkConsistent(t, dir, expected)
+	}
+
+	// older days are left alone once a later day was started
+	days, err := recoveryDays(filepath.Join(dbpath, "eth0"), recoveryTestDay+3*EPOCH_DAY)
+	if err != nil || len(days) != 1 || days[0] != recoveryTestDay {
+		t.Fatalf("expected newest day to be recovered, got %v (error: %v)", days, err)
+	}
+	os.Mkdir(filepath.Join(dbpath, "eth0", strconv.FormatInt(recoveryTestDay+2*EPOCH_DAY, 10)), 0755)
+	os.Mkdir(filepath.Join(dbpath, "eth0", strconv.FormatInt(recoveryTestDay+3*EPOCH_DAY, 10)), 0755)
+	days, err = recoveryDays(filepath.Join(dbpath, "eth0"), recoveryTestDay+3*EPOCH_DAY)
+	if err != nil || !reflect.DeepEqual(days, []int64{recoveryTestDay + 2*EPOCH_DAY, recoveryTestDay + 3*EPOCH_DAY}) {
+		t.Fatalf("expected today and yesterday to be recovered, got %v (error: %v)", days, err)
+	}
+}
+
+func TestRecoverMetadata(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "recovery_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeTestDay(t, dbpath, 3)
+	expected := columnTimestamps(t, dir, "sip")
+	metaPath := filepath.Join(dir, METADATA_FILE_NAME)
+
+	// metadata of the last block is missing: the writeout was interrupted
+	meta, _ := ReadMetadata(metaPath)
+	meta.Blocks = meta.Blocks[:2]
+	WriteMetadata(metaPath, meta)
+
+	report, err := RecoverDay(dir)
+	if err != nil {
+		t.Fatalf("recovery failed: %s", err)
+	}
+	if len(report.DroppedBlocks) != len(columnFileNames)+1 || report.DroppedBlocks["proto"] != 1 || report.DroppedBlocks[BLOCK_INDEX_NAME] != 1 {
+		t.Fatalf("expected last block to be dropped from all columns and the index: %s", report.String())
+	}
+	checkConsistent(t, dir, expected[:2])
+
+	// metadata of a block that doesn't exist
+	meta, _ = ReadMetadata(metaPath)
+	meta.Blocks = append(meta.Blocks, BlockMetadata{Timestamp: expected[2]})
+	WriteMetadata(metaPath, meta)
+
+	if report, err = RecoverDay(dir); err != nil || report.MetadataDropped != 1 {
+		t.Fatalf("expected metadata entry to be dropped: %s (error: %v)", report.String(), err)
+	}
+	checkConsistent(t, dir, expected[:2])
+
+	// unreadable metadata
+	ioutil.WriteFile(metaPath, []byte("{\"blocks\": [{\"time"), 0644)
+	if report, err = RecoverDay(dir); err != nil || !report.MetadataRebuilt || len(report.DroppedBlocks) != 0 {
+		t.Fatalf("expected metadata to be rebuilt: %s (error: %v)", report.String(), err)
+	}
+	checkConsistent(t, dir, expected[:2])
+	meta, _ = ReadMetadata(metaPath)
+	if meta.Blocks[1].FlowCount != 2 || meta.Blocks[1].PcapPacketsReceived != -1 {
+		t.Fatalf("unexpected rebuilt metadata %+v", meta.Blocks[1])
+	}
+}
+
+func TestRecoverIncompleteHeader(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "recovery_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// the first writeout of the day crashed while creating the dport column
+	dir := writeTestDay(t, dbpath, 1)
+	os.Remove(filepath.Join(dir, METADATA_FILE_NAME))
+	for _, column := range columnFileNames[4:] {
+		os.Remove(filepath.Join(dir, column+".gpf"))
+	}
+	os.Truncate(filepath.Join(dir, "dport.gpf"), BUF_SIZE+17)
+
+	report, err := RecoverDay(dir)
+	if err != nil {
+		t.Fatalf("recovery failed: %s", err)
+	}
+	if !reflect.DeepEqual(report.RemovedFiles, []string{"dport.gpf"}) || report.DroppedBlocks["sip"] != 1 {
+		t.Fatalf("unexpected repairs: %s", report.String())
+	}
+	for _, column := range columnFileNames[:3] {
+		if timestamps := columnTimestamps(t, dir, column); len(timestamps) != 0 {
+			t.Fatalf("%s: expected no blocks, got %v", column, timestamps)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, METADATA_FILE_NAME)); !os.IsNotExist(err) {
+		t.Fatalf("expected no metadata to be written")
+	}
+}
+
+func TestLockDB(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "lock_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	lock, err := LockDB(dbpath)
+	if err != nil {
+		t.Fatalf("failed to lock database: %s", err)
+	}
+	if _, err := LockDB(dbpath); err == nil {
+		t.Fatalf("expected second lock to fail")
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("failed to unlock database: %s", err)
+	}
+
+	lock, err = LockDB(dbpath)
+	if err != nil {
+		t.Fatalf("failed to lock database after unlocking: %s", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockDay(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "lock_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	w := NewDBWriter(dbpath, "eth0", Compression{})
+	write := func(ts int64) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := w.Write(testFlowMap(1), BlockMetadata{Timestamp: ts}, ts)
+			done <- err
+		}()
+		return done
+	}
+
+	// a write to the locked day waits for the lock
+	unlock := lockDay(w.dailyDir(recoveryTestDay))
+	done := write(recoveryTestDay + DB_WRITE_INTERVAL)
+	select {
+	case <-done:
+		t.Fatalf("expected write to wait for the locked day")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
+
+	// other days aren't affected
+	unlock = lockDay(w.dailyDir(recoveryTestDay))
+	err = <-write(recoveryTestDay + EPOCH_DAY + DB_WRITE_INTERVAL)
+	unlock()
+	if err != nil {
+		t.Fatalf("failed to write block: %s", err)
+	}
+	if len(dayLocks) != 0 {
+		t.Fatalf("expected day locks to be released, got %d", len(dayLocks))
+	}
+}
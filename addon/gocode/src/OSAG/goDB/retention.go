@@ -0,0 +1,407 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// retention.go
+//
+// Removal of old daily directories, either up to a given timestamp or
+// according to a retention policy
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RetentionConfig describes how long goProbe keeps the data of each
+// interface and how much disk space the database may use. The zero value
+// keeps everything forever.
+type RetentionConfig struct {
+	// number of days for which the data of an interface is kept. 0 keeps
+	// data forever.
+	MaxAgeDays int `json:"max_age_days"`
+	// overrides of MaxAgeDays for individual interfaces
+	Interfaces map[string]int `json:"interfaces"`
+	// maximum size of all daily directories in bytes. 0 means no limit.
+	MaxSize int64 `json:"max_size"`
+	// rollup of days that are kept, but not at full resolution
+	Rollup RollupConfig `json:"rollup"`
+}
+
+// Validate checks that the given RetentionConfig contains no bogus settings.
+func (rc RetentionConfig) Validate() error {
+	if rc.MaxAgeDays < 0 {
+		return fmt.Errorf("Invalid maximum age %d", rc.MaxAgeDays)
+	}
+	for iface, days := range rc.Interfaces {
+		if days < 0 {
+			return fmt.Errorf("Invalid maximum age %d for interface '%s'", days, iface)
+		}
+	}
+	if rc.MaxSize < 0 {
+		return fmt.Errorf("Invalid maximum size %d", rc.MaxSize)
+	}
+	return rc.Rollup.Validate()
+}
+
+// Enabled checks whether any data is ever removed.
+func (rc RetentionConfig) Enabled() bool {
+	if rc.MaxAgeDays > 0 || rc.MaxSize > 0 || rc.Rollup.Enabled() {
+		return true
+	}
+	for _, days := range rc.Interfaces {
+		if days > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAgeDays returns the number of days for which the data of iface is
+// kept, 0 meaning forever.
+func (rc RetentionConfig) maxAgeDays(iface string) int {
+	if days, exists := rc.Interfaces[iface]; exists {
+		return days
+	}
+	return rc.MaxAgeDays
+}
+
+// CleanIfaceResult describes the changes required to an interface's
+// summary after some of its daily directories were removed.
+type CleanIfaceResult struct {
+	DeltaFlowCount uint64  // number of flows deleted
+	DeltaTraffic   uint64  // traffic bytes deleted
+	NewBegin       int64   // timestamp of new begin
+	Gone           bool    // The interface has no entries left
+	Removed        []int64 // timestamps of the removed directories
+}
+
+// parseDayDir returns the timestamp of the daily directory name. Directories
+// whose name isn't an int64 weren't created by goProbe.
+func parseDayDir(name string) (int64, bool) {
+	dirTimestamp, err := strconv.ParseInt(name, 10, 64)
+	if err != nil || fmt.Sprintf("%d", dirTimestamp) != name {
+		return 0, false
+	}
+	return dirTimestamp, true
+}
+
+// CleanIfaceDir removes the daily directories of iface for which remove
+// returns true. If nothing but daily directories was left in the
+// interface's directory, it is removed as well.
+//
+// On error, the result describes the directories removed so far.
+func CleanIfaceDir(dbPath string, iface string, remove func(day int64) bool) (result CleanIfaceResult, err error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dbPath, iface))
+	if err != nil {
+		return result, err
+	}
+
+	result.NewBegin = math.MaxInt64
+
+	clean := true
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			clean = false
+			continue
+		}
+
+		dirTimestamp, ok := parseDayDir(entry.Name())
+		if !ok {
+			// leave directories we didn't create untouched
+			clean = false
+			continue
+		}
+
+		entryPath := filepath.Join(dbPath, iface, entry.Name())
+		metaFilePath := filepath.Join(entryPath, METADATA_FILE_NAME)
+
+		if remove(dirTimestamp) {
+			// delete directory, which may be written to concurrently
+			// (see lockDay)
+			unlock := lockDay(entryPath)
+			meta := TryReadMetadata(metaFilePath)
+			err := os.RemoveAll(entryPath)
+			unlock()
+			if err != nil {
+				return result, err
+			}
+			result.Removed = append(result.Removed, dirTimestamp)
+
+			for _, block := range meta.Blocks {
+				result.DeltaFlowCount += block.FlowCount
+				result.DeltaTraffic += block.Traffic
+			}
+		} else {
+			clean = false
+			if dirTimestamp < result.NewBegin {
+				// update NewBegin
+				meta := TryReadMetadata(metaFilePath)
+				if len(meta.Blocks) > 0 && meta.Blocks[0].Timestamp < result.NewBegin {
+					result.NewBegin = meta.Blocks[0].Timestamp
+				}
+			}
+
+		}
+	}
+
+	result.Gone = result.NewBegin == math.MaxInt64
+
+	if clean {
+		if err := os.RemoveAll(filepath.Join(dbPath, iface)); err != nil {
+			return result, err
+		}
+	}
+
+	return
+}
+
+// ApplyClean updates the summary of iface after some of its daily
+// directories were removed by CleanIfaceDir.
+func (s *DBSummary) ApplyClean(iface string, change CleanIfaceResult) {
+	if change.Gone {
+		delete(s.Interfaces, iface)
+		return
+	}
+	ifaceSumm, exists := s.Interfaces[iface]
+	if !exists {
+		return
+	}
+	if ifaceSumm.FlowCount < change.DeltaFlowCount {
+		ifaceSumm.FlowCount = 0
+	} else {
+		ifaceSumm.FlowCount -= change.DeltaFlowCount
+	}
+	if ifaceSumm.Traffic < change.DeltaTraffic {
+		ifaceSumm.Traffic = 0
+	} else {
+		ifaceSumm.Traffic -= change.DeltaTraffic
+	}
+	// NewBegin is unknown if CleanIfaceDir failed early
+	if change.NewBegin != math.MaxInt64 {
+		ifaceSumm.Begin = change.NewBegin
+	}
+	s.Interfaces[iface] = ifaceSumm
+}
+
+// RetentionRemoval describes a daily directory removed by EnforceRetention
+type RetentionRemoval struct {
+	Iface string
+	Day   int64
+	// size of the directory in bytes
+	Size int64
+	// why the directory was removed
+	Reason string
+}
+
+func (r RetentionRemoval) String() string {
+	return fmt.Sprintf("Removed %s/%d (%s, %d bytes): %s",
+		r.Iface, r.Day, time.Unix(r.Day, 0).UTC().Format("2006-01-02"), r.Size, r.Reason)
+}
+
+// RetentionReport describes what EnforceRetention did.
+type RetentionReport struct {
+	Removed []RetentionRemoval
+	// size of the remaining daily directories in bytes
+	Size int64
+	// set if the remaining daily directories exceed the maximum size, which
+	// happens if the current day's data alone is too large
+	OverQuota bool
+}
+
+// DayDir identifies the daily directory of an interface
+type DayDir struct {
+	Iface string
+	Day   int64
+}
+
+func (d DayDir) String() string {
+	return fmt.Sprintf("%s/%d", d.Iface, d.Day)
+}
+
+// dayDirList sorts daily directories by age, oldest first
+type dayDirList []DayDir
+
+func (d dayDirList) Len() int      { return len(d) }
+func (d dayDirList) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d dayDirList) Less(i, j int) bool {
+	if d[i].Day != d[j].Day {
+		return d[i].Day < d[j].Day
+	}
+	return d[i].Iface < d[j].Iface
+}
+
+// listDayDirs returns the daily directories of all interfaces in dbpath
+// for whose day include returns true, oldest first
+func listDayDirs(dbpath string, include func(day int64) bool) (dayDirList, error) {
+	ifaces, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var days dayDirList
+	for _, iface := range ifaces {
+		if !iface.IsDir() {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(dbpath, iface.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if day, ok := parseDayDir(entry.Name()); ok && entry.IsDir() && include(day) {
+				days = append(days, DayDir{iface.Name(), day})
+			}
+		}
+	}
+	sort.Sort(days)
+	return days, nil
+}
+
+type retentionDay struct {
+	DayDir
+	size int64
+}
+
+// dirSize returns the total size of the files below dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// listRetentionDays returns the daily directories of all interfaces in dbpath
+// along with their sizes, oldest first
+func listRetentionDays(dbpath string) ([]retentionDay, error) {
+	dirs, err := listDayDirs(dbpath, func(int64) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	days := make([]retentionDay, 0, len(dirs))
+	for _, d := range dirs {
+		size, err := dirSize(filepath.Join(dbpath, d.Iface, strconv.FormatInt(d.Day, 10)))
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, retentionDay{d, size})
+	}
+	return days, nil
+}
+
+// EnforceRetention removes the daily directories of the database at dbpath
+// that are older than the maximum age of their interface. If the remaining
+// directories exceed the maximum size, the oldest ones are removed until
+// they fit. The current day (according to now) is never removed since it
+// may still be written to.
+//
+// The directories are removed and the summary is updated while the summary
+// is locked. The caller must hold the database lock.
+func EnforceRetention(dbpath string, rc RetentionConfig, now int64) (report RetentionReport, err error) {
+	days, err := listRetentionDays(dbpath)
+	if err != nil {
+		return report, err
+	}
+
+	today := DayTimestamp(now)
+	remove := make(map[string]map[int64]RetentionRemoval)
+	planRemoval := func(d retentionDay, reason string) {
+		if remove[d.Iface] == nil {
+			remove[d.Iface] = make(map[int64]RetentionRemoval)
+		}
+		remove[d.Iface][d.Day] = RetentionRemoval{d.Iface, d.Day, d.size, reason}
+	}
+
+	// directories that can't contain any flows recorded within the
+	// maximum age, like goquery -clean does
+	var kept []retentionDay
+	for _, d := range days {
+		maxAge := rc.maxAgeDays(d.Iface)
+		if maxAge > 0 && d.Day < DayTimestamp(now-int64(maxAge)*EPOCH_DAY) {
+			planRemoval(d, fmt.Sprintf("older than %d days", maxAge))
+			continue
+		}
+		kept = append(kept, d)
+		report.Size += d.size
+	}
+
+	// oldest directories beyond the maximum size
+	if rc.MaxSize > 0 {
+		for _, d := range kept {
+			if report.Size <= rc.MaxSize {
+				break
+			}
+			if d.Day >= today {
+				continue
+			}
+			planRemoval(d, fmt.Sprintf("database exceeds maximum size of %d bytes", rc.MaxSize))
+			report.Size -= d.size
+		}
+		report.OverQuota = report.Size > rc.MaxSize
+	}
+
+	if len(remove) == 0 {
+		return report, nil
+	}
+
+	var ifaces []string
+	for iface := range remove {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	var cleanErr error
+	err = ModifyDBSummary(dbpath, DBSINK_SUMMARY_TIMEOUT, func(summ *DBSummary) (*DBSummary, error) {
+		for _, iface := range ifaces {
+			planned := remove[iface]
+			result, err := CleanIfaceDir(dbpath, iface, func(day int64) bool {
+				_, exists := planned[day]
+				return exists
+			})
+			// the directories removed so far have to be accounted for
+			for _, day := range result.Removed {
+				report.Removed = append(report.Removed, planned[day])
+			}
+			summ.ApplyClean(iface, result)
+			if err != nil {
+				cleanErr = err
+				break
+			}
+		}
+		return summ, nil
+	})
+	if err == nil {
+		err = cleanErr
+	}
+	sort.Sort(retentionRemovals(report.Removed))
+	return report, err
+}
+
+type retentionRemovals []RetentionRemoval
+
+func (r retentionRemovals) Len() int      { return len(r) }
+func (r retentionRemovals) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r retentionRemovals) Less(i, j int) bool {
+	if r[i].Day != r[j].Day {
+		return r[i].Day < r[j].Day
+	}
+	return r[i].Iface < r[j].Iface
+}
@@ -0,0 +1,128 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// retention_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeRetentionTestDays writes a block for each of the given days
+// (relative to recoveryTestDay) of iface and updates the summary
+func writeRetentionTestDays(t *testing.T, dbpath string, iface string, days ...int) {
+	var blocks []testBlock
+	for _, day := range days {
+		ts := recoveryTestDay + int64(day)*EPOCH_DAY + DB_WRITE_INTERVAL
+		blocks = append(blocks, testBlock{testFlowMap(day + 1), BlockMetadata{Timestamp: ts}})
+	}
+	writeTestFlows(t, dbpath, iface, blocks...)
+}
+
+func removedDays(report RetentionReport) []RetentionRemoval {
+	var removed []RetentionRemoval
+	for _, r := range report.Removed {
+		removed = append(removed, RetentionRemoval{Iface: r.Iface, Day: r.Day})
+	}
+	return removed
+}
+
+func TestEnforceRetention(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "retention_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	writeRetentionTestDays(t, dbpath, "eth0", 0, 1, 2, 3)
+	writeRetentionTestDays(t, dbpath, "eth1", 0, 1, 2, 3)
+	writeRetentionTestDays(t, dbpath, "eth2", 0)
+	now := recoveryTestDay + 3*EPOCH_DAY + 3600
+	day := func(n int) int64 { return recoveryTestDay + int64(n)*EPOCH_DAY }
+
+	// maximum age
+	rc := RetentionConfig{MaxAgeDays: 2, Interfaces: map[string]int{"eth1": 1, "eth2": 1}}
+	report, err := EnforceRetention(dbpath, rc, now)
+	if err != nil {
+		t.Fatalf("failed to enforce retention: %s", err)
+	}
+	expected := []RetentionRemoval{{Iface: "eth0", Day: day(0)}, {Iface: "eth1", Day: day(0)}, {Iface: "eth2", Day: day(0)}, {Iface: "eth1", Day: day(1)}}
+	if !reflect.DeepEqual(removedDays(report), expected) || report.OverQuota {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.Removed[3].Reason != "older than 1 days" || report.Removed[3].Size == 0 {
+		t.Fatalf("unexpected removal %+v", report.Removed[3])
+	}
+	for _, r := range expected {
+		if _, err := os.Stat(filepath.Join(dbpath, r.Iface, "1466035200")); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected directory to be removed", r.Iface)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dbpath, "eth2")); !os.IsNotExist(err) {
+		t.Fatalf("expected interface directory to be removed")
+	}
+
+	summ, err := ReadDBSummary(dbpath)
+	if err != nil {
+		t.Fatalf("failed to read summary: %s", err)
+	}
+	expectedSumm := map[string]InterfaceSummary{
+		"eth0": {FlowCount: 2 + 3 + 4, Traffic: 0, Begin: day(1) + DB_WRITE_INTERVAL, End: day(3) + DB_WRITE_INTERVAL},
+		"eth1": {FlowCount: 3 + 4, Traffic: 0, Begin: day(2) + DB_WRITE_INTERVAL, End: day(3) + DB_WRITE_INTERVAL},
+	}
+	for iface, is := range summ.Interfaces {
+		// the traffic depends on the flow maps only
+		is.Traffic = 0
+		summ.Interfaces[iface] = is
+	}
+	if !reflect.DeepEqual(summ.Interfaces, expectedSumm) {
+		t.Fatalf("unexpected summary %+v", summ.Interfaces)
+	}
+
+	// nothing left to do
+	if report, err = EnforceRetention(dbpath, rc, now); err != nil || len(report.Removed) != 0 {
+		t.Fatalf("expected nothing to be removed, got %+v (error: %v)", report, err)
+	}
+
+	// maximum size: the oldest day goes first
+	rc = RetentionConfig{MaxSize: report.Size - 1}
+	report, err = EnforceRetention(dbpath, rc, now)
+	if err != nil || !reflect.DeepEqual(removedDays(report), []RetentionRemoval{{Iface: "eth0", Day: day(1)}}) || report.OverQuota {
+		t.Fatalf("expected oldest day to be removed, got %+v (error: %v)", report, err)
+	}
+
+	// the current day is kept even if it exceeds the maximum size
+	rc = RetentionConfig{MaxSize: 1}
+	report, err = EnforceRetention(dbpath, rc, now)
+	expected = []RetentionRemoval{{Iface: "eth0", Day: day(2)}, {Iface: "eth1", Day: day(2)}}
+	if err != nil || !reflect.DeepEqual(removedDays(report), expected) || !report.OverQuota {
+		t.Fatalf("expected all but the current day to be removed, got %+v (error: %v)", report, err)
+	}
+	if summ, _ = ReadDBSummary(dbpath); summ.Interfaces["eth1"].Begin != day(3)+DB_WRITE_INTERVAL {
+		t.Fatalf("unexpected summary %+v", summ.Interfaces)
+	}
+}
+
+func TestRetentionConfig(t *testing.T) {
+	if (RetentionConfig{}).Enabled() || !(RetentionConfig{Interfaces: map[string]int{"eth0": 7}}).Enabled() {
+		t.Fatalf("unexpected Enabled()")
+	}
+	for _, rc := range []RetentionConfig{
+		{MaxAgeDays: -1},
+		{Interfaces: map[string]int{"eth0": -1}},
+		{MaxSize: -1},
+	} {
+		if err := rc.Validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", rc)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// rollup.go
+//
+// Rollup of old daily directories into blocks covering an hour or a day
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"OSAG/goDB/bigendian"
+)
+
+const (
+	ROLLUP_HOUR = "hour"
+	ROLLUP_DAY  = "day"
+
+	// rolled up daily directories are written to this directory (relative
+	// to the interface directory) before they replace the original ones
+	ROLLUP_TEMP_DIR = "rollup.tmp"
+	// the original directory is renamed to this while it's replaced
+	rollupOldSuffix = ".old"
+
+	// goQuery prints the attributes of the flow with RollupOtherKey as this
+	ROLLUP_OTHER = "other"
+)
+
+// RollupOtherKey is the key of the flow into which the flows of a rolled up
+// block with less than RollupConfig.MinBytes of traffic are merged. Its
+// attributes are all zero, so conditions like "dport < 1024" or "proto = 0"
+// match it.
+var RollupOtherKey = Key{}
+
+// RollupConfig describes which daily directories are rolled up and how.
+type RollupConfig struct {
+	// days older than this many days are rolled up. 0 disables rollups.
+	AfterDays int `json:"after_days"`
+	// time span covered by a rolled up block: ROLLUP_HOUR (default) or
+	// ROLLUP_DAY
+	Resolution string `json:"resolution"`
+	// flows with less traffic (received and sent) in a rolled up block
+	// are merged into a single flow with RollupOtherKey. 0 keeps all flows.
+	MinBytes uint64 `json:"min_bytes"`
+}
+
+// Validate checks that the given RollupConfig contains no bogus settings.
+func (rc RollupConfig) Validate() error {
+	if rc.AfterDays < 0 {
+		return fmt.Errorf("Invalid rollup age %d", rc.AfterDays)
+	}
+	switch rc.Resolution {
+	case "", ROLLUP_HOUR, ROLLUP_DAY:
+	default:
+		return fmt.Errorf("Unknown rollup resolution '%s'", rc.Resolution)
+	}
+	return nil
+}
+
+// Enabled checks whether any directories are rolled up.
+func (rc RollupConfig) Enabled() bool {
+	return rc.AfterDays > 0
+}
+
+// interval returns the number of seconds covered by a rolled up block
+func (rc RollupConfig) interval() int64 {
+	if rc.Resolution == ROLLUP_DAY {
+		return EPOCH_DAY
+	}
+	return 3600
+}
+
+// RollupResult describes a daily directory that was rolled up.
+type RollupResult struct {
+	Iface string
+	Day   int64
+	// number of blocks and flows before and after the rollup
+	Blocks       int
+	RolledBlocks int
+	Flows        uint64
+	RolledFlows  uint64
+}
+
+func (r RollupResult) String() string {
+	return fmt.Sprintf("Rolled up %s/%d (%s): %d blocks into %d, %d flows into %d",
+		r.Iface, r.Day, time.Unix(r.Day, 0).UTC().Format("2006-01-02"),
+		r.Blocks, r.RolledBlocks, r.Flows, r.RolledFlows)
+}
+
+// rollupBuckets groups the blocks of the day by the rolled up block they go
+// into. Returns nil if the day doesn't need to be rolled up.
+func rollupBuckets(blocks []BlockMetadata, day int64, interval int64) [][]BlockMetadata {
+	byBucket := make(map[int64][]BlockMetadata)
+	var buckets []int64
+	for _, block := range blocks {
+		bucket := (block.Timestamp - day) / interval
+		if _, exists := byBucket[bucket]; !exists {
+			buckets = append(buckets, bucket)
+		}
+		byBucket[bucket] = append(byBucket[bucket], block)
+	}
+	if len(buckets) == len(blocks) {
+		return nil
+	}
+
+	sort.Sort(int64Slice(buckets))
+	result := make([][]BlockMetadata, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, byBucket[bucket])
+	}
+	return result
+}
+
+// readFlows adds the flows of the block for timestamp to flowmap
+func readFlows(files [COLIDX_COUNT]*GPFile, timestamp int64, flowmap AggFlowMap) error {
+	var blocks [COLIDX_COUNT][]byte
+	entries := -1
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		block, err := files[i].ReadTimedBlock(timestamp)
+		if err != nil {
+			return fmt.Errorf("%s.gpf: %s", columnFileNames[i], err)
+		}
+		if len(block) < 16 || bigendian.ReadInt64At(block, 0) != timestamp || (len(block)-16)%columnSizeofs[i] != 0 {
+			return fmt.Errorf("%s.gpf: block %d is malformed", columnFileNames[i], timestamp)
+		}
+		n := (len(block) - 16) / columnSizeofs[i]
+		if entries != -1 && n != entries {
+			return fmt.Errorf("%s.gpf: expected %d entries, found %d", columnFileNames[i], entries, n)
+		}
+		entries = n
+		// cut off the timestamp in front
+		blocks[i] = block[8:]
+	}
+
+	for i := 0; i < entries; i++ {
+		var key Key
+		copy(key.Sip[:], blocks[SIP_COLIDX][i*SIP_SIZEOF:])
+		copy(key.Dip[:], blocks[DIP_COLIDX][i*DIP_SIZEOF:])
+		copy(key.Dport[:], blocks[DPORT_COLIDX][i*DPORT_SIZEOF:])
+		key.Protocol = blocks[PROTO_COLIDX][i*PROTO_SIZEOF]
+
+		val, exists := flowmap[key]
+		if !exists {
+			val = &Val{}
+			flowmap[key] = val
+		}
+		val.NBytesRcvd += bigendian.ReadUint64At(blocks[BYTESRCVD_COLIDX], i)
+		val.NBytesSent += bigendian.ReadUint64At(blocks[BYTESSENT_COLIDX], i)
+		val.NPktsRcvd += bigendian.ReadUint64At(blocks[PKTSRCVD_COLIDX], i)
+		val.NPktsSent += bigendian.ReadUint64At(blocks[PKTSSENT_COLIDX], i)
+	}
+	return nil
+}
+
+// mergeLongTail merges the flows with less than minBytes of traffic into
+// a single flow with RollupOtherKey
+func mergeLongTail(flowmap AggFlowMap, minBytes uint64) {
+	other := &Val{}
+	merged := false
+	for key, val := range flowmap {
+		if key == RollupOtherKey || val.NBytesRcvd+val.NBytesSent >= minBytes {
+			continue
+		}
+		other.NBytesRcvd += val.NBytesRcvd
+		other.NBytesSent += val.NBytesSent
+		other.NPktsRcvd += val.NPktsRcvd
+		other.NPktsSent += val.NPktsSent
+		delete(flowmap, key)
+		merged = true
+	}
+	if !merged {
+		return
+	}
+	if val, exists := flowmap[RollupOtherKey]; exists {
+		other.NBytesRcvd += val.NBytesRcvd
+		other.NBytesSent += val.NBytesSent
+		other.NPktsRcvd += val.NPktsRcvd
+		other.NPktsSent += val.NPktsSent
+	}
+	flowmap[RollupOtherKey] = other
+}
+
+// addPcapCounter adds a pcap counter, which is -1 if it isn't available
+func addPcapCounter(sum, value int) int {
+	if sum == -1 || value == -1 {
+		return -1
+	}
+	return sum + value
+}
+
+// rollupMetadata combines the metadata of the blocks of a bucket. The
+// rolled up block ends with the last of them.
+func rollupMetadata(bucket []BlockMetadata) BlockMetadata {
+	first, last := bucket[0], bucket[len(bucket)-1]
+	meta := BlockMetadata{
+		Timestamp: last.Timestamp,
+		Duration:  last.Timestamp - (first.Timestamp - first.BlockDuration()),
+	}
+	for _, block := range bucket {
+		meta.PcapPacketsReceived = addPcapCounter(meta.PcapPacketsReceived, block.PcapPacketsReceived)
+		meta.PcapPacketsDropped = addPcapCounter(meta.PcapPacketsDropped, block.PcapPacketsDropped)
+		meta.PcapPacketsIfDropped = addPcapCounter(meta.PcapPacketsIfDropped, block.PcapPacketsIfDropped)
+		meta.PacketsLogged += block.PacketsLogged
+	}
+	return meta
+}
+
+// writeRollup writes the rolled up version of the daily directory dir to
+// tempDir/<day>, including its block and host index
+func writeRollup(dir, tempDir string, day int64, buckets [][]BlockMetadata, rc RollupConfig, compression Compression, result *RollupResult) error {
+	var files [COLIDX_COUNT]*GPFile
+	for i := columnIndex(0); i < COLIDX_COUNT; i++ {
+		gpfile, err := NewGPFile(filepath.Join(dir, columnFileNames[i]+".gpf"))
+		if err != nil {
+			return err
+		}
+		defer gpfile.Close()
+		files[i] = gpfile
+	}
+
+	// the writer puts the day into tempDir since the interface is empty
+	w := NewDBWriter(tempDir, "", compression)
+	for _, bucket := range buckets {
+		flowmap := make(AggFlowMap)
+		for _, block := range bucket {
+			if err := readFlows(files, block.Timestamp, flowmap); err != nil {
+				return err
+			}
+		}
+		if rc.MinBytes > 0 {
+			mergeLongTail(flowmap, rc.MinBytes)
+		}
+
+		meta := rollupMetadata(bucket)
+		update, err := w.Write(flowmap, meta, meta.Timestamp)
+		if err != nil {
+			return err
+		}
+		result.RolledBlocks++
+		result.RolledFlows += update.FlowCount
+	}
+	return syncDir(filepath.Join(tempDir, strconv.FormatInt(day, 10)))
+}
+
+// RollupDay rolls up the daily directory of iface for day, replacing its
+// blocks by blocks covering an hour (or the whole day) each. The flows of the
+// combined blocks are aggregated by their key. Returns false if the
+// directory was already rolled up.
+//
+// The directory is locked (see lockDay) while it is rolled up. It is replaced
+// and the summary is updated while the summary is locked. The caller must
+// hold the database lock.
+func RollupDay(dbpath, iface string, day int64, rc RollupConfig, compression Compression) (RollupResult, bool, error) {
+	result := RollupResult{Iface: iface, Day: day}
+	ifaceDir := filepath.Join(dbpath, iface)
+	dir := filepath.Join(ifaceDir, strconv.FormatInt(day, 10))
+	defer lockDay(dir)()
+
+	meta, err := ReadMetadata(filepath.Join(dir, METADATA_FILE_NAME))
+	if err != nil {
+		return result, false, err
+	}
+	buckets := rollupBuckets(meta.Blocks, day, rc.interval())
+	if buckets == nil {
+		return result, false, nil
+	}
+	result.Blocks = len(meta.Blocks)
+	for _, block := range meta.Blocks {
+		result.Flows += block.FlowCount
+	}
+
+	tempDir := filepath.Join(ifaceDir, ROLLUP_TEMP_DIR)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return result, false, err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := writeRollup(dir, tempDir, day, buckets, rc, compression, &result); err != nil {
+		return result, false, err
+	}
+
+	err = ModifyDBSummary(dbpath, DBSINK_SUMMARY_TIMEOUT, func(summ *DBSummary) (*DBSummary, error) {
+		// recovery restores the original directory if we are interrupted
+		// between the renames
+		old := dir + rollupOldSuffix
+		if err := os.Rename(dir, old); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(filepath.Join(tempDir, strconv.FormatInt(day, 10)), dir); err != nil {
+			os.Rename(old, dir)
+			return nil, err
+		}
+		if err := syncDir(ifaceDir); err != nil {
+			return nil, err
+		}
+		os.RemoveAll(old)
+
+		if ifaceSumm, exists := summ.Interfaces[iface]; exists && ifaceSumm.FlowCount >= result.Flows-result.RolledFlows {
+			ifaceSumm.FlowCount -= result.Flows - result.RolledFlows
+			summ.Interfaces[iface] = ifaceSumm
+		}
+		return summ, nil
+	})
+	if err != nil {
+		return result, false, err
+	}
+	return result, true, nil
+}
+
+// RollupCandidates returns the daily directories of all interfaces in the
+// database at dbpath that are older than rc.AfterDays, oldest first. Those
+// that were rolled up already are included; RollupDay skips them.
+func RollupCandidates(dbpath string, rc RollupConfig, now int64) ([]DayDir, error) {
+	if !rc.Enabled() {
+		return nil, nil
+	}
+	// directories that can't contain any flows recorded within AfterDays
+	cutoff := DayTimestamp(now - int64(rc.AfterDays)*EPOCH_DAY)
+	return listDayDirs(dbpath, func(day int64) bool { return day < cutoff })
+}
+
+// RollupDB rolls up the daily directories of all interfaces in the database
+// at dbpath that are older than rc.AfterDays, oldest first. At most maxDays
+// directories are rolled up, so that a large backlog is worked off in
+// several runs.
+func RollupDB(dbpath string, rc RollupConfig, compression Compression, now int64, maxDays int) ([]RollupResult, error) {
+	days, err := RollupCandidates(dbpath, rc, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []RollupResult
+		errs    []string
+	)
+	for _, d := range days {
+		if len(results) >= maxDays {
+			break
+		}
+		result, rolled, err := RollupDay(dbpath, d.Iface, d.Day, rc, compression)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", d, err))
+			continue
+		}
+		if rolled {
+			results = append(results, result)
+		}
+	}
+
+	if len(errs) > 0 {
+		return results, fmt.Errorf("Failed to roll up %s", strings.Join(errs, "; "))
+	}
+	return results, nil
+}
+
+// recoverRollup cleans up after a rollup in the interface directory ifaceDir
+// that was interrupted. If the original daily directory was already moved
+// aside but not yet replaced, it is restored.
+func recoverRollup(ifaceDir string) ([]RecoveryReport, error) {
+	entries, err := ioutil.ReadDir(ifaceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []RecoveryReport
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasSuffix(entry.Name(), rollupOldSuffix) {
+			continue
+		}
+		if _, ok := parseDayDir(strings.TrimSuffix(entry.Name(), rollupOldSuffix)); !ok {
+			continue
+		}
+		old := filepath.Join(ifaceDir, entry.Name())
+		dir := strings.TrimSuffix(old, rollupOldSuffix)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			if err := os.Rename(old, dir); err != nil {
+				return reports, err
+			}
+			reports = append(reports, RecoveryReport{Dir: dir, RollupUndone: true})
+		} else if err := os.RemoveAll(old); err != nil {
+			return reports, err
+		}
+	}
+	return reports, os.RemoveAll(filepath.Join(ifaceDir, ROLLUP_TEMP_DIR))
+}
@@ -0,0 +1,275 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// rollup_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goDB
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const rollupTestDay int64 = 1450656000
+
+// writeRollupTestDay writes n blocks to the day of eth0 starting at day,
+// all of which share the flows of testFlowMap(4), and updates the summary
+func writeRollupTestDay(t *testing.T, dbpath string, day int64, n int) string {
+	rnd := rand.New(rand.NewSource(day))
+	var blocks []testBlock
+	for b := 0; b < n; b++ {
+		ts := day + int64(b+1)*DB_WRITE_INTERVAL
+		flowmap := syntheticFlowMap(rnd, 100)
+		for k, v := range testFlowMap(4) {
+			flowmap[k] = v
+		}
+		blocks = append(blocks, testBlock{flowmap, BlockMetadata{Timestamp: ts, PcapPacketsReceived: 10, PacketsLogged: 1}})
+	}
+	return writeTestFlows(t, dbpath, "eth0", blocks...)
+}
+
+// totals sums up the counters of all flows of a query result
+func totals(result map[ExtraKey]Val) Val {
+	var total Val
+	for _, val := range result {
+		total.NBytesRcvd += val.NBytesRcvd
+		total.NBytesSent += val.NBytesSent
+		total.NPktsRcvd += val.NPktsRcvd
+		total.NPktsSent += val.NPktsSent
+	}
+	return total
+}
+
+func TestRollupDay(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "rollup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// 11 blocks in the first hour, 12 in the second and one in the third
+	dir := writeRollupTestDay(t, dbpath, rollupTestDay, 24)
+	queries := []struct{ queryType, conditional string }{
+		{"talk_conv", ""},
+		{"sip,dport", "dport = 443"},
+		{"dip", "sip = 10.0.0.1"},
+	}
+	var before []map[ExtraKey]Val
+	for _, q := range queries {
+		result, _ := runQuery(t, dbpath, q.queryType, q.conditional)
+		before = append(before, result)
+	}
+
+	result, rolled, err := RollupDay(dbpath, "eth0", rollupTestDay, RollupConfig{AfterDays: 1}, Compression{})
+	if err != nil || !rolled {
+		t.Fatalf("expected day to be rolled up, got %v (error: %v)", rolled, err)
+	}
+	if result.Blocks != 24 || result.RolledBlocks != 3 || result.RolledFlows >= result.Flows {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	for i, q := range queries {
+		if after, _ := runQuery(t, dbpath, q.queryType, q.conditional); !reflect.DeepEqual(before[i], after) {
+			t.Fatalf("%s (%s): results differ after rollup", q.queryType, q.conditional)
+		}
+	}
+
+	// the rolled up blocks cover the same time span as the original ones
+	meta, err := ReadMetadata(filepath.Join(dir, METADATA_FILE_NAME))
+	if err != nil {
+		t.Fatalf("failed to read metadata: %s", err)
+	}
+	var flows uint64
+	for i, expected := range []BlockMetadata{
+		{Timestamp: rollupTestDay + 3300, Duration: 3300, PcapPacketsReceived: 110, PacketsLogged: 11},
+		{Timestamp: rollupTestDay + 6900, Duration: 3600, PcapPacketsReceived: 120, PacketsLogged: 12},
+		{Timestamp: rollupTestDay + 7200, Duration: 300, PcapPacketsReceived: 10, PacketsLogged: 1},
+	} {
+		block := meta.Blocks[i]
+		flows += block.FlowCount
+		block.FlowCount, block.Traffic = 0, 0
+		if block != expected {
+			t.Fatalf("block %d: expected %+v, got %+v", i, expected, block)
+		}
+	}
+	if flows != result.RolledFlows {
+		t.Fatalf("expected %d flows, got %d", result.RolledFlows, flows)
+	}
+	if summ, _ := ReadDBSummary(dbpath); summ.Interfaces["eth0"].FlowCount != flows {
+		t.Fatalf("unexpected summary %+v", summ.Interfaces["eth0"])
+	}
+
+	// the block index and host index were written along with the blocks
+	if check, err := CheckDay(dir, false); err != nil || !check.OK() {
+		t.Fatalf("expected consistent directory, got %+v (error: %v)", check, err)
+	}
+	if _, rolled, err = RollupDay(dbpath, "eth0", rollupTestDay, RollupConfig{AfterDays: 1}, Compression{}); err != nil || rolled {
+		t.Fatalf("expected day to be left alone, got %v (error: %v)", rolled, err)
+	}
+	if _, err := os.Stat(filepath.Join(dbpath, "eth0", ROLLUP_TEMP_DIR)); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary directory to be removed")
+	}
+
+	// an hourly rollup can be rolled up further
+	result, rolled, err = RollupDay(dbpath, "eth0", rollupTestDay, RollupConfig{AfterDays: 1, Resolution: ROLLUP_DAY}, Compression{})
+	if err != nil || !rolled || result.RolledBlocks != 1 {
+		t.Fatalf("expected day to be rolled up into a single block, got %+v (error: %v)", result, err)
+	}
+	if meta, _ = ReadMetadata(filepath.Join(dir, METADATA_FILE_NAME)); meta.Blocks[0].Duration != 7200 {
+		t.Fatalf("unexpected metadata %+v", meta.Blocks)
+	}
+	if after, _ := runQuery(t, dbpath, "talk_conv", ""); !reflect.DeepEqual(before[0], after) {
+		t.Fatalf("results differ after daily rollup")
+	}
+}
+
+// the blocks of a query are chosen based on the time span they cover
+func TestRollupCoveredTimeInterval(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "rollup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	writeRollupTestDay(t, dbpath, rollupTestDay, 24)
+	if _, _, err := RollupDay(dbpath, "eth0", rollupTestDay, RollupConfig{AfterDays: 1}, Compression{}); err != nil {
+		t.Fatalf("rollup failed: %s", err)
+	}
+
+	for _, test := range []struct {
+		tfirst, tlast int64
+		blocks        int
+		first, last   int64
+	}{
+		// the first rolled up block starts with the day
+		{rollupTestDay - 600, rollupTestDay, 0, 0, 0},
+		{rollupTestDay - 600, rollupTestDay + 100, 1, rollupTestDay, rollupTestDay + 3300},
+		{rollupTestDay + 3600, rollupTestDay + 3700, 1, rollupTestDay + 3300, rollupTestDay + 6900},
+		{rollupTestDay + 3000, rollupTestDay + 7000, 3, rollupTestDay, rollupTestDay + 7200},
+		{rollupTestDay + 6900, rollupTestDay + 7200, 1, rollupTestDay + 6900, rollupTestDay + 7200},
+	} {
+		_, wm := runQueryInterval(t, dbpath, "sip", "", test.tfirst, test.tlast)
+		if stats := wm.BlockStats(); stats.Total != test.blocks {
+			t.Fatalf("%d-%d: expected %d blocks, got %d", test.tfirst, test.tlast, test.blocks, stats.Total)
+		}
+		if test.blocks == 0 {
+			continue
+		}
+		first, last := wm.GetCoveredTimeInterval()
+		if first.Unix() != test.first || last.Unix() != test.last {
+			t.Fatalf("%d-%d: expected covered time span %d-%d, got %d-%d", test.tfirst, test.tlast, test.first, test.last, first.Unix(), last.Unix())
+		}
+	}
+}
+
+func TestRollupMinBytes(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "rollup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	writeRollupTestDay(t, dbpath, rollupTestDay, 12)
+	before, _ := runQuery(t, dbpath, "talk_conv", "")
+
+	rc := RollupConfig{AfterDays: 1, Resolution: ROLLUP_DAY, MinBytes: 20000}
+	result, rolled, err := RollupDay(dbpath, "eth0", rollupTestDay, rc, Compression{})
+	if err != nil || !rolled || result.RolledFlows > result.Flows/2 {
+		t.Fatalf("expected most flows to be merged, got %+v (error: %v)", result, err)
+	}
+
+	after, _ := runQuery(t, dbpath, "talk_conv", "")
+	if totals(before) != totals(after) {
+		t.Fatalf("totals differ after rollup: %+v and %+v", totals(before), totals(after))
+	}
+	var other ExtraKey
+	copy(other.Sip[:], RollupOtherKey.Sip[:])
+	copy(other.Dip[:], RollupOtherKey.Dip[:])
+	if val, exists := after[other]; !exists || val.NBytesRcvd+val.NBytesSent == 0 {
+		t.Fatalf("expected traffic of the other flow, got %+v", val)
+	}
+	for key, val := range after {
+		if key != other && val.NBytesRcvd+val.NBytesSent < rc.MinBytes {
+			t.Fatalf("flow %v below %d bytes wasn't merged", key, rc.MinBytes)
+		}
+	}
+}
+
+func TestRollupDB(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "rollup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	for day := 0; day < 3; day++ {
+		writeRollupTestDay(t, dbpath, rollupTestDay+int64(day)*EPOCH_DAY, 24)
+	}
+	now := rollupTestDay + 3*EPOCH_DAY + 3600
+
+	// the last two days are younger than two days
+	rc := RollupConfig{AfterDays: 2}
+	results, err := RollupDB(dbpath, rc, Compression{}, now, 10)
+	if err != nil || len(results) != 1 || results[0].Day != rollupTestDay {
+		t.Fatalf("expected the first day to be rolled up, got %+v (error: %v)", results, err)
+	}
+
+	// at most one day per run, and days that were rolled up don't count
+	rc = RollupConfig{AfterDays: 1}
+	now += EPOCH_DAY
+	for _, day := range []int64{rollupTestDay + EPOCH_DAY, rollupTestDay + 2*EPOCH_DAY} {
+		results, err = RollupDB(dbpath, rc, Compression{}, now, 1)
+		if err != nil || len(results) != 1 || results[0].Day != day {
+			t.Fatalf("expected day %d to be rolled up, got %+v (error: %v)", day, results, err)
+		}
+	}
+	if results, err = RollupDB(dbpath, rc, Compression{}, now, 1); err != nil || len(results) != 0 {
+		t.Fatalf("expected nothing to be rolled up, got %+v (error: %v)", results, err)
+	}
+}
+
+func TestRecoverRollup(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "rollup_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	dir := writeRollupTestDay(t, dbpath, rollupTestDay, 3)
+	before, _ := runQuery(t, dbpath, "talk_conv", "")
+
+	// the rollup was interrupted after the original directory was moved aside
+	tempDir := filepath.Join(dbpath, "eth0", ROLLUP_TEMP_DIR, strconv.FormatInt(rollupTestDay, 10))
+	os.MkdirAll(tempDir, 0755)
+	os.Rename(dir, dir+rollupOldSuffix)
+
+	reports, err := RecoverDB(dbpath, time.Now().Unix())
+	if err != nil || len(reports) != 1 || !reports[0].RollupUndone {
+		t.Fatalf("expected rollup to be undone, got %v (error: %v)", reports, err)
+	}
+	if after, _ := runQuery(t, dbpath, "talk_conv", ""); !reflect.DeepEqual(before, after) {
+		t.Fatalf("results differ after recovery")
+	}
+	if _, err := os.Stat(filepath.Join(dbpath, "eth0", ROLLUP_TEMP_DIR)); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary directory to be removed")
+	}
+
+	// the rollup was interrupted before the original directory was removed
+	os.MkdirAll(dir+rollupOldSuffix, 0755)
+	if reports, err = RecoverDB(dbpath, time.Now().Unix()); err != nil || len(reports) != 0 {
+		t.Fatalf("expected nothing to be repaired, got %v (error: %v)", reports, err)
+	}
+	if _, err := os.Stat(dir + rollupOldSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected original directory to be removed")
+	}
+}
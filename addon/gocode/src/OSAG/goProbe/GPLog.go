@@ -14,25 +14,142 @@
 package goProbe
 
 import (
+    "encoding/json"
     "fmt"
     "log/syslog"
     "os"
+    "path/filepath"
+    "sort"
     "sync"
+    "time"
 
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
     "github.com/google/gopacket/pcapgo"
 )
 
+// PacketLogConfig controls how packets that could not be decoded are
+// logged to the per-interface error pcap files.
+type PacketLogConfig struct {
+    Enabled         bool  `json:"enabled"`
+    MaxFileSize     int64 `json:"max_file_size"`     // in bytes
+    MaxFiles        int   `json:"max_files"`         // number of files kept per interface
+    SamplesPerClass int   `json:"samples_per_class"` // packets logged per error class
+}
+
+const (
+    PACKET_LOG_DEFAULT_MAX_FILE_SIZE     = 1024 * 1024 // 1 MiB
+    PACKET_LOG_DEFAULT_MAX_FILES         = 5
+    PACKET_LOG_DEFAULT_SAMPLES_PER_CLASS = 1
+
+    // the timestamp format is chosen such that lexical order
+    // equals chronological order
+    PACKET_LOG_TIME_FORMAT = "20060102-150405.000000000"
+
+    pcapFileHeaderSize   = 24
+    pcapPacketHeaderSize = 16
+)
+
+// DefaultPacketLogConfig returns the configuration used if none is
+// provided. It corresponds to the historic behaviour of logging the
+// first packet of every error class.
+func DefaultPacketLogConfig() PacketLogConfig {
+    return PacketLogConfig{
+        Enabled:         true,
+        MaxFileSize:     PACKET_LOG_DEFAULT_MAX_FILE_SIZE,
+        MaxFiles:        PACKET_LOG_DEFAULT_MAX_FILES,
+        SamplesPerClass: PACKET_LOG_DEFAULT_SAMPLES_PER_CLASS,
+    }
+}
+
+// Validate checks that the given PacketLogConfig contains no bogus settings.
+func (pc PacketLogConfig) Validate() error {
+    if !pc.Enabled {
+        return nil
+    }
+    if pc.MaxFileSize < pcapFileHeaderSize+pcapPacketHeaderSize+CAPTURE_SNAPLEN {
+        return fmt.Errorf("Invalid configuration entry MaxFileSize. Value must be at least %d.", pcapFileHeaderSize+pcapPacketHeaderSize+CAPTURE_SNAPLEN)
+    }
+    if pc.MaxFiles < 1 {
+        return fmt.Errorf("Invalid configuration entry MaxFiles. Value must be at least 1.")
+    }
+    if pc.SamplesPerClass < 1 {
+        return fmt.Errorf("Invalid configuration entry SamplesPerClass. Value must be at least 1.")
+    }
+    return nil
+}
+
+// ErrorLogFile describes an error pcap file and the error classes
+// of the packets stored in it.
+type ErrorLogFile struct {
+    Path    string         `json:"path"`
+    Size    int64          `json:"size"`
+    Classes map[string]int `json:"classes"` // error class -> number of packets
+}
+
 type PacketLogWriter struct {
     sync.Mutex
     path    string
+    config  PacketLogConfig
     writers map[string]*PcapWriter
+
+    // error classes per file name, for each interface. Loaded lazily
+    // from the interface's error index file.
+    classes map[string]map[string]map[string]int
 }
 
 type PcapWriter struct {
     file       *os.File
     pcapWriter *pcapgo.Writer
+    size       int64
+    packets    int
+}
+
+// NewPcapWriter creates the pcap file at path (which must not exist yet)
+// and writes the pcap file header to it.
+func NewPcapWriter(path string, snapshotLen int, linkType layers.LinkType) (*PcapWriter, error) {
+    var err error
+
+    pw := new(PcapWriter)
+    if pw.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+        return nil, err
+    }
+    pw.pcapWriter = pcapgo.NewWriter(pw.file)
+    if err = pw.pcapWriter.WriteFileHeader(uint32(snapshotLen), linkType); err != nil {
+        pw.file.Close()
+        return nil, err
+    }
+    pw.size = pcapFileHeaderSize
+
+    return pw, nil
+}
+
+// WritePacket appends packet to the pcap file.
+func (pw *PcapWriter) WritePacket(packet gopacket.Packet) error {
+    return pw.WritePacketData(packet.Metadata().CaptureInfo, packet.Data())
+}
+
+// WritePacketData appends the packet given by its capture info and
+// (possibly truncated) data to the pcap file.
+func (pw *PcapWriter) WritePacketData(ci gopacket.CaptureInfo, data []byte) error {
+    if pw.pcapWriter == nil || pw.file == nil {
+        return fmt.Errorf("packet log writer is nil")
+    }
+
+    if err := pw.pcapWriter.WritePacket(ci, data); err != nil {
+        return err
+    }
+    pw.size += int64(pcapPacketHeaderSize + len(data))
+    pw.packets++
+
+    return nil
+}
+
+func (pw *PcapWriter) Close() error {
+    if pw.file != nil {
+        return pw.file.Close()
+    }
+    return nil
 }
 
 var SysLog *syslog.Writer
@@ -52,10 +169,14 @@ func InitGPLog() error {
     return nil
 }
 
-func InitPacketLog(dbpath string, ifaces []string) {
+func InitPacketLog(dbpath string, ifaces []string, config PacketLogConfig) {
 
-    PacketLog = &PacketLogWriter{writers: make(map[string]*PcapWriter)}
+    PacketLog = &PacketLogWriter{
+        writers: make(map[string]*PcapWriter),
+        classes: make(map[string]map[string]map[string]int),
+    }
     PacketLog.path = dbpath
+    PacketLog.config = config
 
     PacketLog.Lock()
     defer PacketLog.Unlock()
@@ -65,48 +186,229 @@ func InitPacketLog(dbpath string, ifaces []string) {
     }
 }
 
-func (p *PacketLogWriter) Close() {
-    for _, w := range p.writers {
-        if w != nil {
-            if w.file != nil {
-                w.file.Close()
-            }
+// SetConfig replaces the configuration of the packet logger. The new limits
+// apply from the next logged packet onwards.
+func (p *PacketLogWriter) SetConfig(config PacketLogConfig) {
+    p.Lock()
+    defer p.Unlock()
+
+    if !config.Enabled {
+        for iface := range p.writers {
+            p.closeWriter(iface)
         }
     }
+    p.config = config
 }
 
-func (p *PacketLogWriter) Log(iface string, packet gopacket.Packet, snapshotLen int) error {
+// SamplesPerClass returns how many packets of each error class should be
+// logged. It returns 0 if packet logging is disabled.
+func (p *PacketLogWriter) SamplesPerClass() int {
     p.Lock()
     defer p.Unlock()
 
-    var err error
+    if !p.config.Enabled {
+        return 0
+    }
+    return p.config.SamplesPerClass
+}
 
-    // create a new packet logger if nothing has been logged yet
-    if p.writers[iface] == nil {
-        pw := new(PcapWriter)
+func (p *PacketLogWriter) Close() {
+    p.Lock()
+    defer p.Unlock()
 
-        // make sure the directory exists before logging the packet to disk. If this is the very first
-        // time that goProbe is started, this is important
-        if err = os.MkdirAll(p.path+"/"+iface, 0755); err != nil {
-            return err
+    for iface := range p.writers {
+        p.closeWriter(iface)
+    }
+}
+
+func (p *PacketLogWriter) ifaceDir(iface string) string {
+    return filepath.Join(p.path, iface)
+}
+
+func (p *PacketLogWriter) indexPath(iface string) string {
+    return filepath.Join(p.ifaceDir(iface), iface+"_errors.json")
+}
+
+// pcapFiles returns the paths of all error pcap files of iface, oldest first.
+func (p *PacketLogWriter) pcapFiles(iface string) []string {
+    files, _ := filepath.Glob(filepath.Join(p.ifaceDir(iface), iface+"_errors_*.pcap"))
+    sort.Strings(files)
+    return files
+}
+
+// ifaceClasses returns the error classes recorded for the pcap files of iface,
+// reading them from the index file on first access.
+func (p *PacketLogWriter) ifaceClasses(iface string) map[string]map[string]int {
+    if classes, exists := p.classes[iface]; exists {
+        return classes
+    }
+
+    classes := make(map[string]map[string]int)
+    if f, err := os.Open(p.indexPath(iface)); err == nil {
+        if err := json.NewDecoder(f).Decode(&classes); err != nil {
+            SysLog.Warning(fmt.Sprintf("Interface '%s': failed to read error log index: %s", iface, err))
+            classes = make(map[string]map[string]int)
         }
+        f.Close()
+    }
+    p.classes[iface] = classes
+    return classes
+}
 
-        if pw.file, err = os.Create(p.path + "/" + iface + "/" + iface + "_errors.pcap"); err != nil {
-            return err
+// writeIndex writes the error classes of the pcap files of iface to its index
+// file. It is written to a temporary file first and then renamed, so a crash
+// can't leave a truncated index behind.
+func (p *PacketLogWriter) writeIndex(iface string) error {
+    classes := p.ifaceClasses(iface)
+
+    // forget about files that no longer exist
+    existing := make(map[string]struct{})
+    for _, path := range p.pcapFiles(iface) {
+        existing[filepath.Base(path)] = struct{}{}
+    }
+    for name := range classes {
+        if _, exists := existing[name]; !exists {
+            delete(classes, name)
         }
-        pw.pcapWriter = pcapgo.NewWriter(pw.file)
-        pw.pcapWriter.WriteFileHeader(uint32(snapshotLen), layers.LinkTypeEthernet)
+    }
+
+    path := p.indexPath(iface)
+    tmpPath := path + ".tmp"
 
-        p.writers[iface] = pw
+    f, err := os.Create(tmpPath)
+    if err != nil {
+        return err
     }
 
-    // log the packet
-    if p.writers[iface].pcapWriter != nil && p.writers[iface].file != nil {
-        if err = p.writers[iface].pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+    err = json.NewEncoder(f).Encode(classes)
+    if err == nil {
+        err = f.Sync()
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmpPath)
+        return err
+    }
+
+    return os.Rename(tmpPath, path)
+}
+
+// openWriter creates a new timestamped error pcap file for iface and removes the
+// oldest files if there are more than config.MaxFiles of them.
+func (p *PacketLogWriter) openWriter(iface string, snapshotLen int) error {
+    // make sure the directory exists before logging the packet to disk. If this is the very first
+    // time that goProbe is started, this is important
+    if err := os.MkdirAll(p.ifaceDir(iface), 0755); err != nil {
+        return err
+    }
+
+    name := fmt.Sprintf("%s_errors_%s.pcap", iface, time.Now().UTC().Format(PACKET_LOG_TIME_FORMAT))
+    pw, err := NewPcapWriter(filepath.Join(p.ifaceDir(iface), name), snapshotLen, layers.LinkTypeEthernet)
+    if err != nil {
+        return err
+    }
+
+    p.writers[iface] = pw
+
+    // enforce the limit on the number of files
+    files := p.pcapFiles(iface)
+    for i := 0; i < len(files)-p.config.MaxFiles; i++ {
+        if err := os.Remove(files[i]); err != nil {
+            SysLog.Warning(fmt.Sprintf("Interface '%s': failed to remove old error log %s: %s", iface, files[i], err))
+        }
+    }
+
+    return nil
+}
+
+// closeWriter closes the current error pcap file of iface and writes the
+// error classes logged to it to the index file.
+func (p *PacketLogWriter) closeWriter(iface string) {
+    if w := p.writers[iface]; w != nil {
+        w.Close()
+        p.writers[iface] = nil
+
+        if err := p.writeIndex(iface); err != nil {
+            SysLog.Warning(fmt.Sprintf("Interface '%s': failed to write error log index: %s", iface, err))
+        }
+    }
+}
+
+// Log writes packet to the current error pcap file of iface and records that
+// it failed to decode with the given error class. The file is rotated once
+// it would grow beyond the configured maximum size. The error classes are
+// written to the index file when the file is rotated or closed and when the
+// files are listed (see Files).
+func (p *PacketLogWriter) Log(iface string, errClass string, packet gopacket.Packet, snapshotLen int) error {
+    p.Lock()
+    defer p.Unlock()
+
+    if !p.config.Enabled {
+        return nil
+    }
+
+    packetSize := int64(pcapPacketHeaderSize + len(packet.Data()))
+
+    // rotate the file if the packet doesn't fit anymore. A file always
+    // holds at least one packet
+    if w := p.writers[iface]; w != nil && w.packets > 0 && w.size+packetSize > p.config.MaxFileSize {
+        p.closeWriter(iface)
+    }
+
+    // create a new packet logger if nothing has been logged yet
+    if p.writers[iface] == nil {
+        if err := p.openWriter(iface, snapshotLen); err != nil {
             return err
         }
-    } else {
-        return fmt.Errorf("packet log writer is nil")
     }
+
+    // log the packet
+    w := p.writers[iface]
+    if err := w.WritePacket(packet); err != nil {
+        return err
+    }
+
+    // remember which error class ended up in which file
+    classes := p.ifaceClasses(iface)
+    name := filepath.Base(w.file.Name())
+    if classes[name] == nil {
+        classes[name] = make(map[string]int)
+    }
+    classes[name][errClass]++
+
     return nil
 }
+
+// Files returns all error pcap files of iface (oldest first), including those
+// written before the last restart of goProbe.
+func (p *PacketLogWriter) Files(iface string) []ErrorLogFile {
+    p.Lock()
+    defer p.Unlock()
+
+    classes := p.ifaceClasses(iface)
+    if len(classes) > 0 {
+        if err := p.writeIndex(iface); err != nil {
+            SysLog.Warning(fmt.Sprintf("Interface '%s': failed to write error log index: %s", iface, err))
+        }
+    }
+
+    var files []ErrorLogFile
+    for _, path := range p.pcapFiles(iface) {
+        var size int64
+        if fi, err := os.Stat(path); err == nil {
+            size = fi.Size()
+        }
+        fileClasses := make(map[string]int)
+        for errClass, count := range classes[filepath.Base(path)] {
+            fileClasses[errClass] = count
+        }
+        files = append(files, ErrorLogFile{
+            Path:    path,
+            Size:    size,
+            Classes: fileClasses,
+        })
+    }
+    return files
+}
@@ -0,0 +1,122 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// GPLog_test.go
+//
+// Tests for the rotation of error packet logs
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/layers"
+)
+
+func testPacket(size int) gopacket.Packet {
+    data := make([]byte, size)
+    packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+    packet.Metadata().CaptureInfo = gopacket.CaptureInfo{
+        Timestamp:     time.Now(),
+        CaptureLength: size,
+        Length:        size,
+    }
+    return packet
+}
+
+func TestPacketLogRotation(t *testing.T) {
+    dbpath, err := ioutil.TempDir("", "gplog_test")
+    if err != nil {
+        t.Fatalf("failed to create temporary directory: %s", err)
+    }
+    defer os.RemoveAll(dbpath)
+
+    config := PacketLogConfig{
+        Enabled:         true,
+        MaxFileSize:     pcapFileHeaderSize + 2*(pcapPacketHeaderSize+CAPTURE_SNAPLEN),
+        MaxFiles:        2,
+        SamplesPerClass: 1,
+    }
+    InitPacketLog(dbpath, []string{"eth0"}, config)
+    defer PacketLog.Close()
+
+    // 5 packets, two fit into each file
+    for i, class := range []string{"a", "b", "a", "c", "d"} {
+        if err := PacketLog.Log("eth0", class, testPacket(CAPTURE_SNAPLEN), CAPTURE_SNAPLEN); err != nil {
+            t.Fatalf("failed to log packet %d: %s", i, err)
+        }
+    }
+
+    // the index is only written when a file is rotated, not for every packet
+    index, err := ioutil.ReadFile(PacketLog.indexPath("eth0"))
+    if err != nil || strings.Contains(string(index), `"d"`) {
+        t.Fatalf("expected index without the current file, got %q (error: %v)", index, err)
+    }
+
+    files := PacketLog.Files("eth0")
+    if len(files) != 2 {
+        t.Fatalf("expected 2 error logs, got %d", len(files))
+    }
+    for _, file := range files {
+        if file.Size > config.MaxFileSize {
+            t.Fatalf("error log %s exceeds maximum size: %d bytes", file.Path, file.Size)
+        }
+    }
+    if files[0].Classes["a"] != 1 || files[0].Classes["c"] != 1 {
+        t.Fatalf("unexpected error classes in %s: %v", files[0].Path, files[0].Classes)
+    }
+    if files[1].Classes["d"] != 1 || len(files[1].Classes) != 1 {
+        t.Fatalf("unexpected error classes in %s: %v", files[1].Path, files[1].Classes)
+    }
+
+    // a restart must not truncate the existing files and must recover the
+    // error classes from the index
+    PacketLog.Close()
+    InitPacketLog(dbpath, []string{"eth0"}, config)
+    if err := PacketLog.Log("eth0", "e", testPacket(CAPTURE_SNAPLEN), CAPTURE_SNAPLEN); err != nil {
+        t.Fatalf("failed to log packet after restart: %s", err)
+    }
+
+    restarted := PacketLog.Files("eth0")
+    if len(restarted) != 2 {
+        t.Fatalf("expected 2 error logs after restart, got %d", len(restarted))
+    }
+    if restarted[0].Path != files[1].Path || restarted[0].Classes["d"] != 1 {
+        t.Fatalf("error log from before the restart was lost: %v", restarted)
+    }
+    if restarted[1].Classes["e"] != 1 {
+        t.Fatalf("unexpected error classes in %s: %v", restarted[1].Path, restarted[1].Classes)
+    }
+}
+
+func TestPacketLogDisabled(t *testing.T) {
+    dbpath, err := ioutil.TempDir("", "gplog_test")
+    if err != nil {
+        t.Fatalf("failed to create temporary directory: %s", err)
+    }
+    defer os.RemoveAll(dbpath)
+
+    config := DefaultPacketLogConfig()
+    config.Enabled = false
+    InitPacketLog(dbpath, []string{"eth0"}, config)
+    defer PacketLog.Close()
+
+    if PacketLog.SamplesPerClass() != 0 {
+        t.Fatalf("disabled packet log should not request any samples")
+    }
+    if err := PacketLog.Log("eth0", "a", testPacket(CAPTURE_SNAPLEN), CAPTURE_SNAPLEN); err != nil {
+        t.Fatalf("failed to log packet: %s", err)
+    }
+    if files := PacketLog.Files("eth0"); len(files) != 0 {
+        t.Fatalf("disabled packet log wrote files: %v", files)
+    }
+}
@@ -42,6 +42,8 @@ type CaptureConfig struct {
 	BufSize   int    `json:"buf_size"` // in bytes
 	BPFFilter string `json:"bpf_filter"`
 	Promisc   bool   `json:"promisc"`
+	// memory budget of the packet ring in bytes. 0 disables the ring.
+	RingSize int `json:"ring_size"`
 }
 
 // Validate (partially) checks that the given CaptureConfig contains no bogus settings.
@@ -51,6 +53,9 @@ func (cc CaptureConfig) Validate() error {
 	if !(MIN_PCAP_BUF_SIZE <= cc.BufSize && cc.BufSize <= MAX_PCAP_BUF_SIZE) {
 		return fmt.Errorf("Invalid configuration entry BufSize. Value must be in range [%d, %d].", MIN_PCAP_BUF_SIZE, MAX_PCAP_BUF_SIZE)
 	}
+	if cc.RingSize != 0 && !(MIN_PACKET_RING_SIZE <= cc.RingSize && cc.RingSize <= MAX_PACKET_RING_SIZE) {
+		return fmt.Errorf("Invalid configuration entry RingSize. Value must be 0 or in range [%d, %d].", MIN_PACKET_RING_SIZE, MAX_PACKET_RING_SIZE)
+	}
 	return nil
 }
 
@@ -86,6 +91,8 @@ type CaptureStats struct {
 type CaptureStatus struct {
 	State CaptureState
 	Stats CaptureStats
+	// memory used by the packet ring in bytes
+	RingMemory int
 }
 
 type errorMap map[string]int
@@ -131,6 +138,10 @@ func (cmd captureCommandStatus) execute(c *Capture) {
 		PacketsLogged: c.packetsLogged - c.lastRotationStats.PacketsLogged,
 	}
 
+	if c.ring != nil {
+		result.RingMemory = c.ring.memoryUsage()
+	}
+
 	cmd.returnChan <- result
 }
 
@@ -212,6 +223,71 @@ func (cmd captureCommandRotate) execute(c *Capture) {
 	cmd.returnChan <- result
 }
 
+type captureCommandTrigger struct {
+	spec       TriggerSpec
+	returnChan chan<- triggerResult
+}
+
+// helper struct to bundle up the multiple return values
+// of Trigger
+type triggerResult struct {
+	record TriggerRecord
+	err    error
+}
+
+func (cmd captureCommandTrigger) execute(c *Capture) {
+	var result triggerResult
+
+	switch {
+	case c.state != CAPTURE_STATE_ACTIVE:
+		result.err = fmt.Errorf("Capture is in state %s", c.state)
+	case c.trigger != nil:
+		result.err = fmt.Errorf("Trigger '%s' is still running", c.trigger.record.ID)
+	default:
+		c.trigger, result.err = newTrigger(c.iface, c.pcapHandle, cmd.spec)
+		if result.err == nil {
+			result.record = c.trigger.record
+			SysLog.Info(fmt.Sprintf("Interface '%s': started trigger '%s'", c.iface, c.trigger.record.ID))
+		}
+	}
+
+	cmd.returnChan <- result
+}
+
+type dumpResult struct {
+	snapshot *ringSnapshot
+	err      error
+}
+
+type captureCommandDump struct {
+	returnChan chan<- dumpResult
+}
+
+// The ring is only copied here. Writing it out is left to the caller, so
+// that the capture isn't held up by the file system.
+func (cmd captureCommandDump) execute(c *Capture) {
+	var result dumpResult
+
+	if c.ring == nil {
+		result.err = fmt.Errorf("Packet ring is disabled")
+	} else {
+		result.snapshot = c.ring.snapshot()
+	}
+
+	cmd.returnChan <- result
+}
+
+type captureCommandExpireTrigger struct {
+	returnChan chan<- struct{}
+}
+
+func (cmd captureCommandExpireTrigger) execute(c *Capture) {
+	if c.trigger != nil && c.trigger.expired(time.Now()) {
+		c.finishTrigger()
+	}
+	cmd.returnChan <- struct{}{}
+}
+
 type captureCommandEnable struct {
 	returnChan chan<- struct{}
 }
@@ -257,6 +333,23 @@ func (cmd captureCommandDisable) execute(c *Capture) {
 // doing.
 var PcapMutex sync.Mutex
 
+// AvailableInterfaces returns the names of all network interfaces
+// that pcap can capture on.
+func AvailableInterfaces() ([]string, error) {
+	PcapMutex.Lock()
+	devs, err := pcap.FindAllDevs()
+	PcapMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		ifaces = append(ifaces, dev.Name)
+	}
+	return ifaces, nil
+}
+
 //////////////////////// Capture definition ////////////////////////
 
 // A Capture captures and logs flow data for all traffic on a
@@ -341,6 +434,13 @@ type Capture struct {
 
 	// error map for logging errors more properly
 	errMap errorMap
+
+	// currently running trigger (nil if there is none)
+	trigger *trigger
+
+	// ring of the most recent packets (nil if disabled). Survives
+	// reinitialization unless the configuration or link type changes.
+	ring *packetRing
 }
 
 // NewCapture creates a new Capture associated with the given iface.
@@ -361,6 +461,8 @@ func NewCapture(iface string, config CaptureConfig) *Capture {
 		nil, // pcapHandle
 		nil, // packetSource
 		make(map[string]int),
+		nil, // trigger
+		nil, // ring
 	}
 	go c.process()
 	return c
@@ -404,23 +506,39 @@ func (c *Capture) process() {
 			}
 		}
 
+		if c.ring != nil {
+			c.ring.add(packet)
+		}
+
 		if err := gppacket.Populate(packet); err == nil {
+			if c.trigger != nil {
+				// the key has to be extracted before the packet is added to the
+				// flow log since adding may swap its source and destination
+				if c.trigger.log(packet, triggerKey(c.iface, &gppacket)) {
+					c.finishTrigger()
+				}
+			}
 			c.flowLog.Add(&gppacket)
 			errcount = 0
 			c.packetsLogged++
 		} else {
 			errcount++
 
+			if c.trigger != nil && c.trigger.log(packet, nil) {
+				c.finishTrigger()
+			}
+
 			// collect the error. The errors value is the key here. Otherwise, the address
 			// of the error would be taken, which results in a non-minimal set of errors
-			if _, exists := c.errMap[err.Error()]; !exists {
+			errClass := err.Error()
+			if c.errMap[errClass] < PacketLog.SamplesPerClass() {
 				// log the packet to the pcap error logs
-				if logerr := PacketLog.Log(c.iface, packet, CAPTURE_SNAPLEN); logerr != nil {
+				if logerr := PacketLog.Log(c.iface, errClass, packet, CAPTURE_SNAPLEN); logerr != nil {
 					SysLog.Info("failed to log faulty packet: " + logerr.Error())
 				}
 			}
 
-			c.errMap[err.Error()]++
+			c.errMap[errClass]++
 
 			// shut down the interface thread if too many consecutive decoding failures
 			// have been encountered
@@ -442,6 +560,10 @@ func (c *Capture) process() {
 				SysLog.Err(fmt.Sprintf("Interface '%s': %s", c.iface, err.Error()))
 			}
 
+			if c.trigger != nil && c.trigger.expired(time.Now()) {
+				c.finishTrigger()
+			}
+
 			select {
 			case cmd, ok := <-c.cmdChan:
 				if ok {
@@ -513,6 +635,8 @@ func (c *Capture) initialize() {
 
 	c.packetSource = gopacket.NewPacketSource(c.pcapHandle, c.pcapHandle.LinkType())
 
+	c.setupRing()
+
 	// set the decoding options to lazy decoding in order to ensure that the packet
 	// layers are only decoded once they are needed. Additionally, this is imperative
 	// when GRE-encapsulated packets are decoded because otherwise the layers cannot
@@ -577,6 +701,10 @@ func (c *Capture) reset() {
 	// flowLog.
 	c.lastRotationStats.Pcap = &pcap.Stats{}
 	c.pcapHandle = nil
+	// a running trigger depends on the pcap handle
+	if c.trigger != nil {
+		c.finishTrigger()
+	}
 	c.packetSource = nil
 	c.setState(CAPTURE_STATE_UNINITIALIZED)
 
@@ -585,6 +713,24 @@ func (c *Capture) reset() {
 	c.errMap = make(map[string]int)
 }
 
+// setupRing creates, replaces or removes the packet ring according to
+// the Capture's config and the link type of its pcap handle.
+func (c *Capture) setupRing() {
+	linkType := c.pcapHandle.LinkType()
+	switch {
+	case c.config.RingSize == 0:
+		c.ring = nil
+	case c.ring == nil || c.ring.budget != c.config.RingSize || c.ring.linkType != linkType:
+		c.ring = newPacketRing(c.config.RingSize, linkType)
+	}
+}
+
+// finishTrigger ends the currently running trigger.
+func (c *Capture) finishTrigger() {
+	c.trigger.finish()
+	c.trigger = nil
+}
+
 // needReinitialization checks whether we need to reinitialize the capture
 // to apply the given config.
 func (c *Capture) needReinitialization(config CaptureConfig) bool {
@@ -679,6 +825,21 @@ func (c *Capture) Status() (result CaptureStatus) {
 	return <-ch
 }
 
+// ExpireTrigger ends the running trigger if its time is up. The capture
+// only checks this by itself while it is capturing packets.
+func (c *Capture) ExpireTrigger() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		panic("Capture is closed")
+	}
+
+	ch := make(chan struct{}, 1)
+	c.cmdChan <- captureCommandExpireTrigger{ch}
+	<-ch
+}
+
 // Error map status call
 func (c *Capture) Errors() (result errorMap) {
 	c.mutex.Lock()
@@ -764,6 +925,50 @@ func (c *Capture) Rotate() (agg goDB.AggFlowMap, stats CaptureStats) {
 	return result.agg, result.stats
 }
 
+// Trigger makes the Capture write all packets matching spec
+// to a pcap file in addition to logging flows. Only a single
+// trigger can run at any time and the Capture needs to be in
+// CAPTURE_STATE_ACTIVE. The returned record describes the newly
+// started trigger.
+func (c *Capture) Trigger(spec TriggerSpec) (TriggerRecord, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		panic("Capture is closed")
+	}
+
+	ch := make(chan triggerResult, 1)
+	c.cmdChan <- captureCommandTrigger{spec, ch}
+	result := <-ch
+	return result.record, result.err
+}
+
+// Dump writes the packets currently held in the Capture's packet ring
+// to a pcap file. The returned record describes the written file.
+func (c *Capture) Dump() (TriggerRecord, error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		panic("Capture is closed")
+	}
+
+	// the snapshot is written out without holding the mutex
+	ch := make(chan dumpResult, 1)
+	c.cmdChan <- captureCommandDump{ch}
+	result := <-ch
+	c.mutex.Unlock()
+
+	if result.err != nil {
+		return TriggerRecord{}, result.err
+	}
+	record, err := result.snapshot.dump(c.iface)
+	if err == nil {
+		SysLog.Info(fmt.Sprintf("Interface '%s': dumped %d packets from packet ring to %s", c.iface, record.Packets, record.File))
+	}
+	return record, err
+}
+
 // Close closes the Capture and releases all underlying resources.
 // Close is idempotent. Once you have closed a Capture, you can no
 // longer call any of its methods (apart from Close).
@@ -158,6 +158,18 @@ func (cm *CaptureManager) capturesCopy() map[string]*Capture {
     return copyMap
 }
 
+// Ifaces returns the names of the interfaces of all managed Capture instances.
+func (cm *CaptureManager) Ifaces() []string {
+    cm.Lock()
+    defer cm.Unlock()
+
+    ifaces := make([]string, 0, len(cm.captures))
+    for iface := range cm.captures {
+        ifaces = append(ifaces, iface)
+    }
+    return ifaces
+}
+
 // DisableAll disables all managed Capture instances.
 //
 // Returns once all instances have been disabled.
@@ -275,6 +287,35 @@ func (cm *CaptureManager) ErrorsAll() map[string]errorMap {
     return errormap
 }
 
+// Trigger() starts a trigger on the Capture of the given interface.
+func (cm *CaptureManager) Trigger(iface string, spec TriggerSpec) (TriggerRecord, error) {
+    capture := cm.getCapture(iface)
+    if capture == nil {
+        return TriggerRecord{}, fmt.Errorf("Interface '%s' is not being captured", iface)
+    }
+    return capture.Trigger(spec)
+}
+
+// ExpireTriggersAll() ends the triggers of all managed Capture instances
+// whose time is up.
+func (cm *CaptureManager) ExpireTriggersAll() {
+    var rg RunGroup
+    for _, capture := range cm.capturesCopy() {
+        capture := capture
+        rg.Run(capture.ExpireTrigger)
+    }
+    rg.Wait()
+}
+
+// Dump() writes the packet ring of the given interface to a pcap file.
+func (cm *CaptureManager) Dump(iface string) (TriggerRecord, error) {
+    capture := cm.getCapture(iface)
+    if capture == nil {
+        return TriggerRecord{}, fmt.Errorf("Interface '%s' is not being captured", iface)
+    }
+    return capture.Dump()
+}
+
 // RotateAll() returns the state of all managed Capture instances.
 //
 // The resulting TaggedAggFlowMaps will be sent over returnChan and
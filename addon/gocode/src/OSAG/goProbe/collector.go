@@ -0,0 +1,371 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// collector.go
+//
+// Collector for NetFlow v5/v9 and IPFIX records. Flows received from other
+// exporters are turned into goDB flows of virtual interfaces, so that they
+// can be written to the database just like captured flows.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/pcap"
+
+	"OSAG/goDB"
+	"OSAG/netflow"
+)
+
+const (
+	// prefix of the names of the virtual interfaces created by the collector
+	COLLECTOR_IFACE_PREFIX = "nf_"
+
+	// large enough for any UDP datagram
+	collectorBufferSize = 65535
+)
+
+type CollectorConfig struct {
+	// address to listen on (e.g. ":2055"). Leave empty to disable the collector.
+	Listen string `json:"listen"`
+	// addresses or networks (e.g. "10.0.0.0/24") of the exporters whose
+	// messages are accepted. Leave empty to accept messages from anyone.
+	Exporters []string `json:"exporters"`
+}
+
+// Enabled checks whether the collector is to be run.
+func (cc CollectorConfig) Enabled() bool {
+	return cc.Listen != ""
+}
+
+// Validate checks that the given CollectorConfig contains no bogus settings.
+func (cc CollectorConfig) Validate() error {
+	if !cc.Enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(cc.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address '%s': %s", cc.Listen, err)
+	}
+	if _, err := cc.exporterNets(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// exporterNets parses the allowed exporters. Single addresses are turned
+// into networks containing only them.
+func (cc CollectorConfig) exporterNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, exporter := range cc.Exporters {
+		if strings.Contains(exporter, "/") {
+			_, network, err := net.ParseCIDR(exporter)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid exporter '%s': %s", exporter, err)
+			}
+			nets = append(nets, network)
+			continue
+		}
+
+		ip := net.ParseIP(exporter)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid exporter '%s': not an IP address", exporter)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// exporterStats are the statistics of a single exporter since
+// the last rotation.
+type exporterStats struct {
+	messages  int
+	malformed int
+	// data sets that couldn't be decoded for lack of a template
+	unknown int
+	// records dropped because there were too many virtual interfaces
+	dropped int
+}
+
+// virtualIface accumulates the flows of a virtual interface
+// since the last rotation.
+type virtualIface struct {
+	exporter string
+	flows    goDB.AggFlowMap
+	records  int
+}
+
+// Collector receives flow records over UDP and aggregates them per virtual
+// interface. A virtual interface is named after the exporter and the
+// ifIndex of the flows (e.g. nf_10.0.0.1_3). The direction of a record
+// (as given by flowDirection, ingress by default) determines whether its
+// counters are treated as received or sent and which ifIndex (ingress
+// or egress interface) is used. Records without ifIndex are assigned to
+// the exporter's observation domain.
+//
+// Flows are assigned to the block in which they are received. Messages of
+// exporters that aren't allowed by the configuration are ignored.
+type Collector struct {
+	conn      net.PacketConn
+	decoder   *netflow.Decoder
+	allowed   []*net.IPNet
+	maxIfaces int
+
+	// protects everything below
+	mutex     sync.Mutex
+	ifaces    map[string]*virtualIface
+	exporters map[string]*exporterStats
+	// names of all virtual interfaces ever created, including those
+	// found in the database at startup
+	known map[string]struct{}
+	// messages from exporters that aren't allowed since the last rotation
+	rejected int
+}
+
+// NewCollector starts a Collector listening on the address given by config.
+// At most maxIfaces distinct virtual interfaces are created, counting the
+// known ones (e.g. those already in the database); records of further
+// interfaces are dropped.
+func NewCollector(config CollectorConfig, maxIfaces int, known []string) (*Collector, error) {
+	allowed, err := config.exporterNets()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Collector{
+		conn:      conn,
+		decoder:   netflow.NewDecoder(),
+		allowed:   allowed,
+		maxIfaces: maxIfaces,
+		ifaces:    make(map[string]*virtualIface),
+		exporters: make(map[string]*exporterStats),
+		known:     make(map[string]struct{}),
+	}
+	for _, name := range known {
+		c.known[name] = struct{}{}
+	}
+	go c.process()
+	return c, nil
+}
+
+// Addr returns the address the Collector is listening on.
+func (c *Collector) Addr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Close stops the Collector. Flows that haven't been rotated yet are lost.
+func (c *Collector) Close() error {
+	return c.conn.Close()
+}
+
+// process receives and decodes messages until the Collector is closed.
+func (c *Collector) process() {
+	buf := make([]byte, collectorBufferSize)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			SysLog.Info(fmt.Sprintf("Stopped collecting flows because: %s", err))
+			return
+		}
+
+		exporter := addr.String()
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			if !c.isAllowed(udpAddr.IP) {
+				c.mutex.Lock()
+				c.rejected++
+				c.mutex.Unlock()
+				continue
+			}
+			exporter = udpAddr.IP.String()
+		}
+
+		// the decoder is only used by this goroutine
+		msg, err := c.decoder.Decode(exporter, buf[:n])
+
+		c.mutex.Lock()
+		c.add(exporter, msg, err)
+		c.mutex.Unlock()
+	}
+}
+
+// isAllowed checks whether messages from the exporter at ip are accepted
+func (c *Collector) isAllowed(ip net.IP) bool {
+	if len(c.allowed) == 0 {
+		return true
+	}
+	for _, network := range c.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// add accounts for a decoded message (or the error encountered
+// decoding it). Must be called with the mutex held.
+func (c *Collector) add(exporter string, msg *netflow.Message, err error) {
+	stats, exists := c.exporters[exporter]
+	if !exists {
+		stats = &exporterStats{}
+		c.exporters[exporter] = stats
+	}
+	stats.messages++
+
+	if err != nil {
+		stats.malformed++
+		SysLog.Debug(fmt.Sprintf("Failed to decode flow message from %s: %s", exporter, err))
+		// a message may fail to decode after some of its
+		// records have been decoded
+		if msg == nil {
+			return
+		}
+	}
+	stats.unknown += msg.Unknown
+
+	for _, record := range msg.Records {
+		key, ifIndex, inbound, ok := recordToKey(record, msg.DomainID)
+		if !ok {
+			continue
+		}
+
+		name := virtualIfaceName(exporter, ifIndex)
+		iface, exists := c.ifaces[name]
+		if !exists {
+			if _, known := c.known[name]; !known {
+				if len(c.known) >= c.maxIfaces {
+					stats.dropped++
+					continue
+				}
+				c.known[name] = struct{}{}
+			}
+			iface = &virtualIface{exporter: exporter, flows: make(goDB.AggFlowMap)}
+			c.ifaces[name] = iface
+		}
+
+		val, exists := iface.flows[key]
+		if !exists {
+			val = &goDB.Val{}
+			iface.flows[key] = val
+		}
+
+		bytes, _ := record.Uint(netflow.FIELD_OCTET_DELTA_COUNT)
+		packets, _ := record.Uint(netflow.FIELD_PACKET_DELTA_COUNT)
+		if inbound {
+			val.NBytesRcvd += bytes
+			val.NPktsRcvd += packets
+		} else {
+			val.NBytesSent += bytes
+			val.NPktsSent += packets
+		}
+		iface.records++
+	}
+}
+
+// Rotate sends the flows of all virtual interfaces collected since the
+// last rotation over returnChan. The statistics of each virtual interface
+// are those of its exporter: messages received (as Pcap.PacketsReceived),
+// messages that couldn't be decoded (as Pcap.PacketsDropped) and data sets
+// with unknown templates (as Pcap.PacketsIfDropped). PacketsLogged is the
+// number of records of the virtual interface.
+func (c *Collector) Rotate(returnChan chan TaggedAggFlowMap) {
+	c.mutex.Lock()
+	ifaces, exporters, rejected := c.ifaces, c.exporters, c.rejected
+	c.ifaces = make(map[string]*virtualIface)
+	c.exporters = make(map[string]*exporterStats)
+	c.rejected = 0
+	c.mutex.Unlock()
+
+	if rejected > 0 {
+		SysLog.Warning(fmt.Sprintf("Ignored %d flow messages from exporters that aren't allowed", rejected))
+	}
+	for exporter, stats := range exporters {
+		if stats.dropped > 0 {
+			SysLog.Warning(fmt.Sprintf("Dropped %d flow records from %s: too many virtual interfaces", stats.dropped, exporter))
+		}
+	}
+
+	for name, iface := range ifaces {
+		stats := exporters[iface.exporter]
+		returnChan <- TaggedAggFlowMap{
+			iface.flows,
+			CaptureStats{
+				Pcap: &pcap.Stats{
+					PacketsReceived:  stats.messages,
+					PacketsDropped:   stats.malformed,
+					PacketsIfDropped: stats.unknown,
+				},
+				PacketsLogged: iface.records,
+			},
+			name,
+		}
+	}
+}
+
+// virtualIfaceName returns the name of the virtual interface for the
+// given exporter and ifIndex. Colons of IPv6 addresses are replaced to
+// keep the name usable on the goquery command line.
+func virtualIfaceName(exporter string, ifIndex uint64) string {
+	return fmt.Sprintf("%s%s_%d", COLLECTOR_IFACE_PREFIX, strings.Replace(exporter, ":", "-", -1), ifIndex)
+}
+
+// recordToKey extracts the goDB key from a flow record. It also returns the
+// ifIndex the flow belongs to and whether the flow was inbound on that
+// interface. ok is false if the record doesn't describe an IP flow.
+func recordToKey(record netflow.Record, domain uint32) (key goDB.Key, ifIndex uint64, inbound bool, ok bool) {
+	if sip, exists := record[netflow.FIELD_SOURCE_IPV4_ADDRESS]; exists && len(sip) == 4 {
+		dip := record[netflow.FIELD_DESTINATION_IPV4_ADDRESS]
+		if len(dip) != 4 {
+			return
+		}
+		copy(key.Sip[:], sip)
+		copy(key.Dip[:], dip)
+	} else if sip, exists := record[netflow.FIELD_SOURCE_IPV6_ADDRESS]; exists && len(sip) == 16 {
+		dip := record[netflow.FIELD_DESTINATION_IPV6_ADDRESS]
+		if len(dip) != 16 {
+			return
+		}
+		copy(key.Sip[:], sip)
+		copy(key.Dip[:], dip)
+	} else {
+		return
+	}
+
+	if dport, exists := record.Uint(netflow.FIELD_DESTINATION_TRANSPORT_PORT); exists {
+		key.Dport = [2]byte{byte(dport >> 8), byte(dport)}
+	}
+	if proto, exists := record.Uint(netflow.FIELD_PROTOCOL_IDENTIFIER); exists {
+		key.Protocol = byte(proto)
+	}
+
+	inbound = true
+	if direction, exists := record.Uint(netflow.FIELD_FLOW_DIRECTION); exists && direction == netflow.DIRECTION_EGRESS {
+		inbound = false
+	}
+
+	ifField := netflow.FIELD_INGRESS_INTERFACE
+	if !inbound {
+		ifField = netflow.FIELD_EGRESS_INTERFACE
+	}
+	if ifIndex, exists := record.Uint(ifField); exists {
+		return key, ifIndex, inbound, true
+	}
+	return key, uint64(domain), inbound, true
+}
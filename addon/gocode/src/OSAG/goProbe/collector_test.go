@@ -0,0 +1,260 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// collector_test.go
+//
+// Tests for the NetFlow / IPFIX collector
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"OSAG/goDB"
+	"OSAG/netflow"
+)
+
+const MAX_TEST_IFACES = 4
+
+func startTestCollector(t *testing.T) *Collector {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	c, err := NewCollector(CollectorConfig{Listen: "127.0.0.1:0"}, MAX_TEST_IFACES, nil)
+	if err != nil {
+		t.Fatalf("failed to start collector: %s", err)
+	}
+	return c
+}
+
+// waitForMessages waits until the collector has received n messages.
+func waitForMessages(t *testing.T, c *Collector, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		received := 0
+		for _, stats := range c.exporters {
+			received += stats.messages
+		}
+		c.mutex.Unlock()
+
+		if received >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("collector didn't receive %d messages in time", n)
+}
+
+func rotateCollector(c *Collector) map[string]TaggedAggFlowMap {
+	ch := make(chan TaggedAggFlowMap, MAX_TEST_IFACES)
+	c.Rotate(ch)
+	close(ch)
+
+	result := make(map[string]TaggedAggFlowMap)
+	for tagged := range ch {
+		result[tagged.Iface] = tagged
+	}
+	return result
+}
+
+func TestCollectorNetflow5(t *testing.T) {
+	c := startTestCollector(t)
+	defer c.Close()
+
+	// two records: one arriving on ifIndex 3, one on ifIndex 7
+	msg := make([]byte, 24+2*48)
+	binary.BigEndian.PutUint16(msg[0:], 5)
+	binary.BigEndian.PutUint16(msg[2:], 2)
+	for i, ifIndex := range []uint16{3, 7} {
+		record := msg[24+i*48:]
+		copy(record[0:], []byte{10, 0, 0, 1})
+		copy(record[4:], []byte{10, 0, 0, 2})
+		binary.BigEndian.PutUint16(record[12:], ifIndex)
+		binary.BigEndian.PutUint32(record[16:], 10)   // packets
+		binary.BigEndian.PutUint32(record[20:], 1500) // bytes
+		binary.BigEndian.PutUint16(record[34:], 53)
+		record[38] = 17
+	}
+
+	conn, err := net.Dial("udp", c.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to collector: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+	// a message of an unsupported version
+	if _, err := conn.Write([]byte{0, 1, 0, 0}); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+	waitForMessages(t, c, 2)
+
+	result := rotateCollector(c)
+	if len(result) != 2 {
+		t.Fatalf("expected 2 virtual interfaces, got %d", len(result))
+	}
+
+	key := goDB.Key{Sip: [16]byte{10, 0, 0, 1}, Dip: [16]byte{10, 0, 0, 2}, Dport: [2]byte{0, 53}, Protocol: 17}
+	for _, iface := range []string{"nf_127.0.0.1_3", "nf_127.0.0.1_7"} {
+		tagged, exists := result[iface]
+		if !exists {
+			t.Fatalf("missing virtual interface %s", iface)
+		}
+		val, exists := tagged.Map[key]
+		if !exists || *val != (goDB.Val{NBytesRcvd: 1500, NPktsRcvd: 10}) {
+			t.Fatalf("%s: unexpected flow %v", iface, val)
+		}
+		if tagged.Stats.PacketsLogged != 1 || tagged.Stats.Pcap.PacketsReceived != 2 || tagged.Stats.Pcap.PacketsDropped != 1 {
+			t.Fatalf("%s: unexpected stats %+v / %+v", iface, tagged.Stats, *tagged.Stats.Pcap)
+		}
+	}
+
+	// the collector starts over after a rotation
+	if result := rotateCollector(c); len(result) != 0 {
+		t.Fatalf("expected no flows after rotation, got %d interfaces", len(result))
+	}
+}
+
+func testCollectorRoundTrip(t *testing.T, protocol string) {
+	c := startTestCollector(t)
+	defer c.Close()
+
+	exporter := netflow.NewExporter(netflow.ExporterConfig{
+		Targets: []netflow.TargetConfig{{Address: c.Addr().String(), Protocol: protocol}},
+	}, 300)
+	if err := exporter.Open(); err != nil {
+		t.Fatalf("failed to open exporter: %s", err)
+	}
+	defer exporter.Close()
+
+	flowmap := goDB.AggFlowMap{
+		goDB.Key{Sip: [16]byte{10, 0, 0, 1}, Dip: [16]byte{10, 0, 0, 2}, Dport: [2]byte{1, 187}, Protocol: 6}: &goDB.Val{
+			NBytesRcvd: 1000, NBytesSent: 2000, NPktsRcvd: 10, NPktsSent: 20,
+		},
+		goDB.Key{Sip: [16]byte{0x20, 0x01, 15: 1}, Dip: [16]byte{0x20, 0x01, 15: 2}, Dport: [2]byte{0, 53}, Protocol: 17}: &goDB.Val{
+			NBytesSent: 300, NPktsSent: 3,
+		},
+	}
+	if err := exporter.Write("nonexistent0", time.Now().Unix(), flowmap, goDB.BlockMetadata{}); err != nil {
+		t.Fatalf("failed to export flows: %s", err)
+	}
+	waitForMessages(t, c, 1)
+
+	result := rotateCollector(c)
+	if len(result) != 1 {
+		t.Fatalf("expected 1 virtual interface, got %d", len(result))
+	}
+	for _, tagged := range result {
+		if len(tagged.Map) != len(flowmap) {
+			t.Fatalf("expected %d flows, got %d", len(flowmap), len(tagged.Map))
+		}
+		for key, val := range flowmap {
+			if got, exists := tagged.Map[key]; !exists || *got != *val {
+				t.Fatalf("flow %s: expected %s, got %v", key.String(), val.String(), got)
+			}
+		}
+		if tagged.Stats.PacketsLogged != 3 {
+			t.Fatalf("expected 3 records, got %d", tagged.Stats.PacketsLogged)
+		}
+	}
+}
+
+func TestCollectorIPFIX(t *testing.T) {
+	testCollectorRoundTrip(t, netflow.PROTOCOL_IPFIX)
+}
+
+func TestCollectorNetflow9(t *testing.T) {
+	testCollectorRoundTrip(t, netflow.PROTOCOL_NETFLOW9)
+}
+
+func TestCollectorExporters(t *testing.T) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+	if err := (CollectorConfig{Listen: ":2055", Exporters: []string{"10.0.0"}}).Validate(); err == nil {
+		t.Fatalf("expected invalid exporter to be rejected")
+	}
+
+	c, err := NewCollector(CollectorConfig{Listen: "127.0.0.1:0", Exporters: []string{"10.0.0.0/8", "::1"}}, MAX_TEST_IFACES, nil)
+	if err != nil {
+		t.Fatalf("failed to start collector: %s", err)
+	}
+	defer c.Close()
+
+	for ip, allowed := range map[string]bool{"10.1.2.3": true, "::1": true, "127.0.0.1": false, "::2": false} {
+		if c.isAllowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("%s: expected allowed to be %v", ip, allowed)
+		}
+	}
+
+	conn, err := net.Dial("udp", c.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to collector: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0, 5, 0, 0}); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mutex.Lock()
+		rejected, exporters := c.rejected, len(c.exporters)
+		c.mutex.Unlock()
+
+		if rejected == 1 && exporters == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected message to be rejected, got %d rejected messages and %d exporters", rejected, exporters)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollectorIfaceLimit(t *testing.T) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	// one virtual interface is already in the database
+	c, err := NewCollector(CollectorConfig{Listen: "127.0.0.1:0"}, MAX_TEST_IFACES, []string{"nf_10.0.0.9_1"})
+	if err != nil {
+		t.Fatalf("failed to start collector: %s", err)
+	}
+	defer c.Close()
+
+	send := func(ifIndices ...byte) map[string]TaggedAggFlowMap {
+		msg := &netflow.Message{}
+		for _, ifIndex := range ifIndices {
+			msg.Records = append(msg.Records, netflow.Record{
+				netflow.FIELD_SOURCE_IPV4_ADDRESS:      []byte{10, 0, 0, 1},
+				netflow.FIELD_DESTINATION_IPV4_ADDRESS: []byte{10, 0, 0, 2},
+				netflow.FIELD_INGRESS_INTERFACE:        []byte{ifIndex},
+			})
+		}
+		c.mutex.Lock()
+		c.add("10.0.0.1", msg, nil)
+		c.mutex.Unlock()
+		return rotateCollector(c)
+	}
+
+	if result := send(1, 2, 3, 4); len(result) != MAX_TEST_IFACES-1 {
+		t.Fatalf("expected %d virtual interfaces, got %d", MAX_TEST_IFACES-1, len(result))
+	}
+	// the limit holds across rotations, known interfaces are still used
+	result := send(4, 5, 1)
+	if _, exists := result["nf_10.0.0.1_1"]; len(result) != 1 || !exists {
+		t.Fatalf("expected only the known virtual interface, got %d interfaces", len(result))
+	}
+}
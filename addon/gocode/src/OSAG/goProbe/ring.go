@@ -0,0 +1,163 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// ring.go
+//
+// In-memory ring of the most recently captured packets of an interface. The
+// ring can be dumped to a pcap file to see what happened just before an
+// incident.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// Memory budgets smaller than this can't even hold a handful of packets
+	MIN_PACKET_RING_SIZE = 64 * 1024         // 64 KiB
+	MAX_PACKET_RING_SIZE = 256 * 1024 * 1024 // 256 MiB
+)
+
+// ringSlot holds a single packet of a packetRing. The data
+// of the packet lives in the ring's buffer.
+type ringSlot struct {
+	ci     gopacket.CaptureInfo
+	length int
+}
+
+// packetRing stores the headers of the last packets seen on an interface
+// (each truncated to CAPTURE_SNAPLEN bytes). All memory is allocated
+// up front, so adding a packet never allocates.
+//
+// A packetRing is only ever accessed from the process() goroutine of
+// its Capture.
+type packetRing struct {
+	budget   int
+	linkType layers.LinkType
+	buf      []byte
+	slots    []ringSlot
+	// index of the slot the next packet is written to
+	next int
+	// number of filled slots
+	count int
+}
+
+// newPacketRing creates a packetRing for packets of the given link type
+// that uses at most budget bytes of memory.
+func newPacketRing(budget int, linkType layers.LinkType) *packetRing {
+	slotSize := CAPTURE_SNAPLEN + int(unsafe.Sizeof(ringSlot{}))
+	n := budget / slotSize
+	if n < 1 {
+		n = 1
+	}
+
+	return &packetRing{
+		budget:   budget,
+		linkType: linkType,
+		buf:      make([]byte, n*CAPTURE_SNAPLEN),
+		slots:    make([]ringSlot, n),
+	}
+}
+
+// add copies packet into the ring, overwriting the oldest packet if the ring is full.
+func (r *packetRing) add(packet gopacket.Packet) {
+	slot := &r.slots[r.next]
+	slot.ci = packet.Metadata().CaptureInfo
+	slot.length = copy(r.buf[r.next*CAPTURE_SNAPLEN:(r.next+1)*CAPTURE_SNAPLEN], packet.Data())
+	slot.ci.CaptureLength = slot.length
+
+	r.next = (r.next + 1) % len(r.slots)
+	if r.count < len(r.slots) {
+		r.count++
+	}
+}
+
+// memoryUsage returns the number of bytes allocated by the ring.
+func (r *packetRing) memoryUsage() int {
+	return len(r.buf) + len(r.slots)*int(unsafe.Sizeof(ringSlot{}))
+}
+
+// ringSnapshot holds a copy of the packets of a packetRing, so that they
+// can be written out without holding up the capture.
+type ringSnapshot struct {
+	linkType layers.LinkType
+	// the packets, oldest first. The data of each packet is stored
+	// right after the one of its predecessor in buf.
+	slots []ringSlot
+	buf   []byte
+}
+
+// snapshot copies the packets currently in the ring. Only the captured
+// bytes of each packet are copied, not the whole buffer.
+func (r *packetRing) snapshot() *ringSnapshot {
+	s := &ringSnapshot{
+		linkType: r.linkType,
+		slots:    make([]ringSlot, 0, r.count),
+	}
+
+	size := 0
+	first := (r.next - r.count + len(r.slots)) % len(r.slots)
+	for i := 0; i < r.count; i++ {
+		size += r.slots[(first+i)%len(r.slots)].length
+	}
+	s.buf = make([]byte, 0, size)
+	for i := 0; i < r.count; i++ {
+		idx := (first + i) % len(r.slots)
+		slot := r.slots[idx]
+		s.slots = append(s.slots, slot)
+		s.buf = append(s.buf, r.buf[idx*CAPTURE_SNAPLEN:idx*CAPTURE_SNAPLEN+slot.length]...)
+	}
+	return s
+}
+
+// dump writes the packets of the snapshot to a new pcap file in the trigger
+// directory (oldest packet first) and registers it in the trigger manifest.
+func (s *ringSnapshot) dump(iface string) (TriggerRecord, error) {
+	now := time.Now()
+	id := fmt.Sprintf("%s_dump_%s", iface, now.UTC().Format(PACKET_LOG_TIME_FORMAT))
+	record := TriggerRecord{
+		ID:    id,
+		Iface: iface,
+		File:  filepath.Join(TriggerLog.path, id+".pcap"),
+		Dump:  true,
+		Begin: now.Unix(),
+	}
+
+	if err := TriggerLog.mkdir(); err != nil {
+		return record, err
+	}
+
+	writer, err := NewPcapWriter(record.File, CAPTURE_SNAPLEN, s.linkType)
+	if err != nil {
+		return record, err
+	}
+
+	pos := 0
+	for _, slot := range s.slots {
+		if err = writer.WritePacketData(slot.ci, s.buf[pos:pos+slot.length]); err != nil {
+			break
+		}
+		pos += slot.length
+		record.Packets++
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return record, err
+	}
+
+	record.End = time.Now().Unix()
+	return record, TriggerLog.update(record)
+}
@@ -0,0 +1,90 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// ring_test.go
+//
+// Tests for the in-memory packet ring
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPacketRingDump(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "ring_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	InitTriggerLog(dbpath)
+
+	ring := newPacketRing(MIN_PACKET_RING_SIZE, layers.LinkTypeEthernet)
+	if ring.memoryUsage() > MIN_PACKET_RING_SIZE {
+		t.Fatalf("ring uses %d bytes, exceeding its budget of %d bytes", ring.memoryUsage(), MIN_PACKET_RING_SIZE)
+	}
+
+	// overfill the ring and mark each packet with its sequence number
+	n := len(ring.slots)
+	for i := 0; i < n+10; i++ {
+		packet := testPacket(2 * CAPTURE_SNAPLEN)
+		packet.Data()[0] = byte(i)
+		ring.add(packet)
+	}
+
+	// the snapshot isn't affected by packets added afterwards
+	snapshot := ring.snapshot()
+	ring.add(testPacket(2 * CAPTURE_SNAPLEN))
+	record, err := snapshot.dump("eth0")
+	if err != nil {
+		t.Fatalf("failed to dump ring: %s", err)
+	}
+	if record.Packets != n {
+		t.Fatalf("expected %d packets in dump, got %d", n, record.Packets)
+	}
+
+	f, err := os.Open(record.File)
+	if err != nil {
+		t.Fatalf("failed to open dump: %s", err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read dump: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("failed to read packet %d: %s", i, err)
+		}
+		if len(data) != CAPTURE_SNAPLEN || ci.CaptureLength != CAPTURE_SNAPLEN || ci.Length != 2*CAPTURE_SNAPLEN {
+			t.Fatalf("packet %d not truncated to snaplen: %d bytes, capture info %+v", i, len(data), ci)
+		}
+		// the oldest 10 packets must have been overwritten
+		if data[0] != byte(i+10) {
+			t.Fatalf("expected packet %d, got %d", byte(i+10), data[0])
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err == nil {
+		t.Fatalf("dump contains more than %d packets", n)
+	}
+
+	manifest, err := TriggerLog.ReadManifest()
+	if err != nil {
+		t.Fatalf("failed to read manifest: %s", err)
+	}
+	if len(manifest.Triggers) != 1 || !manifest.Triggers[0].Dump {
+		t.Fatalf("dump not registered in manifest: %+v", manifest)
+	}
+}
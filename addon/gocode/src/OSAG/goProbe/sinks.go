@@ -0,0 +1,227 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// sinks.go
+//
+// Dispatching of rotated flow maps to the flow sinks configured for each
+// interface.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"OSAG/goDB"
+)
+
+// Names of the available flow sinks
+const (
+	SINK_GODB    = "godb"
+	SINK_SYSLOG  = "syslog"
+	SINK_NETFLOW = "netflow"
+	SINK_STREAM  = "stream"
+)
+
+const (
+	// Number of writes (or flushes) an asynchronous sink may lag
+	// behind before further flow maps are dropped for it.
+	SINK_QUEUE_DEPTH = 4 * 1024
+
+	// Time granted to asynchronous sinks to catch up on Close
+	SINK_CLOSE_TIMEOUT = 10 * time.Second
+)
+
+// sinkJob is a single write to (or flush of) a sink
+type sinkJob struct {
+	iface     string
+	timestamp int64
+	flowmap   goDB.AggFlowMap
+	meta      goDB.BlockMetadata
+	flush     bool
+}
+
+// sinkRunner executes the jobs of a single sink, either directly
+// (synchronous sinks) or in its own goroutine.
+type sinkRunner struct {
+	name   string
+	sink   goDB.FlowSink
+	opened bool
+	// nil for synchronous sinks
+	queue chan sinkJob
+	done  chan struct{}
+}
+
+// run executes job on the sink, opening the sink first if necessary. Sinks
+// are only opened once they are written to. Errors and panics are logged,
+// so they don't affect any other sinks.
+func (r *sinkRunner) run(job sinkJob) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			SysLog.Err(fmt.Sprintf("Flow sink '%s': panic returned %v. Stacktrace:\n%s", r.name, rec, debug.Stack()))
+		}
+	}()
+
+	// a sink that hasn't been written to has nothing to flush
+	if job.flush && !r.opened {
+		return
+	}
+
+	if !r.opened {
+		if err := r.sink.Open(); err != nil {
+			SysLog.Err(fmt.Sprintf("Flow sink '%s': failed to open: %s", r.name, err))
+			return
+		}
+		r.opened = true
+	}
+
+	if job.flush {
+		if flusher, ok := r.sink.(goDB.FlowSinkFlusher); ok {
+			if err := flusher.Flush(); err != nil {
+				SysLog.Err(fmt.Sprintf("Flow sink '%s': failed to flush: %s", r.name, err))
+			}
+		}
+		return
+	}
+
+	if err := r.sink.Write(job.iface, job.timestamp, job.flowmap, job.meta); err != nil {
+		SysLog.Err(fmt.Sprintf("Flow sink '%s': failed to write flows of interface '%s': %s", r.name, job.iface, err))
+	}
+}
+
+// process runs the jobs of an asynchronous sink until its queue is closed.
+func (r *sinkRunner) process() {
+	for job := range r.queue {
+		r.run(job)
+	}
+	r.close()
+	close(r.done)
+}
+
+func (r *sinkRunner) close() {
+	if !r.opened {
+		return
+	}
+	if err := r.sink.Close(); err != nil {
+		SysLog.Err(fmt.Sprintf("Flow sink '%s': failed to close: %s", r.name, err))
+	}
+}
+
+// enqueue hands job to the sink. Jobs for asynchronous sinks are dropped if
+// the sink can't keep up.
+func (r *sinkRunner) enqueue(job sinkJob) {
+	if r.queue == nil {
+		r.run(job)
+		return
+	}
+
+	select {
+	case r.queue <- job:
+	default:
+		if job.flush {
+			SysLog.Warning(fmt.Sprintf("Flow sink '%s' is lagging behind: skipped flush", r.name))
+		} else {
+			SysLog.Warning(fmt.Sprintf("Flow sink '%s' is lagging behind: dropped flows of interface '%s'", r.name, job.iface))
+		}
+	}
+}
+
+// FlowSinks passes the flow maps of each writeout to the sinks configured
+// for their interface.
+//
+// Synchronous sinks are run directly by Write. Asynchronous sinks are run
+// in a goroutine of their own, so a slow or broken asynchronous sink can
+// neither delay nor prevent writing to the other sinks.
+//
+// FlowSinks must not be used concurrently.
+type FlowSinks struct {
+	runners map[string]*sinkRunner
+	// the order in which sinks were added
+	names []string
+
+	defaultSinks []string
+	ifaceSinks   map[string][]string
+}
+
+// NewFlowSinks creates a FlowSinks that writes the flows of each interface
+// to the sinks listed for it in ifaceSinks or, if it isn't listed, to
+// defaultSinks.
+func NewFlowSinks(defaultSinks []string, ifaceSinks map[string][]string) *FlowSinks {
+	return &FlowSinks{
+		runners:      make(map[string]*sinkRunner),
+		defaultSinks: defaultSinks,
+		ifaceSinks:   ifaceSinks,
+	}
+}
+
+// Add registers sink under name.
+func (fs *FlowSinks) Add(name string, sink goDB.FlowSink, async bool) {
+	r := &sinkRunner{
+		name: name,
+		sink: sink,
+	}
+	if async {
+		r.queue = make(chan sinkJob, SINK_QUEUE_DEPTH)
+		r.done = make(chan struct{})
+		go r.process()
+	}
+	fs.runners[name] = r
+	fs.names = append(fs.names, name)
+}
+
+// sinksOf returns the names of the sinks iface is written to.
+func (fs *FlowSinks) sinksOf(iface string) []string {
+	if sinks, exists := fs.ifaceSinks[iface]; exists {
+		return sinks
+	}
+	return fs.defaultSinks
+}
+
+// Write passes the flow map of iface to the interface's sinks.
+func (fs *FlowSinks) Write(iface string, timestamp int64, flowmap goDB.AggFlowMap, meta goDB.BlockMetadata) {
+	for _, name := range fs.sinksOf(iface) {
+		r, exists := fs.runners[name]
+		if !exists {
+			SysLog.Err(fmt.Sprintf("Interface '%s': flow sink '%s' does not exist", iface, name))
+			continue
+		}
+		r.enqueue(sinkJob{
+			iface:     iface,
+			timestamp: timestamp,
+			flowmap:   flowmap,
+			meta:      meta,
+		})
+	}
+}
+
+// Flush tells all sinks that the current writeout is complete.
+func (fs *FlowSinks) Flush() {
+	for _, name := range fs.names {
+		fs.runners[name].enqueue(sinkJob{flush: true})
+	}
+}
+
+// Close closes all sinks. Asynchronous sinks are given up to
+// SINK_CLOSE_TIMEOUT to finish their outstanding work.
+func (fs *FlowSinks) Close() {
+	deadline := time.After(SINK_CLOSE_TIMEOUT)
+	for _, name := range fs.names {
+		r := fs.runners[name]
+		if r.queue == nil {
+			r.close()
+			continue
+		}
+
+		close(r.queue)
+		select {
+		case <-r.done:
+		case <-deadline:
+			SysLog.Err(fmt.Sprintf("Flow sink '%s' didn't finish in time", name))
+		}
+	}
+}
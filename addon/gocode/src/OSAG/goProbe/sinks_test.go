@@ -0,0 +1,126 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// sinks_test.go
+//
+// Tests for the dispatching of flow maps to flow sinks
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"OSAG/goDB"
+)
+
+// testSink records the interfaces written to it. It can be made to fail
+// on Open, panic on Write or block on Write.
+type testSink struct {
+	failOpen bool
+	panics   bool
+	block    chan struct{}
+
+	opens   int
+	written []string
+	flushes int
+	closed  bool
+}
+
+func (s *testSink) Open() error {
+	s.opens++
+	if s.failOpen {
+		return fmt.Errorf("open failed")
+	}
+	return nil
+}
+
+func (s *testSink) Write(iface string, timestamp int64, flowmap goDB.AggFlowMap, meta goDB.BlockMetadata) error {
+	if s.panics {
+		panic("write panicked")
+	}
+	if s.block != nil {
+		<-s.block
+	}
+	s.written = append(s.written, iface)
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFlowSinksIsolation(t *testing.T) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	db := &testSink{}
+	broken := &testSink{failOpen: true}
+	panicking := &testSink{panics: true}
+	blocking := &testSink{block: make(chan struct{})}
+
+	sinks := NewFlowSinks(
+		[]string{"db", "broken", "panicking", "blocking"},
+		map[string][]string{"eth1": {"db"}},
+	)
+	sinks.Add("db", db, false)
+	sinks.Add("broken", broken, true)
+	sinks.Add("panicking", panicking, false)
+	sinks.Add("blocking", blocking, true)
+
+	// fill the queue of the blocking sink, and then some
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < SINK_QUEUE_DEPTH+10; i++ {
+			sinks.Write("eth0", int64(i), goDB.AggFlowMap{}, goDB.BlockMetadata{})
+			sinks.Write("eth1", int64(i), goDB.AggFlowMap{}, goDB.BlockMetadata{})
+			sinks.Flush()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("writing was blocked by a sink")
+	}
+
+	if len(db.written) != 2*(SINK_QUEUE_DEPTH+10) {
+		t.Fatalf("expected %d writes to the db sink, got %d", 2*(SINK_QUEUE_DEPTH+10), len(db.written))
+	}
+	if db.flushes != SINK_QUEUE_DEPTH+10 {
+		t.Fatalf("expected %d flushes of the db sink, got %d", SINK_QUEUE_DEPTH+10, db.flushes)
+	}
+
+	close(blocking.block)
+	sinks.Close()
+
+	// the broken sink is reopened on every write
+	if broken.opens < 2 || broken.closed {
+		t.Fatalf("unexpected state of broken sink: %d opens, closed: %v", broken.opens, broken.closed)
+	}
+	// only eth0 is written to sinks other than db
+	for _, iface := range blocking.written {
+		if iface != "eth0" {
+			t.Fatalf("unexpected write of %s to blocking sink", iface)
+		}
+	}
+	if len(blocking.written) == 0 || len(blocking.written) > SINK_QUEUE_DEPTH+1 {
+		t.Fatalf("unexpected number of writes to blocking sink: %d", len(blocking.written))
+	}
+	if !db.closed || !blocking.closed || !panicking.closed {
+		t.Fatalf("not all sinks were closed")
+	}
+}
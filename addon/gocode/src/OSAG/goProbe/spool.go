@@ -0,0 +1,238 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// spool.go
+//
+// On-disk spool for writeouts that can't be written to the database in time
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// directory of the spool, relative to the database path
+	SPOOL_DIR = "spool"
+
+	SPOOL_FILE_SUFFIX = ".gob"
+	// files being written have this suffix until they are complete
+	spoolTempSuffix = ".tmp"
+
+	DEFAULT_SPOOL_MAX_SIZE = 1024 * 1024 * 1024 // bytes
+)
+
+type SpoolConfig struct {
+	// disk budget of the spool in bytes. Defaults to DEFAULT_SPOOL_MAX_SIZE.
+	MaxSize int64 `json:"max_size"`
+}
+
+// Validate checks that the given SpoolConfig contains no bogus settings.
+func (sc SpoolConfig) Validate() error {
+	if sc.MaxSize < 0 {
+		return fmt.Errorf("Invalid spool size %d", sc.MaxSize)
+	}
+	return nil
+}
+
+// SpooledWriteout is a writeout (the flow maps of all interfaces rotated at
+// Timestamp) stored in the spool.
+type SpooledWriteout struct {
+	Timestamp int64
+	Maps      []TaggedAggFlowMap
+}
+
+// Spool stores writeouts on disk until they can be written to the
+// database. Writeouts are returned in the order they were added, also
+// across restarts. It is safe for concurrent use.
+type Spool struct {
+	dir     string
+	maxSize int64
+
+	mutex sync.Mutex
+	// the spooled files, oldest first
+	files []spoolFile
+	size  int64
+}
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// NewSpool opens the spool in dbpath, picking up any writeouts that were
+// left in it when goProbe was last stopped.
+func NewSpool(dbpath string, config SpoolConfig) (*Spool, error) {
+	s := &Spool{
+		dir:     filepath.Join(dbpath, SPOOL_DIR),
+		maxSize: config.MaxSize,
+	}
+	if s.maxSize == 0 {
+		s.maxSize = DEFAULT_SPOOL_MAX_SIZE
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by name and file names are zero-padded sequence
+	// numbers, so the oldest writeout comes first
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(s.dir, entry.Name())
+		if strings.HasSuffix(entry.Name(), spoolTempSuffix) {
+			// left over from an interrupted Add
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), SPOOL_FILE_SUFFIX) {
+			continue
+		}
+		s.files = append(s.files, spoolFile{path, entry.Size()})
+		s.size += entry.Size()
+	}
+	return s, nil
+}
+
+// Depth returns the number of spooled writeouts and their size in bytes.
+func (s *Spool) Depth() (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.files), s.size
+}
+
+// MaxSize returns the disk budget of the spool.
+func (s *Spool) MaxSize() int64 {
+	return s.maxSize
+}
+
+// nextPath returns the path of the next spool file. Must be called with
+// the mutex held.
+func (s *Spool) nextPath() string {
+	seq := uint64(0)
+	if len(s.files) > 0 {
+		last := filepath.Base(s.files[len(s.files)-1].path)
+		seq, _ = strconv.ParseUint(strings.TrimSuffix(last, SPOOL_FILE_SUFFIX), 10, 64)
+		seq++
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, SPOOL_FILE_SUFFIX))
+}
+
+// Add stores writeout in the spool. It fails if the spool would exceed its
+// disk budget, in which case nothing is stored.
+func (s *Spool) Add(writeout SpooledWriteout) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := s.nextPath()
+	tmpPath := path + spoolTempSuffix
+
+	size, err := writeSpoolFile(tmpPath, writeout, s.maxSize-s.size)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.files = append(s.files, spoolFile{path, size})
+	s.size += size
+	return nil
+}
+
+// limitedWriter fails once more than limit bytes have been written.
+type limitedWriter struct {
+	w     *bufio.Writer
+	n     int64
+	limit int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if lw.n+int64(len(p)) > lw.limit {
+		return 0, fmt.Errorf("Spool is full")
+	}
+	n, err := lw.w.Write(p)
+	lw.n += int64(n)
+	return n, err
+}
+
+func writeSpoolFile(path string, writeout SpooledWriteout, limit int64) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	lw := &limitedWriter{w: bufio.NewWriter(file), limit: limit}
+	if err := gob.NewEncoder(lw).Encode(&writeout); err != nil {
+		return 0, err
+	}
+	if err := lw.w.Flush(); err != nil {
+		return 0, err
+	}
+	// the file is only renamed into place once it is complete
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return lw.n, nil
+}
+
+// Peek returns the oldest spooled writeout without removing it. ok is false
+// if the spool is empty. A spooled writeout that can't be read is removed
+// and returned as error.
+func (s *Spool) Peek() (writeout SpooledWriteout, ok bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.files) == 0 {
+		return writeout, false, nil
+	}
+
+	file, err := os.Open(s.files[0].path)
+	if err == nil {
+		err = gob.NewDecoder(bufio.NewReader(file)).Decode(&writeout)
+		file.Close()
+	}
+	if err != nil {
+		path := s.files[0].path
+		s.pop()
+		return writeout, false, fmt.Errorf("Discarded unreadable spool file '%s': %s", path, err)
+	}
+	return writeout, true, nil
+}
+
+// Pop removes the oldest spooled writeout.
+func (s *Spool) Pop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.files) == 0 {
+		return nil
+	}
+	return s.pop()
+}
+
+// pop removes the oldest spool file. Must be called with the mutex held.
+func (s *Spool) pop() error {
+	f := s.files[0]
+	s.files = s.files[1:]
+	s.size -= f.size
+	return os.Remove(f.path)
+}
@@ -0,0 +1,139 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// spool_test.go
+//
+// Tests for the on-disk writeout spool
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+
+	"OSAG/goDB"
+)
+
+func testSpooledWriteout(timestamp int64) SpooledWriteout {
+	return SpooledWriteout{
+		Timestamp: timestamp,
+		Maps: []TaggedAggFlowMap{
+			{
+				Map: goDB.AggFlowMap{
+					goDB.Key{Sip: [16]byte{10, 0, 0, 1}, Dip: [16]byte{10, 0, 0, 2}, Dport: [2]byte{0, 53}, Protocol: 17}: &goDB.Val{NBytesRcvd: 100, NPktsRcvd: 1},
+				},
+				Stats: CaptureStats{Pcap: &pcap.Stats{PacketsReceived: 10, PacketsDropped: 1}, PacketsLogged: 9},
+				Iface: "eth0",
+			},
+			{
+				Map:   goDB.AggFlowMap{},
+				Iface: "eth1",
+			},
+		},
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "spool_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	s, err := NewSpool(dbpath, SpoolConfig{})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+	if _, ok, err := s.Peek(); ok || err != nil {
+		t.Fatalf("expected empty spool")
+	}
+
+	for ts := int64(1); ts <= 3; ts++ {
+		if err := s.Add(testSpooledWriteout(ts)); err != nil {
+			t.Fatalf("failed to spool writeout: %s", err)
+		}
+	}
+
+	// an interrupted write
+	tmpPath := filepath.Join(dbpath, SPOOL_DIR, "junk"+spoolTempSuffix)
+	if err := ioutil.WriteFile(tmpPath, []byte("junk"), 0644); err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+
+	// the writeouts survive a restart
+	n, size := s.Depth()
+	if s, err = NewSpool(dbpath, SpoolConfig{}); err != nil {
+		t.Fatalf("failed to reopen spool: %s", err)
+	}
+	if n2, size2 := s.Depth(); n2 != 3 || n != 3 || size2 != size {
+		t.Fatalf("expected 3 writeouts of %d bytes after restart, got %d of %d bytes", size, n2, size2)
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatalf("expected incomplete spool file to be removed")
+	}
+
+	for ts := int64(1); ts <= 3; ts++ {
+		spooled, ok, err := s.Peek()
+		if !ok || err != nil {
+			t.Fatalf("failed to read spooled writeout: %v", err)
+		}
+		if spooled.Timestamp != ts {
+			t.Fatalf("expected writeout %d, got %d", ts, spooled.Timestamp)
+		}
+		if len(spooled.Maps) != 2 || spooled.Maps[0].Iface != "eth0" || spooled.Maps[0].Stats.Pcap.PacketsDropped != 1 {
+			t.Fatalf("unexpected spooled writeout %+v", spooled)
+		}
+		for key, val := range testSpooledWriteout(ts).Maps[0].Map {
+			if got, exists := spooled.Maps[0].Map[key]; !exists || *got != *val {
+				t.Fatalf("flow %s: expected %s, got %v", key.String(), val.String(), got)
+			}
+		}
+		if err := s.Pop(); err != nil {
+			t.Fatalf("failed to remove spooled writeout: %s", err)
+		}
+	}
+
+	if n, size := s.Depth(); n != 0 || size != 0 {
+		t.Fatalf("expected empty spool, got %d writeouts of %d bytes", n, size)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "spool_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	s, err := NewSpool(dbpath, SpoolConfig{MaxSize: 1024})
+	if err != nil {
+		t.Fatalf("failed to open spool: %s", err)
+	}
+
+	var added int
+	for ; added < 100; added++ {
+		if err := s.Add(testSpooledWriteout(int64(added))); err != nil {
+			break
+		}
+	}
+	if added == 0 || added == 100 {
+		t.Fatalf("expected spool to fill up, added %d writeouts", added)
+	}
+
+	n, size := s.Depth()
+	if n != added || size > 1024 {
+		t.Fatalf("unexpected spool depth: %d writeouts of %d bytes", n, size)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dbpath, SPOOL_DIR))
+	if len(files) != added {
+		t.Fatalf("expected %d spool files, found %d", added, len(files))
+	}
+}
@@ -0,0 +1,298 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// stream.go
+//
+// Streaming of rotated flows to local subscribers
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"OSAG/goDB"
+)
+
+const (
+	// SUBSCRIBE <format> [<filter>]
+	STREAM_CMD_SUBSCRIBE = "SUBSCRIBE"
+
+	STREAM_REPLY_DONE  = "DONE"
+	STREAM_REPLY_ERROR = "ERROR"
+
+	STREAM_FORMAT_JSON = goDB.SYSLOG_FORMAT_JSON
+	STREAM_FORMAT_CSV  = goDB.SYSLOG_FORMAT_CSV
+
+	// Number of flow maps a subscriber may lag behind before it is dropped
+	STREAM_QUEUE_DEPTH = 1024
+
+	STREAM_MAX_SUBSCRIBERS = 64
+
+	// Time a client has to send its subscription
+	STREAM_SUBSCRIBE_TIMEOUT = 10 * time.Second
+	// Time a subscriber has to accept the flows of a single interface
+	STREAM_WRITE_TIMEOUT = 10 * time.Second
+
+	STREAM_FILTER_DNS_TIMEOUT = time.Second
+)
+
+// subscriber is a client of a FlowStreamer
+type subscriber struct {
+	conn net.Conn
+	// the subscription line, for logging
+	desc        string
+	format      string
+	conditional goDB.Node
+	// formatted flows of a single interface each
+	queue chan []byte
+}
+
+// FlowStreamer is a FlowSink sending the flows of each writeout to the
+// clients that subscribed on its listener.
+//
+// A client subscribes by sending a single line of the form
+//
+//	SUBSCRIBE <format> [<filter>]
+//
+// where format is json (JSON lines) or csv and filter is a goDB
+// conditional. If the subscription is accepted, the client receives DONE
+// followed by one line per flow; otherwise it receives ERROR and is
+// disconnected. Subscribers that fall behind are disconnected.
+type FlowStreamer struct {
+	listener net.Listener
+
+	mutex       sync.Mutex
+	subscribers map[*subscriber]struct{}
+	// connections of clients that haven't subscribed yet
+	pending map[net.Conn]struct{}
+	closed  bool
+
+	// the accept, subscribe and send goroutines
+	wg sync.WaitGroup
+}
+
+// NewFlowStreamer accepts subscriptions on listener until the FlowStreamer
+// is closed.
+func NewFlowStreamer(listener net.Listener) *FlowStreamer {
+	fs := &FlowStreamer{
+		listener:    listener,
+		subscribers: make(map[*subscriber]struct{}),
+		pending:     make(map[net.Conn]struct{}),
+	}
+	fs.wg.Add(1)
+	go fs.accept()
+	return fs
+}
+
+func (fs *FlowStreamer) accept() {
+	defer fs.wg.Done()
+	for {
+		conn, err := fs.listener.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			SysLog.Info(fmt.Sprintf("Stopped accepting flow subscriptions because: %s", err))
+			return
+		}
+
+		fs.mutex.Lock()
+		if fs.closed {
+			fs.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		fs.pending[conn] = struct{}{}
+		fs.wg.Add(1)
+		fs.mutex.Unlock()
+		go fs.subscribe(conn)
+	}
+}
+
+// subscribe handles the subscription request of a new client.
+func (fs *FlowStreamer) subscribe(conn net.Conn) {
+	defer fs.wg.Done()
+
+	conn.SetReadDeadline(time.Now().Add(STREAM_SUBSCRIBE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+
+	fs.mutex.Lock()
+	delete(fs.pending, conn)
+	fs.mutex.Unlock()
+
+	if err != nil {
+		SysLog.Debug(fmt.Sprintf("Error on flow stream socket: %s", err))
+		conn.Close()
+		return
+	}
+
+	line = strings.TrimSpace(line)
+	sub, err := parseSubscription(line)
+	if err == nil {
+		sub.conn, sub.desc = conn, line
+		err = fs.add(sub)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+	if err != nil {
+		SysLog.Warning(fmt.Sprintf("Rejected flow subscription '%s': %s", line, err))
+		io.WriteString(conn, STREAM_REPLY_ERROR+"\n")
+		conn.Close()
+		return
+	}
+	SysLog.Info(fmt.Sprintf("Accepted flow subscription '%s'", line))
+
+	// flows queued in the meantime are only sent after the reply
+	if _, err := io.WriteString(conn, STREAM_REPLY_DONE+"\n"); err != nil {
+		fs.remove(sub)
+	}
+	fs.send(sub)
+}
+
+// parseSubscription parses a SUBSCRIBE line.
+func parseSubscription(line string) (*subscriber, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if fields[0] != STREAM_CMD_SUBSCRIBE || len(fields) < 2 {
+		return nil, fmt.Errorf("Expected '%s <format> [<filter>]'", STREAM_CMD_SUBSCRIBE)
+	}
+
+	sub := &subscriber{queue: make(chan []byte, STREAM_QUEUE_DEPTH)}
+
+	switch fields[1] {
+	case STREAM_FORMAT_JSON, STREAM_FORMAT_CSV:
+		sub.format = fields[1]
+	default:
+		return nil, fmt.Errorf("Unknown format '%s'", fields[1])
+	}
+
+	if len(fields) == 3 && strings.TrimSpace(fields[2]) != "" {
+		conditional, err := goDB.SanitizeUserInput(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if sub.conditional, err = goDB.ParseAndInstrumentConditional(conditional, STREAM_FILTER_DNS_TIMEOUT); err != nil {
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+func (fs *FlowStreamer) add(sub *subscriber) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return fmt.Errorf("Shutting down")
+	}
+	if len(fs.subscribers) >= STREAM_MAX_SUBSCRIBERS {
+		return fmt.Errorf("Too many subscribers")
+	}
+	fs.subscribers[sub] = struct{}{}
+	return nil
+}
+
+// drop disconnects sub. Must be called with the mutex held.
+func (fs *FlowStreamer) drop(sub *subscriber) {
+	if _, exists := fs.subscribers[sub]; !exists {
+		return
+	}
+	delete(fs.subscribers, sub)
+	close(sub.queue)
+}
+
+func (fs *FlowStreamer) remove(sub *subscriber) {
+	fs.mutex.Lock()
+	fs.drop(sub)
+	fs.mutex.Unlock()
+}
+
+// send writes the queued flows to the subscriber until its queue is closed
+// or writing fails.
+func (fs *FlowStreamer) send(sub *subscriber) {
+	defer sub.conn.Close()
+
+	for data := range sub.queue {
+		sub.conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		if _, err := sub.conn.Write(data); err != nil {
+			SysLog.Info(fmt.Sprintf("Dropped flow subscriber '%s': %s", sub.desc, err))
+			fs.remove(sub)
+			// discard whatever is left in the (now closed) queue
+			for range sub.queue {
+			}
+			return
+		}
+	}
+}
+
+// formatFlows formats the flows matching the subscriber's filter.
+func (sub *subscriber) formatFlows(iface string, timestamp int64, flowmap goDB.AggFlowMap) []byte {
+	var buf bytes.Buffer
+	for flowKey, flowVal := range flowmap {
+		key := &goDB.ExtraKey{Time: timestamp, Iface: iface, Key: flowKey}
+		if !goDB.EvaluateConditional(sub.conditional, key) {
+			continue
+		}
+		buf.WriteString(goDB.FormatFlow(sub.format, key, flowVal))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func (fs *FlowStreamer) Open() error {
+	return nil
+}
+
+// Write queues the flows of iface for all subscribers. It never blocks:
+// subscribers whose queue is full are dropped.
+func (fs *FlowStreamer) Write(iface string, timestamp int64, flowmap goDB.AggFlowMap, meta goDB.BlockMetadata) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for sub := range fs.subscribers {
+		data := sub.formatFlows(iface, timestamp, flowmap)
+		if len(data) == 0 {
+			continue
+		}
+
+		select {
+		case sub.queue <- data:
+		default:
+			SysLog.Warning(fmt.Sprintf("Dropped flow subscriber '%s': too slow", sub.desc))
+			fs.drop(sub)
+		}
+	}
+	return nil
+}
+
+// Close stops accepting subscriptions and disconnects all subscribers
+// once they have received the flows queued for them. It returns after
+// all goroutines of the FlowStreamer have exited.
+func (fs *FlowStreamer) Close() error {
+	err := fs.listener.Close()
+
+	fs.mutex.Lock()
+	fs.closed = true
+	for sub := range fs.subscribers {
+		fs.drop(sub)
+	}
+	// don't wait for clients that never subscribe
+	for conn := range fs.pending {
+		conn.Close()
+	}
+	fs.mutex.Unlock()
+
+	fs.wg.Wait()
+	return err
+}
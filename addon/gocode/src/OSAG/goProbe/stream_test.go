@@ -0,0 +1,183 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// stream_test.go
+//
+// Tests for the streaming of flows to local subscribers
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"OSAG/goDB"
+)
+
+func startTestStreamer(t *testing.T) (*FlowStreamer, string, func()) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "stream_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	path := filepath.Join(dir, "stream.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	fs := NewFlowStreamer(listener)
+	return fs, path, func() {
+		fs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func subscribe(t *testing.T, path, line string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	if reply != STREAM_REPLY_DONE+"\n" {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, reader
+}
+
+func TestFlowStreamer(t *testing.T) {
+	fs, path, cleanup := startTestStreamer(t)
+	defer cleanup()
+
+	if conn, _ := subscribe(t, path, "SUBSCRIBE xml"); conn != nil {
+		t.Fatalf("expected subscription with unknown format to be rejected")
+	}
+
+	conn, reader := subscribe(t, path, "SUBSCRIBE json dport = 443")
+	if conn == nil {
+		t.Fatalf("subscription was rejected")
+	}
+	defer conn.Close()
+
+	flowmap := goDB.AggFlowMap{
+		goDB.Key{Sip: [16]byte{10, 0, 0, 1}, Dip: [16]byte{10, 0, 0, 2}, Dport: [2]byte{1, 187}, Protocol: 6}: &goDB.Val{NBytesRcvd: 100, NPktsRcvd: 1},
+		goDB.Key{Sip: [16]byte{10, 0, 0, 1}, Dip: [16]byte{10, 0, 0, 2}, Dport: [2]byte{0, 80}, Protocol: 6}:  &goDB.Val{NBytesRcvd: 100, NPktsRcvd: 1},
+	}
+	if err := fs.Write("eth0", 1466000000, flowmap, goDB.BlockMetadata{}); err != nil {
+		t.Fatalf("failed to write flows: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read flow: %s", err)
+	}
+	var flow map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &flow); err != nil {
+		t.Fatalf("failed to parse flow %q: %s", line, err)
+	}
+	if flow["iface"] != "eth0" || flow["dport"] != float64(443) {
+		t.Fatalf("unexpected flow %v", flow)
+	}
+
+	// the flow to port 80 doesn't match the filter
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("unexpected flow %q", line)
+	}
+}
+
+func TestFlowStreamerSlowSubscriber(t *testing.T) {
+	fs, path, cleanup := startTestStreamer(t)
+	defer cleanup()
+
+	// a subscriber that never reads
+	conn, _ := subscribe(t, path, "SUBSCRIBE csv")
+	if conn == nil {
+		t.Fatalf("subscription was rejected")
+	}
+	defer conn.Close()
+
+	flowmap := make(goDB.AggFlowMap)
+	for i := 0; i < 1000; i++ {
+		flowmap[goDB.Key{Sip: [16]byte{10, 0, byte(i >> 8), byte(i)}, Protocol: 17}] = &goDB.Val{NPktsSent: 1}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*STREAM_QUEUE_DEPTH; i++ {
+			fs.Write("eth0", int64(i), flowmap, goDB.BlockMetadata{})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("writing was blocked by a slow subscriber")
+	}
+
+	fs.mutex.Lock()
+	subscribers := len(fs.subscribers)
+	fs.mutex.Unlock()
+	if subscribers != 0 {
+		t.Fatalf("expected slow subscriber to be dropped")
+	}
+}
+
+func TestFlowStreamerClose(t *testing.T) {
+	fs, path, cleanup := startTestStreamer(t)
+	defer cleanup()
+
+	// a subscriber and a client that never sends its subscription
+	conn, reader := subscribe(t, path, "SUBSCRIBE json")
+	if conn == nil {
+		t.Fatalf("subscription was rejected")
+	}
+	defer conn.Close()
+	idle, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer idle.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		fs.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(STREAM_SUBSCRIBE_TIMEOUT / 2):
+		t.Fatalf("closing waited for the idle client")
+	}
+
+	// all goroutines are done, so the subscriber is disconnected
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("unexpected data %q after closing", line)
+	}
+}
@@ -0,0 +1,300 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// trigger.go
+//
+// On-demand packet capture: a trigger makes a Capture write all packets
+// matching a filter to a pcap file for a limited time or number of packets.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+
+	"OSAG/goDB"
+)
+
+const (
+	TRIGGER_DIR           = "triggers"
+	TRIGGER_MANIFEST_FILE = "manifest.json"
+
+	// Upper bound on the lifetime of a trigger. Also applies to triggers
+	// that are only limited by a number of packets.
+	TRIGGER_MAX_DURATION = time.Hour
+
+	TRIGGER_FILTER_CONDITIONAL = "conditional"
+	TRIGGER_FILTER_BPF         = "bpf"
+)
+
+// TriggerSpec describes which packets a trigger captures and when it ends.
+type TriggerSpec struct {
+	// FilterType is either TRIGGER_FILTER_CONDITIONAL or TRIGGER_FILTER_BPF
+	FilterType string
+	// Filter is a goDB conditional or a BPF expression, depending on FilterType.
+	// An empty filter matches all packets.
+	Filter string
+	// The trigger ends after Duration has passed or MaxPackets packets have
+	// been written, whichever comes first. Zero values mean "no limit", but
+	// a trigger never runs for longer than TRIGGER_MAX_DURATION.
+	Duration   time.Duration
+	MaxPackets int
+}
+
+// Validate checks that the given TriggerSpec contains no bogus settings.
+func (ts TriggerSpec) Validate() error {
+	if ts.FilterType != TRIGGER_FILTER_CONDITIONAL && ts.FilterType != TRIGGER_FILTER_BPF {
+		return fmt.Errorf("Unknown filter type '%s'", ts.FilterType)
+	}
+	if ts.Duration < 0 || ts.Duration > TRIGGER_MAX_DURATION {
+		return fmt.Errorf("Trigger duration must be in range [0, %s]", TRIGGER_MAX_DURATION)
+	}
+	if ts.MaxPackets < 0 {
+		return fmt.Errorf("Trigger packet limit must not be negative")
+	}
+	return nil
+}
+
+// TriggerRecord is the manifest entry of a trigger.
+type TriggerRecord struct {
+	ID         string `json:"id"`
+	Iface      string `json:"iface"`
+	File       string `json:"file"`
+	FilterType string `json:"filter_type"`
+	Filter     string `json:"filter"`
+	// Dump is set if the file was written from the packet ring
+	// of the interface rather than by a trigger
+	Dump bool `json:"dump,omitempty"`
+	// limits as requested
+	Duration   int64 `json:"duration"` // in seconds
+	MaxPackets int   `json:"max_packets"`
+	// trigger time and end time as epoch timestamps. End is 0 as long
+	// as the trigger is running.
+	Begin   int64 `json:"begin"`
+	End     int64 `json:"end"`
+	Packets int   `json:"packets"`
+}
+
+// TriggerManifest lists all triggers ever issued for a database.
+type TriggerManifest struct {
+	Triggers []TriggerRecord `json:"triggers"`
+}
+
+// TriggerLogWriter maintains the trigger directory and manifest in
+// the database directory.
+type TriggerLogWriter struct {
+	sync.Mutex
+	path string
+}
+
+var TriggerLog *TriggerLogWriter
+
+func InitTriggerLog(dbpath string) {
+	TriggerLog = &TriggerLogWriter{path: filepath.Join(dbpath, TRIGGER_DIR)}
+}
+
+// mkdir creates the trigger directory if it doesn't exist yet.
+func (t *TriggerLogWriter) mkdir() error {
+	return os.MkdirAll(t.path, 0755)
+}
+
+func (t *TriggerLogWriter) manifestPath() string {
+	return filepath.Join(t.path, TRIGGER_MANIFEST_FILE)
+}
+
+// ReadManifest reads the trigger manifest. A missing manifest
+// yields an empty one.
+func (t *TriggerLogWriter) ReadManifest() (*TriggerManifest, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.readManifest()
+}
+
+func (t *TriggerLogWriter) readManifest() (*TriggerManifest, error) {
+	var manifest TriggerManifest
+
+	f, err := os.Open(t.manifestPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &manifest, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// update inserts record into the manifest or replaces the entry with the same ID.
+func (t *TriggerLogWriter) update(record TriggerRecord) error {
+	t.Lock()
+	defer t.Unlock()
+
+	manifest, err := t.readManifest()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range manifest.Triggers {
+		if manifest.Triggers[i].ID == record.ID {
+			manifest.Triggers[i] = record
+			found = true
+		}
+	}
+	if !found {
+		manifest.Triggers = append(manifest.Triggers, record)
+	}
+
+	f, err := os.Create(t.manifestPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(manifest)
+}
+
+// trigger is an active trigger of a Capture. It is only
+// ever accessed from the Capture's process() goroutine.
+type trigger struct {
+	record      TriggerRecord
+	deadline    time.Time
+	conditional goDB.Node
+	bpf         *pcap.BPF
+	writer      *PcapWriter
+}
+
+// newTrigger creates the pcap file for a trigger on the given (active) pcap handle
+// and registers the trigger in the manifest.
+func newTrigger(iface string, handle *pcap.Handle, spec TriggerSpec) (*trigger, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	t := &trigger{}
+
+	switch spec.FilterType {
+	case TRIGGER_FILTER_CONDITIONAL:
+		conditional, err := goDB.SanitizeUserInput(spec.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if t.conditional, err = goDB.ParseAndInstrumentConditional(conditional, time.Second); err != nil {
+			return nil, err
+		}
+	case TRIGGER_FILTER_BPF:
+		if spec.Filter != "" {
+			PcapMutex.Lock()
+			bpf, err := handle.NewBPF(spec.Filter)
+			PcapMutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			t.bpf = bpf
+		}
+	}
+
+	now := time.Now()
+	t.deadline = now.Add(TRIGGER_MAX_DURATION)
+	if spec.Duration > 0 {
+		t.deadline = now.Add(spec.Duration)
+	}
+
+	id := fmt.Sprintf("%s_%s", iface, now.UTC().Format(PACKET_LOG_TIME_FORMAT))
+	t.record = TriggerRecord{
+		ID:         id,
+		Iface:      iface,
+		File:       filepath.Join(TriggerLog.path, id+".pcap"),
+		FilterType: spec.FilterType,
+		Filter:     spec.Filter,
+		Duration:   int64(spec.Duration / time.Second),
+		MaxPackets: spec.MaxPackets,
+		Begin:      now.Unix(),
+	}
+
+	if err := TriggerLog.mkdir(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if t.writer, err = NewPcapWriter(t.record.File, CAPTURE_SNAPLEN, handle.LinkType()); err != nil {
+		return nil, err
+	}
+
+	if err := TriggerLog.update(t.record); err != nil {
+		t.writer.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// matches checks whether packet passes the trigger's filter. key
+// is nil if the packet could not be decoded.
+func (t *trigger) matches(packet gopacket.Packet, key *goDB.ExtraKey) bool {
+	if t.bpf != nil {
+		return t.bpf.Matches(packet.Metadata().CaptureInfo, packet.Data())
+	}
+	if t.conditional != nil {
+		return key != nil && goDB.EvaluateConditional(t.conditional, key)
+	}
+	return true
+}
+
+// log writes packet to the trigger's pcap file if it matches the filter.
+// Returns whether the trigger is done.
+func (t *trigger) log(packet gopacket.Packet, key *goDB.ExtraKey) bool {
+	if t.matches(packet, key) {
+		if err := t.writer.WritePacket(packet); err != nil {
+			SysLog.Err(fmt.Sprintf("Trigger '%s': failed to write packet: %s", t.record.ID, err))
+			return true
+		}
+		t.record.Packets++
+	}
+	return t.record.MaxPackets > 0 && t.record.Packets >= t.record.MaxPackets
+}
+
+func (t *trigger) expired(now time.Time) bool {
+	return !now.Before(t.deadline)
+}
+
+// finish closes the trigger's pcap file and updates its manifest entry.
+func (t *trigger) finish() {
+	t.writer.Close()
+	t.record.End = time.Now().Unix()
+
+	if err := TriggerLog.update(t.record); err != nil {
+		SysLog.Err(fmt.Sprintf("Trigger '%s': failed to update manifest: %s", t.record.ID, err))
+	}
+	SysLog.Info(fmt.Sprintf("Trigger '%s': wrote %d packets to %s", t.record.ID, t.record.Packets, t.record.File))
+}
+
+// triggerKey builds the key a goDB conditional is evaluated on from a packet.
+func triggerKey(iface string, p *GPPacket) *goDB.ExtraKey {
+	return &goDB.ExtraKey{
+		Time:  time.Now().Unix(),
+		Iface: iface,
+		Key: goDB.Key{
+			Sip:      p.sip,
+			Dip:      p.dip,
+			Dport:    p.dport,
+			Protocol: p.protocol,
+		},
+	}
+}
@@ -0,0 +1,171 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// trigger_test.go
+//
+// Tests for on-demand packet capture triggers
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package goProbe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"OSAG/goDB"
+)
+
+func TestTriggerPacketLimit(t *testing.T) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	dbpath, err := ioutil.TempDir("", "trigger_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	InitTriggerLog(dbpath)
+	if err := TriggerLog.mkdir(); err != nil {
+		t.Fatalf("failed to create trigger directory: %s", err)
+	}
+
+	conditional, err := goDB.ParseAndInstrumentConditional("dport = 443", time.Second)
+	if err != nil {
+		t.Fatalf("failed to parse conditional: %s", err)
+	}
+
+	tr := &trigger{
+		record: TriggerRecord{
+			ID:         "eth0_test",
+			Iface:      "eth0",
+			File:       filepath.Join(TriggerLog.path, "eth0_test.pcap"),
+			FilterType: TRIGGER_FILTER_CONDITIONAL,
+			Filter:     "dport = 443",
+			MaxPackets: 2,
+			Begin:      time.Now().Unix(),
+		},
+		deadline:    time.Now().Add(time.Minute),
+		conditional: conditional,
+	}
+	if tr.writer, err = NewPcapWriter(tr.record.File, CAPTURE_SNAPLEN, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to create pcap writer: %s", err)
+	}
+	if err := TriggerLog.update(tr.record); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+
+	https := &goDB.ExtraKey{Iface: "eth0", Key: goDB.Key{Dport: [2]byte{0x01, 0xbb}, Protocol: 6}}
+	dns := &goDB.ExtraKey{Iface: "eth0", Key: goDB.Key{Dport: [2]byte{0x00, 0x35}, Protocol: 17}}
+
+	for i, key := range []*goDB.ExtraKey{dns, https, nil, dns} {
+		if tr.log(testPacket(CAPTURE_SNAPLEN), key) {
+			t.Fatalf("trigger done after packet %d", i)
+		}
+	}
+	if !tr.log(testPacket(CAPTURE_SNAPLEN), https) {
+		t.Fatalf("trigger not done after reaching packet limit")
+	}
+	tr.finish()
+
+	manifest, err := TriggerLog.ReadManifest()
+	if err != nil {
+		t.Fatalf("failed to read manifest: %s", err)
+	}
+	if len(manifest.Triggers) != 1 {
+		t.Fatalf("expected 1 manifest entry, got %d", len(manifest.Triggers))
+	}
+	record := manifest.Triggers[0]
+	if record.Packets != 2 {
+		t.Fatalf("expected 2 packets in manifest, got %d", record.Packets)
+	}
+	if record.End == 0 {
+		t.Fatalf("trigger not marked as ended in manifest")
+	}
+
+	fi, err := os.Stat(record.File)
+	if err != nil {
+		t.Fatalf("failed to stat pcap: %s", err)
+	}
+	if expected := int64(pcapFileHeaderSize + 2*(pcapPacketHeaderSize+CAPTURE_SNAPLEN)); fi.Size() != expected {
+		t.Fatalf("expected pcap of %d bytes, got %d", expected, fi.Size())
+	}
+}
+
+// setTrigger makes a trigger the running trigger of a Capture
+type setTrigger struct {
+	trigger    *trigger
+	returnChan chan<- struct{}
+}
+
+func (cmd setTrigger) execute(c *Capture) {
+	c.trigger = cmd.trigger
+	cmd.returnChan <- struct{}{}
+}
+
+func TestTriggerExpiry(t *testing.T) {
+	if err := InitGPLog(); err != nil {
+		t.Fatalf("failed to initialize logger: %s", err)
+	}
+
+	dbpath, err := ioutil.TempDir("", "trigger_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	InitTriggerLog(dbpath)
+	if err := TriggerLog.mkdir(); err != nil {
+		t.Fatalf("failed to create trigger directory: %s", err)
+	}
+
+	tr := &trigger{
+		record: TriggerRecord{
+			ID:    "eth0_test",
+			Iface: "eth0",
+			File:  filepath.Join(TriggerLog.path, "eth0_test.pcap"),
+			Begin: time.Now().Unix(),
+		},
+		deadline: time.Now().Add(100 * time.Millisecond),
+	}
+	if tr.writer, err = NewPcapWriter(tr.record.File, CAPTURE_SNAPLEN, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to create pcap writer: %s", err)
+	}
+	if err := TriggerLog.update(tr.record); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+
+	// a capture that isn't capturing any packets
+	c := NewCapture("eth0", CaptureConfig{})
+	defer c.Close()
+	ch := make(chan struct{}, 1)
+	c.cmdChan <- setTrigger{tr, ch}
+	<-ch
+
+	ended := func() bool {
+		manifest, err := TriggerLog.ReadManifest()
+		if err != nil || len(manifest.Triggers) != 1 {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+		return manifest.Triggers[0].End != 0
+	}
+
+	c.ExpireTrigger()
+	if ended() {
+		t.Fatalf("trigger ended before its deadline")
+	}
+	time.Sleep(200 * time.Millisecond)
+	c.ExpireTrigger()
+	if !ended() {
+		t.Fatalf("trigger didn't end after its deadline")
+	}
+}
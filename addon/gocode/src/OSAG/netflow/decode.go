@@ -0,0 +1,437 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// decode.go
+//
+// Decoding of NetFlow v9 and IPFIX messages
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package netflow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// variable length fields are announced with this length in IPFIX templates
+const variableLength = 0xFFFF
+
+const (
+	// Templates of an exporter beyond this number are ignored, so that
+	// a (spoofed) exporter can't make the Decoder grow without bounds
+	MAX_TEMPLATES_PER_EXPORTER = 1024
+	// Templates that aren't refreshed within this time are forgotten.
+	// Exporters resend their templates every 30 minutes by default.
+	TEMPLATE_TIMEOUT = 2 * time.Hour
+	// Interval at which the templates are checked for expiry
+	TEMPLATE_EXPIRY_INTERVAL = time.Minute
+)
+
+const (
+	netflow5HeaderSize = 24
+	netflow5RecordSize = 48
+)
+
+// netflow5Fields describes where the fields of a NetFlow v5 record are
+// located. They are decoded into the corresponding information elements.
+var netflow5Fields = []struct {
+	id     uint16
+	offset int
+	length int
+}{
+	{FIELD_SOURCE_IPV4_ADDRESS, 0, 4},
+	{FIELD_DESTINATION_IPV4_ADDRESS, 4, 4},
+	{FIELD_INGRESS_INTERFACE, 12, 2},
+	{FIELD_EGRESS_INTERFACE, 14, 2},
+	{FIELD_PACKET_DELTA_COUNT, 16, 4},
+	{FIELD_OCTET_DELTA_COUNT, 20, 4},
+	{FIELD_FLOW_START_SYSUPTIME, 24, 4},
+	{FIELD_FLOW_END_SYSUPTIME, 28, 4},
+	{FIELD_SOURCE_TRANSPORT_PORT, 32, 2},
+	{FIELD_DESTINATION_TRANSPORT_PORT, 34, 2},
+	{FIELD_PROTOCOL_IDENTIFIER, 38, 1},
+}
+
+// Record maps the information element IDs of a data record to their raw
+// values (in network byte order). Enterprise-specific elements are dropped.
+type Record map[uint16][]byte
+
+// Uint returns the value of the unsigned integer element id. Reduced size
+// encodings (RFC 7011, section 6.2) are supported.
+func (r Record) Uint(id uint16) (uint64, bool) {
+	value, exists := r[id]
+	if !exists || len(value) == 0 || len(value) > 8 {
+		return 0, false
+	}
+	var result uint64
+	for _, b := range value {
+		result = result<<8 | uint64(b)
+	}
+	return result, true
+}
+
+// Message is a decoded export packet.
+type Message struct {
+	Version    uint16
+	ExportTime uint32 // epoch seconds
+	SysUptime  uint32 // milliseconds, NetFlow only
+	Sequence   uint32
+	// observation domain (IPFIX), source ID (NetFlow v9) or
+	// engine type and ID (NetFlow v5, as engine_type<<8 | engine_id)
+	DomainID uint32
+	// data records. Records described by options templates are not included.
+	Records []Record
+	// number of data sets that were skipped because their template is unknown
+	Unknown int
+}
+
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+}
+
+type template struct {
+	fields []templateField
+	// options templates describe metadata about the exporter
+	// rather than flows
+	options bool
+	// when the template was last received
+	refreshed time.Time
+}
+
+// templates are scoped to an exporter and an observation domain
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+// Decoder decodes messages of any number of exporters, keeping track of their
+// templates. A Decoder must not be used concurrently.
+type Decoder struct {
+	templates map[templateKey]*template
+	// number of templates per exporter
+	counts map[string]int
+
+	now        func() time.Time
+	lastExpiry time.Time
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		templates: make(map[templateKey]*template),
+		counts:    make(map[string]int),
+		now:       time.Now,
+	}
+}
+
+// addTemplate remembers t as the template for key unless the exporter
+// already has MAX_TEMPLATES_PER_EXPORTER other templates. Data sets
+// referring to an ignored template count as unknown.
+func (d *Decoder) addTemplate(key templateKey, t *template) {
+	if _, exists := d.templates[key]; !exists {
+		if d.counts[key.exporter] >= MAX_TEMPLATES_PER_EXPORTER {
+			return
+		}
+		d.counts[key.exporter]++
+	}
+	t.refreshed = d.now()
+	d.templates[key] = t
+}
+
+func (d *Decoder) removeTemplate(key templateKey) {
+	if _, exists := d.templates[key]; !exists {
+		return
+	}
+	delete(d.templates, key)
+	if d.counts[key.exporter]--; d.counts[key.exporter] == 0 {
+		delete(d.counts, key.exporter)
+	}
+}
+
+// expireTemplates forgets the templates that weren't refreshed within
+// TEMPLATE_TIMEOUT, at most once every TEMPLATE_EXPIRY_INTERVAL
+func (d *Decoder) expireTemplates() {
+	now := d.now()
+	if now.Sub(d.lastExpiry) < TEMPLATE_EXPIRY_INTERVAL {
+		return
+	}
+	d.lastExpiry = now
+	for key, t := range d.templates {
+		if now.Sub(t.refreshed) > TEMPLATE_TIMEOUT {
+			d.removeTemplate(key)
+		}
+	}
+}
+
+// Decode decodes the message in data, received from exporter (usually the
+// exporter's address). Templates contained in the message are remembered for
+// subsequent messages of the same exporter. NetFlow v5 records are decoded
+// as if they were described by a template.
+// The values of the returned records point into data.
+func (d *Decoder) Decode(exporter string, data []byte) (*Message, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("Message too short")
+	}
+	d.expireTemplates()
+
+	switch version := binary.BigEndian.Uint16(data); version {
+	case VERSION_NETFLOW5:
+		return decodeNetflow5(data)
+	case VERSION_NETFLOW9:
+		return d.decodeNetflow9(exporter, data)
+	case VERSION_IPFIX:
+		return d.decodeIPFIX(exporter, data)
+	default:
+		return nil, fmt.Errorf("Unsupported version %d", version)
+	}
+}
+
+func decodeNetflow5(data []byte) (*Message, error) {
+	if len(data) < netflow5HeaderSize {
+		return nil, fmt.Errorf("NetFlow v5 header truncated")
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < netflow5HeaderSize+count*netflow5RecordSize {
+		return nil, fmt.Errorf("NetFlow v5 message truncated")
+	}
+	msg := &Message{
+		Version:    VERSION_NETFLOW5,
+		SysUptime:  binary.BigEndian.Uint32(data[4:]),
+		ExportTime: binary.BigEndian.Uint32(data[8:]),
+		Sequence:   binary.BigEndian.Uint32(data[16:]),
+		DomainID:   uint32(data[20])<<8 | uint32(data[21]),
+	}
+
+	for i := 0; i < count; i++ {
+		raw := data[netflow5HeaderSize+i*netflow5RecordSize:]
+		record := make(Record, len(netflow5Fields))
+		for _, f := range netflow5Fields {
+			record[f.id] = raw[f.offset : f.offset+f.length : f.offset+f.length]
+		}
+		msg.Records = append(msg.Records, record)
+	}
+	return msg, nil
+}
+
+func (d *Decoder) decodeNetflow9(exporter string, data []byte) (*Message, error) {
+	if len(data) < netflow9HeaderSize {
+		return nil, fmt.Errorf("NetFlow v9 header truncated")
+	}
+	msg := &Message{
+		Version:    VERSION_NETFLOW9,
+		SysUptime:  binary.BigEndian.Uint32(data[4:]),
+		ExportTime: binary.BigEndian.Uint32(data[8:]),
+		Sequence:   binary.BigEndian.Uint32(data[12:]),
+		DomainID:   binary.BigEndian.Uint32(data[16:]),
+	}
+
+	return msg, d.decodeSets(exporter, msg, data[netflow9HeaderSize:])
+}
+
+func (d *Decoder) decodeIPFIX(exporter string, data []byte) (*Message, error) {
+	if len(data) < ipfixHeaderSize {
+		return nil, fmt.Errorf("IPFIX header truncated")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if length < ipfixHeaderSize || length > len(data) {
+		return nil, fmt.Errorf("Invalid IPFIX message length %d", length)
+	}
+	msg := &Message{
+		Version:    VERSION_IPFIX,
+		ExportTime: binary.BigEndian.Uint32(data[4:]),
+		Sequence:   binary.BigEndian.Uint32(data[8:]),
+		DomainID:   binary.BigEndian.Uint32(data[12:]),
+	}
+
+	return msg, d.decodeSets(exporter, msg, data[ipfixHeaderSize:length])
+}
+
+// decodeSets decodes the sets (NetFlow v9: flowsets) following the message header.
+func (d *Decoder) decodeSets(exporter string, msg *Message, data []byte) error {
+	for len(data) >= setHeaderSize {
+		id := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < setHeaderSize || length > len(data) {
+			return fmt.Errorf("Invalid set length %d", length)
+		}
+		body := data[setHeaderSize:length]
+		data = data[length:]
+
+		var err error
+		switch {
+		case msg.Version == VERSION_NETFLOW9 && id == SET_ID_NETFLOW9_TEMPLATE:
+			err = d.decodeTemplates(exporter, msg, body, false)
+		case msg.Version == VERSION_NETFLOW9 && id == SET_ID_NETFLOW9_OPTIONS_TEMPLATE:
+			err = d.decodeNetflow9OptionsTemplates(exporter, msg, body)
+		case msg.Version == VERSION_IPFIX && id == SET_ID_IPFIX_TEMPLATE:
+			err = d.decodeTemplates(exporter, msg, body, false)
+		case msg.Version == VERSION_IPFIX && id == SET_ID_IPFIX_OPTIONS_TEMPLATE:
+			err = d.decodeTemplates(exporter, msg, body, true)
+		case id >= MIN_DATA_SET_ID:
+			t, exists := d.templates[templateKey{exporter, msg.DomainID, id}]
+			if !exists {
+				msg.Unknown++
+				continue
+			}
+			err = decodeRecords(msg, t, body)
+		default:
+			// reserved set IDs are ignored
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeField parses a field specifier of a template.
+func decodeField(msg *Message, data []byte) (templateField, []byte, error) {
+	var f templateField
+	if len(data) < 4 {
+		return f, nil, fmt.Errorf("Template truncated")
+	}
+	f.id = binary.BigEndian.Uint16(data)
+	f.length = binary.BigEndian.Uint16(data[2:])
+	data = data[4:]
+
+	if msg.Version == VERSION_IPFIX && f.id&0x8000 != 0 {
+		if len(data) < 4 {
+			return f, nil, fmt.Errorf("Template truncated")
+		}
+		f.id &^= 0x8000
+		f.enterprise = true
+		data = data[4:]
+	}
+	if msg.Version == VERSION_NETFLOW9 && f.length == variableLength {
+		return f, nil, fmt.Errorf("Variable length field %d in NetFlow v9 template", f.id)
+	}
+	return f, data, nil
+}
+
+// decodeTemplates decodes a template set of NetFlow v9 or a (options) template set of IPFIX.
+func (d *Decoder) decodeTemplates(exporter string, msg *Message, data []byte, options bool) error {
+	headerLength := 4
+	if options {
+		headerLength = 6
+	}
+
+	for len(data) >= headerLength {
+		id := binary.BigEndian.Uint16(data)
+		count := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[headerLength:]
+
+		if id < MIN_DATA_SET_ID {
+			if id == 0 && count == 0 {
+				// padding
+				break
+			}
+			return fmt.Errorf("Invalid template ID %d", id)
+		}
+
+		key := templateKey{exporter, msg.DomainID, id}
+		if count == 0 {
+			// template withdrawal (IPFIX)
+			d.removeTemplate(key)
+			continue
+		}
+
+		t := &template{options: options}
+		for i := 0; i < count; i++ {
+			var (
+				f   templateField
+				err error
+			)
+			if f, data, err = decodeField(msg, data); err != nil {
+				return err
+			}
+			t.fields = append(t.fields, f)
+		}
+		d.addTemplate(key, t)
+	}
+	return nil
+}
+
+// decodeNetflow9OptionsTemplates decodes an options template flowset of NetFlow v9.
+// Scope and option fields are not distinguished since we ignore options data.
+func (d *Decoder) decodeNetflow9OptionsTemplates(exporter string, msg *Message, data []byte) error {
+	for len(data) >= 6 {
+		id := binary.BigEndian.Uint16(data)
+		scopeLength := int(binary.BigEndian.Uint16(data[2:]))
+		optionLength := int(binary.BigEndian.Uint16(data[4:]))
+		data = data[6:]
+
+		if id < MIN_DATA_SET_ID {
+			if id == 0 {
+				// padding
+				break
+			}
+			return fmt.Errorf("Invalid template ID %d", id)
+		}
+
+		t := &template{options: true}
+		for i := 0; i < (scopeLength+optionLength)/4; i++ {
+			var (
+				f   templateField
+				err error
+			)
+			if f, data, err = decodeField(msg, data); err != nil {
+				return err
+			}
+			t.fields = append(t.fields, f)
+		}
+		d.addTemplate(templateKey{exporter, msg.DomainID, id}, t)
+	}
+	return nil
+}
+
+// decodeRecords decodes the records of a data set described by t. Trailing
+// bytes too short to hold another record are treated as padding.
+func decodeRecords(msg *Message, t *template, data []byte) error {
+	minLength := 0
+	for _, f := range t.fields {
+		if f.length == variableLength {
+			minLength++
+		} else {
+			minLength += int(f.length)
+		}
+	}
+	if minLength == 0 {
+		return fmt.Errorf("Template describes empty records")
+	}
+
+	for len(data) >= minLength {
+		record := make(Record, len(t.fields))
+		for _, f := range t.fields {
+			length := int(f.length)
+			if f.length == variableLength {
+				if len(data) < 1 {
+					return fmt.Errorf("Record truncated")
+				}
+				length, data = int(data[0]), data[1:]
+				if length == 255 {
+					if len(data) < 2 {
+						return fmt.Errorf("Record truncated")
+					}
+					length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+				}
+			}
+			if len(data) < length {
+				return fmt.Errorf("Record truncated")
+			}
+			if !f.enterprise {
+				record[f.id] = data[:length:length]
+			}
+			data = data[length:]
+		}
+		if !t.options {
+			msg.Records = append(msg.Records, record)
+		}
+	}
+	return nil
+}
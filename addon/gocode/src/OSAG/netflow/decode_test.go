@@ -0,0 +1,104 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// decode_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package netflow
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// ipfixMessage returns an IPFIX message of observation domain 1 with a
+// template set defining the templates ids (one protocolIdentifier field
+// each) and a data set with a single record for each ID in data.
+func ipfixMessage(templates []uint16, data []uint16) []byte {
+	msg := make([]byte, ipfixHeaderSize)
+	binary.BigEndian.PutUint16(msg, VERSION_IPFIX)
+	binary.BigEndian.PutUint32(msg[12:], 1)
+
+	set := func(id uint16, body []byte) {
+		header := make([]byte, setHeaderSize)
+		binary.BigEndian.PutUint16(header, id)
+		binary.BigEndian.PutUint16(header[2:], uint16(setHeaderSize+len(body)))
+		msg = append(append(msg, header...), body...)
+	}
+	if len(templates) > 0 {
+		var body []byte
+		for _, id := range templates {
+			body = append(body, byte(id>>8), byte(id), 0, 1, 0, byte(FIELD_PROTOCOL_IDENTIFIER), 0, 1)
+		}
+		set(SET_ID_IPFIX_TEMPLATE, body)
+	}
+	for _, id := range data {
+		set(id, []byte{6})
+	}
+
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	return msg
+}
+
+func TestDecoderTemplateLimit(t *testing.T) {
+	d := NewDecoder()
+
+	var ids []uint16
+	for i := 0; i < MAX_TEMPLATES_PER_EXPORTER+10; i++ {
+		ids = append(ids, uint16(MIN_DATA_SET_ID+i))
+	}
+	last := ids[len(ids)-1]
+	msg, err := d.Decode("10.0.0.1", ipfixMessage(ids, []uint16{ids[0], last}))
+	if err != nil {
+		t.Fatalf("failed to decode message: %s", err)
+	}
+	if len(msg.Records) != 1 || msg.Unknown != 1 {
+		t.Fatalf("expected templates beyond the limit to be ignored, got %d records and %d unknown sets", len(msg.Records), msg.Unknown)
+	}
+	if d.counts["10.0.0.1"] != MAX_TEMPLATES_PER_EXPORTER {
+		t.Fatalf("expected %d templates, got %d", MAX_TEMPLATES_PER_EXPORTER, d.counts["10.0.0.1"])
+	}
+
+	// refreshing a known template is fine, other exporters have their own limit
+	if msg, err = d.Decode("10.0.0.1", ipfixMessage(ids[:1], ids[:1])); err != nil || len(msg.Records) != 1 {
+		t.Fatalf("expected refreshed template to be used (error: %v)", err)
+	}
+	if msg, err = d.Decode("10.0.0.2", ipfixMessage([]uint16{last}, []uint16{last})); err != nil || len(msg.Records) != 1 {
+		t.Fatalf("expected template of other exporter to be used (error: %v)", err)
+	}
+}
+
+func TestDecoderTemplateExpiry(t *testing.T) {
+	now := time.Unix(1466000000, 0)
+	d := NewDecoder()
+	d.now = func() time.Time { return now }
+
+	if _, err := d.Decode("10.0.0.1", ipfixMessage([]uint16{256, 257}, nil)); err != nil {
+		t.Fatalf("failed to decode message: %s", err)
+	}
+
+	// template 256 is refreshed, 257 isn't
+	now = now.Add(TEMPLATE_TIMEOUT / 2)
+	d.Decode("10.0.0.1", ipfixMessage([]uint16{256}, nil))
+	now = now.Add(TEMPLATE_TIMEOUT/2 + TEMPLATE_EXPIRY_INTERVAL)
+
+	msg, err := d.Decode("10.0.0.1", ipfixMessage(nil, []uint16{256, 257}))
+	if err != nil {
+		t.Fatalf("failed to decode message: %s", err)
+	}
+	if len(msg.Records) != 1 || msg.Unknown != 1 || len(d.templates) != 1 || d.counts["10.0.0.1"] != 1 {
+		t.Fatalf("expected template 257 to expire, got %d records, %d unknown sets and %d templates",
+			len(msg.Records), msg.Unknown, len(d.templates))
+	}
+
+	// once all templates expired, nothing is left of the exporter
+	now = now.Add(TEMPLATE_TIMEOUT + TEMPLATE_EXPIRY_INTERVAL)
+	d.Decode("10.0.0.1", ipfixMessage(nil, nil))
+	if len(d.templates) != 0 || len(d.counts) != 0 {
+		t.Fatalf("expected all templates to expire, got %d templates of %d exporters", len(d.templates), len(d.counts))
+	}
+}
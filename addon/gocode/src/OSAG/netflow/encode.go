@@ -0,0 +1,204 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// encode.go
+//
+// Construction of NetFlow v9 and IPFIX messages
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package netflow
+
+import (
+	"encoding/binary"
+
+	"OSAG/goDB"
+)
+
+const (
+	// Keep messages below the usual path MTU to avoid IP fragmentation
+	MAX_MESSAGE_SIZE = 1400
+
+	ipfixHeaderSize    = 16
+	netflow9HeaderSize = 20
+	setHeaderSize      = 4
+)
+
+// flowRecord is a single direction of a goDB flow
+type flowRecord struct {
+	key       goDB.Key
+	direction byte
+	bytes     uint64
+	packets   uint64
+}
+
+// recordTimes holds the timestamps written to the records of a message.
+// Depending on the protocol, they are either epoch seconds (IPFIX) or
+// milliseconds of system uptime (NetFlow v9).
+type recordTimes struct {
+	start uint32
+	end   uint32
+}
+
+// messageBuilder assembles a single NetFlow v9 or IPFIX message.
+type messageBuilder struct {
+	protocol string
+	buf      []byte
+	// offset of the header of the currently open set (-1 if none)
+	setOffset int
+	setID     uint16
+	// number of records in the message. For NetFlow v9 this includes
+	// template records, for IPFIX only data records are counted.
+	count int
+}
+
+func headerSize(protocol string) int {
+	if protocol == PROTOCOL_NETFLOW9 {
+		return netflow9HeaderSize
+	}
+	return ipfixHeaderSize
+}
+
+func newMessageBuilder(protocol string) *messageBuilder {
+	return &messageBuilder{
+		protocol:  protocol,
+		buf:       make([]byte, headerSize(protocol), MAX_MESSAGE_SIZE),
+		setOffset: -1,
+	}
+}
+
+func (b *messageBuilder) empty() bool {
+	return len(b.buf) == headerSize(b.protocol)
+}
+
+// closeSet finishes the currently open set (if any) by padding it to
+// a multiple of four bytes (NetFlow v9 only) and writing its length.
+func (b *messageBuilder) closeSet() {
+	if b.setOffset < 0 {
+		return
+	}
+	if b.protocol == PROTOCOL_NETFLOW9 {
+		for (len(b.buf)-b.setOffset)%4 != 0 {
+			b.buf = append(b.buf, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(b.buf[b.setOffset+2:], uint16(len(b.buf)-b.setOffset))
+	b.setOffset = -1
+}
+
+// openSet makes sure that the records appended next end up in a set with the given ID.
+func (b *messageBuilder) openSet(id uint16) {
+	if b.setOffset >= 0 && b.setID == id {
+		return
+	}
+	b.closeSet()
+	b.setOffset = len(b.buf)
+	b.setID = id
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b.buf[b.setOffset:], id)
+}
+
+// fits checks whether a record of the given length can be added to set id
+// without exceeding MAX_MESSAGE_SIZE (accounting for a new set header and
+// padding).
+func (b *messageBuilder) fits(id uint16, length int) bool {
+	needed := length + 3
+	if b.setOffset < 0 || b.setID != id {
+		needed += setHeaderSize
+	}
+	return len(b.buf)+needed <= MAX_MESSAGE_SIZE
+}
+
+func (b *messageBuilder) addTemplate(templateID uint16, fields []field) {
+	setID := uint16(SET_ID_IPFIX_TEMPLATE)
+	if b.protocol == PROTOCOL_NETFLOW9 {
+		setID = SET_ID_NETFLOW9_TEMPLATE
+		b.count++
+	}
+	b.openSet(setID)
+
+	var tmp [4]byte
+	binary.BigEndian.PutUint16(tmp[0:], templateID)
+	binary.BigEndian.PutUint16(tmp[2:], uint16(len(fields)))
+	b.buf = append(b.buf, tmp[:]...)
+	for _, f := range fields {
+		binary.BigEndian.PutUint16(tmp[0:], f.id)
+		binary.BigEndian.PutUint16(tmp[2:], f.length)
+		b.buf = append(b.buf, tmp[:]...)
+	}
+}
+
+// addRecord appends rec to the data set of templateID. The caller must have
+// checked that the record fits.
+func (b *messageBuilder) addRecord(templateID uint16, fields []field, rec *flowRecord, times recordTimes, iface string) {
+	b.openSet(templateID)
+
+	var tmp [8]byte
+	for _, f := range fields {
+		switch f.id {
+		case FIELD_SOURCE_IPV4_ADDRESS:
+			b.buf = append(b.buf, rec.key.Sip[:4]...)
+		case FIELD_DESTINATION_IPV4_ADDRESS:
+			b.buf = append(b.buf, rec.key.Dip[:4]...)
+		case FIELD_SOURCE_IPV6_ADDRESS:
+			b.buf = append(b.buf, rec.key.Sip[:]...)
+		case FIELD_DESTINATION_IPV6_ADDRESS:
+			b.buf = append(b.buf, rec.key.Dip[:]...)
+		case FIELD_DESTINATION_TRANSPORT_PORT:
+			b.buf = append(b.buf, rec.key.Dport[:]...)
+		case FIELD_PROTOCOL_IDENTIFIER:
+			b.buf = append(b.buf, rec.key.Protocol)
+		case FIELD_OCTET_DELTA_COUNT:
+			binary.BigEndian.PutUint64(tmp[:], rec.bytes)
+			b.buf = append(b.buf, tmp[:]...)
+		case FIELD_PACKET_DELTA_COUNT:
+			binary.BigEndian.PutUint64(tmp[:], rec.packets)
+			b.buf = append(b.buf, tmp[:]...)
+		case FIELD_FLOW_DIRECTION:
+			b.buf = append(b.buf, rec.direction)
+		case FIELD_FLOW_START_SECONDS, FIELD_FLOW_START_SYSUPTIME:
+			binary.BigEndian.PutUint32(tmp[:], times.start)
+			b.buf = append(b.buf, tmp[:4]...)
+		case FIELD_FLOW_END_SECONDS, FIELD_FLOW_END_SYSUPTIME:
+			binary.BigEndian.PutUint32(tmp[:], times.end)
+			b.buf = append(b.buf, tmp[:4]...)
+		case FIELD_INTERFACE_NAME:
+			var name [INTERFACE_NAME_LENGTH]byte
+			copy(name[:], iface)
+			b.buf = append(b.buf, name[:]...)
+		default:
+			// only happens if exportTemplate and this function disagree
+			panic("Unsupported field in export template")
+		}
+	}
+	b.count++
+}
+
+// finish closes the open set, fills in the message header and returns
+// the encoded message.
+//
+// For IPFIX, sequence is the number of data records sent before this
+// message and uptime is ignored. For NetFlow v9, sequence is the number
+// of messages sent before this one.
+func (b *messageBuilder) finish(exportTime int64, uptime uint32, sequence uint32, domain uint32) []byte {
+	b.closeSet()
+
+	h := b.buf
+	if b.protocol == PROTOCOL_NETFLOW9 {
+		binary.BigEndian.PutUint16(h[0:], VERSION_NETFLOW9)
+		binary.BigEndian.PutUint16(h[2:], uint16(b.count))
+		binary.BigEndian.PutUint32(h[4:], uptime)
+		binary.BigEndian.PutUint32(h[8:], uint32(exportTime))
+		binary.BigEndian.PutUint32(h[12:], sequence)
+		binary.BigEndian.PutUint32(h[16:], domain)
+	} else {
+		binary.BigEndian.PutUint16(h[0:], VERSION_IPFIX)
+		binary.BigEndian.PutUint16(h[2:], uint16(len(b.buf)))
+		binary.BigEndian.PutUint32(h[4:], uint32(exportTime))
+		binary.BigEndian.PutUint32(h[8:], sequence)
+		binary.BigEndian.PutUint32(h[12:], domain)
+	}
+	return b.buf
+}
@@ -0,0 +1,270 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// exporter.go
+//
+// Export of rotated goDB flow maps to IPFIX / NetFlow v9 collectors
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package netflow
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"time"
+
+	"OSAG/goDB"
+)
+
+// TargetConfig describes a collector flows are exported to.
+type TargetConfig struct {
+	Address  string `json:"address"`  // host:port
+	Protocol string `json:"protocol"` // PROTOCOL_IPFIX (default) or PROTOCOL_NETFLOW9
+}
+
+type ExporterConfig struct {
+	Targets []TargetConfig `json:"targets"`
+}
+
+// Enabled checks whether any flows are to be exported.
+func (ec ExporterConfig) Enabled() bool {
+	return len(ec.Targets) > 0
+}
+
+// Validate checks that the given ExporterConfig contains no bogus settings.
+func (ec ExporterConfig) Validate() error {
+	for _, target := range ec.Targets {
+		if _, _, err := net.SplitHostPort(target.Address); err != nil {
+			return fmt.Errorf("Invalid target address '%s': %s", target.Address, err)
+		}
+		switch target.Protocol {
+		case "", PROTOCOL_IPFIX, PROTOCOL_NETFLOW9:
+		default:
+			return fmt.Errorf("Unknown export protocol '%s' for target '%s'", target.Protocol, target.Address)
+		}
+	}
+	return nil
+}
+
+type exportTarget struct {
+	address  string
+	protocol string
+	conn     net.Conn // nil until the Exporter is opened
+	// per observation domain: number of data records (IPFIX) or
+	// messages (NetFlow v9) sent so far
+	sequence map[uint32]uint32
+}
+
+// Exporter is a goDB.FlowSink sending the flows of rotated flow maps to a
+// set of collectors.
+//
+// Each goDB flow is exported as one record per direction that saw any
+// traffic (distinguished by flowDirection). The flow's interface is
+// exported as interfaceName and determines the observation domain
+// (NetFlow v9: source ID) of the message: it is the index of the interface
+// or, if there is no such interface on the system, a hash of its name.
+//
+// An Exporter must not be used concurrently.
+type Exporter struct {
+	targets []*exportTarget
+	// nominal duration of a block. Used as the flow duration of
+	// the first block exported for an interface.
+	interval int64
+	// timestamp of the last block exported for each interface
+	lastWrite map[string]int64
+	// reference point for the system uptime reported in NetFlow v9.
+	// It lies a day before the creation of the Exporter, so that the
+	// start of any block we are going to export can be expressed in
+	// uptime.
+	started time.Time
+}
+
+// NewExporter creates an Exporter for the targets in config.
+// interval is the nominal duration of a block in seconds.
+func NewExporter(config ExporterConfig, interval int64) *Exporter {
+	e := &Exporter{
+		interval:  interval,
+		lastWrite: make(map[string]int64),
+		started:   time.Now().Add(-24 * time.Hour),
+	}
+
+	for _, target := range config.Targets {
+		protocol := target.Protocol
+		if protocol == "" {
+			protocol = PROTOCOL_IPFIX
+		}
+
+		e.targets = append(e.targets, &exportTarget{
+			address:  target.Address,
+			protocol: protocol,
+			sequence: make(map[uint32]uint32),
+		})
+	}
+
+	return e
+}
+
+// Open creates the sockets of the Exporter.
+func (e *Exporter) Open() error {
+	for _, target := range e.targets {
+		conn, err := net.Dial("udp", target.address)
+		if err != nil {
+			e.Close()
+			return err
+		}
+		target.conn = conn
+	}
+	return nil
+}
+
+// Close releases the sockets of the Exporter.
+func (e *Exporter) Close() error {
+	var err error
+	for _, target := range e.targets {
+		if target.conn == nil {
+			continue
+		}
+		if cerr := target.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		target.conn = nil
+	}
+	return err
+}
+
+// Write exports the flows of the block of interface iface written at timestamp.
+// Failing to reach one target doesn't prevent the export to the others.
+func (e *Exporter) Write(iface string, timestamp int64, flowmap goDB.AggFlowMap, meta goDB.BlockMetadata) error {
+	start := timestamp - e.interval
+	if last, exists := e.lastWrite[iface]; exists && last < timestamp {
+		start = last
+	}
+	e.lastWrite[iface] = timestamp
+
+	var v4, v6 []flowRecord
+	for key, val := range flowmap {
+		var records []flowRecord
+		if val.NBytesRcvd > 0 || val.NPktsRcvd > 0 {
+			records = append(records, flowRecord{key, DIRECTION_INGRESS, val.NBytesRcvd, val.NPktsRcvd})
+		}
+		if val.NBytesSent > 0 || val.NPktsSent > 0 {
+			records = append(records, flowRecord{key, DIRECTION_EGRESS, val.NBytesSent, val.NPktsSent})
+		}
+
+		if isIPv4(&key) {
+			v4 = append(v4, records...)
+		} else {
+			v6 = append(v6, records...)
+		}
+	}
+
+	domain := domainID(iface)
+
+	var errs []string
+	for _, target := range e.targets {
+		if err := e.export(target, iface, domain, start, timestamp, v4, v6); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", target.address, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to export flows of interface '%s' to %s", iface, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// export sends the records to a single target. Every message carries the
+// templates, so that collectors can decode it even if earlier messages
+// were lost.
+func (e *Exporter) export(target *exportTarget, iface string, domain uint32, start, end int64, v4, v6 []flowRecord) error {
+	if target.conn == nil {
+		return fmt.Errorf("Exporter is not open")
+	}
+
+	now := time.Now()
+	uptime := uint32(now.Sub(e.started) / time.Millisecond)
+
+	times := recordTimes{uint32(start), uint32(end)}
+	if target.protocol == PROTOCOL_NETFLOW9 {
+		times = recordTimes{sysUptimeAt(start, now, uptime), sysUptimeAt(end, now, uptime)}
+	}
+
+	templates := map[uint16][]field{
+		TEMPLATE_ID_IPV4: exportTemplate(TEMPLATE_ID_IPV4, target.protocol),
+		TEMPLATE_ID_IPV6: exportTemplate(TEMPLATE_ID_IPV6, target.protocol),
+	}
+
+	newMessage := func() *messageBuilder {
+		b := newMessageBuilder(target.protocol)
+		b.addTemplate(TEMPLATE_ID_IPV4, templates[TEMPLATE_ID_IPV4])
+		b.addTemplate(TEMPLATE_ID_IPV6, templates[TEMPLATE_ID_IPV6])
+		return b
+	}
+
+	send := func(b *messageBuilder) error {
+		msg := b.finish(now.Unix(), uptime, target.sequence[domain], domain)
+		if target.protocol == PROTOCOL_NETFLOW9 {
+			target.sequence[domain]++
+		} else {
+			target.sequence[domain] += uint32(b.count)
+		}
+		_, err := target.conn.Write(msg)
+		return err
+	}
+
+	b := newMessage()
+	for _, group := range []struct {
+		templateID uint16
+		records    []flowRecord
+	}{
+		{TEMPLATE_ID_IPV4, v4},
+		{TEMPLATE_ID_IPV6, v6},
+	} {
+		fields := templates[group.templateID]
+		length := recordLength(fields)
+		for i := range group.records {
+			if !b.fits(group.templateID, length) {
+				if err := send(b); err != nil {
+					return err
+				}
+				b = newMessage()
+			}
+			b.addRecord(group.templateID, fields, &group.records[i], times, iface)
+		}
+	}
+
+	// always send at least one message to keep the templates fresh
+	return send(b)
+}
+
+// sysUptimeAt converts the epoch timestamp t into milliseconds of system
+// uptime, given that the uptime at now is uptime. Like the uptime itself,
+// the result wraps around after about 49 days.
+func sysUptimeAt(t int64, now time.Time, uptime uint32) uint32 {
+	ago := now.Sub(time.Unix(t, 0)) / time.Millisecond
+	if ago < 0 {
+		ago = 0
+	}
+	return uptime - uint32(ago)
+}
+
+// isIPv4 mirrors how goDB tells IPv4 and IPv6 addresses apart
+func isIPv4(key *goDB.Key) bool {
+	for i := 4; i < 16; i++ {
+		if key.Sip[i] != 0 || key.Dip[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func domainID(iface string) uint32 {
+	if netIface, err := net.InterfaceByName(iface); err == nil {
+		return uint32(netIface.Index)
+	}
+	return crc32.ChecksumIEEE([]byte(iface))
+}
@@ -0,0 +1,187 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// exporter_test.go
+//
+// Tests for the IPFIX / NetFlow v9 exporter. The exported messages are
+// received on a local UDP socket and decoded again.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package netflow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"OSAG/goDB"
+)
+
+func testFlowMap(n int) goDB.AggFlowMap {
+	flowmap := make(goDB.AggFlowMap)
+
+	for i := 0; i < n; i++ {
+		var key goDB.Key
+		if i%2 == 0 {
+			copy(key.Sip[:], []byte{10, 0, byte(i >> 8), byte(i)})
+			copy(key.Dip[:], []byte{192, 168, 0, 1})
+		} else {
+			key.Sip = [16]byte{0x20, 0x01, 0x0d, 0xb8, 14: byte(i >> 8), 15: byte(i)}
+			key.Dip = [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+		}
+		key.Dport = [2]byte{0x01, 0xbb}
+		key.Protocol = 6
+
+		val := &goDB.Val{NBytesSent: uint64(100 * i), NPktsSent: uint64(i)}
+		if i%3 != 0 {
+			val.NBytesRcvd, val.NPktsRcvd = 1000, 10
+		}
+		flowmap[key] = val
+	}
+	return flowmap
+}
+
+// receive reads messages from conn until no new message arrives for a while.
+func receive(t *testing.T, conn net.PacketConn, decoder *Decoder) []*Message {
+	var messages []*Message
+
+	buf := make([]byte, 65535)
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return messages
+			}
+			t.Fatalf("failed to receive message: %s", err)
+		}
+		if n > MAX_MESSAGE_SIZE {
+			t.Fatalf("message of %d bytes exceeds maximum size", n)
+		}
+
+		msg, err := decoder.Decode(addr.String(), append([]byte(nil), buf[:n]...))
+		if err != nil {
+			t.Fatalf("failed to decode message: %s", err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func testExport(t *testing.T, protocol string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer conn.Close()
+
+	exporter := NewExporter(ExporterConfig{
+		Targets: []TargetConfig{{Address: conn.LocalAddr().String(), Protocol: protocol}},
+	}, 300)
+	if err := exporter.Open(); err != nil {
+		t.Fatalf("failed to open exporter: %s", err)
+	}
+	defer exporter.Close()
+
+	const iface = "nonexistent0"
+	flowmap := testFlowMap(200)
+	timestamp := time.Now().Unix()
+
+	if err := exporter.Write(iface, timestamp, flowmap, goDB.BlockMetadata{}); err != nil {
+		t.Fatalf("failed to export flows: %s", err)
+	}
+
+	messages := receive(t, conn, NewDecoder())
+	if len(messages) < 2 {
+		t.Fatalf("expected flows to be split across messages, got %d message(s)", len(messages))
+	}
+
+	// reassemble the flow map from the received records
+	received := make(goDB.AggFlowMap)
+	for _, msg := range messages {
+		if msg.Unknown > 0 {
+			t.Fatalf("message contains data sets with unknown templates")
+		}
+		if msg.DomainID != domainID(iface) {
+			t.Fatalf("unexpected observation domain %d", msg.DomainID)
+		}
+
+		for _, record := range msg.Records {
+			var key goDB.Key
+			if sip, exists := record[FIELD_SOURCE_IPV4_ADDRESS]; exists {
+				copy(key.Sip[:], sip)
+				copy(key.Dip[:], record[FIELD_DESTINATION_IPV4_ADDRESS])
+			} else {
+				copy(key.Sip[:], record[FIELD_SOURCE_IPV6_ADDRESS])
+				copy(key.Dip[:], record[FIELD_DESTINATION_IPV6_ADDRESS])
+			}
+			copy(key.Dport[:], record[FIELD_DESTINATION_TRANSPORT_PORT])
+			key.Protocol = record[FIELD_PROTOCOL_IDENTIFIER][0]
+
+			if !bytes.Equal(bytes.TrimRight(record[FIELD_INTERFACE_NAME], "\x00"), []byte(iface)) {
+				t.Fatalf("unexpected interface name %q", record[FIELD_INTERFACE_NAME])
+			}
+
+			switch protocol {
+			case PROTOCOL_IPFIX:
+				start, _ := record.Uint(FIELD_FLOW_START_SECONDS)
+				end, _ := record.Uint(FIELD_FLOW_END_SECONDS)
+				if int64(start) != timestamp-300 || int64(end) != timestamp {
+					t.Fatalf("unexpected flow times [%d, %d]", start, end)
+				}
+			case PROTOCOL_NETFLOW9:
+				start, _ := record.Uint(FIELD_FLOW_START_SYSUPTIME)
+				end, _ := record.Uint(FIELD_FLOW_END_SYSUPTIME)
+				// convert back to epoch seconds, allowing for rounding
+				toEpoch := func(uptime uint64) int64 {
+					return int64(msg.ExportTime) - (int64(msg.SysUptime)-int64(uptime))/1000
+				}
+				if d := toEpoch(start) - (timestamp - 300); d < -1 || d > 1 {
+					t.Fatalf("unexpected flow start %d", toEpoch(start))
+				}
+				if d := toEpoch(end) - timestamp; d < -1 || d > 1 {
+					t.Fatalf("unexpected flow end %d", toEpoch(end))
+				}
+			}
+
+			val, exists := received[key]
+			if !exists {
+				val = &goDB.Val{}
+				received[key] = val
+			}
+			bytes, _ := record.Uint(FIELD_OCTET_DELTA_COUNT)
+			packets, _ := record.Uint(FIELD_PACKET_DELTA_COUNT)
+			direction, _ := record.Uint(FIELD_FLOW_DIRECTION)
+			if direction == DIRECTION_INGRESS {
+				val.NBytesRcvd += bytes
+				val.NPktsRcvd += packets
+			} else {
+				val.NBytesSent += bytes
+				val.NPktsSent += packets
+			}
+		}
+	}
+
+	// flows without any traffic are not exported
+	delete(flowmap, goDB.Key{Sip: [16]byte{10}, Dip: [16]byte{192, 168, 0, 1}, Dport: [2]byte{0x01, 0xbb}, Protocol: 6})
+
+	if len(received) != len(flowmap) {
+		t.Fatalf("expected %d flows, got %d", len(flowmap), len(received))
+	}
+	for key, val := range flowmap {
+		if got, exists := received[key]; !exists || *got != *val {
+			t.Fatalf("flow %s: expected %s, got %v", key.String(), val.String(), got)
+		}
+	}
+}
+
+func TestExportIPFIX(t *testing.T) {
+	testExport(t, PROTOCOL_IPFIX)
+}
+
+func TestExportNetflow9(t *testing.T) {
+	testExport(t, PROTOCOL_NETFLOW9)
+}
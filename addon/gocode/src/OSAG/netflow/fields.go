@@ -0,0 +1,116 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// fields.go
+//
+// Information elements (IPFIX) and field types (NetFlow v9) used by goProbe.
+// Both protocols share the numbering for the fields we are interested in.
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+// Package netflow implements encoding and decoding of NetFlow v9 and
+// IPFIX (RFC 7011) messages as well as decoding of NetFlow v5 messages,
+// as far as needed to exchange goDB flows with other flow monitoring tools.
+package netflow
+
+const (
+	VERSION_NETFLOW5 = 5
+	VERSION_NETFLOW9 = 9
+	VERSION_IPFIX    = 10
+
+	PROTOCOL_NETFLOW9 = "netflow9"
+	PROTOCOL_IPFIX    = "ipfix"
+)
+
+// Information element identifiers
+const (
+	FIELD_OCTET_DELTA_COUNT          uint16 = 1
+	FIELD_PACKET_DELTA_COUNT         uint16 = 2
+	FIELD_PROTOCOL_IDENTIFIER        uint16 = 4
+	FIELD_SOURCE_TRANSPORT_PORT      uint16 = 7
+	FIELD_SOURCE_IPV4_ADDRESS        uint16 = 8
+	FIELD_INGRESS_INTERFACE          uint16 = 10
+	FIELD_DESTINATION_TRANSPORT_PORT uint16 = 11
+	FIELD_DESTINATION_IPV4_ADDRESS   uint16 = 12
+	FIELD_EGRESS_INTERFACE           uint16 = 14
+	FIELD_FLOW_END_SYSUPTIME         uint16 = 21 // LAST_SWITCHED in NetFlow v9
+	FIELD_FLOW_START_SYSUPTIME       uint16 = 22 // FIRST_SWITCHED in NetFlow v9
+	FIELD_POST_OCTET_DELTA_COUNT     uint16 = 23 // OUT_BYTES in NetFlow v9
+	FIELD_POST_PACKET_DELTA_COUNT    uint16 = 24 // OUT_PKTS in NetFlow v9
+	FIELD_SOURCE_IPV6_ADDRESS        uint16 = 27
+	FIELD_DESTINATION_IPV6_ADDRESS   uint16 = 28
+	FIELD_FLOW_DIRECTION             uint16 = 61
+	FIELD_INTERFACE_NAME             uint16 = 82
+	FIELD_FLOW_START_SECONDS         uint16 = 150
+	FIELD_FLOW_END_SECONDS           uint16 = 151
+	FIELD_FLOW_START_MILLISECONDS    uint16 = 152
+	FIELD_FLOW_END_MILLISECONDS      uint16 = 153
+)
+
+// Values of FIELD_FLOW_DIRECTION
+const (
+	DIRECTION_INGRESS = 0
+	DIRECTION_EGRESS  = 1
+)
+
+// IDs of template sets and the first ID available for templates
+const (
+	SET_ID_NETFLOW9_TEMPLATE         = 0
+	SET_ID_NETFLOW9_OPTIONS_TEMPLATE = 1
+	SET_ID_IPFIX_TEMPLATE            = 2
+	SET_ID_IPFIX_OPTIONS_TEMPLATE    = 3
+	MIN_DATA_SET_ID                  = 256
+)
+
+// Length of interface names in exported records (IFNAMSIZ on Linux)
+const INTERFACE_NAME_LENGTH = 16
+
+type field struct {
+	id     uint16
+	length uint16
+}
+
+// templates used for exporting goDB flows. Flows are exported as
+// (up to) two records, one per direction, because neither protocol
+// offers a portable way to express the sent/received counters of a
+// goDB flow in a single record.
+const (
+	TEMPLATE_ID_IPV4 = 256
+	TEMPLATE_ID_IPV6 = 257
+)
+
+func exportTemplate(templateID uint16, protocol string) []field {
+	sip, dip := field{FIELD_SOURCE_IPV4_ADDRESS, 4}, field{FIELD_DESTINATION_IPV4_ADDRESS, 4}
+	if templateID == TEMPLATE_ID_IPV6 {
+		sip, dip = field{FIELD_SOURCE_IPV6_ADDRESS, 16}, field{FIELD_DESTINATION_IPV6_ADDRESS, 16}
+	}
+
+	// NetFlow v9 lacks absolute timestamps
+	start, end := field{FIELD_FLOW_START_SECONDS, 4}, field{FIELD_FLOW_END_SECONDS, 4}
+	if protocol == PROTOCOL_NETFLOW9 {
+		start, end = field{FIELD_FLOW_START_SYSUPTIME, 4}, field{FIELD_FLOW_END_SYSUPTIME, 4}
+	}
+
+	return []field{
+		sip,
+		dip,
+		{FIELD_DESTINATION_TRANSPORT_PORT, 2},
+		{FIELD_PROTOCOL_IDENTIFIER, 1},
+		{FIELD_OCTET_DELTA_COUNT, 8},
+		{FIELD_PACKET_DELTA_COUNT, 8},
+		{FIELD_FLOW_DIRECTION, 1},
+		start,
+		end,
+		{FIELD_INTERFACE_NAME, INTERFACE_NAME_LENGTH},
+	}
+}
+
+func recordLength(fields []field) int {
+	length := 0
+	for _, f := range fields {
+		length += int(f.length)
+	}
+	return length
+}
@@ -239,6 +239,10 @@ func ReadFlags(config *Config) error {
 	flagSet.BoolVar(&config.Version, "version", false, "Print version information and exit")
 	flagSet.BoolVar(&config.WipeAdmin, "wipe", false, "wipes the entire database")
 	flagSet.Int64Var(&config.CleanAdmin, "clean", 0, "cleans all entries before indicated timestamp")
+	flagSet.BoolVar(&config.Fsck, "fsck", false, "checks the integrity of the entire database")
+	flagSet.BoolVar(&config.Repair, "repair", false, "repairs the problems found by -fsck")
+	flagSet.StringVar(&config.Lookup, "lookup", "", "finds the days on which an IP address or network was seen")
+	flagSet.BoolVar(&config.IndexHosts, "index-hosts", false, "builds the missing host indexes of the database")
 	flagSet.BoolVar(&config.External, "x", false, "Mode for external calls, e.g. from portal")
 	flagSet.StringVar(&config.Sort, "s", "bytes", "Sort results by accumulated packets instead of bytes")
 	flagSet.BoolVar(&config.SortAscending, "a", false, "Sort results in ascending order")
@@ -394,80 +398,6 @@ func createWorkManager(dbPath string, iface string, tfirst, tlast int64, query *
 	return workManager, nonempty, err
 }
 
-type aggregateResult struct {
-	aggregatedMap map[goDB.ExtraKey]goDB.Val
-	totals        Counts
-	err           error
-}
-
-// receive maps on mapChan until mapChan gets closed.
-// Then send aggregation result over resultChan.
-// If an error occurs, aggregate may return prematurely.
-// Closes resultChan on termination.
-func aggregate(mapChan <-chan map[goDB.ExtraKey]goDB.Val, resultChan chan<- aggregateResult) {
-	defer close(resultChan)
-
-	var finalMap = make(map[goDB.ExtraKey]goDB.Val)
-	var totals Counts
-
-	// Temporary goDB.Val because map values cannot be updated in-place
-	var tempVal goDB.Val
-	var exists bool
-
-	// Create global MemStats object for tracking of memory consumption
-	m := runtime.MemStats{}
-	lastGC := time.Now()
-
-	for item := range mapChan {
-		if item == nil {
-			resultChan <- aggregateResult{
-				err: fmt.Errorf("Error during daily DB processing. Check syslog/messages for more information"),
-			}
-			return
-		}
-		for k, v := range item {
-			totals.BytesRcvd += v.NBytesRcvd
-			totals.BytesSent += v.NBytesSent
-			totals.PktsRcvd += v.NPktsRcvd
-			totals.PktsSent += v.NPktsSent
-
-			if tempVal, exists = finalMap[k]; exists {
-				tempVal.NBytesRcvd += v.NBytesRcvd
-				tempVal.NBytesSent += v.NBytesSent
-				tempVal.NPktsRcvd += v.NPktsRcvd
-				tempVal.NPktsSent += v.NPktsSent
-
-				finalMap[k] = tempVal
-			} else {
-				finalMap[k] = v
-			}
-		}
-
-		item = nil
-
-		// Conditionally call a manual garbage collection and memory release if the current heap allocation
-		// is above GOGCLIMIT and more than GOGCINTERVAL seconds have passed
-		runtime.ReadMemStats(&m)
-		if m.Sys-m.HeapReleased > GOGCLIMIT && time.Since(lastGC) > GOGCINTERVAL {
-			runtime.GC()
-			debug.FreeOSMemory()
-			lastGC = time.Now()
-		}
-	}
-
-	if len(finalMap) == 0 {
-		resultChan <- aggregateResult{
-			err: fmt.Errorf(ERROR_NORESULTS),
-		}
-		return
-	}
-
-	resultChan <- aggregateResult{
-		aggregatedMap: finalMap,
-		totals:        totals,
-	}
-}
-
 //--------------------------------------------------------------------------------
 func main() {
 	//--------------------------------------------------------------------------------
@@ -556,6 +486,28 @@ func main() {
 		return
 	}
 
+	if queryConfig.Fsck {
+		if fsckerr := fsckDB(queryConfig.BaseDir, queryConfig.Repair, queryConfig.External || queryConfig.Format == "json"); fsckerr != nil {
+			throwMsg("Database check failed: "+fsckerr.Error(), queryConfig.External, queryConfig.Format)
+		}
+		return
+	}
+
+	if queryConfig.IndexHosts {
+		if idxerr := indexHosts(queryConfig.BaseDir); idxerr != nil {
+			throwMsg("Failed to build host indexes: "+idxerr.Error(), queryConfig.External, queryConfig.Format)
+		}
+		return
+	}
+
+	if queryConfig.Lookup != "" {
+		if lkerr := lookupHost(&queryConfig); lkerr != nil {
+			printHelpFlag("lookup")
+			throwMsg("Host lookup failed: "+lkerr.Error(), queryConfig.External, queryConfig.Format)
+		}
+		return
+	}
+
 	// We are in query mode.
 	// Parse/check corresponding flags.
 
@@ -723,7 +675,9 @@ func main() {
 	}()
 
 	// create work managers
-	workManagers := map[string]*goDB.DBWorkManager{} // map interfaces to workManagers
+	var workManagers []*goDB.DBWorkManager
+	// blocks read and skipped on all interfaces
+	var blocks goDB.BlockStats
 	for _, iface := range ifaces {
 		wm, nonempty, err := createWorkManager(queryConfig.BaseDir, iface, qcFirst, qcLast, query, numProcessingUnits)
 		if err != nil {
@@ -732,7 +686,14 @@ func main() {
 		}
 		// Only add work managers that have work to do.
 		if nonempty {
-			workManagers[iface] = wm
+			workManagers = append(workManagers, wm)
+		} else {
+			// all days of the interface may have been left out
+			stats := wm.BlockStats()
+			blocks.Total += stats.Total
+			blocks.Skipped += stats.Skipped
+		blocks.Aggregated += stats.Aggregated
+			blocks.Aggregated += stats.Aggregated
 		}
 	}
 
@@ -751,15 +712,22 @@ func main() {
 	// Channel for handling of returned maps
 	mapChan := make(chan map[goDB.ExtraKey]goDB.Val, 1024)
 	aggregateChan := make(chan aggregateResult, 1)
-	go aggregate(mapChan, aggregateChan)
+	go aggregate(mapChan, aggregateChan, numProcessingUnits)
 
 	// spawn reader processing units and make them work on the individual DB blocks
-	for _, workManager := range workManagers {
-		workManager.ExecuteWorkerReadJobs(mapChan)
-	}
+	// of all interfaces
+	goDB.ExecuteReadJobs(workManagers, numProcessingUnits, mapChan)
 	// we are done with all worker jobs
 	close(mapChan)
 
+	// blocks ruled out by their summaries weren't read
+	for _, workManager := range workManagers {
+		stats := workManager.BlockStats()
+		blocks.Total += stats.Total
+		blocks.Skipped += stats.Skipped
+		blocks.Aggregated += stats.Aggregated
+	}
+
 	agg := <-aggregateChan
 
 	if agg.err != nil {
@@ -768,22 +736,10 @@ func main() {
 	}
 
 	/// DATA PRESENATION ///
-	var mapEntries []Entry = make([]Entry, len(agg.aggregatedMap))
-	var val goDB.Val
-	count := 0
-
-	for mapEntries[count].k, val = range agg.aggregatedMap {
-
-		mapEntries[count].nBr = val.NBytesRcvd
-		mapEntries[count].nPr = val.NPktsRcvd
-		mapEntries[count].nBs = val.NBytesSent
-		mapEntries[count].nPs = val.NPktsSent
-
-		count++
-	}
+	mapEntries := agg.entries()
+	count := len(mapEntries)
 
 	// Now is a good time to release memory one last time for the final processing step
-	agg.aggregatedMap = nil
 	runtime.GC()
 	debug.FreeOSMemory()
 
@@ -849,7 +805,7 @@ func main() {
 		printer.AddRow(entry)
 	}
 
-	printer.Footer(queryConfig.Conditions, tSpanFirst, tSpanLast, tStop.Sub(tStart), resolveDuration)
+	printer.Footer(queryConfig.Conditions, blocks, tSpanFirst, tSpanLast, tStop.Sub(tStart), resolveDuration)
 
 	// print the data
 	if perr := printer.Print(); perr != nil {
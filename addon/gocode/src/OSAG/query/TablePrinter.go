@@ -153,6 +153,15 @@ func extract(format Formatter, ips2domains map[string]string, totals Counts, e E
 		return u
 	}
 
+	switch col {
+	case OUTCOL_SIP, OUTCOL_DIP, OUTCOL_DPORT, OUTCOL_PROTO:
+		// the flow into which rollups merge small flows would otherwise be
+		// printed as 0.0.0.0 -> 0.0.0.0, port 0, protocol 0
+		if e.k.Key == goDB.RollupOtherKey {
+			return format.String(goDB.ROLLUP_OTHER)
+		}
+	}
+
 	switch col {
 	case OUTCOL_TIME:
 		return format.Time(e.k.Time)
@@ -255,7 +264,7 @@ func describe(o SortOrder, d Direction) string {
 // Note that some impementations may start printing data before you call Print().
 type TablePrinter interface {
 	AddRow(entry Entry)
-	Footer(conditional string, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration)
+	Footer(conditional string, blocks goDB.BlockStats, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration)
 	Print() error
 }
 
@@ -372,7 +381,7 @@ func (c *CSVTablePrinter) AddRow(entry Entry) {
 	c.writer.Write(c.fields)
 }
 
-func (c *CSVTablePrinter) Footer(conditional string, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
+func (c *CSVTablePrinter) Footer(conditional string, blocks goDB.BlockStats, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
 	var summaryEntries [COUNT_OUTCOL]string
 	summaryEntries[OUTCOL_INPKTS] = "Overall packets"
 	summaryEntries[OUTCOL_INBYTES] = "Overall data volume (bytes)"
@@ -474,7 +483,7 @@ func (j *JSONTablePrinter) AddRow(entry Entry) {
 	j.rows = append(j.rows, row)
 }
 
-func (j *JSONTablePrinter) Footer(conditional string, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
+func (j *JSONTablePrinter) Footer(conditional string, blocks goDB.BlockStats, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
 	j.data["status"] = "ok"
 	j.data["ext_ips"] = externalIPs()
 
@@ -499,6 +508,15 @@ func (j *JSONTablePrinter) Footer(conditional string, spanFirst, spanLast time.T
 		}
 	}
 
+	if conditional != "" {
+		summary["blocks_total"] = blocks.Total
+		summary["blocks_skipped"] = blocks.Skipped
+	}
+	if blocks.Aggregated > 0 {
+		summary["blocks_total"] = blocks.Total
+		summary["blocks_aggregated"] = blocks.Aggregated
+	}
+
 	j.data["summary"] = summary
 }
 
@@ -641,7 +659,7 @@ func (t *TextTablePrinter) AddRow(entry Entry) {
 	t.numPrinted++
 }
 
-func (t *TextTablePrinter) Footer(conditional string, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
+func (t *TextTablePrinter) Footer(conditional string, blocks goDB.BlockStats, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
 	var isTotal [COUNT_OUTCOL]bool
 	isTotal[OUTCOL_INPKTS] = true
 	isTotal[OUTCOL_INBYTES] = true
@@ -709,6 +727,12 @@ func (t *TextTablePrinter) Footer(conditional string, spanFirst, spanLast time.T
 	if conditional != "" {
 		fmt.Fprintf(t.footwriter, "Conditions:\t: %s\n",
 			conditional)
+		fmt.Fprintf(t.footwriter, "Blocks skipped\t: %d of %d\n",
+			blocks.Skipped, blocks.Total)
+	}
+	if blocks.Aggregated > 0 {
+		fmt.Fprintf(t.footwriter, "Blocks aggregated\t: %d of %d answered from aggregates\n",
+			blocks.Aggregated, blocks.Total)
 	}
 }
 
@@ -890,7 +914,7 @@ func (i *InfluxDBTablePrinter) AddRow(entry Entry) {
 	fmt.Fprintln(output)
 }
 
-func (_ *InfluxDBTablePrinter) Footer(conditional string, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
+func (_ *InfluxDBTablePrinter) Footer(conditional string, blocks goDB.BlockStats, spanFirst, spanLast time.Time, queryDuration, resolveDuration time.Duration) {
 }
 
 func (_ *InfluxDBTablePrinter) Print() error {
@@ -736,7 +736,7 @@ func testCSVTablePrinter(t *testing.T, test printerTest, b basePrinter, buf *byt
     for _, entry := range test.entries {
         c.AddRow(entry)
     }
-    c.Footer("", time.Now(), time.Now(), time.Duration(0), time.Duration(0))
+    c.Footer("", goDB.BlockStats{}, time.Now(), time.Now(), time.Duration(0), time.Duration(0))
     if err := c.Print(); err != nil {
         t.Fatalf("Unexpected error during Print(): %s", err)
     }
@@ -752,7 +752,7 @@ func testJSONTablePrinter(t *testing.T, test printerTest, b basePrinter, buf *by
     for _, entry := range test.entries {
         j.AddRow(entry)
     }
-    j.Footer("", time.Now(), time.Now(), time.Duration(0), time.Duration(0))
+    j.Footer("", goDB.BlockStats{}, time.Now(), time.Now(), time.Duration(0), time.Duration(0))
     if err := j.Print(); err != nil {
         t.Fatalf("Unexpected error during Print(): %s", err)
     }
@@ -780,7 +780,7 @@ func testTextTablePrinter(t *testing.T, test printerTest, b basePrinter, buf *by
     for _, entry := range test.entries {
         p.AddRow(entry)
     }
-    p.Footer("", time.Now(), time.Now(), time.Duration(0), time.Duration(0))
+    p.Footer("", goDB.BlockStats{}, time.Now(), time.Now(), time.Duration(0), time.Duration(0))
     if err := p.Print(); err != nil {
         t.Fatalf("Unexpected error during Print(): %s", err)
     }
@@ -802,7 +802,7 @@ func testInfluxDBTablePrinter(t *testing.T, test printerTest, b basePrinter, buf
     for _, entry := range test.entries {
         i.AddRow(entry)
     }
-    i.Footer("", time.Now(), time.Now(), time.Duration(0), time.Duration(0)) // footer is irrelevant for influxdb
+    i.Footer("", goDB.BlockStats{}, time.Now(), time.Now(), time.Duration(0), time.Duration(0)) // footer is irrelevant for influxdb
     if err := i.Print(); err != nil {
         t.Fatalf("Unexpected error during Print(): %s", err)
     }
@@ -891,6 +891,7 @@ var textTablePrinterFooterTests = []struct {
     numFlows                                       int
     iface                                          string
     conditional                                    string
+    blocks                                         goDB.BlockStats
     spanFirst, spanLast                            time.Time
     queryDuration, resolveDuration, resolveTimeout time.Duration
     outputRegex                                    string
@@ -903,6 +904,7 @@ var textTablePrinterFooterTests = []struct {
         1270,
         "eth17",
         "",
+        goDB.BlockStats{},
         time.Unix(1455522462, 0), time.Unix(1455622462, 0),
         17 * time.Second, 0, 2 * time.Second,
         `\nTimespan \/ Interface : \[` + time.Unix(1455522462, 0).Format("2006-01-02 15:04:05") + `, ` + time.Unix(1455622462, 0).Format("2006-01-02 15:04:05") + `\] \/ eth17\n` +
@@ -917,6 +919,7 @@ var textTablePrinterFooterTests = []struct {
         1270,
         "t4_1232",
         "",
+        goDB.BlockStats{},
         time.Unix(1455522462, 0), time.Unix(1455622462, 0),
         17 * time.Second, 18*time.Millisecond + 500*time.Microsecond, 2 * time.Second,
         `\nTimespan \/ Interface : \[` + time.Unix(1455522462, 0).Format("2006-01-02 15:04:05") + `, ` + time.Unix(1455622462, 0).Format("2006-01-02 15:04:05") + `\] \/ t4_1232\n` +
@@ -932,13 +935,15 @@ var textTablePrinterFooterTests = []struct {
         92270,
         "eth17",
         "sip = 10.0.0.1 | dip = open.ch",
+        goDB.BlockStats{Total: 288, Skipped: 251},
         time.Unix(1455522462, 0), time.Unix(1455622462, 0),
         17 * time.Millisecond, 18*time.Millisecond + 500*time.Microsecond, 500 * time.Millisecond,
         `\nTimespan \/ Interface : \[` + time.Unix(1455522462, 0).Format("2006-01-02 15:04:05") + `, ` + time.Unix(1455622462, 0).Format("2006-01-02 15:04:05") + `\] \/ eth17\n` +
             `Sorted by            : first packet time\n` +
             `Reverse DNS stats    : RDNS took 18ms, timeout was 500ms\n` +
             `Query stats          : 92.27 k hits in 17ms\n` +
-            `Conditions:          : sip = 10.0.0.1 \| dip = open.ch\n`,
+            `Conditions:          : sip = 10.0.0.1 \| dip = open.ch\n` +
+            `Blocks skipped       : 251 of 288\n`,
     },
 }
 
@@ -958,7 +963,7 @@ func TestTextTablePrinterFooter(t *testing.T) {
         )
         p := NewTextTablePrinter(b, test.numFlows, test.resolveTimeout)
 
-        p.Footer(test.conditional, test.spanFirst, test.spanLast, test.queryDuration, test.resolveDuration)
+        p.Footer(test.conditional, test.blocks, test.spanFirst, test.spanLast, test.queryDuration, test.resolveDuration)
         if err := p.Print(); err != nil {
             t.Fatalf("Unexpected error: %s", err)
         }
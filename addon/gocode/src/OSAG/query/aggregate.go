@@ -0,0 +1,205 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// aggregate.go
+//
+// Merging of the result maps of the workers, sharded by key across several
+// goroutines
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"OSAG/goDB"
+)
+
+const (
+	// FNV-1a 32bit parameters
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+type aggregateResult struct {
+	// The aggregated flows. Each key is in exactly one shard.
+	shards []map[goDB.ExtraKey]goDB.Val
+	totals Counts
+	count  int
+	err    error
+}
+
+// entries returns the aggregated flows as entries. The shards are released
+// as they are converted, so that the flows aren't held twice in full.
+func (r *aggregateResult) entries() []Entry {
+	mapEntries := make([]Entry, 0, r.count)
+	for i, shard := range r.shards {
+		for k, val := range shard {
+			mapEntries = append(mapEntries, Entry{
+				k:   k,
+				nBr: val.NBytesRcvd,
+				nPr: val.NPktsRcvd,
+				nBs: val.NBytesSent,
+				nPs: val.NPktsSent,
+			})
+		}
+		r.shards[i] = nil
+	}
+	r.shards = nil
+	return mapEntries
+}
+
+// shardOf assigns a key to one of numShards shards based on its FNV-1a hash
+func shardOf(k *goDB.ExtraKey, numShards int) int {
+	h := uint32(fnvOffset32)
+	for _, b := range k.Sip {
+		h = (h ^ uint32(b)) * fnvPrime32
+	}
+	for _, b := range k.Dip {
+		h = (h ^ uint32(b)) * fnvPrime32
+	}
+	h = (h ^ uint32(k.Dport[0])) * fnvPrime32
+	h = (h ^ uint32(k.Dport[1])) * fnvPrime32
+	h = (h ^ uint32(k.Protocol)) * fnvPrime32
+	for t := uint64(k.Time); t != 0; t >>= 8 {
+		h = (h ^ uint32(t&0xff)) * fnvPrime32
+	}
+	for i := 0; i < len(k.Iface); i++ {
+		h = (h ^ uint32(k.Iface[i])) * fnvPrime32
+	}
+	return int(h % uint32(numShards))
+}
+
+// memoryReleaser frees memory if the process uses more than GOGCLIMIT bytes,
+// at most once every GOGCINTERVAL
+type memoryReleaser struct {
+	sync.Mutex
+	m      runtime.MemStats
+	lastGC time.Time
+}
+
+func (r *memoryReleaser) check() {
+	r.Lock()
+	defer r.Unlock()
+
+	runtime.ReadMemStats(&r.m)
+	if r.m.Sys-r.m.HeapReleased > GOGCLIMIT && time.Since(r.lastGC) > GOGCINTERVAL {
+		runtime.GC()
+		debug.FreeOSMemory()
+		r.lastGC = time.Now()
+	}
+}
+
+// merge adds v to the flow with key k in finalMap and to totals
+func merge(finalMap map[goDB.ExtraKey]goDB.Val, totals *Counts, k goDB.ExtraKey, v goDB.Val) {
+	totals.BytesRcvd += v.NBytesRcvd
+	totals.BytesSent += v.NBytesSent
+	totals.PktsRcvd += v.NPktsRcvd
+	totals.PktsSent += v.NPktsSent
+
+	if tempVal, exists := finalMap[k]; exists {
+		tempVal.NBytesRcvd += v.NBytesRcvd
+		tempVal.NBytesSent += v.NBytesSent
+		tempVal.NPktsRcvd += v.NPktsRcvd
+		tempVal.NPktsSent += v.NPktsSent
+
+		finalMap[k] = tempVal
+	} else {
+		finalMap[k] = v
+	}
+}
+
+// receive maps on mapChan until mapChan gets closed.
+// Then send aggregation result over resultChan.
+// Closes resultChan on termination.
+//
+// The flows are merged by numShards goroutines, each of which is responsible
+// for the keys of one shard. Every map is handed to all of them and each picks
+// the flows of its own shard, so the maps aren't copied before being merged
+// and no single goroutine has to merge all flows.
+func aggregate(mapChan <-chan map[goDB.ExtraKey]goDB.Val, resultChan chan<- aggregateResult, numShards int) {
+	defer close(resultChan)
+
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	var (
+		releaser  memoryReleaser
+		failed    bool
+		shardChan = make([]chan map[goDB.ExtraKey]goDB.Val, numShards)
+		shards    = make([]map[goDB.ExtraKey]goDB.Val, numShards)
+		totals    = make([]Counts, numShards)
+		mergeWG   sync.WaitGroup
+	)
+
+	// merge the flows of each shard
+	mergeWG.Add(numShards)
+	for s := 0; s < numShards; s++ {
+		shardChan[s] = make(chan map[goDB.ExtraKey]goDB.Val, 4)
+		shards[s] = make(map[goDB.ExtraKey]goDB.Val)
+		go func(s int) {
+			defer mergeWG.Done()
+			for item := range shardChan[s] {
+				for k, v := range item {
+					if numShards == 1 || shardOf(&k, numShards) == s {
+						merge(shards[s], &totals[s], k, v)
+					}
+				}
+			}
+		}(s)
+	}
+
+	// hand the maps of the workers to all merging goroutines
+	for item := range mapChan {
+		if item == nil {
+			// keep draining mapChan so that the workers don't block
+			failed = true
+			continue
+		}
+		for s := range shardChan {
+			shardChan[s] <- item
+		}
+
+		// Conditionally call a manual garbage collection and memory release if the current heap allocation
+		// is above GOGCLIMIT and more than GOGCINTERVAL seconds have passed
+		releaser.check()
+	}
+
+	for s := range shardChan {
+		close(shardChan[s])
+	}
+	mergeWG.Wait()
+
+	if failed {
+		resultChan <- aggregateResult{
+			err: fmt.Errorf("Error during daily DB processing. Check syslog/messages for more information"),
+		}
+		return
+	}
+
+	result := aggregateResult{shards: shards}
+	for s := range shards {
+		result.count += len(shards[s])
+		result.totals.BytesRcvd += totals[s].BytesRcvd
+		result.totals.BytesSent += totals[s].BytesSent
+		result.totals.PktsRcvd += totals[s].PktsRcvd
+		result.totals.PktsSent += totals[s].PktsSent
+	}
+
+	if result.count == 0 {
+		resultChan <- aggregateResult{
+			err: fmt.Errorf(ERROR_NORESULTS),
+		}
+		return
+	}
+
+	resultChan <- result
+}
@@ -0,0 +1,128 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// aggregate_test.go
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"OSAG/goDB"
+)
+
+// syntheticResultMaps returns n result maps of a raw query, i.e. with the
+// timestamp of a block in each key, with flows entries each. Half of the
+// flows of a map also occur in the next map.
+func syntheticResultMaps(n, flows int) []map[goDB.ExtraKey]goDB.Val {
+	rnd := rand.New(rand.NewSource(1))
+	maps := make([]map[goDB.ExtraKey]goDB.Val, n)
+	for i := range maps {
+		maps[i] = make(map[goDB.ExtraKey]goDB.Val, flows)
+	}
+	for i := range maps {
+		for len(maps[i]) < flows {
+			var key goDB.ExtraKey
+			key.Time = 1450656000 + int64(i/2)*goDB.DB_WRITE_INTERVAL
+			key.Iface = []string{"eth0", "eth1"}[rnd.Intn(2)]
+			copy(key.Sip[:], []byte{10, 1, byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+			copy(key.Dip[:], []byte{byte(1 + rnd.Intn(223)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), 1})
+			key.Dport = [2]byte{byte(rnd.Intn(256)), byte(rnd.Intn(256))}
+			key.Protocol = 6
+
+			traffic := uint64(rnd.ExpFloat64() * 20000)
+			val := goDB.Val{NBytesRcvd: traffic, NBytesSent: traffic / 8, NPktsRcvd: 1 + traffic/1200, NPktsSent: 1 + traffic/9600}
+			maps[i][key] = val
+			if i%2 == 0 && len(maps[i])%2 == 0 {
+				maps[i+1][key] = val
+			}
+		}
+	}
+	return maps
+}
+
+// runAggregate passes the maps to aggregate and returns its result
+func runAggregate(maps []map[goDB.ExtraKey]goDB.Val, numShards int) aggregateResult {
+	mapChan := make(chan map[goDB.ExtraKey]goDB.Val, 1024)
+	resultChan := make(chan aggregateResult, 1)
+	go aggregate(mapChan, resultChan, numShards)
+	for _, m := range maps {
+		mapChan <- m
+	}
+	close(mapChan)
+	return <-resultChan
+}
+
+func TestAggregateShards(t *testing.T) {
+	maps := syntheticResultMaps(8, 1000)
+
+	expected := make(map[goDB.ExtraKey]goDB.Val)
+	var expectedTotals Counts
+	for _, m := range maps {
+		for k, v := range m {
+			merge(expected, &expectedTotals, k, v)
+		}
+	}
+
+	for _, numShards := range []int{1, 2, 7} {
+		result := runAggregate(maps, numShards)
+		if result.err != nil {
+			t.Fatalf("%d shards: %s", numShards, result.err)
+		}
+		if len(result.shards) != numShards || result.totals != expectedTotals || result.count != len(expected) {
+			t.Fatalf("%d shards: unexpected result with %d shards, %d entries and totals %+v",
+				numShards, len(result.shards), result.count, result.totals)
+		}
+
+		entries := result.entries()
+		aggregated := make(map[goDB.ExtraKey]goDB.Val)
+		for _, e := range entries {
+			if _, exists := aggregated[e.k]; exists {
+				t.Fatalf("%d shards: duplicate entry %+v", numShards, e.k)
+			}
+			aggregated[e.k] = goDB.Val{NBytesRcvd: e.nBr, NBytesSent: e.nBs, NPktsRcvd: e.nPr, NPktsSent: e.nPs}
+		}
+		if !reflect.DeepEqual(aggregated, expected) {
+			t.Fatalf("%d shards: entries differ", numShards)
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	maps := syntheticResultMaps(4, 10)
+
+	if result := runAggregate(append(maps[:2:2], nil, maps[2]), 3); result.err == nil {
+		t.Fatalf("expected failed workload to be reported")
+	}
+	if result := runAggregate([]map[goDB.ExtraKey]goDB.Val{{}, {}}, 3); result.err == nil || result.err.Error() != ERROR_NORESULTS {
+		t.Fatalf("expected empty result to be reported, got %v", result.err)
+	}
+}
+
+func BenchmarkAggregateRaw(b *testing.B) {
+	const blocks, flows = 96, 20000
+
+	maps := syntheticResultMaps(blocks, flows)
+	for _, numShards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+			// throughput is measured in flows per second, i.e. the
+			// reported MB/s are millions of flows per second. Since the
+			// maps aren't copied per shard, the allocations don't depend
+			// on the number of shards.
+			b.SetBytes(blocks * flows)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if result := runAggregate(maps, numShards); result.err != nil {
+					b.Fatalf("aggregation failed: %s", result.err)
+				}
+			}
+		})
+	}
+}
@@ -13,87 +13,11 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"math"
-	"os"
-	"path/filepath"
-	"strconv"
 	"time"
 
 	"OSAG/goDB"
 )
 
-type cleanIfaceResult struct {
-	DeltaFlowCount uint64 // number of flows deleted
-	DeltaTraffic   uint64 // traffic bytes deleted
-	NewBegin       int64  // timestamp of new begin
-	Gone           bool   // The interface has no entries left
-}
-
-func cleanIfaceDir(dbPath string, timestamp int64, iface string) (result cleanIfaceResult, err error) {
-	dayTimestamp := goDB.DayTimestamp(timestamp)
-
-	entries, err := ioutil.ReadDir(filepath.Join(dbPath, iface))
-	if err != nil {
-		return result, err
-	}
-
-	result.NewBegin = math.MaxInt64
-
-	clean := true
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			clean = false
-			continue
-		}
-
-		dirTimestamp, err := strconv.ParseInt(entry.Name(), 10, 64)
-		if err != nil || fmt.Sprintf("%d", dirTimestamp) != entry.Name() {
-			// a directory whose name isn't an int64 wasn't created by
-			// goProbe; leave it untouched
-			clean = false
-			continue
-		}
-
-		entryPath := filepath.Join(dbPath, iface, entry.Name())
-		metaFilePath := filepath.Join(entryPath, goDB.METADATA_FILE_NAME)
-
-		if dirTimestamp < dayTimestamp {
-			// delete directory
-
-			meta := goDB.TryReadMetadata(metaFilePath)
-
-			if err := os.RemoveAll(entryPath); err != nil {
-				return result, err
-			}
-
-			for _, block := range meta.Blocks {
-				result.DeltaFlowCount += block.FlowCount
-				result.DeltaTraffic += block.Traffic
-			}
-		} else {
-			clean = false
-			if dirTimestamp < result.NewBegin {
-				// update NewBegin
-				meta := goDB.TryReadMetadata(metaFilePath)
-				if len(meta.Blocks) > 0 && meta.Blocks[0].Timestamp < result.NewBegin {
-					result.NewBegin = meta.Blocks[0].Timestamp
-				}
-			}
-
-		}
-	}
-
-	result.Gone = result.NewBegin == math.MaxInt64
-
-	if clean {
-		if err := os.RemoveAll(filepath.Join(dbPath, iface)); err != nil {
-			return result, err
-		}
-	}
-
-	return
-}
-
 // Cleans up all directories that cannot contain any flow records
 // recorded at timestamp or later.
 func cleanOldDBDirs(dbPath string, timestamp int64) error {
@@ -106,15 +30,19 @@ func cleanOldDBDirs(dbPath string, timestamp int64) error {
 		return err
 	}
 
+	dayTimestamp := goDB.DayTimestamp(timestamp)
+
 	// Contains changes required to each interface's summary
-	ifaceResults := make(map[string]cleanIfaceResult)
+	ifaceResults := make(map[string]goDB.CleanIfaceResult)
 
 	for _, iface := range ifaces {
 		if !iface.IsDir() {
 			continue
 		}
 
-		result, err := cleanIfaceDir(dbPath, timestamp, iface.Name())
+		result, err := goDB.CleanIfaceDir(dbPath, iface.Name(), func(day int64) bool {
+			return day < dayTimestamp
+		})
 		if err != nil {
 			return err
 		}
@@ -127,15 +55,7 @@ func cleanOldDBDirs(dbPath string, timestamp int64) error {
 		}
 
 		for iface, change := range ifaceResults {
-			if change.Gone {
-				delete(summ.Interfaces, iface)
-			} else {
-				ifaceSumm := summ.Interfaces[iface]
-				ifaceSumm.FlowCount -= change.DeltaFlowCount
-				ifaceSumm.Traffic -= change.DeltaTraffic
-				ifaceSumm.Begin = change.NewBegin
-				summ.Interfaces[iface] = ifaceSumm
-			}
+			summ.ApplyClean(iface, change)
 		}
 
 		return summ, nil
@@ -42,4 +42,8 @@ type Config struct {
     ResolveRows    int
     ResolveTimeout time.Duration
     ShowMgmtTraffic bool
+    Fsck           bool
+    Repair         bool
+    Lookup         string
+    IndexHosts     bool
 }
@@ -0,0 +1,111 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// fsck.go
+//
+// Integrity check and repair of the database (-fsck)
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"OSAG/goDB"
+)
+
+// fsckDB checks the database at dbPath and prints a report of the problems
+// found to stdout. If problems remain (i.e. they were not repaired), goquery
+// exits with status 1.
+func fsckDB(dbPath string, repair, asJSON bool) error {
+	if repair {
+		// goProbe mustn't write to the database while we're changing it
+		lock, err := goDB.LockDB(dbPath)
+		if err != nil {
+			return fmt.Errorf("Cannot repair database while it is in use: %s", err)
+		}
+		defer lock.Unlock()
+	}
+
+	report, err := goDB.CheckDB(dbPath, repair)
+	if report != nil {
+		if asJSON {
+			json.NewEncoder(os.Stdout).Encode(report)
+		} else {
+			printFsckReport(os.Stdout, report, repair)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.OK() && !repair {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func printProblems(w io.Writer, problems []string) {
+	for _, problem := range problems {
+		fmt.Fprintf(w, "    %s\n", problem)
+	}
+}
+
+func printFsckReport(w io.Writer, report *goDB.FsckReport, repaired bool) {
+	var broken, blocks, brokenBlocks int
+	ifaces := make(map[string]struct{})
+	for _, day := range report.Days {
+		ifaces[day.Iface] = struct{}{}
+		blocks += day.Blocks
+		if day.OK() {
+			continue
+		}
+		broken++
+		brokenBlocks += len(day.BrokenBlocks)
+
+		fmt.Fprintf(w, "%s/%d (%s):\n", day.Iface, day.Day, time.Unix(day.Day, 0).Format("2006-01-02"))
+		printProblems(w, day.FileProblems)
+		for _, block := range day.BrokenBlocks {
+			fmt.Fprintf(w, "    broken block %d (%s):\n", block.Timestamp, time.Unix(block.Timestamp, 0).Format("2006-01-02 15:04:05"))
+			for _, problem := range block.Problems {
+				fmt.Fprintf(w, "        %s\n", problem)
+			}
+		}
+		for _, problem := range day.MetadataProblems {
+			fmt.Fprintf(w, "    %s: %s\n", goDB.METADATA_FILE_NAME, problem)
+		}
+		printProblems(w, day.IndexProblems)
+		if day.Repaired {
+			fmt.Fprintf(w, "    -> repaired\n")
+		}
+	}
+
+	if len(report.SummaryProblems) > 0 {
+		fmt.Fprintf(w, "%s:\n", goDB.SUMMARY_FILE_NAME)
+		printProblems(w, report.SummaryProblems)
+		if report.SummaryRepaired {
+			fmt.Fprintf(w, "    -> repaired\n")
+		}
+	}
+
+	fmt.Fprintf(w, "\nChecked %d blocks in %d daily directories of %d interfaces.\n", blocks, len(report.Days), len(ifaces))
+	if report.OK() {
+		fmt.Fprintf(w, "No problems found.\n")
+		return
+	}
+	fmt.Fprintf(w, "Found problems in %d daily directories (%d broken blocks)", broken, brokenBlocks)
+	if len(report.SummaryProblems) > 0 {
+		fmt.Fprintf(w, " and in %s", goDB.SUMMARY_FILE_NAME)
+	}
+	fmt.Fprintf(w, ".\n")
+	if !repaired {
+		fmt.Fprintf(w, "Run with -repair (while goProbe is stopped) to remove broken blocks and rebuild the metadata.\n")
+	}
+}
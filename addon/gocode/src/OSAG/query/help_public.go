@@ -23,6 +23,9 @@ var helpBase string = `USAGE:
     [-e txt|csv|json|influxdb] [-d <db-path>] [-f <timestamp>] [-l <timestamp>]
     [-c <conditions>] [-s <column>] {COLUMNS|QUERY_TYPE}
 
+    goquery -lookup <ip|network> [-i <interfaces>] [-e txt|json] [-d <db-path>]
+    [-f <timestamp>] [-l <timestamp>]
+
     Flow database query tool to extract flow statistics from the goDB database
     created by goProbe. By default, output is written to STDOUT, sorted by overall
     (incoming and outgoing) data volume in descending order.
@@ -80,6 +83,11 @@ EXAMPLES
       (-f "-9999d") whose source or destination was in 172.27.0.0/16:
 
         goquery -i eth0 -f "-9999d" -c "snet = 172.27.0.0/16 | dnet = 172.27.0.0/16" -n 10 "sip,dip"
+
+    * Find the days of the last year (-f "-365d") on which 10.1.2.3 was seen on any
+      interface:
+
+        goquery -lookup 10.1.2.3 -f "-365d"
 `
 var admin string = `
     Advanced maintenance options (should not be used in interactive mode):
@@ -92,6 +100,20 @@ var admin string = `
     -wipe
         Wipe all database entries from disk.
         Handle with utmost care, all changes are permanent and cannot be undone!
+
+    -fsck [-repair]
+        Check the integrity of the entire database: read every block of every
+        interface and day, check that all columns agree on the timestamps and
+        number of entries of each block and compare meta.json and summary.json
+        with the actual data. Only problems are reported.
+        With -repair, broken blocks are removed and the metadata and summary are
+        rebuilt from the remaining blocks. Repairing requires goProbe to be
+        stopped. Exits with status 1 if unrepaired problems remain.
+
+    -index-hosts
+        Build the host indexes used by -lookup for all days that don't have
+        one, e.g. because they were written by an older version of goProbe.
+        Requires goProbe to be stopped.
 `
 
 var helpMap map[string]string = map[string]string{
@@ -323,6 +345,17 @@ var helpMap map[string]string = map[string]string{
     -a
         Sort results in ascending instead of descending order. Forced for queries
         including the "time" field.
+`,
+	"lookup": `
+    -lookup <ip|network>
+
+        Instead of running a query, list the days on which the IP address or the
+        network (in CIDR notation) was seen, together with the first and last
+        block and the number of blocks containing each address. Only the days
+        covered by -f and -l are searched; all interfaces are searched unless -i
+        is given. The lookup uses the host index of each day, so it doesn't read
+        any flows. Days without a host index are counted but not searched (see
+        -index-hosts in the advanced help).
 `,
 	"list": `
     -list, --list
@@ -0,0 +1,106 @@
+/////////////////////////////////////////////////////////////////////////////////
+//
+// lookup.go
+//
+// Lookup of the days on which a host was seen (-lookup) and construction of
+// the host indexes it relies on (-index-hosts)
+//
+// Copyright (c) 2016 Open Systems AG, Switzerland
+// All Rights Reserved.
+//
+/////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"OSAG/goDB"
+)
+
+// lookupHost prints the days on which the IP address or network given by
+// -lookup was seen on the interfaces given by -i (all interfaces by default)
+// within the time span given by -f and -l.
+func lookupHost(config *Config) error {
+	ifacelist := config.Ifaces
+	if ifacelist == "" {
+		ifacelist = "any"
+	}
+	ifaces, err := parseIfaceList(config.BaseDir, ifacelist)
+	if err != nil {
+		return err
+	}
+
+	tfirst, err := goDB.ParseTimeArgument(config.First)
+	if err != nil {
+		return fmt.Errorf("Invalid time format: %s", err)
+	}
+	tlast, err := goDB.ParseTimeArgument(config.Last)
+	if err != nil {
+		return fmt.Errorf("Invalid time format: %s", err)
+	}
+
+	start := time.Now()
+	result, err := goDB.LookupHost(config.BaseDir, ifaces, config.Lookup, tfirst, tlast)
+	if err != nil {
+		return err
+	}
+	duration := time.Now().Sub(start)
+
+	if config.External || config.Format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+
+	wtxt := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintln(wtxt, "")
+	fmt.Fprintln(wtxt, "Iface\tDay\tAddress\tFirst seen\tLast seen\tBlocks\tSeen as\t")
+	fmt.Fprintln(wtxt, "---------\t----------\t---------\t-------------------\t-------------------\t------\t-------\t")
+
+	days := make(map[string]struct{})
+	for _, s := range result.Sightings {
+		var roles []string
+		if s.Source {
+			roles = append(roles, "sip")
+		}
+		if s.Destination {
+			roles = append(roles, "dip")
+		}
+		fmt.Fprintf(wtxt, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t\n",
+			s.Iface,
+			time.Unix(s.Day, 0).Format("2006-01-02"),
+			s.IP,
+			time.Unix(s.FirstSeen, 0).Format("2006-01-02 15:04:05"),
+			time.Unix(s.LastSeen, 0).Format("2006-01-02 15:04:05"),
+			s.Blocks,
+			strings.Join(roles, ","))
+		days[fmt.Sprintf("%s/%d", s.Iface, s.Day)] = struct{}{}
+	}
+	wtxt.Flush()
+
+	fmt.Printf("\n%s was seen on %d of %d indexed days (searched in %s).\n",
+		config.Lookup, len(days), result.Days, TextFormatter{}.Duration(duration))
+	if len(result.Unindexed) > 0 {
+		fmt.Printf("%d daily directories have no host index and weren't searched.\n", len(result.Unindexed))
+		fmt.Printf("Run goquery -index-hosts (while goProbe is stopped) to build the missing indexes.\n")
+	}
+	return nil
+}
+
+// indexHosts builds the host indexes missing in the database at dbPath
+func indexHosts(dbPath string) error {
+	// goProbe mustn't write to the database while we're adding indexes
+	lock, err := goDB.LockDB(dbPath)
+	if err != nil {
+		return fmt.Errorf("Cannot index database while it is in use: %s", err)
+	}
+	defer lock.Unlock()
+
+	built, err := goDB.BuildHostIndexes(dbPath)
+	fmt.Printf("Built the host indexes of %d daily directories.\n", built)
+	return err
+}
@@ -14,6 +14,9 @@ import (
     "encoding/json"
     "strings"
     "testing"
+    "time"
+
+    "OSAG/goDB"
 )
 
 var emptyOutputArgs = [][]string{
@@ -73,3 +76,33 @@ func TestDNS(t *testing.T) {
         t.Fatalf("Expected to get 'no such host' error.")
     }
 }
+
+// Check that the flow into which rollups merge small flows is printed as
+// "other" rather than as an all-zero flow.
+func TestExtractRollupOther(t *testing.T) {
+    other := Entry{k: goDB.ExtraKey{Time: 1455531929, Iface: "eth1"}, nBr: 40 * 1024}
+    for _, col := range []OutputColumn{OUTCOL_SIP, OUTCOL_DIP, OUTCOL_DPORT, OUTCOL_PROTO} {
+        if actual := extract(TextFormatter{}, map[string]string{}, Counts{}, other, col); actual != goDB.ROLLUP_OTHER {
+            t.Fatalf("Column %d: Expected '%s', got '%s'", col, goDB.ROLLUP_OTHER, actual)
+        }
+    }
+    if actual := extract(TextFormatter{}, map[string]string{}, Counts{}, other, OUTCOL_IFACE); actual != "eth1" {
+        t.Fatalf("Expected 'eth1', got '%s'", actual)
+    }
+}
+
+// Check that blocks answered from aggregates are reported in the summary.
+func TestFooterAggregatedBlocks(t *testing.T) {
+    j := NewJSONTablePrinter(basePrinter{}, "talk_conv")
+    j.Footer("", goDB.BlockStats{Total: 24, Aggregated: 12}, time.Time{}, time.Time{}, 0, 0)
+    summary := j.data["summary"].(map[string]interface{})
+    if summary["blocks_total"] != 24 || summary["blocks_aggregated"] != 12 {
+        t.Fatalf("Expected 12 of 24 blocks to be aggregated, got %v", summary)
+    }
+
+    j = NewJSONTablePrinter(basePrinter{}, "talk_conv")
+    j.Footer("", goDB.BlockStats{Total: 24}, time.Time{}, time.Time{}, 0, 0)
+    if summary := j.data["summary"].(map[string]interface{}); summary["blocks_aggregated"] != nil {
+        t.Fatalf("Expected no aggregated blocks in summary, got %v", summary)
+    }
+}
@@ -88,7 +88,7 @@ sub humanize {
 }
 
 my $lnum=0;
-my ($detailed, $time_elapsed);
+my ($detailed, $time_elapsed, $wo_queued, $wo_spooled);
 my ($t_rcv_gp, $t_rcv_pcap, $t_drop_pcap, $t_ifdrop);
 my $iface_states;
 
@@ -96,7 +96,7 @@ my $iface_states;
 while(<>) {
     chomp($_);
     if ($lnum == 0) {
-        ($detailed, $time_elapsed) = split(" ", $_);
+        ($detailed, $time_elapsed, $wo_queued, $wo_spooled) = split(" ", $_);
         $lnum++; next;
     }
 
@@ -121,7 +121,11 @@ print "Interface Capture Statistics:\n
        last writeout: ", sprintf("%-s%-s", " "x($MAX_WIDTH-length($last_write)), $last_write),"
     packets received: ", humanize(".2", "1000", $t_rcv_gp),"
      dropped by pcap: ", humanize(".2", "1000", $t_drop_pcap),"
-    dropped by iface: ", humanize(".2", "1000", $t_ifdrop),"\n\n";
+    dropped by iface: ", humanize(".2", "1000", $t_ifdrop),"\n";
+if ($wo_spooled) {
+    print "   spooled writeouts: ", humanize(".2", "1000", $wo_spooled),"\n";
+}
+print "\n";
 
 # print detailed statistics
 if ($detailed) {